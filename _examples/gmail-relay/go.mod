@@ -7,6 +7,7 @@ require github.com/chrj/smtpd/v2 v2.0.0
 require (
 	blitiri.com.ar/go/spf v1.5.1 // indirect
 	github.com/chrj/keyrate v0.2.2 // indirect
+	golang.org/x/net v0.57.0 // indirect
 	golang.org/x/time v0.15.0 // indirect
 )
 
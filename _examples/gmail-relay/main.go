@@ -4,10 +4,7 @@
 package main
 
 import (
-	"context"
-	"crypto/tls"
 	"flag"
-	"io"
 	"log/slog"
 	"net/smtp"
 	"os"
@@ -15,6 +12,7 @@ import (
 
 	"github.com/chrj/smtpd/v2"
 	"github.com/chrj/smtpd/v2/middleware"
+	"github.com/chrj/smtpd/v2/relay"
 )
 
 var (
@@ -32,61 +30,6 @@ const (
 	gmailAddr = "smtp.gmail.com:587"
 )
 
-// forwardToGmail streams env.Data straight into the upstream DATA writer
-// without buffering the message body, by driving an smtp.Client directly
-// rather than going through smtp.SendMail.
-func forwardToGmail(user, pass string) smtpd.Handler {
-	auth := smtp.PlainAuth("", user, pass, gmailHost)
-	return func(ctx context.Context, _ smtpd.Peer, env *smtpd.Envelope) (context.Context, error) {
-		defer func() { _ = env.Data.Close() }()
-
-		relayErr := func(err error) error {
-			smtpd.LoggerFromContext(ctx).Error("relay failed", slog.Any("err", err))
-			return smtpd.Error{Code: 451, Message: "upstream delivery failed"}
-		}
-
-		c, err := smtp.Dial(gmailAddr)
-		if err != nil {
-			return ctx, relayErr(err)
-		}
-		defer func() { _ = c.Close() }()
-
-		if err := c.Hello("localhost"); err != nil {
-			return ctx, relayErr(err)
-		}
-		if err := c.StartTLS(&tls.Config{ServerName: gmailHost}); err != nil {
-			return ctx, relayErr(err)
-		}
-		if err := c.Auth(auth); err != nil {
-			return ctx, relayErr(err)
-		}
-		if err := c.Mail(env.Sender); err != nil {
-			return ctx, relayErr(err)
-		}
-		for _, rcpt := range env.Recipients {
-			if err := c.Rcpt(rcpt); err != nil {
-				return ctx, relayErr(err)
-			}
-		}
-
-		w, err := c.Data()
-		if err != nil {
-			return ctx, relayErr(err)
-		}
-		if _, err := io.Copy(w, env.Data); err != nil {
-			_ = w.Close()
-			return ctx, relayErr(err)
-		}
-		if err := w.Close(); err != nil {
-			return ctx, relayErr(err)
-		}
-		if err := c.Quit(); err != nil {
-			return ctx, relayErr(err)
-		}
-		return ctx, nil
-	}
-}
-
 func main() {
 	flag.Parse()
 
@@ -104,10 +47,16 @@ func main() {
 	rbl := middleware.RBL(lists)
 	spf := middleware.SPF()
 
+	gmail := relay.New(gmailAddr,
+		relay.WithSTARTTLS(nil),
+		relay.WithAuth(smtp.PlainAuth("", *gmailUser, *gmailPass, gmailHost)),
+	)
+	defer func() { _ = gmail.Close() }()
+
 	srv := &smtpd.Server{
 		WelcomeMessage: *welcomeMsg,
 		Logger:         logger,
-		Handler:        forwardToGmail(*gmailUser, *gmailPass),
+		Handler:        gmail.Handler,
 	}
 
 	srv.Use(middleware.CheckConnection(middleware.IPAddressRateLimit(*rps, *burst)))
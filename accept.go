@@ -0,0 +1,125 @@
+package smtpd
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// busyRefusal is the reply to a connection over MaxConnectionRate, and to
+// one that finds no slot of MaxConnections. It stands in the place of the
+// greeting, which carries no enhanced code.
+const busyRefusal = "421 Too busy. Try again later.\r\n"
+
+// refuseTimeout bounds the write of a refusal, so that a client that reads
+// nothing holds the server no longer than this.
+const refuseTimeout = time.Second
+
+// acceptGuard holds what Serve keeps about the connections it accepts
+// against MaxConnectionRate.
+type acceptGuard struct {
+	limiter *rate.Limiter
+
+	// refused counts the refusals since the last warning, which goes out
+	// once a second at most, so that a flood does not flood the log too.
+	refused atomic.Int64
+	warn    rate.Sometimes
+}
+
+func newAcceptGuard(perSecond, burst int) *acceptGuard {
+	return &acceptGuard{
+		limiter: rate.NewLimiter(rate.Limit(perSecond), burst),
+		warn:    rate.Sometimes{Interval: time.Second},
+	}
+}
+
+// admit reports whether conn is within MaxConnectionRate. Serve refuses
+// one that is not before it spends a session on it.
+func (srv *Server) admit(conn net.Conn) bool {
+	if srv.acceptGuard == nil || srv.acceptGuard.limiter.Allow() {
+		return true
+	}
+
+	g := srv.acceptGuard
+	g.refused.Add(1)
+	g.warn.Do(func() {
+		srv.newLogger().Warn("refused connections over MaxConnectionRate",
+			slog.Int64("refused", g.refused.Swap(0)),
+		)
+	})
+
+	srv.refuse(conn, busyRefusal)
+	return false
+}
+
+// refuse writes line to conn in the place of the greeting, and closes it.
+// The write runs on its own goroutine, so that the accept loop does not wait
+// on a client that reads nothing.
+func (srv *Server) refuse(conn net.Conn, line string) {
+	srv.wg.Add(1)
+	go func() {
+		defer srv.wg.Done()
+		writeRefusal(conn, line)
+	}()
+}
+
+// writeRefusal writes line to conn, within refuseTimeout, and closes it.
+func writeRefusal(conn net.Conn, line string) {
+	_ = conn.SetWriteDeadline(time.Now().Add(refuseTimeout))
+	_, _ = io.WriteString(conn, line)
+	_ = conn.Close()
+}
+
+// acceptBackoff is the wait of Serve after a temporary error of Accept, such
+// as a process out of file descriptors. It starts at 5ms and doubles on each
+// error in a row, up to a second, as net/http waits.
+type acceptBackoff struct {
+	delay time.Duration
+}
+
+// wait sleeps after err and reports true where err is temporary. An error
+// that is not ends Serve.
+func (b *acceptBackoff) wait(srv *Server, err error) bool {
+	if !temporary(err) {
+		return false
+	}
+
+	if b.delay == 0 {
+		b.delay = 5 * time.Millisecond
+	} else {
+		b.delay = min(2*b.delay, time.Second)
+	}
+
+	srv.newLogger().Warn("accept failed, retrying",
+		slog.Any("error", err),
+		slog.Duration("delay", b.delay),
+	)
+	time.Sleep(b.delay)
+	return true
+}
+
+// temporary reports whether err from Accept may pass: a timeout, an error
+// that calls itself temporary, or a process or system out of file
+// descriptors, which Accept gives as an error that is not a timeout.
+func temporary(err error) bool {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	var te interface{ Temporary() bool }
+	if errors.As(err, &te) && te.Temporary() {
+		return true
+	}
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) || errors.Is(err, syscall.ECONNABORTED)
+}
+
+// reset starts the wait over after an Accept that succeeded.
+func (b *acceptBackoff) reset() {
+	b.delay = 0
+}
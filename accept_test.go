@@ -1,9 +1,14 @@
 package smtpd_test
 
 import (
+	"bufio"
+	"context"
 	"net"
+	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"testing/synctest"
 	"time"
@@ -19,17 +24,25 @@ func (acceptTimeoutErr) Error() string   { return "accept: temporary failure" }
 func (acceptTimeoutErr) Timeout() bool   { return true }
 func (acceptTimeoutErr) Temporary() bool { return true }
 
-// flakyListener fails the first failures calls to Accept with a timeout, then
+// acceptTemporaryErr is a net.Error that is temporary but not a timeout.
+type acceptTemporaryErr struct{}
+
+func (acceptTemporaryErr) Error() string   { return "accept: too many open files" }
+func (acceptTemporaryErr) Timeout() bool   { return false }
+func (acceptTemporaryErr) Temporary() bool { return true }
+
+// flakyListener fails the first failures calls to Accept with err, then
 // blocks until Close.
 type flakyListener struct {
+	err       error
 	remaining atomic.Int32
 	accepts   atomic.Int32
 	closed    chan struct{}
 	once      sync.Once
 }
 
-func newFlakyListener(failures int32) *flakyListener {
-	l := &flakyListener{closed: make(chan struct{})}
+func newFlakyListener(failures int32, err error) *flakyListener {
+	l := &flakyListener{err: err, closed: make(chan struct{})}
 	l.remaining.Store(failures)
 
 	return l
@@ -38,7 +51,7 @@ func newFlakyListener(failures int32) *flakyListener {
 func (l *flakyListener) Accept() (net.Conn, error) {
 	l.accepts.Add(1)
 	if l.remaining.Add(-1) >= 0 {
-		return nil, acceptTimeoutErr{}
+		return nil, l.err
 	}
 
 	<-l.closed
@@ -55,7 +68,8 @@ func (l *flakyListener) Addr() net.Addr {
 }
 
 // TestAcceptRetryBackoff verifies that a timeout from Accept does not stop the
-// server. Serve waits one second and accepts again.
+// server. Serve waits 5ms, doubles the wait on each failure in a row up to a
+// second, and accepts again.
 //
 // The test sleeps in its own goroutine, and not in synctest.Wait. Wait returns
 // as soon as the other goroutines block, and it does not move the clock, so
@@ -64,35 +78,125 @@ func TestAcceptRetryBackoff(t *testing.T) {
 	t.Parallel()
 
 	synctest.Test(t, func(t *testing.T) {
-		const failures = 3
+		const failures = 12
 
-		l := newFlakyListener(failures)
+		l := newFlakyListener(failures, acceptTimeoutErr{})
 		srv := &smtpd.Server{Logger: testLogger(t)}
 
 		served := make(chan error, 1)
 		go func() { served <- srv.Serve(l) }()
 
-		// The backoff is one second, so the server calls Accept at 0s, 1s and
-		// 2s. The call at 3s is still in the future.
-		time.Sleep(2*time.Second + 500*time.Millisecond)
-		synctest.Wait()
+		// The server calls Accept at 0, 5ms, 15ms, 35ms, 75ms, 155ms, 315ms,
+		// 635ms and 1275ms, and a second apart after that: at 2275ms, 3275ms,
+		// 4275ms and 5275ms, where the failures are spent.
+		start := time.Now()
+		for _, step := range []struct {
+			at   time.Duration
+			want int32
+		}{
+			{10 * time.Millisecond, 2},
+			{time.Second, 8},
+			{2500 * time.Millisecond, 10},
+			{5200 * time.Millisecond, 12},
+			{5300 * time.Millisecond, failures + 1},
+		} {
+			time.Sleep(step.at - time.Since(start))
+			synctest.Wait()
+
+			if got := l.accepts.Load(); got != step.want {
+				t.Errorf("Accept calls after %v = %d, want %d", step.at, got, step.want)
+			}
+		}
+
+		_ = l.Close()
 
-		if got, want := l.accepts.Load(), int32(3); got != want {
-			t.Errorf("Accept calls after 2.5s = %d, want %d", got, want)
+		if err := <-served; err == nil {
+			t.Error("Serve returned nil, want the error of the listener")
 		}
+	})
+}
 
-		// The last failure is spent, so the call at 3s blocks until Close.
-		time.Sleep(time.Second)
-		synctest.Wait()
+// TestAcceptRetryTemporary verifies that Serve waits out an error of Accept
+// that is not a timeout but is temporary, as a process out of file
+// descriptors gives.
+func TestAcceptRetryTemporary(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"Temporary", acceptTemporaryErr{}},
+		{"EMFILE", &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept4", syscall.EMFILE)}},
+		{"ENFILE", &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept4", syscall.ENFILE)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			synctest.Test(t, func(t *testing.T) {
+				l := newFlakyListener(2, tt.err)
+				srv := &smtpd.Server{Logger: testLogger(t)}
+
+				served := make(chan error, 1)
+				go func() { served <- srv.Serve(l) }()
 
-		if got, want := l.accepts.Load(), int32(failures+1); got != want {
-			t.Errorf("Accept calls after 3.5s = %d, want %d", got, want)
+				// The server calls Accept at 0, 5ms and 15ms.
+				time.Sleep(20 * time.Millisecond)
+				synctest.Wait()
+				if got := l.accepts.Load(); got != 3 {
+					t.Errorf("Accept calls = %d, want 3", got)
+				}
+
+				_ = l.Close()
+				<-served
+			})
+		})
+	}
+}
+
+func TestMaxConnectionRate(t *testing.T) {
+	t.Parallel()
+
+	synctest.Test(t, func(t *testing.T) {
+		var sessions atomic.Int32
+		srv := &smtpd.Server{
+			MaxConnectionRate:   1,
+			ConnectionRateBurst: 2,
+			ConnContext: func(ctx context.Context, _ net.Conn) context.Context {
+				sessions.Add(1)
+				return ctx
+			},
+			Logger: testLogger(t),
+		}
+		l := runpipeserver(t, srv)
+		t.Cleanup(func() { _ = l.Close() })
+
+		greet := func() string {
+			c := l.dial(t)
+			t.Cleanup(func() { _ = c.Close() })
+			line, _ := bufio.NewReader(c).ReadString('\n')
+			return line
 		}
 
-		_ = l.Close()
+		// The burst takes two connections at once, and the third waits for
+		// the rate to give it room.
+		for range 2 {
+			if line := greet(); !strings.HasPrefix(line, "220 ") {
+				t.Fatalf("greeting = %q, want 220", line)
+			}
+		}
+		if line := greet(); line != "421 Too busy. Try again later.\r\n" {
+			t.Errorf("greeting over the rate = %q, want 421", line)
+		}
+		if got := sessions.Load(); got != 2 {
+			t.Errorf("ConnContext ran for %d connections, want 2: a refused one gets no session", got)
+		}
 
-		if err := <-served; err == nil {
-			t.Error("Serve returned nil, want the error of the listener")
+		time.Sleep(time.Second)
+		if line := greet(); !strings.HasPrefix(line, "220 ") {
+			t.Errorf("greeting a second later = %q, want 220", line)
 		}
 	})
 }
@@ -0,0 +1,128 @@
+package smtpd
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+
+	"golang.org/x/time/rate"
+)
+
+// errNoBudget answers a message that finds MaxBytesInFlight spent, at DATA or
+// at the first BDAT, or once the octets of the message spent it.
+var errNoBudget = Error{Code: 452, Enhanced: EnhancedCode{4, 3, 1}, Message: "Insufficient system storage, try again later"}
+
+// byteBudget counts the octets of the messages that the sessions of a server
+// hold, against MaxBytesInFlight.
+type byteBudget struct {
+	used atomic.Int64
+}
+
+// take draws n octets, unless that takes the budget past limit.
+func (b *byteBudget) take(n, limit int64) bool {
+	for {
+		used := b.used.Load()
+		if used+n > limit {
+			return false
+		}
+		if b.used.CompareAndSwap(used, used+n) {
+			return true
+		}
+	}
+}
+
+// BytesInFlight gives the octets of the messages that the sessions hold
+// under MaxBytesInFlight: the octets that arrived of each message that a
+// handler has not returned for yet. The server counts them only with
+// MaxBytesInFlight set.
+func (srv *Server) BytesInFlight() int64 {
+	return srv.budget.used.Load()
+}
+
+// budgetFull reports whether MaxBytesInFlight is spent, so that a new message
+// gets errNoBudget at once.
+func (srv *Server) budgetFull() bool {
+	return srv.MaxBytesInFlight > 0 && srv.budget.used.Load() >= srv.MaxBytesInFlight
+}
+
+// budgetHold is what one message drew from MaxBytesInFlight. A BDAT message
+// keeps one across its chunks.
+type budgetHold struct {
+	budget  *byteBudget
+	held    int64
+	refused bool
+}
+
+// newHold gives the hold of a new message.
+func (srv *Server) newHold() budgetHold {
+	return budgetHold{budget: &srv.budget}
+}
+
+// release gives back what h drew, once the handler is done with the message.
+func (h *budgetHold) release() {
+	if h.budget != nil {
+		h.budget.used.Add(-h.held)
+	}
+	h.held = 0
+}
+
+func (h *budgetHold) refusal() error {
+	if h.refused {
+		return errNoBudget
+	}
+	return nil
+}
+
+// budgetReader reads the octets of a message against MaxBytesInFlight and
+// MaxIngressRate. A message that spends the budget is refused, and the reader
+// reads on without drawing from it, so that the session finds the end of the
+// message.
+type budgetReader struct {
+	srv  *Server
+	ctx  context.Context
+	r    io.Reader
+	hold *budgetHold
+}
+
+// budgetReader gives r under MaxBytesInFlight and MaxIngressRate, or r itself
+// without either.
+func (s *session) budgetReader(ctx context.Context, r io.Reader, hold *budgetHold) io.Reader {
+	if s.server.MaxBytesInFlight <= 0 && s.server.ingress == nil {
+		return r
+	}
+	return &budgetReader{srv: s.server, ctx: ctx, r: r, hold: hold}
+}
+
+func (b *budgetReader) Read(p []byte) (int, error) {
+	// A wait takes no more than the burst of the limiter.
+	if b.srv.ingress != nil && len(p) > b.srv.ingress.Burst() {
+		p = p[:b.srv.ingress.Burst()]
+	}
+
+	n, err := b.r.Read(p)
+
+	if limit := b.srv.MaxBytesInFlight; limit > 0 && n > 0 && !b.hold.refused {
+		if b.hold.budget.take(int64(n), limit) {
+			b.hold.held += int64(n)
+		} else {
+			b.hold.refused = true
+		}
+	}
+
+	// The wait comes after the read, so that the octets that the client
+	// sent pay for themselves, and it counts no time of the client toward
+	// MinDataRate.
+	if b.srv.ingress != nil && n > 0 {
+		if werr := b.srv.ingress.WaitN(b.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+
+	return n, err
+}
+
+// newIngressLimiter gives the limiter of MaxIngressRate, whose burst is the
+// octets of one second.
+func newIngressLimiter(perSecond int) *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(perSecond), max(perSecond, 1))
+}
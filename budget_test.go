@@ -0,0 +1,231 @@
+package smtpd_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/chrj/smtpd/v2"
+)
+
+// waitInFlight waits until srv holds want octets in flight.
+func waitInFlight(t *testing.T, srv *smtpd.Server, want int64) {
+	t.Helper()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for srv.BytesInFlight() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("BytesInFlight = %d, want %d", srv.BytesInFlight(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMaxBytesInFlight(t *testing.T) {
+	t.Parallel()
+
+	// The handler of the first message holds it until the test lets go.
+	held := make(chan struct{})
+	release := make(chan struct{})
+	var calls atomic.Int32
+	srv := &smtpd.Server{
+		MaxBytesInFlight: 100,
+		Handler: func(ctx context.Context, _ smtpd.Peer, env *smtpd.Envelope) (context.Context, error) {
+			_, err := io.Copy(io.Discard, env.Data)
+			if calls.Add(1) == 1 {
+				close(held)
+				<-release
+			}
+			return ctx, err
+		},
+		Logger: testLogger(t),
+	}
+	ts := runserver(t, srv)
+
+	first := dialRaw(t, ts.Addr)
+	first.send("EHLO client.example.com")
+	first.send("MAIL FROM:<alice@example.com>")
+	first.send("RCPT TO:<bob@example.com>")
+	first.send("DATA")
+	// The body of 100 octets, with the line breaks that the reader of the
+	// default BareLineBreaks gives, takes all of the budget.
+	first.write([]byte(strings.Repeat("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLM\r\n", 2) + ".\r\n"))
+	<-held
+
+	if n := srv.BytesInFlight(); n != 100 {
+		t.Errorf("BytesInFlight = %d while the handler holds the message, want 100", n)
+	}
+
+	second := dialRaw(t, ts.Addr)
+	second.send("EHLO client.example.com")
+	second.send("MAIL FROM:<alice@example.com>")
+	second.send("RCPT TO:<bob@example.com>")
+	if reply := second.send("DATA"); !strings.HasPrefix(reply, "452 4.3.1 ") {
+		t.Errorf("DATA = %q, want 452 4.3.1", reply)
+	}
+
+	close(release)
+	if reply := first.line(); !strings.HasPrefix(reply, "250 ") {
+		t.Errorf("first message = %q, want 250", reply)
+	}
+	waitInFlight(t, srv, 0)
+
+	second.send("RSET")
+	if reply := sendData(t, second, "MAIL FROM:<alice@example.com>", "Subject: test\r\n\r\nhello\r\n.\r\n"); !strings.HasPrefix(reply, "250 ") {
+		t.Errorf("message after the release = %q, want 250", reply)
+	}
+	waitInFlight(t, srv, 0)
+}
+
+func TestMaxBytesInFlightFirstChunk(t *testing.T) {
+	t.Parallel()
+
+	held := make(chan struct{})
+	release := make(chan struct{})
+	var calls atomic.Int32
+	srv := &smtpd.Server{
+		MaxBytesInFlight: 10,
+		Handler: func(ctx context.Context, _ smtpd.Peer, env *smtpd.Envelope) (context.Context, error) {
+			_, err := io.Copy(io.Discard, env.Data)
+			if calls.Add(1) == 1 {
+				close(held)
+				<-release
+			}
+			return ctx, err
+		},
+		Logger: testLogger(t),
+	}
+	ts := runserver(t, srv)
+
+	first := dialRaw(t, ts.Addr)
+	first.send("EHLO client.example.com")
+	first.send("MAIL FROM:<alice@example.com>")
+	first.send("RCPT TO:<bob@example.com>")
+	first.write([]byte("BDAT 10 LAST\r\n0123456789"))
+	<-held
+	defer close(release)
+
+	second := dialRaw(t, ts.Addr)
+	second.send("EHLO client.example.com")
+	second.send("MAIL FROM:<alice@example.com>")
+	second.send("RCPT TO:<bob@example.com>")
+
+	// The message fails at its first chunk, and every chunk after it.
+	second.write([]byte("BDAT 5\r\nhello"))
+	if reply := second.line(); !strings.HasPrefix(reply, "452 4.3.1 ") {
+		t.Errorf("first chunk = %q, want 452 4.3.1", reply)
+	}
+	second.write([]byte("BDAT 5 LAST\r\nworld"))
+	if reply := second.line(); !strings.HasPrefix(reply, "452 4.3.1 ") {
+		t.Errorf("last chunk = %q, want 452 4.3.1", reply)
+	}
+	if reply := second.send("NOOP"); !strings.HasPrefix(reply, "250 ") {
+		t.Errorf("NOOP = %q, the session is out of step", reply)
+	}
+}
+
+func TestMaxBytesInFlightMidMessage(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		send func(c *rawClient, body string) string
+	}{
+		{"DATA", func(c *rawClient, body string) string {
+			return sendData(t, c, "MAIL FROM:<alice@example.com>", body+".\r\n")
+		}},
+		{"BDAT", func(c *rawClient, body string) string {
+			c.send("EHLO client.example.com")
+			c.send("MAIL FROM:<alice@example.com>")
+			c.send("RCPT TO:<bob@example.com>")
+			c.write([]byte("BDAT 100\r\n" + body[:100]))
+			c.line()
+			c.write([]byte("BDAT " + strconv.Itoa(len(body)-100) + " LAST\r\n" + body[100:]))
+			return c.line()
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got := make(chan error, 1)
+			srv := &smtpd.Server{
+				MaxBytesInFlight: 64,
+				Handler: func(ctx context.Context, _ smtpd.Peer, env *smtpd.Envelope) (context.Context, error) {
+					_, err := io.Copy(io.Discard, env.Data)
+					got <- err
+					return ctx, err
+				},
+				Logger: testLogger(t),
+			}
+			ts := runserver(t, srv)
+
+			c := dialRaw(t, ts.Addr)
+			body := strings.Repeat("a line of the message that does not fit\r\n", 5)
+			if reply := tt.send(c, body); !strings.HasPrefix(reply, "452 4.3.1 ") {
+				t.Errorf("reply = %q, want 452 4.3.1", reply)
+			}
+			if err := <-got; err == nil {
+				t.Error("the handler read the message without an error")
+			}
+			if reply := c.send("NOOP"); !strings.HasPrefix(reply, "250 ") {
+				t.Errorf("NOOP = %q, the session is out of step", reply)
+			}
+			waitInFlight(t, srv, 0)
+		})
+	}
+}
+
+func TestMaxIngressRate(t *testing.T) {
+	t.Parallel()
+
+	synctest.Test(t, func(t *testing.T) {
+		srv := &smtpd.Server{
+			MaxIngressRate: 100,
+			Handler: func(ctx context.Context, _ smtpd.Peer, env *smtpd.Envelope) (context.Context, error) {
+				_, err := io.Copy(io.Discard, env.Data)
+				return ctx, err
+			},
+			Logger: testLogger(t),
+		}
+		l := runpipeserver(t, srv)
+		t.Cleanup(func() { _ = l.Close() })
+
+		// Two sessions share the rate: 600 octets at 100 a second, of which
+		// the first second is the burst.
+		done := make(chan time.Duration, 2)
+		start := time.Now()
+		for range 2 {
+			c := l.dial(t)
+			t.Cleanup(func() { _ = c.Close() })
+			r := bufio.NewReader(c)
+			_, _ = r.ReadString('\n')
+
+			go func() {
+				for _, cmd := range []string{"HELO client.example.com", "MAIL FROM:<alice@example.com>", "RCPT TO:<bob@example.com>", "DATA"} {
+					timedCmd(t, c, r, cmd)
+				}
+				_, _ = c.Write([]byte(strings.Repeat("0123456789012345678901234567\r\n", 10) + ".\r\n"))
+				if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, "250 ") {
+					t.Errorf("reply = %q, want 250", line)
+				}
+				done <- time.Since(start)
+			}()
+		}
+
+		var last time.Duration
+		for range 2 {
+			last = max(last, <-done)
+		}
+		if last < 4*time.Second || last > 6*time.Second {
+			t.Errorf("the messages took %v, want about 5s", last)
+		}
+	})
+}
@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"io"
 	"runtime/debug"
-	"time"
 )
 
 // errChunkAborted is what the handler reads in the place of the rest of the
@@ -40,6 +39,17 @@ type chunkTransfer struct {
 	// received counts the octets of the message so far.
 	received int64
 
+	// rate counts the octets of the message against MinDataRate.
+	rate rateWindow
+
+	// conform checks the message under BodyConformance on its way into the
+	// pipe. It is nil where the server checks nothing for the message.
+	conform *conformWriter
+
+	// budget is what the message drew from MaxBytesInFlight. It goes back
+	// once the handler returned.
+	budget budgetHold
+
 	// buf carries the octets from the connection into the pipe. It stays
 	// with the transfer, so that a message of many chunks takes one buffer
 	// and not one for every chunk.
@@ -64,6 +74,34 @@ func (t *chunkTransfer) copyBuf() []byte {
 	return t.buf
 }
 
+// writer gives where the octets of a chunk go: into the pipe, through the
+// conformer where the message has one.
+func (t *chunkTransfer) writer() io.Writer {
+	if t.conform == nil {
+		return t.pw
+	}
+	t.conform.w = t.pw
+	return t.conform
+}
+
+// refusal gives the reason of BodyConformance to refuse the message, once the
+// last chunk arrived or earlier. last writes what the conformer held back for
+// the end of the message first.
+func (t *chunkTransfer) refusal(last bool) error {
+	if err := t.budget.refusal(); err != nil {
+		return err
+	}
+	if t.conform == nil {
+		return nil
+	}
+	if last {
+		// A write that fails here failed for the handler as well, and the
+		// result of the handler tells of it.
+		_ = t.conform.flush()
+	}
+	return t.conform.c.refusal()
+}
+
 // started reports whether the handler is running.
 func (t *chunkTransfer) started() bool {
 	return t != nil && t.pw != nil
@@ -163,6 +201,7 @@ func (s *session) finishChunk(ctx context.Context) (context.Context, int64, erro
 	_ = t.pw.Close()
 	result := t.wait()
 	<-t.exited
+	t.budget.release()
 
 	if result.ctx != nil {
 		ctx = result.ctx
@@ -186,6 +225,7 @@ func (t *chunkTransfer) end(cause error) *deliverResult {
 	_ = t.pw.CloseWithError(cause)
 	<-t.exited
 	t.pw = nil
+	t.budget.release()
 
 	if result, ok := t.poll(); ok {
 		return &result
@@ -233,7 +273,7 @@ func (s *session) handleBDAT(ctx context.Context, cmd *command) context.Context
 	}
 
 	// A chunk arrives at the speed of a message, not of a command.
-	_ = s.conn.SetDeadline(time.Now().Add(s.server.DataTimeout))
+	deadline := s.setDataDeadline()
 
 	if err != nil {
 		// The length reads, so the chunk comes off the wire and the session
@@ -259,7 +299,10 @@ func (s *session) handleBDAT(ctx context.Context, cmd *command) context.Context
 			})
 		}
 
-		s.chunk = &chunkTransfer{}
+		s.chunk = &chunkTransfer{budget: s.server.newHold()}
+		if c := s.conformer("\r\n"); c != nil {
+			s.chunk.conform = &conformWriter{c: c}
+		}
 	}
 
 	if refusal := s.chunkRefusal(size); refusal != nil {
@@ -270,7 +313,9 @@ func (s *session) handleBDAT(ctx context.Context, cmd *command) context.Context
 		s.startChunk(ctx)
 	}
 
-	n, err := io.CopyBuffer(s.chunk.pw, io.LimitReader(s.reader, size), s.chunk.copyBuf())
+	chunk := s.rateReader(io.LimitReader(s.reader, size), &s.chunk.rate, deadline)
+	chunk = s.budgetReader(ctx, chunk, &s.chunk.budget)
+	n, err := io.CopyBuffer(s.chunk.writer(), chunk, s.chunk.copyBuf())
 	if err == nil && n != size {
 		// A reader that stops early gives no error of its own, and a chunk
 		// that is not whole is not a chunk.
@@ -279,6 +324,10 @@ func (s *session) handleBDAT(ctx context.Context, cmd *command) context.Context
 	if err != nil {
 		// The session cannot know how much of the chunk it read, so the line
 		// that follows is not a command.
+		if limit, ok := s.limitOf(err); ok {
+			s.stopChunk(err)
+			return s.closeAtLimit(ctx, limit)
+		}
 		s.setErr(err)
 		s.stopChunk(err)
 		ctx = s.replyEnhanced(ctx, 451, EnhancedCode{4, 3, 0}, "The chunk could not be read")
@@ -287,6 +336,18 @@ func (s *session) handleBDAT(ctx context.Context, cmd *command) context.Context
 
 	s.chunk.received += size
 
+	// The chunk is off the wire, so the session is in step with the client
+	// whatever the answer.
+	if refusal := s.chunk.refusal(last); refusal != nil {
+		if ctx, done := s.reportChunkPanic(ctx, s.chunk.abort(refusal)); done {
+			return ctx
+		}
+		if last {
+			return s.reset(s.replyDeliveryError(ctx, refusal))
+		}
+		return s.replyError(ctx, refusal)
+	}
+
 	if !last {
 		// A handler that returned before the last chunk has an answer that
 		// the client needs now. The chunks that follow get the same one.
@@ -321,6 +382,12 @@ func (s *session) chunkRefusal(size int64) error {
 		return s.chunk.failure
 	}
 
+	// A message that finds the budget spent gets no further than its first
+	// chunk.
+	if s.chunk.received == 0 && s.server.budgetFull() {
+		return errNoBudget
+	}
+
 	if size > int64(s.server.MaxMessageSize)-s.chunk.received {
 		return Error{
 			Code:     552,
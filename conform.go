@@ -0,0 +1,239 @@
+package smtpd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Conformance says what the server does with the body of a message that
+// breaks RFC 5322 or its own BODY parameter: a line longer than
+// MaxBodyLineLength, or an octet above 127 in a message of 7-bit text. It
+// holds for DATA and for BDAT, and a message of BodyBinaryMIME has no lines
+// to check.
+//
+// A relay or an archive behind the server that takes conformant mail alone
+// can rely on what the server let through.
+type Conformance int
+
+const (
+	// ConformanceIgnore takes the body as it comes. It is the default.
+	ConformanceIgnore Conformance = iota
+
+	// ConformanceFlag takes the body as it comes, and records what was
+	// wrong with it on Envelope.LongLines and Envelope.Undeclared8Bit.
+	ConformanceFlag
+
+	// ConformanceRewrap breaks a line longer than MaxBodyLineLength with a
+	// line break and a space, which is a header that continues in a header
+	// and a line that starts with a space in the body, and records it on
+	// Envelope.LongLines. An octet above 127 has no such repair, and the
+	// server records it on Envelope.Undeclared8Bit.
+	ConformanceRewrap
+
+	// ConformanceReject refuses the message with 554 5.6.0 once it ends,
+	// and the handler reads the same error from Envelope.Data.
+	ConformanceReject
+)
+
+// errUndeclared8Bit answers a message of 7-bit text that carries an octet
+// above 127 under ConformanceReject.
+var errUndeclared8Bit = Error{Code: 554, Enhanced: EnhancedCode{5, 6, 0}, Message: "8-bit data in a 7BIT message"}
+
+// bodyCheck is a reader of the body of a message that can find a reason to
+// refuse it on the way. The session reads the body to its end either way,
+// so that the client stays in step, and answers with the refusal then.
+type bodyCheck interface {
+	refusal() error
+}
+
+// conformer checks the body of a message under Server.BodyConformance. A
+// BDAT message keeps one across its chunks, so that a line that goes on from
+// one chunk into the next counts whole.
+type conformer struct {
+	env    *Envelope
+	mode   Conformance
+	max    int
+	check8 bool
+
+	// lineBreak is the break that a rewrap writes. The reader of a DATA
+	// message under BareLineBreaksAllow ends its lines with a bare LF.
+	lineBreak string
+
+	// line counts the octets of the current line. cr says that the last
+	// octet was a CR, which the conformer holds back: it belongs to the line
+	// break where a LF follows it.
+	line int
+	cr   bool
+
+	longLines bool
+	eightBit  bool
+}
+
+// conformer gives the conformer of the message of the session, or nil where
+// the server checks nothing for it.
+func (s *session) conformer(lineBreak string) *conformer {
+	mode := s.server.BodyConformance
+	if mode == ConformanceIgnore || s.envelope.BodyType == BodyBinaryMIME {
+		return nil
+	}
+
+	// RFC 6531 section 3.3 lets an SMTPUTF8 message carry 8-bit headers,
+	// whatever its BODY parameter says.
+	check8 := (s.envelope.BodyType == "" || s.envelope.BodyType == Body7Bit) && !s.envelope.SMTPUTF8
+
+	return &conformer{
+		env:       s.envelope,
+		mode:      mode,
+		max:       s.server.MaxBodyLineLength,
+		check8:    check8,
+		lineBreak: lineBreak,
+	}
+}
+
+// filter checks p, which follows what the conformer saw before, and appends
+// it to dst. Under ConformanceRewrap, a line that grows past the limit gets a
+// break.
+func (c *conformer) filter(dst, p []byte) []byte {
+	for _, b := range p {
+		if b >= 0x80 && c.check8 && !c.eightBit {
+			c.eightBit = true
+			if c.mode != ConformanceReject {
+				c.env.Undeclared8Bit = true
+			}
+		}
+
+		if c.cr {
+			c.cr = false
+			if b == '\n' {
+				dst = append(dst, '\r', '\n')
+				c.line = 0
+				continue
+			}
+			dst = c.put(dst, '\r')
+		}
+
+		switch b {
+		case '\r':
+			c.cr = true
+		case '\n':
+			dst = append(dst, '\n')
+			c.line = 0
+		default:
+			dst = c.put(dst, b)
+		}
+	}
+	return dst
+}
+
+// flush appends the CR that the conformer held back at the end of the
+// message.
+func (c *conformer) flush(dst []byte) []byte {
+	if !c.cr {
+		return dst
+	}
+	c.cr = false
+	return c.put(dst, '\r')
+}
+
+// put appends b to the current line.
+func (c *conformer) put(dst []byte, b byte) []byte {
+	if c.line >= c.max {
+		c.flagLong()
+		if c.mode == ConformanceRewrap {
+			dst = append(dst, c.lineBreak...)
+			dst = append(dst, ' ')
+			c.line = 1
+		}
+	}
+	c.line++
+	return append(dst, b)
+}
+
+func (c *conformer) flagLong() {
+	if c.longLines {
+		return
+	}
+	c.longLines = true
+	if c.mode != ConformanceReject {
+		c.env.LongLines = true
+	}
+}
+
+func (c *conformer) refusal() error {
+	if c.mode != ConformanceReject {
+		return nil
+	}
+	if c.longLines {
+		return Error{Code: 554, Enhanced: EnhancedCode{5, 6, 0}, Message: fmt.Sprintf("Message line longer than %d octets", c.max)}
+	}
+	if c.eightBit {
+		return errUndeclared8Bit
+	}
+	return nil
+}
+
+// conformReader runs the body of a DATA message through a conformer.
+type conformReader struct {
+	r   io.Reader
+	c   *conformer
+	in  []byte
+	out []byte
+	buf []byte
+	err error
+}
+
+func (r *conformReader) Read(p []byte) (int, error) {
+	if len(r.out) == 0 && r.err == nil {
+		if len(r.in) < len(p) {
+			r.in = make([]byte, len(p))
+		}
+		n, err := r.r.Read(r.in[:len(p)])
+		r.buf = r.c.filter(r.buf[:0], r.in[:n])
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				r.buf = r.c.flush(r.buf)
+			}
+			r.err = err
+		}
+		r.out = r.buf
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	if len(r.out) == 0 && r.err != nil {
+		return n, r.err
+	}
+	return n, nil
+}
+
+// conformWriter runs the chunks of a BDAT message through a conformer on
+// their way to the handler. Write counts the octets of p as written, so that
+// the copy of a chunk counts what came off the wire.
+type conformWriter struct {
+	w   io.Writer
+	c   *conformer
+	buf []byte
+}
+
+func (w *conformWriter) Write(p []byte) (int, error) {
+	w.buf = w.c.filter(w.buf[:0], p)
+	if len(w.buf) == 0 {
+		return len(p), nil
+	}
+	if _, err := w.w.Write(w.buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// flush writes the CR that the conformer held back at the end of the
+// message.
+func (w *conformWriter) flush() error {
+	w.buf = w.c.flush(w.buf[:0])
+	if len(w.buf) == 0 {
+		return nil
+	}
+	_, err := w.w.Write(w.buf)
+	return err
+}
@@ -0,0 +1,236 @@
+package smtpd_test
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/chrj/smtpd/v2"
+)
+
+// conformed is what a handler read under BodyConformance.
+type conformed struct {
+	body           string
+	longLines      bool
+	undeclared8Bit bool
+	err            error
+}
+
+// captureConformed returns a Handler that reads the whole body and hands it
+// to the test with the flags of the envelope.
+func captureConformed(got chan<- conformed) smtpd.Handler {
+	return func(ctx context.Context, _ smtpd.Peer, env *smtpd.Envelope) (context.Context, error) {
+		body, err := io.ReadAll(env.Data)
+		got <- conformed{
+			body:           string(body),
+			longLines:      env.LongLines,
+			undeclared8Bit: env.Undeclared8Bit,
+			err:            err,
+		}
+		return ctx, err
+	}
+}
+
+// sendData runs a transaction with from as the MAIL FROM command, and gives
+// the reply to the end of data.
+func sendData(t *testing.T, c *rawClient, from, data string) string {
+	t.Helper()
+
+	c.send("EHLO client.example.com")
+	c.send(from)
+	c.send("RCPT TO:<bob@example.com>")
+	if reply := c.send("DATA"); !strings.HasPrefix(reply, "354 ") {
+		t.Fatalf("DATA = %q", reply)
+	}
+	c.write([]byte(data))
+	return c.line()
+}
+
+func TestConformanceFlag(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name           string
+		from           string
+		data           string
+		longLines      bool
+		undeclared8Bit bool
+	}{
+		{"conformant", "MAIL FROM:<alice@example.com>", "0123456789\r\nabc\r\n.\r\n", false, false},
+		{"long line", "MAIL FROM:<alice@example.com>", "0123456789A\r\n.\r\n", true, false},
+		{"8-bit without BODY", "MAIL FROM:<alice@example.com>", "caf\xc3\xa9\r\n.\r\n", false, true},
+		{"8-bit in 7BIT", "MAIL FROM:<alice@example.com> BODY=7BIT", "caf\xc3\xa9\r\n.\r\n", false, true},
+		{"8-bit in 8BITMIME", "MAIL FROM:<alice@example.com> BODY=8BITMIME", "caf\xc3\xa9\r\n.\r\n", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got := make(chan conformed, 1)
+			srv := runserver(t, &smtpd.Server{
+				BodyConformance:   smtpd.ConformanceFlag,
+				MaxBodyLineLength: 10,
+				Handler:           captureConformed(got),
+				Logger:            testLogger(t),
+			})
+
+			c := dialRaw(t, srv.Addr)
+			if reply := sendData(t, c, tt.from, tt.data); !strings.HasPrefix(reply, "250 ") {
+				t.Fatalf("reply = %q", reply)
+			}
+
+			msg := <-got
+			if msg.longLines != tt.longLines || msg.undeclared8Bit != tt.undeclared8Bit {
+				t.Errorf("LongLines, Undeclared8Bit = %v, %v; want %v, %v", msg.longLines, msg.undeclared8Bit, tt.longLines, tt.undeclared8Bit)
+			}
+		})
+	}
+}
+
+func TestConformanceRewrap(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		mode smtpd.BareLineBreaks
+		data string
+		want string
+		wrap bool
+	}{
+		{"at the limit", smtpd.BareLineBreaksAllow, "0123456789\r\n.\r\n", "0123456789\n", false},
+		{"over the limit", smtpd.BareLineBreaksAllow, "0123456789ABCDEFGHIJKL\r\n.\r\n", "0123456789\n ABCDEFGHI\n JKL\n", true},
+		{"over the limit with CRLF", smtpd.BareLineBreaksNormalize, "0123456789ABCDEFGHIJKL\r\n.\r\n", "0123456789\r\n ABCDEFGHI\r\n JKL\r\n", true},
+		{"CR in the line", smtpd.BareLineBreaksAllow, "012345678\rA\r\n.\r\n", "012345678\r\n A\n", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got := make(chan conformed, 1)
+			srv := runserver(t, &smtpd.Server{
+				BodyConformance:   smtpd.ConformanceRewrap,
+				MaxBodyLineLength: 10,
+				BareLineBreaks:    tt.mode,
+				Handler:           captureConformed(got),
+				Logger:            testLogger(t),
+			})
+
+			c := dialRaw(t, srv.Addr)
+			if reply := sendData(t, c, "MAIL FROM:<alice@example.com>", tt.data); !strings.HasPrefix(reply, "250 ") {
+				t.Fatalf("reply = %q", reply)
+			}
+
+			msg := <-got
+			if msg.body != tt.want || msg.longLines != tt.wrap {
+				t.Errorf("body %q with LongLines %v, want %q with %v", msg.body, msg.longLines, tt.want, tt.wrap)
+			}
+		})
+	}
+}
+
+func TestConformanceReject(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"long line", "0123456789A\r\n.\r\n", "554 5.6.0 Message line longer than 10 octets"},
+		{"8-bit", "caf\xc3\xa9\r\n.\r\n", "554 5.6.0 8-bit data in a 7BIT message"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got := make(chan conformed, 1)
+			srv := runserver(t, &smtpd.Server{
+				BodyConformance:   smtpd.ConformanceReject,
+				MaxBodyLineLength: 10,
+				Handler:           captureConformed(got),
+				Logger:            testLogger(t),
+			})
+
+			c := dialRaw(t, srv.Addr)
+			if reply := sendData(t, c, "MAIL FROM:<alice@example.com>", tt.data); reply != tt.want {
+				t.Errorf("reply = %q, want %q", reply, tt.want)
+			}
+			if msg := <-got; msg.err == nil {
+				t.Error("the handler read the body without an error")
+			}
+			if reply := c.send("QUIT"); !strings.HasPrefix(reply, "221 ") {
+				t.Errorf("QUIT = %q, want the session in step", reply)
+			}
+		})
+	}
+}
+
+func TestConformanceBDAT(t *testing.T) {
+	t.Parallel()
+
+	// The line goes on from one chunk into the next.
+	chunks := []string{"BDAT 8\r\n01234567", "BDAT 9 LAST\r\n89ABCD\r\n\r"}
+
+	t.Run("rewrap", func(t *testing.T) {
+		t.Parallel()
+
+		got := make(chan conformed, 1)
+		srv := runserver(t, &smtpd.Server{
+			BodyConformance:   smtpd.ConformanceRewrap,
+			MaxBodyLineLength: 10,
+			Handler:           captureConformed(got),
+			Logger:            testLogger(t),
+		})
+
+		c := dialRaw(t, srv.Addr)
+		c.send("EHLO client.example.com")
+		c.send("MAIL FROM:<alice@example.com>")
+		c.send("RCPT TO:<bob@example.com>")
+		for _, chunk := range chunks {
+			c.write([]byte(chunk))
+			if reply := c.line(); !strings.HasPrefix(reply, "250 ") {
+				t.Fatalf("%q = %q", chunk, reply)
+			}
+		}
+
+		// The CR at the end of the message stays.
+		if msg := <-got; msg.body != "0123456789\r\n ABCD\r\n\r" || !msg.longLines {
+			t.Errorf("body %q with LongLines %v, want the line broken", msg.body, msg.longLines)
+		}
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		t.Parallel()
+
+		got := make(chan conformed, 1)
+		srv := runserver(t, &smtpd.Server{
+			BodyConformance:   smtpd.ConformanceReject,
+			MaxBodyLineLength: 10,
+			Handler:           captureConformed(got),
+			Logger:            testLogger(t),
+		})
+
+		c := dialRaw(t, srv.Addr)
+		c.send("EHLO client.example.com")
+		c.send("MAIL FROM:<alice@example.com>")
+		c.send("RCPT TO:<bob@example.com>")
+		c.write([]byte(chunks[0]))
+		if reply := c.line(); !strings.HasPrefix(reply, "250 ") {
+			t.Fatalf("first chunk = %q", reply)
+		}
+		c.write([]byte(chunks[1]))
+		if reply := c.line(); reply != "554 5.6.0 Message line longer than 10 octets" {
+			t.Errorf("last chunk = %q, want the 554", reply)
+		}
+		if msg := <-got; msg.err == nil {
+			t.Error("the handler read the body without an error")
+		}
+		if reply := c.send("QUIT"); !strings.HasPrefix(reply, "221 ") {
+			t.Errorf("QUIT = %q, want the session in step", reply)
+		}
+	})
+}
@@ -0,0 +1,134 @@
+package smtpd
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"sync"
+)
+
+// defaultPerIPMessage is the text of the reply to a client over
+// MaxConnectionsPerIP.
+const defaultPerIPMessage = "Too many connections from your address, try again later"
+
+// connCounter counts the open sessions of each client address or network.
+// The zero value is ready for use.
+type connCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// acquire takes a session for key, unless key holds max sessions already.
+func (c *connCounter) acquire(key string, max int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.counts[key] >= max {
+		return false
+	}
+	if c.counts == nil {
+		c.counts = make(map[string]int)
+	}
+	c.counts[key]++
+	return true
+}
+
+// release gives back a session of key.
+func (c *connCounter) release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.counts[key] <= 1 {
+		delete(c.counts, key)
+		return
+	}
+	c.counts[key]--
+}
+
+func (c *connCounter) snapshot() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return maps.Clone(c.counts)
+}
+
+// ConnectionsPerIP gives the open sessions of each client address, or of
+// each network under ConnectionPrefixIPv4 and ConnectionPrefixIPv6, such as
+// "192.0.2.7" or "2001:db8:1:2::/64". The server counts them only with
+// MaxConnectionsPerIP set. The map is a copy, and the caller may keep it.
+func (srv *Server) ConnectionsPerIP() map[string]int {
+	counts := srv.perIP.snapshot()
+	if counts == nil {
+		counts = make(map[string]int)
+	}
+	return counts
+}
+
+// perIPKey gives the key that MaxConnectionsPerIP counts a connection from
+// addr under. A connection that is not on TCP, such as one on a unix socket,
+// has no key and is not counted.
+func (srv *Server) perIPKey(addr net.Addr) string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	ip := tcpAddr.AddrPort().Addr().Unmap()
+
+	bits := srv.ConnectionPrefixIPv6
+	if ip.Is4() {
+		bits = srv.ConnectionPrefixIPv4
+	}
+	if bits == ip.BitLen() {
+		return ip.String()
+	}
+	prefix, err := ip.Prefix(bits)
+	if err != nil {
+		return ip.String()
+	}
+	return prefix.String()
+}
+
+// configurePerIP checks and defaults the fields of MaxConnectionsPerIP.
+func (srv *Server) configurePerIP() error {
+	if srv.ConnectionPrefixIPv4 == 0 {
+		srv.ConnectionPrefixIPv4 = 32
+	}
+	if srv.ConnectionPrefixIPv6 == 0 {
+		srv.ConnectionPrefixIPv6 = 128
+	}
+	if srv.ConnectionPrefixIPv4 < 0 || srv.ConnectionPrefixIPv4 > 32 {
+		return fmt.Errorf("smtpd: ConnectionPrefixIPv4 %d is not between 0 and 32", srv.ConnectionPrefixIPv4)
+	}
+	if srv.ConnectionPrefixIPv6 < 0 || srv.ConnectionPrefixIPv6 > 128 {
+		return fmt.Errorf("smtpd: ConnectionPrefixIPv6 %d is not between 0 and 128", srv.ConnectionPrefixIPv6)
+	}
+	if srv.MaxConnectionsPerIPMessage == "" {
+		srv.MaxConnectionsPerIPMessage = defaultPerIPMessage
+	}
+	return nil
+}
+
+// admitPeer takes a session of MaxConnectionsPerIP for conn, and gives the
+// key to release it under, which is empty where the server does not count
+// conn. It refuses a connection over the cap, as admit refuses one over
+// MaxConnectionRate, and reports false.
+func (srv *Server) admitPeer(conn net.Conn) (string, bool) {
+	if srv.MaxConnectionsPerIP <= 0 {
+		return "", true
+	}
+	key := srv.perIPKey(conn.RemoteAddr())
+	if key == "" {
+		return "", true
+	}
+	if !srv.perIP.acquire(key, srv.MaxConnectionsPerIP) {
+		srv.refuse(conn, "421 4.7.0 "+srv.MaxConnectionsPerIPMessage+"\r\n")
+		return "", false
+	}
+	return key, true
+}
+
+// releasePeer gives back the session that admitPeer took under key.
+func (srv *Server) releasePeer(key string) {
+	if key != "" {
+		srv.perIP.release(key)
+	}
+}
@@ -0,0 +1,209 @@
+package smtpd
+
+import (
+	"container/heap"
+	"context"
+	"log/slog"
+	"math"
+	"net"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnectionQueueStats counts the connections that waited for a slot of
+// MaxConnections. Waiting is the depth of the queue at the moment;
+// Admitted and TimedOut count since the server started.
+type ConnectionQueueStats struct {
+	Waiting  int64
+	Admitted int64
+	TimedOut int64
+}
+
+// connQueueStats holds the counts of ConnectionQueueStats across the
+// listeners of a server.
+type connQueueStats struct {
+	waiting  atomic.Int64
+	admitted atomic.Int64
+	timedOut atomic.Int64
+}
+
+// ConnectionQueueStats gives the counts of the queue of ConnectionQueue.
+func (srv *Server) ConnectionQueueStats() ConnectionQueueStats {
+	return ConnectionQueueStats{
+		Waiting:  srv.queueStats.waiting.Load(),
+		Admitted: srv.queueStats.admitted.Load(),
+		TimedOut: srv.queueStats.timedOut.Load(),
+	}
+}
+
+// connPriority calls Server.ConnectionPriority, and gives a connection whose
+// call panics the lowest priority.
+func (srv *Server) connPriority(ctx context.Context, addr net.Addr) (priority int) {
+	if srv.ConnectionPriority == nil {
+		return 0
+	}
+
+	defer func() {
+		if v := recover(); v != nil {
+			priority = math.MinInt
+			LoggerFromContext(ctx).ErrorContext(ctx, "recovered a panic",
+				slog.Any("panic", v),
+				slog.String("stack", string(debug.Stack())),
+			)
+		}
+	}()
+
+	return srv.ConnectionPriority(addr)
+}
+
+// connSlots hands out the slots of MaxConnections. A connection that finds
+// every slot taken waits in a queue of at most queue others, and a slot that
+// comes free goes to the waiter of the highest priority, the earliest of
+// them first.
+type connSlots struct {
+	max   int
+	queue int
+	stats *connQueueStats
+
+	mu      sync.Mutex
+	active  int
+	waiters connWaiters
+	seq     uint64
+}
+
+// connWaiter is a connection in the queue. index is its place in the heap,
+// and -1 once it holds a slot.
+type connWaiter struct {
+	priority int
+	seq      uint64
+	ready    chan struct{}
+	index    int
+}
+
+func newConnSlots(max, queue int, stats *connQueueStats) *connSlots {
+	return &connSlots{max: max, queue: queue, stats: stats}
+}
+
+// tryAcquire takes a slot where one is free and nobody waits for it. Where
+// it does not, it reports whether the queue has room for the connection to
+// wait in, so that Serve refuses one that has nowhere to wait at once.
+func (c *connSlots) tryAcquire() (ok, wait bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.active < c.max && len(c.waiters) == 0 {
+		c.active++
+		return true, false
+	}
+	return false, len(c.waiters) < c.queue
+}
+
+// acquire takes a slot, and waits up to timeout for one when every slot is
+// taken and the queue has room. It reports whether it got one. A done ctx
+// ends the wait as well. priority runs only for a connection that waits.
+func (c *connSlots) acquire(ctx context.Context, priority func() int, timeout time.Duration) bool {
+	c.mu.Lock()
+	if c.active < c.max && len(c.waiters) == 0 {
+		c.active++
+		c.mu.Unlock()
+		return true
+	}
+	if len(c.waiters) >= c.queue {
+		c.mu.Unlock()
+		return false
+	}
+	c.mu.Unlock()
+
+	// The hook of the priority runs outside the lock. A slot that comes free
+	// meanwhile goes to this connection, unless another one waits already.
+	rank := priority()
+
+	c.mu.Lock()
+	if c.active < c.max && len(c.waiters) == 0 {
+		c.active++
+		c.mu.Unlock()
+		return true
+	}
+	if len(c.waiters) >= c.queue {
+		c.mu.Unlock()
+		return false
+	}
+	c.seq++
+	w := &connWaiter{priority: rank, seq: c.seq, ready: make(chan struct{})}
+	heap.Push(&c.waiters, w)
+	c.stats.waiting.Add(1)
+	c.mu.Unlock()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case <-w.ready:
+		c.stats.admitted.Add(1)
+		return true
+	case <-t.C:
+	case <-ctx.Done():
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if w.index < 0 {
+		// release handed the slot over while the wait ran out.
+		c.stats.admitted.Add(1)
+		return true
+	}
+	heap.Remove(&c.waiters, w.index)
+	c.stats.waiting.Add(-1)
+	c.stats.timedOut.Add(1)
+	return false
+}
+
+// release gives back a slot. The first waiter in the queue takes it over.
+func (c *connSlots) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.waiters) == 0 {
+		c.active--
+		return
+	}
+	w := heap.Pop(&c.waiters).(*connWaiter)
+	w.index = -1
+	c.stats.waiting.Add(-1)
+	close(w.ready)
+}
+
+// connWaiters is a heap of waiters, the highest priority on top and the
+// earliest first among equals.
+type connWaiters []*connWaiter
+
+func (q connWaiters) Len() int { return len(q) }
+
+func (q connWaiters) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q connWaiters) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *connWaiters) Push(x any) {
+	w := x.(*connWaiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+
+func (q *connWaiters) Pop() any {
+	old := *q
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return w
+}
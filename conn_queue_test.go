@@ -0,0 +1,130 @@
+package smtpd_test
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/chrj/smtpd/v2"
+)
+
+// greeting reads the first line that the server writes on c, on a goroutine
+// of its own, so a test can look for a greeting that has not come yet.
+func greeting(c net.Conn) <-chan string {
+	line := make(chan string, 1)
+	go func() {
+		l, err := bufio.NewReader(c).ReadString('\n')
+		if err != nil {
+			l = "error: " + err.Error()
+		}
+		line <- strings.TrimSpace(l)
+	}()
+	return line
+}
+
+// pending gives the line of ch if it has come, and the empty string if not.
+func pending(ch <-chan string) string {
+	select {
+	case l := <-ch:
+		return l
+	default:
+		return ""
+	}
+}
+
+func TestConnectionQueue(t *testing.T) {
+	t.Parallel()
+
+	synctest.Test(t, func(t *testing.T) {
+		// The first connection to wait ranks 1, and the second one 5.
+		var mu sync.Mutex
+		ranks := []int{1, 5}
+		var sessions, disconnects atomic.Int32
+		srv := &smtpd.Server{
+			MaxConnections:         1,
+			ConnectionQueue:        2,
+			ConnectionQueueTimeout: 10 * time.Second,
+			ConnectionPriority: func(net.Addr) int {
+				mu.Lock()
+				defer mu.Unlock()
+				r := ranks[0]
+				ranks = ranks[1:]
+				return r
+			},
+			ConnContext: func(ctx context.Context, _ net.Conn) context.Context {
+				sessions.Add(1)
+				return ctx
+			},
+			Logger: testLogger(t),
+		}
+		srv.Use(smtpd.Middleware{
+			Disconnect: func(context.Context, smtpd.Peer, error) { disconnects.Add(1) },
+		})
+		l := runpipeserver(t, srv)
+		defer func() { _ = l.Close() }()
+
+		c1 := l.dial(t)
+		r1 := bufio.NewReader(c1)
+		if line, _ := r1.ReadString('\n'); !strings.HasPrefix(line, "220 ") {
+			t.Fatalf("first greeting = %q", line)
+		}
+
+		c2 := l.dial(t)
+		g2 := greeting(c2)
+		synctest.Wait()
+		c3 := l.dial(t)
+		g3 := greeting(c3)
+		synctest.Wait()
+
+		// The queue is full, so the fourth connection gets the 421 at once,
+		// before the server spends a session on it.
+		c4 := l.dial(t)
+		if line := <-greeting(c4); line != "421 Too busy. Try again later." {
+			t.Errorf("fourth greeting = %q, want a 421", line)
+		}
+		if n := sessions.Load(); n != 3 {
+			t.Errorf("ConnContext ran %d times, want 3", n)
+		}
+		if got := srv.ConnectionQueueStats(); got.Waiting != 2 {
+			t.Errorf("stats = %+v, want 2 waiting", got)
+		}
+
+		// The slot of the first session goes to the connection of the higher
+		// rank, although it came later.
+		_, _ = c1.Write([]byte("QUIT\r\n"))
+		_, _ = r1.ReadString('\n')
+		synctest.Wait()
+		if line := pending(g3); !strings.HasPrefix(line, "220 ") {
+			t.Errorf("greeting of the higher rank = %q, want a 220", line)
+		}
+		if line := pending(g2); line != "" {
+			t.Errorf("greeting of the lower rank = %q, want none yet", line)
+		}
+
+		// The other one gives up at the timeout.
+		time.Sleep(10 * time.Second)
+		synctest.Wait()
+		if line := pending(g2); line != "421 Too busy. Try again later." {
+			t.Errorf("greeting after the timeout = %q, want a 421", line)
+		}
+		// Only the session that ended with QUIT ran the Disconnect hooks.
+		if n := disconnects.Load(); n != 1 {
+			t.Errorf("Disconnect ran %d times, want 1", n)
+		}
+
+		want := smtpd.ConnectionQueueStats{Waiting: 0, Admitted: 1, TimedOut: 1}
+		if got := srv.ConnectionQueueStats(); got != want {
+			t.Errorf("stats = %+v, want %+v", got, want)
+		}
+
+		for _, c := range []net.Conn{c1, c2, c3, c4} {
+			_ = c.Close()
+		}
+	})
+}
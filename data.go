@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"io"
 	"net/textproto"
-	"time"
 )
 
 func (s *session) handleDATA(ctx context.Context, cmd *command) context.Context {
@@ -31,13 +30,37 @@ func (s *session) handleDATA(ctx context.Context, cmd *command) context.Context
 		return s.replyEnhanced(ctx, 503, EnhancedCode{5, 5, 1}, "A BINARYMIME message needs BDAT")
 	}
 
-	ctx = s.reply(ctx, 354, "Go ahead. End your data with <CR><LF>.<CR><LF>")
-	_ = s.conn.SetDeadline(time.Now().Add(s.server.DataTimeout))
+	if s.server.budgetFull() {
+		return s.replyError(ctx, errNoBudget)
+	}
 
-	body := &dataReader{
-		r:   textproto.NewReader(s.reader).DotReader(),
-		max: s.server.MaxMessageSize,
+	ctx = s.reply(ctx, 354, "Go ahead. End your data with <CR><LF>.<CR><LF>")
+	deadline := s.setDataDeadline()
+
+	body := &dataReader{max: s.server.MaxMessageSize}
+
+	// textproto gives the lines of the message with a bare LF at the end,
+	// and dotReader gives them with CRLF.
+	var r io.Reader
+	lineBreak := "\n"
+	if s.server.BareLineBreaks == BareLineBreaksAllow {
+		r = textproto.NewReader(s.reader).DotReader()
+	} else {
+		dot := newDotReader(s.reader, s.server.BareLineBreaks)
+		body.checks = append(body.checks, dot)
+		r, lineBreak = dot, "\r\n"
+	}
+	r = s.rateReader(r, &rateWindow{}, deadline)
+	hold := s.server.newHold()
+	if br := s.budgetReader(ctx, r, &hold); br != r {
+		body.checks = append(body.checks, &hold)
+		r = br
 	}
+	if c := s.conformer(lineBreak); c != nil {
+		body.checks = append(body.checks, c)
+		r = &conformReader{r: r, c: c}
+	}
+	body.r = r
 	s.envelope.Data = body
 
 	ctx, deliverErr := s.deliver(ctx)
@@ -45,6 +68,7 @@ func (s *session) handleDATA(ctx context.Context, cmd *command) context.Context
 	// Always drain+close so the SMTP stream stays in sync even if the
 	// handler bailed out early or forgot to close.
 	_ = body.Close()
+	hold.release()
 
 	if body.tooBig {
 		ctx = s.replyDeliveryError(ctx, Error{
@@ -67,6 +91,14 @@ func (s *session) handleDATA(ctx context.Context, cmd *command) context.Context
 		return s.reset(ctx)
 	}
 
+	if body.refusal != nil && body.readErr == nil {
+		return s.reset(s.replyDeliveryError(ctx, body.refusal))
+	}
+
+	if limit, ok := s.limitOf(body.readErr); ok {
+		return s.closeAtLimit(ctx, limit)
+	}
+
 	if body.readErr != nil && !errors.Is(body.readErr, io.EOF) {
 		// Network or protocol error reading DATA; the connection is likely
 		// dead. Record the cause for the Disconnect hook and return -
@@ -85,11 +117,15 @@ func (s *session) handleDATA(ctx context.Context, cmd *command) context.Context
 }
 
 // dataReader wraps the DATA dot-stream. Read returns errMessageTooLarge
-// once the body crosses MaxMessageSize; Close drains whatever the handler
-// didn't read so the next SMTP command lands on a clean boundary.
+// once the body crosses MaxMessageSize, and the refusal of one of checks
+// once it finds one; Close drains whatever the handler didn't read so the
+// next SMTP command lands on a clean boundary.
 type dataReader struct {
-	r   io.Reader
-	max int
+	r      io.Reader
+	checks []bodyCheck
+	max    int
+
+	refusal error
 
 	n         int
 	tooBig    bool
@@ -105,6 +141,9 @@ func (d *dataReader) Read(p []byte) (int, error) {
 	if d.tooBig {
 		return 0, errMessageTooLarge
 	}
+	if d.refusal != nil {
+		return 0, d.refusal
+	}
 	n, err := d.r.Read(p)
 	d.n += n
 	if d.n > d.max {
@@ -121,9 +160,23 @@ func (d *dataReader) Read(p []byte) (int, error) {
 	if err != nil && !errors.Is(err, io.EOF) {
 		d.readErr = err
 	}
+	if d.check() {
+		return n, d.refusal
+	}
 	return n, err
 }
 
+// check asks each of checks for a refusal, and reports whether it holds one.
+func (d *dataReader) check() bool {
+	for _, c := range d.checks {
+		if d.refusal != nil {
+			break
+		}
+		d.refusal = c.refusal()
+	}
+	return d.refusal != nil
+}
+
 func (d *dataReader) Close() error {
 	if d.closed {
 		return nil
@@ -145,6 +198,7 @@ func (d *dataReader) Close() error {
 		if d.n > d.max {
 			d.tooBig = true
 		}
+		d.check()
 		if err != nil {
 			if !errors.Is(err, io.EOF) {
 				d.readErr = err
@@ -352,6 +352,48 @@ func TestHandleDATAHandlerError(t *testing.T) {
 	}
 }
 
+// closeRecorder is a body that a Handler stage puts into Envelope.Data, and
+// that records its Close.
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestHandleDATAClosesTheBodyOfAStage(t *testing.T) {
+	t.Parallel()
+
+	body := &closeRecorder{Reader: strings.NewReader("spooled\r\n")}
+	srv := &Server{
+		MaxMessageSize: 1024,
+		Handler: func(ctx context.Context, _ Peer, _ *Envelope) (context.Context, error) {
+			return ctx, Error{Code: 554, Message: "nope"}
+		},
+	}
+	srv.Use(Middleware{
+		Handler: func(ctx context.Context, _ Peer, env *Envelope) (context.Context, error) {
+			_, _ = io.Copy(io.Discard, env.Data)
+			_ = env.Data.Close()
+			env.Data = body
+			return ctx, nil
+		},
+	})
+	env := &Envelope{Recipients: []string{"r@example.net"}}
+
+	codes := runDATA(t, srv, env, "body\r\n.\r\n")
+
+	if len(codes) != 2 || codes[1] != 554 {
+		t.Fatalf("codes = %v, want [354 554]", codes)
+	}
+	if !body.closed {
+		t.Error("the body that the stage put into Data was not closed")
+	}
+}
+
 // chunkReader hands out the body in the sizes it is given, so a fuzz target
 // decides where the reads of dataReader fall.
 type chunkReader struct {
@@ -8,10 +8,11 @@ import "strings"
 //
 // The server reads the parameters and puts them on the envelope. It writes
 // no notification of its own, because only the handler knows what became of
-// the message.
+// the message. The dsn package writes one for the handler.
 //
 // Envelope.DSN is nil unless the server runs with Server.EnableDSN and the
-// client sent at least one of the parameters.
+// client sent at least one of the parameters, or a RewriteRecipient hook
+// changed a recipient and the server recorded its ORCPT.
 type DSN struct {
 	// Return is the RET parameter of MAIL FROM. It says how much of the
 	// message a notification carries back. The empty string means that the
@@ -0,0 +1,538 @@
+// Package dsn writes delivery status notifications of RFC 3464: the message
+// that tells the sender what became of a message, such as a bounce.
+//
+// The server reads the DSN parameters of RFC 3461 into Envelope.DSN, and a
+// handler that delivers the message knows the outcome for each recipient. A
+// Report puts the two together. It leaves out the recipients whose NOTIFY
+// parameter asks for no notification of their outcome, returns the whole
+// message or its header as RET asks, and carries ENVID and ORCPT back to the
+// sender.
+//
+//	report := dsn.FromEnvelope(env, "mx.example.com")
+//	report.Recipients[0].Action = dsn.Failed
+//	report.Recipients[0].Err = err
+//	bounce, err := report.Envelope(body)
+//
+// The notification goes to the sender of the message from the null sender, as
+// RFC 3461 section 6.2 asks, so that a notification never causes another one.
+package dsn
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/chrj/smtpd/v2"
+)
+
+// Action is the outcome of a delivery to one recipient, from RFC 3464
+// section 2.3.3.
+type Action string
+
+const (
+	// Failed is a recipient that the message never reaches.
+	Failed Action = "failed"
+
+	// Delayed is a recipient that the message did not reach yet, and that
+	// the server still tries.
+	Delayed Action = "delayed"
+
+	// Delivered is a recipient that got the message.
+	Delivered Action = "delivered"
+
+	// Relayed is a recipient whose message went on to a server that sends no
+	// notification.
+	Relayed Action = "relayed"
+
+	// Expanded is a recipient that got the message, and passed it on to
+	// other addresses as an alias or a list.
+	Expanded Action = "expanded"
+)
+
+// defaultMaxReturn is the size of the largest message that a notification
+// returns whole.
+const defaultMaxReturn = 1 << 20
+
+// ErrNoNotification says that a Report has nothing to send: no recipient
+// asks for a notification of its outcome, or the message came from the null
+// sender.
+var ErrNoNotification = errors.New("dsn: no recipient asks for a notification")
+
+// Report is a delivery status notification about one message.
+type Report struct {
+	// ReportingMTA is the name of the server that writes the notification.
+	ReportingMTA string
+
+	// Sender is the sender of the message, who gets the notification.
+	Sender string
+
+	// EnvID and Return are the ENVID and RET parameters of the message.
+	EnvID  string
+	Return smtpd.DSNReturn
+
+	// BodyType and SMTPUTF8 are those of the message.
+	BodyType smtpd.BodyType
+	SMTPUTF8 bool
+
+	// Arrival is the time at which the message arrived. The zero value
+	// leaves out the Arrival-Date field.
+	Arrival time.Time
+
+	// Date is the date of the notification. The zero value is the time of
+	// the write.
+	Date time.Time
+
+	// MaxReturn is the size of the largest message that the notification
+	// returns whole. A larger one comes back with its header alone. The zero
+	// value is 1MB, and a negative value returns the header always.
+	MaxReturn int64
+
+	// Recipients holds the outcome for each recipient.
+	Recipients []Recipient
+}
+
+// Recipient is the outcome of the delivery to one recipient.
+type Recipient struct {
+	// Address is the recipient as the server delivered to it.
+	Address string
+
+	// DSN holds the NOTIFY and ORCPT parameters of the recipient.
+	DSN smtpd.RecipientDSN
+
+	Action Action
+
+	// Err is the reason for a failure or a delay. An smtpd.Error gives the
+	// Status and the Diagnostic-Code fields; any other error gives a
+	// generic status of its class.
+	Err error
+
+	// RemoteMTA is the name of the server that gave Err. The empty string
+	// leaves out the field.
+	RemoteMTA string
+
+	// WillRetryUntil is the time until which the server tries a delayed
+	// recipient. The zero value leaves out the field.
+	WillRetryUntil time.Time
+}
+
+// FromEnvelope gives a Report about the message of env, with a recipient for
+// each of env.Recipients and its DSN parameters. Set the Action and the Err
+// of each recipient.
+func FromEnvelope(env *smtpd.Envelope, reportingMTA string) *Report {
+	r := &Report{
+		ReportingMTA: reportingMTA,
+		Sender:       env.Sender,
+		BodyType:     env.BodyType,
+		SMTPUTF8:     env.SMTPUTF8,
+		Arrival:      time.Now(),
+	}
+	if env.DSN != nil {
+		r.EnvID, r.Return = env.DSN.EnvID, env.DSN.Return
+	}
+	for i, addr := range env.Recipients {
+		rcpt := Recipient{Address: addr}
+		if env.DSN != nil && i < len(env.DSN.Recipients) {
+			rcpt.DSN = env.DSN.Recipients[i]
+		}
+		r.Recipients = append(r.Recipients, rcpt)
+	}
+	return r
+}
+
+// Wants reports whether a recipient with the given DSN parameters asks for a
+// notification of action. A recipient without a NOTIFY parameter gets one for
+// a failure and for a delay, which RFC 3461 section 4.1 allows.
+func Wants(dsn smtpd.RecipientDSN, action Action) bool {
+	notify := dsn.Notify
+	if notify == 0 {
+		notify = smtpd.DSNNotifyFailure | smtpd.DSNNotifyDelay
+	}
+
+	switch {
+	case notify&smtpd.DSNNotifyNever != 0:
+		return false
+	case action == Failed:
+		return notify&smtpd.DSNNotifyFailure != 0
+	case action == Delayed:
+		return notify&smtpd.DSNNotifyDelay != 0
+	}
+	return notify&smtpd.DSNNotifySuccess != 0
+}
+
+// Notified gives the recipients that the notification reports on: those
+// that ask for a notification of their action.
+func (r *Report) Notified() []Recipient {
+	var out []Recipient
+	for _, rcpt := range r.Recipients {
+		if Wants(rcpt.DSN, rcpt.Action) {
+			out = append(out, rcpt)
+		}
+	}
+	return out
+}
+
+// Envelope gives the notification as a message to send: from the null
+// sender to r.Sender. original reads the message that the notification is
+// about. It returns ErrNoNotification when there is nothing to send.
+func (r *Report) Envelope(original io.Reader) (*smtpd.Envelope, error) {
+	var buf bytes.Buffer
+	if err := r.Write(&buf, original); err != nil {
+		return nil, err
+	}
+
+	env := &smtpd.Envelope{
+		Recipients: []string{r.Sender},
+		Data:       io.NopCloser(&buf),
+		SMTPUTF8:   r.global(),
+	}
+	if r.global() || (r.BodyType != "" && r.BodyType != smtpd.Body7Bit) {
+		env.BodyType = smtpd.Body8BitMIME
+	}
+	// RFC 3461 section 5.2.1 gives a notification about a notification no
+	// ENVID and no NOTIFY other than NEVER.
+	env.DSN = &smtpd.DSN{Recipients: []smtpd.RecipientDSN{{Notify: smtpd.DSNNotifyNever}}}
+	return env, nil
+}
+
+// Write writes the notification as a message, with its header, to w.
+// original reads the message that the notification is about. It returns
+// ErrNoNotification when there is nothing to send.
+func (r *Report) Write(w io.Writer, original io.Reader) error {
+	rcpts := r.Notified()
+	if r.Sender == "" || len(rcpts) == 0 {
+		return ErrNoNotification
+	}
+
+	date := r.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	bw := bufio.NewWriter(w)
+	mw := multipart.NewWriter(bw)
+
+	h := []string{
+		"From: Mail Delivery System <MAILER-DAEMON@" + r.ReportingMTA + ">",
+		"To: <" + r.Sender + ">",
+		"Subject: " + subject(rcpts),
+		"Date: " + date.Format(time.RFC1123Z),
+		"Message-ID: <" + rand.Text() + "@" + r.ReportingMTA + ">",
+		// RFC 3834 section 5 marks a message that a program wrote in
+		// answer to another one.
+		"Auto-Submitted: auto-replied",
+		"MIME-Version: 1.0",
+		`Content-Type: multipart/report; report-type=delivery-status; boundary="` + mw.Boundary() + `"`,
+	}
+	for _, line := range h {
+		_, _ = bw.WriteString(line + "\r\n")
+	}
+	_, _ = bw.WriteString("\r\n")
+
+	if err := r.writeText(mw, rcpts); err != nil {
+		return err
+	}
+	if err := r.writeStatus(mw, rcpts); err != nil {
+		return err
+	}
+	if err := r.writeOriginal(mw, rcpts, original); err != nil {
+		return err
+	}
+
+	if err := mw.Close(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// subject gives the Subject of a notification about rcpts: the gravest of
+// their actions decides it.
+func subject(rcpts []Recipient) string {
+	delayed := false
+	for _, rcpt := range rcpts {
+		switch rcpt.Action {
+		case Failed:
+			return "Undelivered Mail Returned to Sender"
+		case Delayed:
+			delayed = true
+		}
+	}
+	if delayed {
+		return "Delayed Mail (still being retried)"
+	}
+	return "Successful Mail Delivery Report"
+}
+
+// writeText writes the first part, which says in words what the second part
+// says in fields.
+func (r *Report) writeText(mw *multipart.Writer, rcpts []Recipient) error {
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"text/plain; charset=utf-8"},
+		"Content-Description": {"Notification"},
+	})
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "This is the mail system at host %s.\r\n\r\n", r.ReportingMTA)
+	for _, rcpt := range rcpts {
+		fmt.Fprintf(&b, "<%s>: %s", rcpt.Address, describe(rcpt.Action))
+		if rcpt.Err != nil {
+			fmt.Fprintf(&b, "\r\n    %s", oneLine(rcpt.Err.Error()))
+		}
+		b.WriteString("\r\n\r\n")
+	}
+
+	_, err = io.WriteString(part, b.String())
+	return err
+}
+
+func describe(action Action) string {
+	switch action {
+	case Failed:
+		return "the message could not be delivered."
+	case Delayed:
+		return "the message was not delivered yet. The mail system keeps trying."
+	case Relayed:
+		return "the message was passed on to a system that sends no notifications."
+	case Expanded:
+		return "the message was delivered, and passed on to the members of the list or alias."
+	}
+	return "the message was delivered."
+}
+
+// writeStatus writes the message/delivery-status part of RFC 3464 section
+// 2, or the message/global-delivery-status of RFC 6533 for addresses in
+// UTF-8.
+func (r *Report) writeStatus(mw *multipart.Writer, rcpts []Recipient) error {
+	ct := "message/delivery-status"
+	if r.global() {
+		ct = "message/global-delivery-status"
+	}
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {ct},
+		"Content-Description": {"Delivery report"},
+	})
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Reporting-MTA: dns; %s\r\n", r.ReportingMTA)
+	if r.EnvID != "" {
+		fmt.Fprintf(&b, "Original-Envelope-Id: %s\r\n", printable(r.EnvID))
+	}
+	if !r.Arrival.IsZero() {
+		fmt.Fprintf(&b, "Arrival-Date: %s\r\n", r.Arrival.Format(time.RFC1123Z))
+	}
+
+	for _, rcpt := range rcpts {
+		b.WriteString("\r\n")
+		fmt.Fprintf(&b, "Final-Recipient: %s; %s\r\n", addressType(rcpt.Address), rcpt.Address)
+		if rcpt.DSN.OriginalType != "" {
+			fmt.Fprintf(&b, "Original-Recipient: %s; %s\r\n", rcpt.DSN.OriginalType, printable(rcpt.DSN.OriginalRecipient))
+		}
+		fmt.Fprintf(&b, "Action: %s\r\n", rcpt.Action)
+		fmt.Fprintf(&b, "Status: %s\r\n", status(rcpt))
+		if rcpt.RemoteMTA != "" {
+			fmt.Fprintf(&b, "Remote-MTA: dns; %s\r\n", rcpt.RemoteMTA)
+		}
+		var se smtpd.Error
+		if errors.As(rcpt.Err, &se) {
+			fmt.Fprintf(&b, "Diagnostic-Code: smtp; %s\r\n", oneLine(se.Error()))
+		}
+		if !rcpt.WillRetryUntil.IsZero() {
+			fmt.Fprintf(&b, "Will-Retry-Until: %s\r\n", rcpt.WillRetryUntil.Format(time.RFC1123Z))
+		}
+	}
+
+	_, err = io.WriteString(part, b.String())
+	return err
+}
+
+// status gives the Status field of rcpt: the status code of its error, or
+// the generic code of its action.
+func status(rcpt Recipient) string {
+	var se smtpd.Error
+	if errors.As(rcpt.Err, &se) {
+		if se.Enhanced != (smtpd.EnhancedCode{}) {
+			return se.Enhanced.String()
+		}
+		switch se.Code / 100 {
+		case 4:
+			return "4.0.0"
+		case 5:
+			return "5.0.0"
+		}
+	}
+
+	switch rcpt.Action {
+	case Failed:
+		return "5.0.0"
+	case Delayed:
+		return "4.0.0"
+	}
+	return "2.0.0"
+}
+
+// writeOriginal writes the third part: the message, or its header alone.
+//
+// RET=HDRS asks for the header, and RET=FULL for the whole message. Without
+// RET a failure returns the whole message, and any other notification the
+// header, which RFC 3461 section 4.3 leaves to the server. A message larger
+// than MaxReturn, and a binary one, comes back as its header.
+func (r *Report) writeOriginal(mw *multipart.Writer, rcpts []Recipient, original io.Reader) error {
+	if original == nil {
+		return nil
+	}
+
+	full := r.Return == smtpd.DSNReturnFull
+	if r.Return == "" {
+		for _, rcpt := range rcpts {
+			full = full || rcpt.Action == Failed
+		}
+	}
+	if r.BodyType == smtpd.BodyBinaryMIME {
+		full = false
+	}
+
+	maxReturn := r.MaxReturn
+	if maxReturn == 0 {
+		maxReturn = defaultMaxReturn
+	}
+
+	br := bufio.NewReader(original)
+	var head bytes.Buffer
+	if err := copyHeader(&head, br); err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	full = full && maxReturn > 0
+	if full {
+		n, err := io.Copy(&body, io.LimitReader(br, maxReturn-int64(head.Len())+1))
+		if err != nil {
+			return err
+		}
+		full = int64(head.Len())+n <= maxReturn
+	}
+
+	ct := "text/rfc822-headers"
+	switch {
+	case full && r.global():
+		ct = "message/global"
+	case full:
+		ct = "message/rfc822"
+	case r.global():
+		ct = "message/global-headers"
+	}
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {ct},
+		"Content-Description": {"Undelivered message"},
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := part.Write(head.Bytes()); err != nil {
+		return err
+	}
+	if !full {
+		return nil
+	}
+	_, err = part.Write(toCRLF(body.Bytes()))
+	return err
+}
+
+// copyHeader copies the header of a message from r to w, with the empty line
+// after it and every line end as CRLF.
+func copyHeader(w *bytes.Buffer, r *bufio.Reader) error {
+	for {
+		line, err := r.ReadString('\n')
+		if line != "" {
+			line = strings.TrimRight(line, "\r\n")
+			w.WriteString(line + "\r\n")
+			if line == "" {
+				return nil
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			w.WriteString("\r\n")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// toCRLF writes each bare LF of p as CRLF.
+func toCRLF(p []byte) []byte {
+	if !bytes.Contains(p, []byte("\n")) {
+		return p
+	}
+	out := make([]byte, 0, len(p)+len(p)/32)
+	for i, c := range p {
+		if c == '\n' && (i == 0 || p[i-1] != '\r') {
+			out = append(out, '\r')
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// global reports whether the notification takes the types of RFC 6533, for
+// a message of SMTPUTF8 or an address in UTF-8.
+func (r *Report) global() bool {
+	if r.SMTPUTF8 || !isASCII(r.Sender) {
+		return true
+	}
+	for _, rcpt := range r.Recipients {
+		if !isASCII(rcpt.Address) || !isASCII(rcpt.DSN.OriginalRecipient) {
+			return true
+		}
+	}
+	return false
+}
+
+// addressType gives the address type of the Final-Recipient field: "utf-8"
+// of RFC 6533 for an address in UTF-8, and "rfc822" otherwise.
+func addressType(addr string) string {
+	if isASCII(addr) {
+		return "rfc822"
+	}
+	return "utf-8"
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// printable gives s with its control characters taken out, so a value that
+// the client sent cannot start a field of its own.
+func printable(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// oneLine gives s on one line.
+func oneLine(s string) string {
+	return printable(strings.ReplaceAll(s, "\n", " "))
+}
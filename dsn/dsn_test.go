@@ -0,0 +1,275 @@
+package dsn
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chrj/smtpd/v2"
+)
+
+const original = "From: alice@example.org\nSubject: hello\n\nline one\nline two\n"
+
+// parts reads the notification that r writes about original, and gives its
+// header and the content type and body of each part.
+func parts(t *testing.T, r *Report, original string) (mail.Header, []string, []string) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := r.Write(&buf, strings.NewReader(original)); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mt, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mt != "multipart/report" || params["report-type"] != "delivery-status" {
+		t.Fatalf("Content-Type %q", msg.Header.Get("Content-Type"))
+	}
+
+	var types, bodies []string
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(p)
+		types = append(types, p.Header.Get("Content-Type"))
+		bodies = append(bodies, string(b))
+	}
+	return msg.Header, types, bodies
+}
+
+func TestWants(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		notify smtpd.DSNNotify
+		action Action
+		want   bool
+	}{
+		{0, Failed, true},
+		{0, Delayed, true},
+		{0, Delivered, false},
+		{smtpd.DSNNotifyNever, Failed, false},
+		{smtpd.DSNNotifySuccess, Delivered, true},
+		{smtpd.DSNNotifySuccess, Relayed, true},
+		{smtpd.DSNNotifySuccess, Expanded, true},
+		{smtpd.DSNNotifySuccess, Failed, false},
+		{smtpd.DSNNotifyFailure, Delayed, false},
+		{smtpd.DSNNotifyFailure | smtpd.DSNNotifyDelay, Delayed, true},
+	} {
+		if got := Wants(smtpd.RecipientDSN{Notify: tc.notify}, tc.action); got != tc.want {
+			t.Errorf("Wants(%v, %s) = %v, want %v", tc.notify, tc.action, got, tc.want)
+		}
+	}
+}
+
+func TestReportFailure(t *testing.T) {
+	t.Parallel()
+
+	env := &smtpd.Envelope{
+		Sender:     "alice@example.org",
+		Recipients: []string{"bob@example.net", "carol@example.net", "dave@example.net"},
+		DSN: &smtpd.DSN{
+			EnvID: "QQ@314159",
+			Recipients: []smtpd.RecipientDSN{
+				{OriginalType: "rfc822", OriginalRecipient: "Bob@Example.net"},
+				{Notify: smtpd.DSNNotifyNever},
+				{},
+			},
+		},
+	}
+	r := FromEnvelope(env, "mx.example.com")
+	r.Date = time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	r.Recipients[0].Action = Failed
+	r.Recipients[0].Err = smtpd.Error{Code: 550, Enhanced: smtpd.EnhancedCode{5, 1, 1}, Message: "No such user"}
+	r.Recipients[0].RemoteMTA = "mail.example.net"
+	r.Recipients[1].Action = Failed
+	r.Recipients[1].Err = errors.New("gone")
+	r.Recipients[2].Action = Delivered
+
+	h, types, bodies := parts(t, r, original)
+
+	if got := h.Get("To"); got != "<alice@example.org>" {
+		t.Errorf("To %q", got)
+	}
+	if got := h.Get("Subject"); got != "Undelivered Mail Returned to Sender" {
+		t.Errorf("Subject %q", got)
+	}
+	if got := h.Get("Auto-Submitted"); got != "auto-replied" {
+		t.Errorf("Auto-Submitted %q", got)
+	}
+
+	want := []string{"text/plain; charset=utf-8", "message/delivery-status", "message/rfc822"}
+	if strings.Join(types, ",") != strings.Join(want, ",") {
+		t.Fatalf("parts %q, want %q", types, want)
+	}
+
+	status := bodies[1]
+	for _, field := range []string{
+		"Reporting-MTA: dns; mx.example.com\r\n",
+		"Original-Envelope-Id: QQ@314159\r\n",
+		"Final-Recipient: rfc822; bob@example.net\r\n",
+		"Original-Recipient: rfc822; Bob@Example.net\r\n",
+		"Action: failed\r\n",
+		"Status: 5.1.1\r\n",
+		"Remote-MTA: dns; mail.example.net\r\n",
+		"Diagnostic-Code: smtp; 550 5.1.1 No such user\r\n",
+	} {
+		if !strings.Contains(status, field) {
+			t.Errorf("delivery status lacks %q:\n%s", field, status)
+		}
+	}
+	// NOTIFY=NEVER, and a success that nobody asked to hear of.
+	for _, addr := range []string{"carol@example.net", "dave@example.net"} {
+		if strings.Contains(status, addr) || strings.Contains(bodies[0], addr) {
+			t.Errorf("the notification reports on %s", addr)
+		}
+	}
+
+	if want := strings.ReplaceAll(original, "\n", "\r\n"); bodies[2] != want {
+		t.Errorf("returned message %q, want %q", bodies[2], want)
+	}
+}
+
+func TestReportReturn(t *testing.T) {
+	t.Parallel()
+
+	header := "From: alice@example.org\r\nSubject: hello\r\n\r\n"
+	full := strings.ReplaceAll(original, "\n", "\r\n")
+
+	for _, tc := range []struct {
+		name      string
+		ret       smtpd.DSNReturn
+		action    Action
+		maxReturn int64
+		typ, body string
+	}{
+		{"failure", "", Failed, 0, "message/rfc822", full},
+		{"delay", "", Delayed, 0, "text/rfc822-headers", header},
+		{"HDRS", smtpd.DSNReturnHeaders, Failed, 0, "text/rfc822-headers", header},
+		{"FULL", smtpd.DSNReturnFull, Delayed, 0, "message/rfc822", full},
+		{"too large", smtpd.DSNReturnFull, Failed, 20, "text/rfc822-headers", header},
+		{"never whole", smtpd.DSNReturnFull, Failed, -1, "text/rfc822-headers", header},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := &Report{
+				ReportingMTA: "mx.example.com",
+				Sender:       "alice@example.org",
+				Return:       tc.ret,
+				MaxReturn:    tc.maxReturn,
+				Recipients:   []Recipient{{Address: "bob@example.net", Action: tc.action}},
+			}
+			_, types, bodies := parts(t, r, original)
+			if types[2] != tc.typ || bodies[2] != tc.body {
+				t.Errorf("returned %s %q, want %s %q", types[2], bodies[2], tc.typ, tc.body)
+			}
+		})
+	}
+}
+
+func TestReportDelay(t *testing.T) {
+	t.Parallel()
+
+	until := time.Date(2026, 1, 6, 0, 0, 0, 0, time.UTC)
+	r := &Report{
+		ReportingMTA: "mx.example.com",
+		Sender:       "alice@example.org",
+		Recipients: []Recipient{{
+			Address:        "bob@example.net",
+			Action:         Delayed,
+			Err:            smtpd.Error{Code: 451, Message: "Try later"},
+			WillRetryUntil: until,
+		}},
+	}
+	h, _, bodies := parts(t, r, original)
+
+	if got := h.Get("Subject"); got != "Delayed Mail (still being retried)" {
+		t.Errorf("Subject %q", got)
+	}
+	for _, field := range []string{
+		"Action: delayed\r\n",
+		"Status: 4.0.0\r\n",
+		"Will-Retry-Until: " + until.Format(time.RFC1123Z) + "\r\n",
+	} {
+		if !strings.Contains(bodies[1], field) {
+			t.Errorf("delivery status lacks %q:\n%s", field, bodies[1])
+		}
+	}
+}
+
+func TestReportGlobal(t *testing.T) {
+	t.Parallel()
+
+	r := &Report{
+		ReportingMTA: "mx.example.com",
+		Sender:       "alice@example.org",
+		Recipients:   []Recipient{{Address: "jörg@example.net", Action: Failed}},
+	}
+	_, types, bodies := parts(t, r, original)
+
+	if types[1] != "message/global-delivery-status" || types[2] != "message/global" {
+		t.Errorf("parts %q", types)
+	}
+	if !strings.Contains(bodies[1], "Final-Recipient: utf-8; jörg@example.net\r\n") {
+		t.Errorf("delivery status:\n%s", bodies[1])
+	}
+
+	env, err := r.Envelope(strings.NewReader(original))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !env.SMTPUTF8 || env.BodyType != smtpd.Body8BitMIME {
+		t.Errorf("envelope: SMTPUTF8 %v, body %q", env.SMTPUTF8, env.BodyType)
+	}
+}
+
+func TestReportEnvelope(t *testing.T) {
+	t.Parallel()
+
+	r := &Report{
+		ReportingMTA: "mx.example.com",
+		Sender:       "alice@example.org",
+		EnvID:        "line\r\nInjected: yes",
+		Recipients:   []Recipient{{Address: "bob@example.net", Action: Failed}},
+	}
+	env, err := r.Envelope(strings.NewReader(original))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Sender != "" || len(env.Recipients) != 1 || env.Recipients[0] != "alice@example.org" {
+		t.Errorf("envelope from %q to %q", env.Sender, env.Recipients)
+	}
+	if env.DSN == nil || env.DSN.Recipients[0].Notify != smtpd.DSNNotifyNever {
+		t.Errorf("DSN %+v, want NOTIFY=NEVER", env.DSN)
+	}
+	b, _ := io.ReadAll(env.Data)
+	if bytes.Contains(b, []byte("\r\nInjected:")) {
+		t.Error("ENVID started a field of its own")
+	}
+
+	r.Recipients[0].Action = Delivered
+	if _, err := r.Envelope(strings.NewReader(original)); !errors.Is(err, ErrNoNotification) {
+		t.Errorf("a success without NOTIFY=SUCCESS: %v", err)
+	}
+
+	r.Recipients[0].Action = Failed
+	r.Sender = ""
+	if _, err := r.Envelope(strings.NewReader(original)); !errors.Is(err, ErrNoNotification) {
+		t.Errorf("a message from the null sender: %v", err)
+	}
+}
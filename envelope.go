@@ -23,7 +23,9 @@ const (
 
 // Envelope holds a message. Data is a streaming body that the handler
 // must fully read and Close. The server drains and closes it on return
-// from the handler regardless, to keep the SMTP protocol in sync.
+// from the handler regardless, to keep the SMTP protocol in sync. A
+// middleware Handler that puts a body of its own into Data may leave it
+// open: the server closes the Data that the handlers leave behind as well.
 //
 // A message that arrives in BDAT chunks gives Data the chunks as they come,
 // so a handler that reads it to the end waits for the last chunk. Close on
@@ -58,10 +60,24 @@ type Envelope struct {
 	// server without it takes none of these addresses.
 	SMTPUTF8 bool
 
+	// LongLines and Undeclared8Bit say what was wrong with the body under
+	// Server.BodyConformance of ConformanceFlag or ConformanceRewrap:
+	// LongLines a line longer than Server.MaxBodyLineLength, which
+	// ConformanceRewrap broke, and Undeclared8Bit an octet above 127 in a
+	// message of 7-bit text. The server sets them as the octets pass
+	// through Data, so they are whole once Data gave io.EOF.
+	LongLines      bool
+	Undeclared8Bit bool
+
 	// DSN holds the delivery status notification parameters of RFC 3461
 	// that came with the transaction. It is nil when the server runs
 	// without Server.EnableDSN, and nil when the client sent none of the
 	// parameters.
+	//
+	// A recipient that a RewriteRecipient hook changed carries the address
+	// that the client sent as its ORCPT parameter, unless the client sent
+	// one. The server records it with or without Server.EnableDSN, so DSN
+	// can be there on a server without the extension.
 	DSN *DSN
 
 	// recipientErrs holds the answer that each recipient of an LMTP delivery
@@ -69,4 +85,20 @@ type Envelope struct {
 	// Recipients, and nil there gives that recipient the reply of the
 	// message.
 	recipientErrs []error
+
+	// commands counts the RCPT TO commands that the transaction took, and
+	// command holds, for each address of Recipients, the index of the
+	// command that added it. A RewriteRecipient hook can make one command
+	// add more than one address.
+	commands int
+	command  []int
+}
+
+// addRecipient appends an address of the RCPT TO command that the session
+// takes, with its DSN parameters. The session counts the command once it
+// added all of its addresses.
+func (e *Envelope) addRecipient(addr string, dsn RecipientDSN) {
+	e.Recipients = append(e.Recipients, addr)
+	e.recordRecipientDSN(dsn)
+	e.command = append(e.command, e.commands)
 }
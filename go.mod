@@ -5,5 +5,9 @@ go 1.25.0
 require (
 	blitiri.com.ar/go/spf v1.5.1
 	github.com/chrj/keyrate v0.2.5
+	golang.org/x/crypto v0.54.0
+	golang.org/x/net v0.57.0
 	golang.org/x/time v0.15.0
 )
+
+require golang.org/x/sys v0.47.0 // indirect
@@ -0,0 +1,40 @@
+// Package answer holds the answers of a delivery for the recipients of a
+// message, one error at the index of each, as the handlers that deliver
+// give them.
+package answer
+
+import (
+	"errors"
+
+	"github.com/chrj/smtpd/v2"
+)
+
+// Fill gives err to each recipient that has no answer yet.
+func Fill(errs []error, err error) []error {
+	for i := range errs {
+		if errs[i] == nil {
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+// First gives the error that answers for the whole message. A temporary
+// one comes first, so that the client tries all of the recipients again, and
+// not only the ones that did not work.
+func First(errs []error) error {
+	var first error
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if first == nil {
+			first = err
+		}
+		var se smtpd.Error
+		if errors.As(err, &se) && se.Code/100 == 4 {
+			return err
+		}
+	}
+	return first
+}
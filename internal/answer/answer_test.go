@@ -0,0 +1,29 @@
+package answer
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/chrj/smtpd/v2"
+)
+
+func TestFirstPrefersTemporary(t *testing.T) {
+	t.Parallel()
+
+	permanent := smtpd.Error{Code: 550, Enhanced: smtpd.EnhancedCode{5, 1, 1}, Message: "No such user"}
+	temporary := smtpd.Error{Code: 451, Enhanced: smtpd.EnhancedCode{4, 4, 1}, Message: "No answer from host"}
+
+	errs := Fill([]error{nil, permanent, nil}, temporary)
+	if !errors.Is(errs[0], temporary) || !errors.Is(errs[1], permanent) || !errors.Is(errs[2], temporary) {
+		t.Fatalf("Fill = %v", errs)
+	}
+	if err := First(errs); !errors.Is(err, temporary) {
+		t.Errorf("First = %v, want the temporary error", err)
+	}
+	if err := First([]error{nil, permanent}); !errors.Is(err, permanent) {
+		t.Errorf("First = %v, want the permanent error", err)
+	}
+	if err := First(make([]error, 2)); err != nil {
+		t.Errorf("First = %v, want nil", err)
+	}
+}
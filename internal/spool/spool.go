@@ -0,0 +1,96 @@
+// Package spool holds a message that has to be read more than once, such as
+// by a signer that hashes the body before it writes a header in front of it,
+// or by a relay that sends it to more than one domain.
+package spool
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+)
+
+// DefaultMemory is the part of a message that a spool holds in memory before
+// it moves the message to a file.
+const DefaultMemory = 1 << 20
+
+// Spool holds a message. The first memory octets stay in memory. A message
+// that grows past them moves to a temporary file in dir, so a large message
+// costs disk and not memory. The empty dir is the directory of os.TempDir.
+type Spool struct {
+	memory int64
+	dir    string
+
+	buf  bytes.Buffer
+	file *os.File
+	size int64
+}
+
+// New returns an empty spool.
+func New(memory int64, dir string) *Spool {
+	return &Spool{memory: memory, dir: dir}
+}
+
+// Read reads the whole of r into a new spool.
+func Read(r io.Reader, memory int64, dir string) (*Spool, error) {
+	s := New(memory, dir)
+	if _, err := io.Copy(s, r); err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Write appends p to the message.
+func (s *Spool) Write(p []byte) (int, error) {
+	if s.file == nil && s.size+int64(len(p)) > s.memory {
+		f, err := os.CreateTemp(s.dir, "smtpd-spool-*")
+		if err != nil {
+			return 0, err
+		}
+		s.file = f
+
+		if _, err := s.file.Write(s.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		s.buf = bytes.Buffer{}
+	}
+
+	var (
+		n   int
+		err error
+	)
+	if s.file != nil {
+		n, err = s.file.Write(p)
+	} else {
+		n, err = s.buf.Write(p)
+	}
+	s.size += int64(n)
+	return n, err
+}
+
+// Size gives the octets of the message.
+func (s *Spool) Size() int64 {
+	return s.size
+}
+
+// Section gives the octets from off to the end of the message. Each call
+// gives a reader of its own, so one reader does not move another.
+func (s *Spool) Section(off int64) *io.SectionReader {
+	if s.file != nil {
+		return io.NewSectionReader(s.file, off, s.size-off)
+	}
+	return io.NewSectionReader(bytes.NewReader(s.buf.Bytes()), off, s.size-off)
+}
+
+// Close removes the temporary file. The readers of the spool fail after it.
+func (s *Spool) Close() error {
+	if s.file == nil {
+		return nil
+	}
+
+	name := s.file.Name()
+	err := s.file.Close()
+	s.file = nil
+	return errors.Join(err, os.Remove(name))
+}
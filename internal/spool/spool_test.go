@@ -0,0 +1,62 @@
+package spool
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSpoolMovesToAFile(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	msg := strings.Repeat("A line of a long body.\r\n", 100)
+
+	s, err := Read(strings.NewReader(msg), 64, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Size() != int64(len(msg)) {
+		t.Errorf("Size = %d, want %d", s.Size(), len(msg))
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("the spool holds %d files, want 1", len(entries))
+	}
+
+	// Each section reads on its own.
+	first, second := s.Section(0), s.Section(24)
+	b, _ := io.ReadAll(first)
+	if string(b) != msg {
+		t.Error("the first section changed the message")
+	}
+	b, _ = io.ReadAll(second)
+	if string(b) != msg[24:] {
+		t.Error("the second section changed the message")
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Close left %d files", len(entries))
+	}
+}
+
+func TestSpoolInMemory(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	s, err := Read(strings.NewReader("short\r\n"), DefaultMemory, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = s.Close() }()
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("a short message took %d files", len(entries))
+	}
+	if b, _ := io.ReadAll(s.Section(0)); string(b) != "short\r\n" {
+		t.Errorf("Section = %q", b)
+	}
+}
@@ -0,0 +1,218 @@
+package smtpd
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+)
+
+// BareLineBreaks says what the server does with a CR or a LF that does not
+// stand in a CRLF pair, in a command line or in the body of a DATA message.
+// RFC 5321 section 2.3.8 allows neither.
+//
+// Servers and the clients that relay to them do not agree on what such a
+// break means, which is what SMTP smuggling feeds on: a client hides
+// "<LF>.<LF>" and a second transaction inside a message, a lenient server
+// ends the message there and runs the commands that follow as its own, and
+// the second message goes out under the name of the sending domain.
+type BareLineBreaks int
+
+const (
+	// BareLineBreaksAllow reads a bare LF as a line break, in a command line
+	// and in the body, where "<LF>.<LF>" ends a message as well. It is the
+	// default, and it keeps the behavior of earlier releases.
+	BareLineBreaksAllow BareLineBreaks = iota
+
+	// BareLineBreaksNormalize ends a message at "<CRLF>.<CRLF>" alone, and
+	// turns each bare CR and bare LF of the body into CRLF. A dot line
+	// behind a bare break is part of the message. A command line may end
+	// in a bare LF, and one that holds a bare CR gets 500 5.5.2.
+	BareLineBreaksNormalize
+
+	// BareLineBreaksReject ends a message at "<CRLF>.<CRLF>" alone, and
+	// refuses a message that holds a bare CR or a bare LF with 554 5.5.2
+	// once it ends. A command line that holds one gets 500 5.5.2.
+	BareLineBreaksReject
+)
+
+// errBareLineBreakCommand answers a command line that holds a bare CR or a
+// bare LF that BareLineBreaks does not allow.
+var errBareLineBreakCommand = Error{Code: 500, Enhanced: EnhancedCode{5, 5, 2}, Message: "Bare CR or LF in a command line"}
+
+// errBareLineBreak answers a message that holds a bare CR or a bare LF under
+// BareLineBreaksReject. The handler reads it from Envelope.Data as well.
+var errBareLineBreak = Error{Code: 554, Enhanced: EnhancedCode{5, 5, 2}, Message: "Bare CR or LF in the message"}
+
+// checkLineBreaks checks the line breaks of the command line that the
+// session just read, where readLine took the break off the end already.
+func (s *session) checkLineBreaks(line string) error {
+	switch s.server.BareLineBreaks {
+	case BareLineBreaksNormalize:
+		if strings.Contains(line, "\r") {
+			return errBareLineBreakCommand
+		}
+	case BareLineBreaksReject:
+		if s.bareLF || strings.Contains(line, "\r") {
+			return errBareLineBreakCommand
+		}
+	}
+	return nil
+}
+
+// dotReader reads the body of a DATA message under BareLineBreaksNormalize
+// and BareLineBreaksReject. It takes the dot off the front of a line that
+// the client stuffed, and ends at "<CRLF>.<CRLF>" alone: the CRLF of the
+// DATA command line counts for the first one. Every other line break goes
+// out as CRLF.
+//
+// It reads on past a bare break under BareLineBreaksReject as well, and
+// only records it in bare, so that the session finds the real end of the
+// message and stays in step with the client.
+type dotReader struct {
+	r      *bufio.Reader
+	reject bool
+
+	state dotState
+
+	// strict says that the line under state began after a CRLF, so that a
+	// dot line there may end the message.
+	strict bool
+
+	// pending holds the octets that a break wrote and that did not fit in
+	// the buffer of the caller.
+	pending []byte
+
+	// bare says that the message held a bare CR or a bare LF.
+	bare bool
+}
+
+type dotState int
+
+const (
+	dotBeginLine dotState = iota // at the beginning of a line
+	dotDot                       // after a dot at the beginning of a line
+	dotDotCR                     // after a dot and a CR at the beginning of a line
+	dotCR                        // after a CR
+	dotData                      // inside a line
+	dotEOF                       // after the end of the message
+)
+
+func newDotReader(r *bufio.Reader, mode BareLineBreaks) *dotReader {
+	return &dotReader{r: r, reject: mode == BareLineBreaksReject, strict: true}
+}
+
+func (d *dotReader) Read(p []byte) (int, error) {
+	bare := d.bare
+
+	n := 0
+	for n < len(p) {
+		if len(d.pending) > 0 {
+			c := copy(p[n:], d.pending)
+			d.pending = d.pending[c:]
+			n += c
+			continue
+		}
+		if d.state == dotEOF {
+			return n, io.EOF
+		}
+
+		// The first bare break goes back to the caller at once, so that the
+		// caller learns of it before it passes on what follows.
+		if d.reject && d.bare && !bare {
+			return n, nil
+		}
+
+		c, err := d.r.ReadByte()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+
+		switch d.state {
+		case dotBeginLine:
+			switch c {
+			case '.':
+				d.state = dotDot
+				continue
+			case '\r':
+				d.state = dotCR
+				continue
+			case '\n':
+				d.breakLine()
+				continue
+			}
+			d.state = dotData
+
+		case dotDot:
+			switch c {
+			case '\r':
+				d.state = dotDotCR
+				continue
+			case '\n':
+				d.pending = append(d.pending, '.')
+				d.breakLine()
+				continue
+			}
+			// A dot before the rest of a line is the dot of the stuffing.
+			d.state = dotData
+
+		case dotDotCR:
+			if c == '\n' {
+				if d.strict {
+					d.state = dotEOF
+					continue
+				}
+				// A dot line behind a bare break is part of the message.
+				d.pending = append(d.pending, '.', '\r', '\n')
+				d.state, d.strict = dotBeginLine, true
+				continue
+			}
+			_ = d.r.UnreadByte()
+			d.pending = append(d.pending, '.')
+			d.breakLine()
+			continue
+
+		case dotCR:
+			if c == '\n' {
+				d.pending = append(d.pending, '\r', '\n')
+				d.state, d.strict = dotBeginLine, true
+				continue
+			}
+			_ = d.r.UnreadByte()
+			d.breakLine()
+			continue
+
+		case dotData:
+			switch c {
+			case '\r':
+				d.state = dotCR
+				continue
+			case '\n':
+				d.breakLine()
+				continue
+			}
+		}
+
+		p[n] = c
+		n++
+	}
+	return n, nil
+}
+
+// breakLine writes a bare break as CRLF and records it. A dot line after it
+// does not end the message.
+func (d *dotReader) breakLine() {
+	d.pending = append(d.pending, '\r', '\n')
+	d.state, d.strict = dotBeginLine, false
+	d.bare = true
+}
+
+func (d *dotReader) refusal() error {
+	if d.reject && d.bare {
+		return errBareLineBreak
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package smtpd_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/chrj/smtpd/v2"
+	"github.com/chrj/smtpd/v2/smtptest"
+)
+
+// smugglingEnds are the ends of data of the published SMTP smuggling attacks,
+// each of which some server takes for "<CRLF>.<CRLF>".
+var smugglingEnds = []string{
+	"\n.\n",
+	"\n.\r\n",
+	"\r\n.\n",
+	"\r.\r",
+	"\r.\r\n",
+	"\r\n.\r",
+	"\r.\n",
+	"\n.\r",
+}
+
+// smuggle sends a message with a second transaction hidden behind end, and
+// gives the reply to the message and the reply to the QUIT after it.
+func smuggle(t *testing.T, srv *smtptest.Server, end string) (string, string) {
+	t.Helper()
+
+	c := dialRaw(t, srv.Addr)
+	c.send("EHLO client.example.com")
+	c.send("MAIL FROM:<alice@example.com>")
+	c.send("RCPT TO:<bob@example.com>")
+	if reply := c.send("DATA"); !strings.HasPrefix(reply, "354 ") {
+		t.Fatalf("DATA = %q", reply)
+	}
+
+	c.write([]byte("Subject: hello\r\n\r\nThe real message." + end +
+		"MAIL FROM:<ceo@example.com>\r\n" +
+		"RCPT TO:<victim@example.com>\r\n" +
+		"DATA\r\n" +
+		"Subject: smuggled\r\n\r\nThe smuggled message.\r\n.\r\n"))
+	reply := c.line()
+	return reply, c.send("QUIT")
+}
+
+func TestSmugglingNormalize(t *testing.T) {
+	t.Parallel()
+
+	for _, end := range smugglingEnds {
+		t.Run(strings.NewReplacer("\r", "CR", "\n", "LF").Replace(end), func(t *testing.T) {
+			t.Parallel()
+
+			rec := &smtptest.Recorder{}
+			srv := runserver(t, &smtpd.Server{
+				BareLineBreaks: smtpd.BareLineBreaksNormalize,
+				Handler:        rec.Handler,
+				Logger:         testLogger(t),
+			})
+
+			reply, quit := smuggle(t, srv, end)
+			if !strings.HasPrefix(reply, "250 ") || !strings.HasPrefix(quit, "221 ") {
+				t.Fatalf("replies %q and %q, want one message and the QUIT", reply, quit)
+			}
+
+			// One message holds the other transaction, with each break as
+			// CRLF.
+			msgs := rec.Messages()
+			if len(msgs) != 1 {
+				t.Fatalf("the server took %d messages, want 1", len(msgs))
+			}
+			body := string(msgs[0].Data)
+			if !strings.Contains(body, "\r\nMAIL FROM:<ceo@example.com>\r\n") || !strings.HasSuffix(body, "The smuggled message.\r\n") {
+				t.Errorf("body = %q, want the second transaction in it", body)
+			}
+			if strings.Count(body, "\r") != strings.Count(body, "\n") {
+				t.Errorf("body = %q holds a bare break", body)
+			}
+		})
+	}
+}
+
+func TestSmugglingReject(t *testing.T) {
+	t.Parallel()
+
+	for _, end := range smugglingEnds {
+		t.Run(strings.NewReplacer("\r", "CR", "\n", "LF").Replace(end), func(t *testing.T) {
+			t.Parallel()
+
+			rec := &smtptest.Recorder{}
+			srv := runserver(t, &smtpd.Server{
+				BareLineBreaks: smtpd.BareLineBreaksReject,
+				Handler:        rec.Handler,
+				Logger:         testLogger(t),
+			})
+
+			reply, quit := smuggle(t, srv, end)
+			if reply != "554 5.5.2 Bare CR or LF in the message" {
+				t.Errorf("reply = %q, want the 554 of a bare break", reply)
+			}
+			if !strings.HasPrefix(quit, "221 ") {
+				t.Errorf("QUIT = %q, want the session in step", quit)
+			}
+			if msgs := rec.Messages(); len(msgs) != 0 {
+				t.Errorf("the server took %d messages, want none", len(msgs))
+			}
+		})
+	}
+}
+
+func TestBareLineBreaksBody(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name, data, want string
+	}{
+		{"empty", ".\r\n", ""},
+		{"stuffed dot", "..a\r\n.\r\n", ".a\r\n"},
+		{"stuffed dot after a bare LF", "a\n..b\r\n.\r\n", "a\r\n.b\r\n"},
+		{"dot line after a bare LF", "a\n.\r\nb\r\n.\r\n", "a\r\n.\r\nb\r\n"},
+		{"bare CR", "a\rb\r\n.\r\n", "a\r\nb\r\n"},
+		{"CR before a dot line", "a\r\r\n.\r\n", "a\r\n\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			rec := &smtptest.Recorder{}
+			srv := runserver(t, &smtpd.Server{
+				BareLineBreaks: smtpd.BareLineBreaksNormalize,
+				Handler:        rec.Handler,
+				Logger:         testLogger(t),
+			})
+
+			c := dialRaw(t, srv.Addr)
+			c.send("EHLO client.example.com")
+			c.send("MAIL FROM:<alice@example.com>")
+			c.send("RCPT TO:<bob@example.com>")
+			c.send("DATA")
+			c.write([]byte(tt.data))
+			if reply := c.line(); !strings.HasPrefix(reply, "250 ") {
+				t.Fatalf("reply = %q", reply)
+			}
+
+			msgs := rec.Messages()
+			if len(msgs) != 1 {
+				t.Fatalf("the server took %d messages, want 1", len(msgs))
+			}
+			if got := string(msgs[0].Data); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBareLineBreaksCommand(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		mode smtpd.BareLineBreaks
+		line string
+		want string
+	}{
+		{smtpd.BareLineBreaksAllow, "NOOP\n", "250 "},
+		{smtpd.BareLineBreaksNormalize, "NOOP\n", "250 "},
+		{smtpd.BareLineBreaksNormalize, "NO\rOP\r\n", "500 5.5.2 "},
+		{smtpd.BareLineBreaksReject, "NOOP\n", "500 5.5.2 "},
+		{smtpd.BareLineBreaksReject, "NO\rOP\r\n", "500 5.5.2 "},
+		{smtpd.BareLineBreaksReject, "NOOP\r\n", "250 "},
+	}
+
+	for _, tt := range tests {
+		srv := runserver(t, &smtpd.Server{BareLineBreaks: tt.mode, Logger: testLogger(t)})
+
+		c := dialRaw(t, srv.Addr)
+		c.send("EHLO client.example.com")
+		c.write([]byte(tt.line))
+		if reply := c.line(); !strings.HasPrefix(reply, tt.want) {
+			t.Errorf("mode %d: %q got %q, want %q", tt.mode, tt.line, reply, tt.want)
+		}
+	}
+}
@@ -33,7 +33,9 @@ func (s *session) replyWrongGreeting(ctx context.Context) context.Context {
 // RCPT TO added them (RFC 2033 section 4.2), so a handler can take a message
 // for some of the recipients and refuse it for the rest. A recipient that
 // carries no error of its own gets the reply of the message: the error that
-// the handler returned, or 250 where it returned none.
+// the handler returned, or 250 where it returned none. A RCPT TO command that
+// a RewriteRecipient hook turned into more than one recipient takes one reply,
+// the first error of those recipients.
 //
 // err takes the form of the error of a Handler: an Error goes on the wire
 // with its code and its message, and every other error becomes a 502. An err
@@ -87,9 +89,15 @@ func (s *session) replyDelivery(ctx context.Context, message string) context.Con
 		return s.reply(ctx, 250, message)
 	}
 
-	for i := range s.envelope.Recipients {
-		if err := s.envelope.recipientErr(i); err != nil {
-			ctx = s.replyError(ctx, err)
+	for _, rcpts := range s.envelope.byCommand() {
+		var err error
+		for _, i := range rcpts {
+			if err = s.envelope.recipientErr(i); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			ctx = s.writeError(ctx, err)
 			continue
 		}
 		ctx = s.reply(ctx, 250, message)
@@ -98,6 +106,28 @@ func (s *session) replyDelivery(ctx context.Context, message string) context.Con
 	return ctx
 }
 
+// byCommand gives the indexes in Recipients of the addresses of each RCPT TO
+// command, in the order of the commands. A handler that changed Recipients
+// breaks the link between the two, and then each address stands for a
+// command of its own.
+func (e *Envelope) byCommand() [][]int {
+	groups := make([][]int, 0, len(e.Recipients))
+	if len(e.command) != len(e.Recipients) {
+		for i := range e.Recipients {
+			groups = append(groups, []int{i})
+		}
+		return groups
+	}
+
+	for i, c := range e.command {
+		if c >= len(groups) {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], i)
+	}
+	return groups
+}
+
 // replyDeliveryError answers the end of a message that the server did not
 // take. In LMTP every recipient gets the same answer, because the message
 // failed for all of them.
@@ -106,8 +136,8 @@ func (s *session) replyDeliveryError(ctx context.Context, err error) context.Con
 		return s.replyError(ctx, err)
 	}
 
-	for range s.envelope.Recipients {
-		ctx = s.replyError(ctx, err)
+	for range s.envelope.byCommand() {
+		ctx = s.writeError(ctx, err)
 	}
 
 	return ctx
@@ -291,6 +291,32 @@ func TestLMTPRepliesForEveryRecipientRefusal(t *testing.T) {
 	}
 }
 
+// TestLMTPRecipient421KeepsTheSession covers a 421 for one recipient at the
+// end of a message. It stands for that recipient alone, so the other one
+// still gets its reply and the session goes on.
+func TestLMTPRecipient421KeepsTheSession(t *testing.T) {
+	t.Parallel()
+
+	srv := lmtpserver(t, &smtpd.Server{
+		Handler: rejectRecipientAt(t, 0, smtpd.Error{Code: 421, Enhanced: smtpd.EnhancedCode{4, 4, 2}, Message: "Connection dropped"}),
+	})
+	c := dialRaw(t, srv.Addr)
+	openLMTP(t, c, "one@example.net", "two@example.net")
+
+	if reply := c.send("DATA"); !strings.HasPrefix(reply, "354") {
+		t.Fatalf("DATA reply = %q, want 354", reply)
+	}
+	c.write([]byte("Subject: one\r\n\r\nA short body.\r\n.\r\n"))
+
+	want := []string{"421 4.4.2 Connection dropped", "250 2.0.0 Thank you."}
+	if got := c.replies(len(want)); !reflect.DeepEqual(got, want) {
+		t.Errorf("replies = %q, want %q", got, want)
+	}
+	if reply := c.send("NOOP"); reply != "250 2.0.0 Go ahead" {
+		t.Errorf("NOOP reply = %q, want the answer to that command", reply)
+	}
+}
+
 // TestLMTPTakesMailParameters covers the parameters of MAIL FROM and RCPT TO
 // on an LMTP session. LHLO offers the extensions of the server in the same
 // way as EHLO, so the parameters of those extensions arrive.
@@ -109,6 +109,10 @@ func (s *session) parseMailParams(params map[string]string) (mailParams, error)
 func (s *session) handleMAIL(ctx context.Context, cmd *command) context.Context {
 	ctx, _ = phasedLoggerFromContext(ctx, "mail")
 
+	if limit := s.server.MaxTransactions; limit > 0 && s.transactions >= limit {
+		return s.closeAtLimit(ctx, "MaxTransactions")
+	}
+
 	addrSpec, params, err := cmd.pathArg("FROM")
 	if err != nil {
 		return s.replyEnhanced(ctx, 501, EnhancedCode{5, 5, 4}, "Invalid syntax.")
@@ -155,6 +159,7 @@ func (s *session) handleMAIL(ctx context.Context, cmd *command) context.Context
 		SMTPUTF8: mail.smtputf8,
 		DSN:      mail.dsn,
 	}
+	s.transactions++
 
 	return s.replyEnhanced(ctx, 250, EnhancedCode{2, 1, 0}, "Go ahead")
 
@@ -0,0 +1,441 @@
+// Package maildir delivers messages into Maildir mailboxes on the local disk.
+// A Maildir is the Handler at the end of a server that keeps the mail of its
+// users, such as the LMTP server behind an IMAP server.
+//
+// The handler writes each message into the tmp directory of the mailbox,
+// syncs it, and renames it into new, so a reader of the mailbox never sees
+// half of a message. A function of the caller maps each recipient to its
+// mailbox. WithSubfolders delivers a subaddress such as user+lists@example.net
+// into the Maildir++ folder of the same name.
+//
+// The message goes to disk once. Every further mailbox of the message gets a
+// hard link to that file, or a copy where the mailboxes live on different
+// file systems. A mailbox that fails to take the message fails only its own
+// recipients, and the next one gets the message from a spool.
+package maildir
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/chrj/smtpd/v2"
+	"github.com/chrj/smtpd/v2/internal/answer"
+	"github.com/chrj/smtpd/v2/internal/spool"
+)
+
+// DirFunc gives the mailbox of a recipient: the directory that holds its tmp,
+// new and cur directories. The handler creates the three where they are
+// missing.
+//
+// It returns ErrNoMailbox, or any other smtpd.Error, to refuse the
+// recipient with that reply. Any other error counts as temporary.
+type DirFunc func(ctx context.Context, rcpt string) (string, error)
+
+// ErrNoMailbox is the error of a DirFunc for a recipient without a mailbox.
+var ErrNoMailbox = smtpd.Error{Code: 550, Enhanced: smtpd.EnhancedCode{5, 1, 1}, Message: "No such user"}
+
+var (
+	errDeliver = smtpd.Error{Code: 451, Enhanced: smtpd.EnhancedCode{4, 3, 0}, Message: "Could not deliver the message, try again later"}
+	errQuota   = smtpd.Error{Code: 452, Enhanced: smtpd.EnhancedCode{4, 2, 2}, Message: "Mailbox full"}
+	errNoSpace = smtpd.Error{Code: 452, Enhanced: smtpd.EnhancedCode{4, 3, 1}, Message: "Insufficient system storage"}
+)
+
+// Maildir is a Handler that delivers into Maildir mailboxes. It is safe for
+// concurrent use.
+type Maildir struct {
+	dir        DirFunc
+	subfolders bool
+	hostname   string
+
+	// seq tells apart the names that one process gives in one microsecond.
+	seq atomic.Uint64
+}
+
+// Option configures a Maildir.
+type Option func(*Maildir)
+
+// WithSubfolders delivers a recipient with a subaddress, such as
+// user+lists@example.net, into the Maildir++ folder ".lists" of the mailbox
+// of user@example.net. The DirFunc sees the address without the subaddress.
+//
+// The folder has to exist, since a sender picks the subaddress. A message for
+// a folder that does not, or for a subaddress that names no folder, goes to
+// the inbox.
+func WithSubfolders() Option {
+	return func(m *Maildir) { m.subfolders = true }
+}
+
+// WithHostname sets the host name in the names of the files that the handler
+// writes. The default is the name of the machine.
+func WithHostname(name string) Option {
+	return func(m *Maildir) { m.hostname = name }
+}
+
+// New gives a Maildir that delivers each recipient into the mailbox that dir
+// gives for it.
+func New(dir DirFunc, opts ...Option) *Maildir {
+	m := &Maildir{dir: dir}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.hostname == "" {
+		m.hostname, _ = os.Hostname()
+	}
+	// The Maildir specification keeps "/" and ":" out of the host name,
+	// since they end a file name and start its flags.
+	m.hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(m.hostname)
+	return m
+}
+
+// Handler delivers the message into the mailbox of each recipient.
+//
+// A session of SMTP writes one reply for the message. A recipient that
+// failed refuses the message for all of them, with a temporary error where
+// one of them failed for now, and the client tries every recipient again. A
+// session of LMTP refuses the recipients that failed with
+// Envelope.RejectRecipient, and takes the message for the rest.
+func (m *Maildir) Handler(ctx context.Context, peer smtpd.Peer, env *smtpd.Envelope) (context.Context, error) {
+	defer func() { _ = env.Data.Close() }()
+
+	errs := m.Deliver(ctx, env)
+
+	if peer.Protocol == smtpd.LMTP {
+		for i, err := range errs {
+			if err != nil {
+				_ = env.RejectRecipient(i, err)
+			}
+		}
+		return ctx, nil
+	}
+
+	return ctx, answer.First(errs)
+}
+
+// Deliver delivers env into the mailbox of each recipient, and gives the
+// answer for each one at its index in env.Recipients: nil for a recipient
+// that got the message, and an smtpd.Error for one that did not.
+//
+// Deliver reads env.Data to the end, and leaves it to the caller to close. It
+// is a queue.DeliverFunc.
+func (m *Maildir) Deliver(ctx context.Context, env *smtpd.Envelope) []error {
+	logger := smtpd.LoggerFromContext(ctx)
+	errs := make([]error, len(env.Recipients))
+
+	folders := make([]string, len(env.Recipients))
+	for i, rcpt := range env.Recipients {
+		folder, err := m.folder(ctx, rcpt)
+		if err != nil {
+			var se smtpd.Error
+			if !errors.As(err, &se) {
+				logger.WarnContext(ctx, "no mailbox for the recipient",
+					slog.String("recipient", rcpt), slog.Any("error", err))
+				err = errDeliver
+			}
+			errs[i] = err
+			continue
+		}
+		folders[i] = folder
+	}
+
+	// A message for more than one folder goes to a spool first, so that a
+	// folder that fails to take it, such as one over its quota, leaves it
+	// for the next one and fails only its own recipients.
+	body := func() io.Reader { return env.Data }
+	if distinct(folders) > 1 {
+		sp, err := spool.Read(env.Data, spool.DefaultMemory, "")
+		if err != nil {
+			logger.WarnContext(ctx, "maildir delivery failed", slog.Any("error", err))
+			return answer.Fill(errs, errDeliver)
+		}
+		defer func() { _ = sp.Close() }()
+		body = func() io.Reader { return sp.Section(0) }
+	}
+
+	// Two recipients that share a folder, such as two aliases of one user,
+	// share one copy of the message in it.
+	done := make(map[string]error)
+	var src string
+	for i, folder := range folders {
+		if folder == "" {
+			continue
+		}
+		if err, ok := done[folder]; ok {
+			errs[i] = err
+			continue
+		}
+
+		var err error
+		if src == "" {
+			src, err = m.write(folder, env, body())
+		} else {
+			err = m.link(folder, src)
+		}
+
+		if err != nil {
+			logger.WarnContext(ctx, "maildir delivery failed",
+				slog.String("folder", folder), slog.Any("error", err))
+			err = asError(err)
+		}
+		done[folder] = err
+		errs[i] = err
+	}
+
+	if src == "" {
+		// No recipient has a mailbox. Read the message all the same, so
+		// the session can go on.
+		_, _ = io.Copy(io.Discard, env.Data)
+	}
+	return errs
+}
+
+// distinct gives the number of folders that are set, each counted once.
+func distinct(folders []string) int {
+	seen := make(map[string]bool)
+	for _, f := range folders {
+		if f != "" {
+			seen[f] = true
+		}
+	}
+	return len(seen)
+}
+
+// folder gives the folder that rcpt gets the message in: its mailbox, or a
+// Maildir++ folder of it.
+func (m *Maildir) folder(ctx context.Context, rcpt string) (string, error) {
+	addr, detail := rcpt, ""
+	if m.subfolders {
+		addr, detail = splitDetail(rcpt)
+	}
+
+	dir, err := m.dir(ctx, addr)
+	if err != nil {
+		return "", err
+	}
+
+	if validFolder(detail) {
+		sub := filepath.Join(dir, "."+detail)
+		if fi, err := os.Stat(sub); err == nil && fi.IsDir() {
+			return sub, nil
+		}
+	}
+	return dir, nil
+}
+
+// splitDetail gives addr without its subaddress, and the subaddress: the part
+// of the local part after the first "+".
+func splitDetail(addr string) (string, string) {
+	at := strings.LastIndexByte(addr, '@')
+	if at < 0 {
+		at = len(addr)
+	}
+	local, domain := addr[:at], addr[at:]
+
+	user, detail, ok := strings.Cut(local, "+")
+	if !ok || user == "" {
+		return addr, ""
+	}
+	return user + domain, detail
+}
+
+// validFolder reports whether name can be the name of a Maildir++ folder, in
+// which "." divides the levels. It keeps a subaddress from leaving the
+// mailbox.
+func validFolder(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, part := range strings.Split(name, ".") {
+		if part == "" {
+			return false
+		}
+	}
+	return !strings.ContainsFunc(name, func(r rune) bool {
+		return r < ' ' || r == 0x7f || r == '/' || r == '\\'
+	})
+}
+
+// write writes body, the message of env, into folder, and gives the path of
+// the file in its new directory.
+//
+// The file starts with the Return-Path field that RFC 5321 section 4.4 asks
+// of the final delivery, and ends each line with LF, as a Maildir holds
+// them. A message of BINARYMIME keeps its bytes.
+func (m *Maildir) write(folder string, env *smtpd.Envelope, body io.Reader) (string, error) {
+	if err := ensure(folder); err != nil {
+		return "", err
+	}
+
+	name := m.uniqueName()
+	tmp := filepath.Join(folder, "tmp", name)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return "", err
+	}
+
+	bw := bufio.NewWriter(f)
+	_, _ = fmt.Fprintf(bw, "Return-Path: <%s>\n", env.Sender)
+	if env.BodyType == smtpd.BodyBinaryMIME {
+		_, err = io.Copy(bw, body)
+	} else {
+		err = copyLF(bw, body)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	var size int64
+	if err == nil {
+		var fi os.FileInfo
+		if fi, err = f.Stat(); err == nil {
+			size = fi.Size()
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return "", err
+	}
+
+	return deliver(folder, tmp, name, size)
+}
+
+// link delivers the message at src into folder as well.
+func (m *Maildir) link(folder, src string) error {
+	if err := ensure(folder); err != nil {
+		return err
+	}
+
+	name := m.uniqueName()
+	tmp := filepath.Join(folder, "tmp", name)
+	if err := os.Link(src, tmp); err != nil {
+		if err := copyFile(tmp, src); err != nil {
+			return err
+		}
+	}
+
+	fi, err := os.Stat(tmp)
+	if err == nil {
+		_, err = deliver(folder, tmp, name, fi.Size())
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+// deliver moves the file at tmp into the new directory of folder, with the
+// size that the Maildir++ quota reads from the name.
+func deliver(folder, tmp, name string, size int64) (string, error) {
+	dst := filepath.Join(folder, "new", fmt.Sprintf("%s,S=%d", name, size))
+	if err := os.Rename(tmp, dst); err != nil {
+		_ = os.Remove(tmp)
+		return "", err
+	}
+	return dst, syncDir(filepath.Join(folder, "new"))
+}
+
+// uniqueName gives a file name that no other delivery takes, in the form of
+// the Maildir specification: the time, the process and a sequence number, a
+// random part, and the host.
+func (m *Maildir) uniqueName() string {
+	now := time.Now()
+	var r [4]byte
+	_, _ = rand.Read(r[:])
+	return fmt.Sprintf("%d.M%dP%dQ%dR%s.%s",
+		now.Unix(), now.Nanosecond()/1000, os.Getpid(), m.seq.Add(1), hex.EncodeToString(r[:]), m.hostname)
+}
+
+// ensure creates the tmp, new and cur directories of folder.
+func ensure(folder string) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(folder, sub), 0o700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(dst)
+	}
+	return err
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	return errors.Join(err, d.Close())
+}
+
+// copyLF copies r to w, and writes each CRLF of r as LF.
+func copyLF(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadSlice('\n')
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			line = append(line[:len(line)-2], '\n')
+		}
+		if _, werr := w.Write(line); werr != nil {
+			return werr
+		}
+		switch {
+		case errors.Is(err, io.EOF):
+			return nil
+		case errors.Is(err, bufio.ErrBufferFull):
+			// A line longer than the buffer goes out in pieces. A CR at
+			// the end of a piece keeps its place, which breaks no line.
+			continue
+		case err != nil:
+			return err
+		}
+	}
+}
+
+// asError gives the reply for a delivery that failed with err.
+func asError(err error) error {
+	switch {
+	case errors.Is(err, syscall.EDQUOT):
+		return errQuota
+	case errors.Is(err, syscall.ENOSPC):
+		return errNoSpace
+	}
+	return errDeliver
+}
@@ -0,0 +1,315 @@
+package maildir
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chrj/smtpd/v2"
+	"github.com/chrj/smtpd/v2/smtptest"
+)
+
+// users maps the users of example.net to mailboxes under root. carol is an
+// alias of bob.
+func users(root string) DirFunc {
+	return func(_ context.Context, rcpt string) (string, error) {
+		switch rcpt {
+		case "bob@example.net", "carol@example.net":
+			return filepath.Join(root, "bob"), nil
+		case "dave@example.net":
+			return filepath.Join(root, "dave"), nil
+		case "broken@example.net":
+			return "", errors.New("directory is down")
+		case "full@example.net":
+			// A file where the mailbox should be, which no message can
+			// go into.
+			return filepath.Join(root, "full"), nil
+		}
+		return "", ErrNoMailbox
+	}
+}
+
+func envelope(body string, rcpts ...string) *smtpd.Envelope {
+	return &smtpd.Envelope{
+		Sender:     "alice@example.org",
+		Recipients: rcpts,
+		Data:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+// messages gives the contents of the files in the new directory of folder.
+func messages(t *testing.T, folder string) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(filepath.Join(folder, "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, e := range entries {
+		b, err := os.ReadFile(filepath.Join(folder, "new", e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, size, ok := strings.Cut(e.Name(), ",S=")
+		if n, _ := strconv.Atoi(size); !ok || n != len(b) {
+			t.Errorf("%s holds %d bytes", e.Name(), len(b))
+		}
+		out = append(out, string(b))
+	}
+	if tmp, _ := os.ReadDir(filepath.Join(folder, "tmp")); len(tmp) != 0 {
+		t.Errorf("%s/tmp holds %d files", folder, len(tmp))
+	}
+	return out
+}
+
+func TestDeliver(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	m := New(users(root), WithHostname("mx:1/a"))
+
+	errs := m.Deliver(context.Background(), envelope("Subject: x\r\n\r\nbody\r\n",
+		"bob@example.net", "nobody@example.net", "carol@example.net", "dave@example.net", "broken@example.net"))
+
+	want := []error{nil, ErrNoMailbox, nil, nil, errDeliver}
+	for i := range want {
+		if !errors.Is(errs[i], want[i]) {
+			t.Errorf("recipient %d: %v, want %v", i, errs[i], want[i])
+		}
+	}
+
+	const stored = "Return-Path: <alice@example.org>\nSubject: x\n\nbody\n"
+	for _, user := range []string{"bob", "dave"} {
+		got := messages(t, filepath.Join(root, user))
+		if len(got) != 1 || got[0] != stored {
+			t.Errorf("%s got %q, want one %q", user, got, stored)
+		}
+		if fi, err := os.Stat(filepath.Join(root, user, "cur")); err != nil || !fi.IsDir() {
+			t.Errorf("%s has no cur directory: %v", user, err)
+		}
+	}
+
+	entries, _ := os.ReadDir(filepath.Join(root, "bob", "new"))
+	if name := entries[0].Name(); !strings.Contains(name, `.mx\0721\057a,S=`) {
+		t.Errorf("file name %q does not escape the host name", name)
+	}
+}
+
+func TestDeliverBinary(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	env := envelope("Subject: x\r\n\r\n\x00\r\n", "bob@example.net")
+	env.BodyType = smtpd.BodyBinaryMIME
+
+	if errs := New(users(root)).Deliver(context.Background(), env); errs[0] != nil {
+		t.Fatal(errs[0])
+	}
+	got := messages(t, filepath.Join(root, "bob"))
+	if want := "Return-Path: <alice@example.org>\nSubject: x\r\n\r\n\x00\r\n"; len(got) != 1 || got[0] != want {
+		t.Errorf("stored %q, want %q", got, want)
+	}
+}
+
+func TestDeliverSubfolders(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	for _, dir := range []string{".lists", ".lists.go"} {
+		if err := os.MkdirAll(filepath.Join(root, "bob", dir), 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := New(users(root), WithSubfolders())
+
+	for rcpt, folder := range map[string]string{
+		"bob@example.net":          "bob",
+		"bob+lists@example.net":    "bob/.lists",
+		"bob+lists.go@example.net": "bob/.lists.go",
+		"bob+nothere@example.net":  "bob",
+		"bob+..@example.net":       "bob",
+		"bob+../dave@example.net":  "bob",
+	} {
+		errs := m.Deliver(context.Background(), envelope("Subject: x\n\nbody\n", rcpt))
+		if errs[0] != nil {
+			t.Errorf("%s: %v", rcpt, errs[0])
+			continue
+		}
+		if got, _ := m.folder(context.Background(), rcpt); got != filepath.Join(root, folder) {
+			t.Errorf("%s went to %s, want %s", rcpt, got, folder)
+		}
+	}
+
+	if got := messages(t, filepath.Join(root, "bob", ".lists")); len(got) != 1 {
+		t.Errorf(".lists holds %d messages", len(got))
+	}
+	if _, err := os.Stat(filepath.Join(root, "dave")); !errors.Is(err, os.ErrNotExist) {
+		t.Error("a subaddress reached the mailbox of another user")
+	}
+
+	// Without the option, the subaddress is part of the address.
+	errs := New(users(root)).Deliver(context.Background(), envelope("x\n", "bob+lists@example.net"))
+	if !errors.Is(errs[0], ErrNoMailbox) {
+		t.Errorf("bob+lists@example.net without WithSubfolders: %v", errs[0])
+	}
+}
+
+func TestHandlerSMTP(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	srv := smtptest.NewServer(New(users(root)).Handler)
+	defer srv.Close()
+
+	c := srv.Dial()
+	defer func() { _ = c.Close() }()
+	if err := smtptest.Send(c, "alice@example.org", []string{"dave@example.net"}, "Subject: x\r\n\r\nbody\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if got := messages(t, filepath.Join(root, "dave")); len(got) != 1 {
+		t.Fatalf("dave got %d messages", len(got))
+	}
+
+	c = srv.Dial()
+	defer func() { _ = c.Close() }()
+	err := smtptest.Send(c, "alice@example.org", []string{"dave@example.net", "broken@example.net", "nobody@example.net"}, "Subject: y\r\n\r\nbody\r\n")
+	var tpe *textproto.Error
+	if !errors.As(err, &tpe) || tpe.Code != 451 {
+		t.Errorf("a message with a recipient that failed for now: %v, want 451", err)
+	}
+}
+
+func TestHandlerLMTP(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	srv := smtptest.NewUnstartedServer(New(users(root)).Handler)
+	srv.Config.LMTP = true
+	srv.Start()
+	defer srv.Close()
+
+	nc, err := net.Dial("tcp", srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = nc.Close() }()
+	_ = nc.SetDeadline(time.Now().Add(10 * time.Second))
+	c := textproto.NewConn(nc)
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []struct {
+		code int
+		cmd  string
+	}{
+		{250, "LHLO client.example.org"},
+		{250, "MAIL FROM:<alice@example.org>"},
+		{250, "RCPT TO:<bob@example.net>"},
+		{250, "RCPT TO:<nobody@example.net>"},
+		{250, "RCPT TO:<broken@example.net>"},
+		{354, "DATA"},
+	} {
+		if err := smtptest.Cmd(c, step.code, "%s", step.cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.PrintfLine("Subject: x\r\n\r\nbody\r\n."); err != nil {
+		t.Fatal(err)
+	}
+	for _, code := range []int{250, 550, 451} {
+		if _, msg, err := c.ReadResponse(code); err != nil {
+			t.Errorf("reply %d: %v %s", code, err, msg)
+		}
+	}
+
+	if got := messages(t, filepath.Join(root, "bob")); len(got) != 1 {
+		t.Errorf("bob got %d messages", len(got))
+	}
+}
+
+// TestHandlerLMTPFailedMailbox covers a mailbox that cannot take the message
+// ahead of ones that can. Its recipient fails, and the others get the
+// message.
+func TestHandlerLMTPFailedMailbox(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "full"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	srv := smtptest.NewUnstartedServer(New(users(root)).Handler)
+	srv.Config.LMTP = true
+	srv.Start()
+	defer srv.Close()
+
+	nc, err := net.Dial("tcp", srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = nc.Close() }()
+	_ = nc.SetDeadline(time.Now().Add(10 * time.Second))
+	c := textproto.NewConn(nc)
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []struct {
+		code int
+		cmd  string
+	}{
+		{250, "LHLO client.example.org"},
+		{250, "MAIL FROM:<alice@example.org>"},
+		{250, "RCPT TO:<full@example.net>"},
+		{250, "RCPT TO:<bob@example.net>"},
+		{250, "RCPT TO:<dave@example.net>"},
+		{354, "DATA"},
+	} {
+		if err := smtptest.Cmd(c, step.code, "%s", step.cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.PrintfLine("Subject: x\r\n\r\nbody\r\n."); err != nil {
+		t.Fatal(err)
+	}
+	for _, code := range []int{451, 250, 250} {
+		if _, msg, err := c.ReadResponse(code); err != nil {
+			t.Errorf("reply %d: %v %s", code, err, msg)
+		}
+	}
+
+	for _, user := range []string{"bob", "dave"} {
+		got := messages(t, filepath.Join(root, user))
+		if len(got) != 1 || !strings.HasSuffix(got[0], "Subject: x\n\nbody\n") {
+			t.Errorf("%s got %q", user, got)
+		}
+	}
+}
+
+func TestSplitDetail(t *testing.T) {
+	t.Parallel()
+
+	for addr, want := range map[string][2]string{
+		"bob@example.net":         {"bob@example.net", ""},
+		"bob+lists@example.net":   {"bob@example.net", "lists"},
+		"bob+a+b@example.net":     {"bob@example.net", "a+b"},
+		"+lists@example.net":      {"+lists@example.net", ""},
+		"bob+lists":               {"bob", "lists"},
+		"bob+@example.net":        {"bob@example.net", ""},
+		"bob+lists@sub+domain.io": {"bob@sub+domain.io", "lists"},
+	} {
+		addr2, detail := splitDetail(addr)
+		if addr2 != want[0] || detail != want[1] {
+			t.Errorf("splitDetail(%q) = %q, %q, want %q, %q", addr, addr2, detail, want[0], want[1])
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package mbox
+
+import (
+	"os"
+	"time"
+)
+
+// lockFile does nothing on a system without fcntl locks, where the dot lock
+// alone keeps the writers of a mailbox apart.
+func lockFile(*os.File, time.Time) error { return nil }
+
+func unlockFile(*os.File) error { return nil }
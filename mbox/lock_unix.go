@@ -0,0 +1,36 @@
+//go:build unix
+
+package mbox
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// lockFile takes the fcntl write lock of f, and waits until deadline for a
+// lock that another process holds.
+func lockFile(f *os.File, deadline time.Time) error {
+	lk := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: io.SeekStart}
+	for wait := 10 * time.Millisecond; ; wait = min(2*wait, time.Second) {
+		err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lk)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, syscall.EAGAIN) && !errors.Is(err, syscall.EACCES) {
+			return err
+		}
+		if time.Now().Add(wait).After(deadline) {
+			return errMailboxLocked
+		}
+		time.Sleep(wait)
+	}
+}
+
+// unlockFile releases the fcntl lock of f.
+func unlockFile(f *os.File) error {
+	lk := syscall.Flock_t{Type: syscall.F_UNLCK, Whence: io.SeekStart}
+	return syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lk)
+}
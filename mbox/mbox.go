@@ -0,0 +1,404 @@
+// Package mbox appends messages to mbox files on the local disk, for the
+// tools that still read a mailbox as one file.
+//
+// A message takes the mboxrd form: a "From " line with the sender and the
+// date of delivery starts it, and a line of the message that starts with
+// "From ", after any number of ">", gets one more ">", so a reader can undo
+// the quoting exactly. An empty line ends the message.
+//
+// Another program can append to the same file at the same time, such as a
+// mail client that moves a message. The handler takes a dot lock, the file
+// "mbox.lock" next to the mailbox, and an fcntl lock of the file itself where
+// the system has one, which are the two that mail programs share. A write that
+// fails half way truncates the file back to its size before it, so a reader
+// never finds the start of a message without its end.
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/chrj/smtpd/v2"
+	"github.com/chrj/smtpd/v2/internal/answer"
+	"github.com/chrj/smtpd/v2/internal/spool"
+)
+
+// PathFunc gives the mbox file of a recipient. The handler creates the file
+// where it is missing, but not the directory that holds it.
+//
+// It returns ErrNoMailbox, or any other smtpd.Error, to refuse the recipient
+// with that reply. Any other error counts as temporary.
+type PathFunc func(ctx context.Context, rcpt string) (string, error)
+
+// ErrNoMailbox is the error of a PathFunc for a recipient without a mailbox.
+var ErrNoMailbox = smtpd.Error{Code: 550, Enhanced: smtpd.EnhancedCode{5, 1, 1}, Message: "No such user"}
+
+var (
+	errDeliver = smtpd.Error{Code: 451, Enhanced: smtpd.EnhancedCode{4, 3, 0}, Message: "Could not deliver the message, try again later"}
+	errLocked  = smtpd.Error{Code: 450, Enhanced: smtpd.EnhancedCode{4, 2, 0}, Message: "Mailbox busy, try again later"}
+	errQuota   = smtpd.Error{Code: 452, Enhanced: smtpd.EnhancedCode{4, 2, 2}, Message: "Mailbox full"}
+	errNoSpace = smtpd.Error{Code: 452, Enhanced: smtpd.EnhancedCode{4, 3, 1}, Message: "Insufficient system storage"}
+)
+
+const (
+	// defaultLockTimeout bounds the wait for a mailbox that another program
+	// holds.
+	defaultLockTimeout = 30 * time.Second
+
+	// staleLock is the age of a dot lock that the handler takes for one
+	// that its owner left behind, as mail programs do.
+	staleLock = 5 * time.Minute
+)
+
+// Mbox is a Handler that appends to mbox files. It is safe for concurrent
+// use.
+type Mbox struct {
+	path        PathFunc
+	dotlock     bool
+	lockTimeout time.Duration
+	now         func() time.Time
+
+	// locks orders the appends of this process to one file. An fcntl lock
+	// belongs to the process, so it cannot tell two of them apart.
+	mu    sync.Mutex
+	locks map[string]*pathLock
+}
+
+type pathLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// Option configures an Mbox.
+type Option func(*Mbox)
+
+// WithoutDotlock leaves out the dot lock, for a mailbox in a directory that
+// the server cannot write to, and relies on the fcntl lock alone.
+func WithoutDotlock() Option {
+	return func(m *Mbox) { m.dotlock = false }
+}
+
+// WithLockTimeout sets how long the handler waits for a mailbox that another
+// program holds, before it gives the recipient a temporary error. The default
+// is 30 seconds.
+func WithLockTimeout(d time.Duration) Option {
+	return func(m *Mbox) { m.lockTimeout = d }
+}
+
+// withMboxClock replaces the clock of the "From " line, for tests.
+func withMboxClock(now func() time.Time) Option {
+	return func(m *Mbox) { m.now = now }
+}
+
+// New gives an Mbox that appends the message of each recipient to the file
+// that path gives for it.
+func New(path PathFunc, opts ...Option) *Mbox {
+	m := &Mbox{
+		path:        path,
+		dotlock:     true,
+		lockTimeout: defaultLockTimeout,
+		now:         time.Now,
+		locks:       make(map[string]*pathLock),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Handler appends the message to the mbox file of each recipient.
+//
+// A session of SMTP writes one reply for the message. A recipient that
+// failed refuses the message for all of them, with a temporary error where
+// one of them failed for now, and the client tries every recipient again. A
+// session of LMTP refuses the recipients that failed with
+// Envelope.RejectRecipient, and takes the message for the rest.
+func (m *Mbox) Handler(ctx context.Context, peer smtpd.Peer, env *smtpd.Envelope) (context.Context, error) {
+	defer func() { _ = env.Data.Close() }()
+
+	errs := m.Deliver(ctx, env)
+
+	if peer.Protocol == smtpd.LMTP {
+		for i, err := range errs {
+			if err != nil {
+				_ = env.RejectRecipient(i, err)
+			}
+		}
+		return ctx, nil
+	}
+
+	return ctx, answer.First(errs)
+}
+
+// Deliver appends env to the mbox file of each recipient, and gives the
+// answer for each one at its index in env.Recipients: nil for a recipient
+// that got the message, and an smtpd.Error for one that did not.
+//
+// Deliver reads env.Data to the end, and leaves it to the caller to close. It
+// is a queue.DeliverFunc.
+func (m *Mbox) Deliver(ctx context.Context, env *smtpd.Envelope) []error {
+	logger := smtpd.LoggerFromContext(ctx)
+	errs := make([]error, len(env.Recipients))
+
+	s, err := m.entry(env)
+	if err != nil {
+		logger.WarnContext(ctx, "could not read the message", slog.Any("error", err))
+		return answer.Fill(errs, errDeliver)
+	}
+	defer func() { _ = s.Close() }()
+
+	// Two recipients that share a file, such as two aliases of one user,
+	// share one copy of the message in it.
+	done := make(map[string]error)
+	for i, rcpt := range env.Recipients {
+		path, err := m.path(ctx, rcpt)
+		if err != nil {
+			var se smtpd.Error
+			if !errors.As(err, &se) {
+				logger.WarnContext(ctx, "no mailbox for the recipient",
+					slog.String("recipient", rcpt), slog.Any("error", err))
+				err = errDeliver
+			}
+			errs[i] = err
+			continue
+		}
+
+		if err, ok := done[path]; ok {
+			errs[i] = err
+			continue
+		}
+
+		err = m.append(path, s.Section(0))
+		if err != nil {
+			logger.WarnContext(ctx, "mbox delivery failed",
+				slog.String("mbox", path), slog.Any("error", err))
+			err = asError(err)
+		}
+		done[path] = err
+		errs[i] = err
+	}
+	return errs
+}
+
+// entry gives env as an entry of an mbox: the "From " line, the Return-Path
+// field that RFC 5321 section 4.4 asks of the final delivery, the message
+// with each line that looks like a "From " line quoted, and an empty line.
+// Every line ends with LF, and a message of BINARYMIME keeps its bytes.
+func (m *Mbox) entry(env *smtpd.Envelope) (*spool.Spool, error) {
+	s := spool.New(spool.DefaultMemory, "")
+	w := bufio.NewWriter(s)
+
+	_, _ = fmt.Fprintf(w, "From %s %s\n", fromSender(env.Sender), m.now().Format(time.ANSIC))
+	_, _ = fmt.Fprintf(w, "Return-Path: <%s>\n", env.Sender)
+
+	err := quote(w, env.Data, env.BodyType != smtpd.BodyBinaryMIME)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// fromSender gives the sender as the "From " line takes it: one word, and
+// MAILER-DAEMON for the null sender.
+func fromSender(sender string) string {
+	if sender == "" {
+		return "MAILER-DAEMON"
+	}
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, sender)
+}
+
+// quote copies r to w in the mboxrd form, and ends it with an empty line.
+// With lf, each CRLF of r becomes LF.
+func quote(w *bufio.Writer, r io.Reader, lf bool) error {
+	br := bufio.NewReader(r)
+	lineStart, last := true, byte('\n')
+	for {
+		line, err := br.ReadSlice('\n')
+		if lineStart && isFromLine(line) {
+			_ = w.WriteByte('>')
+		}
+		if lf && bytes.HasSuffix(line, []byte("\r\n")) {
+			line = append(line[:len(line)-2], '\n')
+		}
+		_, _ = w.Write(line)
+		if len(line) > 0 {
+			last = line[len(line)-1]
+			lineStart = last == '\n'
+		}
+
+		switch {
+		case errors.Is(err, bufio.ErrBufferFull):
+			continue
+		case errors.Is(err, io.EOF):
+			if last != '\n' {
+				_ = w.WriteByte('\n')
+			}
+			return w.WriteByte('\n')
+		case err != nil:
+			return err
+		}
+	}
+}
+
+// isFromLine reports whether line is "From " after any number of ">".
+func isFromLine(line []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From "))
+}
+
+// append appends the entry that r reads to the file at path, under the locks
+// of the file. It truncates the file back to its old size when the write
+// fails.
+func (m *Mbox) append(path string, r io.Reader) error {
+	unlock := m.lockPath(path)
+	defer unlock()
+
+	deadline := time.Now().Add(m.lockTimeout)
+	if m.dotlock {
+		if err := dotlock(path, deadline); err != nil {
+			return err
+		}
+		defer func() { _ = os.Remove(path + ".lock") }()
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	if err := lockFile(f, deadline); err != nil {
+		return err
+	}
+	defer func() { _ = unlockFile(f) }()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+
+	err = write(f, size, r)
+	if err == nil {
+		return nil
+	}
+	if terr := f.Truncate(size); terr != nil {
+		return errors.Join(err, fmt.Errorf("mbox: roll back %s: %w", path, terr))
+	}
+	_ = f.Sync()
+	return err
+}
+
+// write writes the entry that r reads at the end of f, which holds size
+// octets, and syncs it. A mailbox whose last message lacks its empty line
+// gets one first, so the "From " line starts a line of its own.
+func write(f *os.File, size int64, r io.Reader) error {
+	var sep []byte
+	if size > 0 {
+		tail := make([]byte, min(size, 2))
+		if _, err := f.ReadAt(tail, size-int64(len(tail))); err != nil {
+			return err
+		}
+		switch {
+		case bytes.Equal(tail, []byte("\n\n")):
+		case tail[len(tail)-1] == '\n':
+			sep = []byte("\n")
+		default:
+			sep = []byte("\n\n")
+		}
+	}
+
+	w := io.NewOffsetWriter(f, size)
+	if _, err := w.Write(sep); err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// dotlock creates the lock file of path, and waits until deadline for a lock
+// file that another program holds. It removes a lock that has been there for
+// longer than staleLock.
+func dotlock(path string, deadline time.Time) error {
+	lock := path + ".lock"
+	for wait := 10 * time.Millisecond; ; wait = min(2*wait, time.Second) {
+		f, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err == nil {
+			return f.Close()
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return err
+		}
+
+		if fi, err := os.Stat(lock); err == nil && time.Since(fi.ModTime()) > staleLock {
+			_ = os.Remove(lock)
+			continue
+		}
+		if time.Now().Add(wait).After(deadline) {
+			return errMailboxLocked
+		}
+		time.Sleep(wait)
+	}
+}
+
+// errMailboxLocked is the error of a mailbox that stayed locked until the
+// deadline.
+var errMailboxLocked = errors.New("mbox: mailbox is locked")
+
+// lockPath takes the lock of this process for path, and gives the function
+// that releases it.
+func (m *Mbox) lockPath(path string) func() {
+	m.mu.Lock()
+	l, ok := m.locks[path]
+	if !ok {
+		l = &pathLock{}
+		m.locks[path] = l
+	}
+	l.refs++
+	m.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+
+		m.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(m.locks, path)
+		}
+		m.mu.Unlock()
+	}
+}
+
+// asError gives the reply for a delivery that failed with err.
+func asError(err error) error {
+	switch {
+	case errors.Is(err, errMailboxLocked):
+		return errLocked
+	case errors.Is(err, syscall.EDQUOT):
+		return errQuota
+	case errors.Is(err, syscall.ENOSPC):
+		return errNoSpace
+	}
+	return errDeliver
+}
@@ -0,0 +1,291 @@
+package mbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chrj/smtpd/v2"
+	"github.com/chrj/smtpd/v2/smtptest"
+)
+
+var date = time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// users maps the users of example.net to files under root. carol is an alias
+// of bob.
+func users(root string) PathFunc {
+	return func(_ context.Context, rcpt string) (string, error) {
+		switch rcpt {
+		case "bob@example.net", "carol@example.net":
+			return filepath.Join(root, "bob"), nil
+		case "dave@example.net":
+			return filepath.Join(root, "dave"), nil
+		case "lost@example.net":
+			return filepath.Join(root, "missing", "lost"), nil
+		case "broken@example.net":
+			return "", errors.New("directory is down")
+		}
+		return "", ErrNoMailbox
+	}
+}
+
+func envelope(sender, body string, rcpts ...string) *smtpd.Envelope {
+	return &smtpd.Envelope{
+		Sender:     sender,
+		Recipients: rcpts,
+		Data:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func read(t *testing.T, path string) string {
+	t.Helper()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestDeliver(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	m := New(users(root), withMboxClock(func() time.Time { return date }))
+
+	body := "Subject: x\r\n\r\nFrom here\r\n>From there\r\n>>From everywhere\r\nFrom: not a From line\r\nno end"
+	errs := m.Deliver(context.Background(), envelope("alice@example.org", body,
+		"bob@example.net", "nobody@example.net", "carol@example.net", "lost@example.net", "broken@example.net"))
+
+	want := []error{nil, ErrNoMailbox, nil, errDeliver, errDeliver}
+	for i := range want {
+		if !errors.Is(errs[i], want[i]) {
+			t.Errorf("recipient %d: %v, want %v", i, errs[i], want[i])
+		}
+	}
+
+	const stored = "From alice@example.org Fri Jan  2 03:04:05 2026\n" +
+		"Return-Path: <alice@example.org>\n" +
+		"Subject: x\n\n" +
+		">From here\n" +
+		">>From there\n" +
+		">>>From everywhere\n" +
+		"From: not a From line\n" +
+		"no end\n\n"
+	if got := read(t, filepath.Join(root, "bob")); got != stored {
+		t.Errorf("bob got\n%q, want\n%q", got, stored)
+	}
+	if _, err := os.Stat(filepath.Join(root, "bob.lock")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the dot lock stayed behind: %v", err)
+	}
+
+	errs = m.Deliver(context.Background(), envelope("", "Subject: y\n\nbody\n", "bob@example.net"))
+	if errs[0] != nil {
+		t.Fatal(errs[0])
+	}
+	second := "From MAILER-DAEMON Fri Jan  2 03:04:05 2026\nReturn-Path: <>\nSubject: y\n\nbody\n\n"
+	if got := read(t, filepath.Join(root, "bob")); got != stored+second {
+		t.Errorf("bob got\n%q, want\n%q", got, stored+second)
+	}
+}
+
+func TestDeliverSeparator(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	m := New(users(root), withMboxClock(func() time.Time { return date }))
+	entry := "From alice@example.org Fri Jan  2 03:04:05 2026\nReturn-Path: <alice@example.org>\nx\n\n"
+
+	// A mailbox that another program left without the empty line, or
+	// without the end of the line.
+	for before, sep := range map[string]string{
+		"":                     "",
+		"From a b\nbody\n":     "\n",
+		"From a b\nbody":       "\n\n",
+		"From a b\nbody\n\n":   "",
+		"From a b\nbody\n\n\n": "",
+	} {
+		path := filepath.Join(root, "dave")
+		if err := os.WriteFile(path, []byte(before), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if errs := m.Deliver(context.Background(), envelope("alice@example.org", "x\n", "dave@example.net")); errs[0] != nil {
+			t.Fatal(errs[0])
+		}
+		if got, want := read(t, path), before+sep+entry; got != want {
+			t.Errorf("after %q: %q, want %q", before, got, want)
+		}
+	}
+}
+
+// failingReader gives n octets of a message, and then an error.
+type failingReader struct{ n int }
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, errors.New("disk went away")
+	}
+	n := min(len(p), r.n)
+	for i := range n {
+		p[i] = 'x'
+	}
+	r.n -= n
+	return n, nil
+}
+
+func TestAppendRollback(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "bob")
+	const before = "From a b\nbody\n\n"
+	if err := os.WriteFile(path, []byte(before), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	m := New(users(""))
+	if err := m.append(path, &failingReader{n: 100}); err == nil {
+		t.Fatal("append of a failing message succeeded")
+	}
+	if got := read(t, path); got != before {
+		t.Errorf("the mailbox holds %q after the failed write, want %q", got, before)
+	}
+}
+
+func TestDotlock(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	lock := filepath.Join(root, "bob.lock")
+	if err := os.WriteFile(lock, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	m := New(users(root), WithLockTimeout(50*time.Millisecond))
+	errs := m.Deliver(context.Background(), envelope("alice@example.org", "x\n", "bob@example.net"))
+	if !errors.Is(errs[0], errLocked) {
+		t.Errorf("a locked mailbox: %v, want %v", errs[0], errLocked)
+	}
+	if _, err := os.Stat(filepath.Join(root, "bob")); !errors.Is(err, os.ErrNotExist) {
+		t.Error("the handler wrote to a locked mailbox")
+	}
+
+	// A lock that its owner left behind long ago.
+	old := time.Now().Add(-2 * staleLock)
+	if err := os.Chtimes(lock, old, old); err != nil {
+		t.Fatal(err)
+	}
+	errs = m.Deliver(context.Background(), envelope("alice@example.org", "x\n", "bob@example.net"))
+	if errs[0] != nil {
+		t.Errorf("a stale lock: %v", errs[0])
+	}
+
+	// Without the dot lock, a lock file does not stop the handler.
+	if err := os.WriteFile(lock, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	m = New(users(root), WithoutDotlock(), WithLockTimeout(50*time.Millisecond))
+	errs = m.Deliver(context.Background(), envelope("alice@example.org", "x\n", "bob@example.net"))
+	if errs[0] != nil {
+		t.Errorf("WithoutDotlock: %v", errs[0])
+	}
+}
+
+func TestDeliverConcurrent(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	m := New(users(root), WithoutDotlock())
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Go(func() {
+			body := fmt.Sprintf("Subject: %d\n\n%s\n", i, strings.Repeat("line\n", 1000))
+			if errs := m.Deliver(context.Background(), envelope("alice@example.org", body, "bob@example.net")); errs[0] != nil {
+				t.Error(errs[0])
+			}
+		})
+	}
+	wg.Wait()
+
+	got := read(t, filepath.Join(root, "bob"))
+	if n := strings.Count(got, "\nFrom alice@example.org "); n != 19 || !strings.HasPrefix(got, "From ") {
+		t.Errorf("the mailbox holds %d messages after the first, want 19", n)
+	}
+	if len(m.locks) != 0 {
+		t.Errorf("%d locks of the process stayed behind", len(m.locks))
+	}
+}
+
+func TestHandlerLMTP(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	srv := smtptest.NewUnstartedServer(New(users(root)).Handler)
+	srv.Config.LMTP = true
+	srv.Start()
+	defer srv.Close()
+
+	nc, err := net.Dial("tcp", srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = nc.Close() }()
+	_ = nc.SetDeadline(time.Now().Add(10 * time.Second))
+	c := textproto.NewConn(nc)
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []struct {
+		code int
+		cmd  string
+	}{
+		{250, "LHLO client.example.org"},
+		{250, "MAIL FROM:<alice@example.org>"},
+		{250, "RCPT TO:<bob@example.net>"},
+		{250, "RCPT TO:<nobody@example.net>"},
+		{250, "RCPT TO:<lost@example.net>"},
+		{354, "DATA"},
+	} {
+		if err := smtptest.Cmd(c, step.code, "%s", step.cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.PrintfLine("Subject: x\r\n\r\nbody\r\n."); err != nil {
+		t.Fatal(err)
+	}
+	for _, code := range []int{250, 550, 451} {
+		if _, msg, err := c.ReadResponse(code); err != nil {
+			t.Errorf("reply %d: %v %s", code, err, msg)
+		}
+	}
+
+	if got := read(t, filepath.Join(root, "bob")); !strings.HasSuffix(got, "Subject: x\n\nbody\n\n") {
+		t.Errorf("bob got %q", got)
+	}
+}
+
+func TestHandlerSMTP(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	srv := smtptest.NewServer(New(users(root)).Handler)
+	defer srv.Close()
+
+	c := srv.Dial()
+	defer func() { _ = c.Close() }()
+	err := smtptest.Send(c, "alice@example.org", []string{"dave@example.net", "nobody@example.net"}, "Subject: x\r\n\r\nbody\r\n")
+	var tpe *textproto.Error
+	if !errors.As(err, &tpe) || tpe.Code != 550 {
+		t.Errorf("a message with an unknown recipient: %v, want 550", err)
+	}
+}
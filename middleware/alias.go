@@ -0,0 +1,263 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/chrj/smtpd/v2"
+)
+
+// AliasMap gives the addresses that a key of a virtual alias table stands
+// for, or nil for a key that it does not carry. A key is an address in lower
+// case, or "@domain" for every address of the domain.
+type AliasMap interface {
+	Aliases(ctx context.Context, key string) ([]string, error)
+}
+
+// AliasTable is an AliasMap that holds the table in memory. Its keys are in
+// lower case.
+type AliasTable map[string][]string
+
+// Aliases gives the addresses of key.
+func (t AliasTable) Aliases(_ context.Context, key string) ([]string, error) {
+	return t[key], nil
+}
+
+// AliasFile is an AliasMap that reads the table from a file in the form of
+// the virtual table of Postfix. Reload reads the file again. It is safe for
+// concurrent use.
+//
+// Each line holds a key and the addresses that it stands for, apart by white
+// space, and the addresses apart by commas or white space:
+//
+//	# A list of three.
+//	sales@example.com     bob@example.com, carol@example.com,
+//	                      dave@example.com
+//	@old.example.com      @example.com
+//
+// A line that starts with white space continues the line before it, and "#"
+// starts a comment line.
+type AliasFile struct {
+	path string
+
+	mu    sync.RWMutex
+	table AliasTable
+}
+
+// LoadAliasFile reads the alias table in the file at path.
+func LoadAliasFile(path string) (*AliasFile, error) {
+	f := &AliasFile{path: path}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads the file again, and puts its table in the place of the one
+// that the AliasFile held. A file that does not parse leaves the old table in
+// place.
+func (f *AliasFile) Reload() error {
+	table, err := readAliasFile(f.path)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.table = table
+	f.mu.Unlock()
+	return nil
+}
+
+// Aliases gives the addresses of key.
+func (f *AliasFile) Aliases(_ context.Context, key string) ([]string, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.table[key], nil
+}
+
+func readAliasFile(path string) (AliasTable, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("alias: %w", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	table := make(AliasTable)
+	var (
+		key     string
+		keyLine int
+	)
+	// end checks the entry of key once its last line is read.
+	end := func() error {
+		if key != "" && len(table[key]) == 0 {
+			return fmt.Errorf("alias: %s:%d: %s has no address", path, keyLine, key)
+		}
+		return nil
+	}
+
+	sc := bufio.NewScanner(file)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if line[0] != ' ' && line[0] != '\t' {
+			if err := end(); err != nil {
+				return nil, err
+			}
+			key, keyLine = strings.ToLower(fields[0]), n
+			if _, ok := table[key]; ok {
+				return nil, fmt.Errorf("alias: %s:%d: %s appears twice", path, n, key)
+			}
+			table[key] = nil
+			fields = fields[1:]
+		} else if key == "" {
+			return nil, fmt.Errorf("alias: %s:%d: continuation line without a key", path, n)
+		}
+
+		for _, field := range fields {
+			for addr := range strings.SplitSeq(field, ",") {
+				if addr != "" {
+					table[key] = append(table[key], addr)
+				}
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("alias: %w", err)
+	}
+	if err := end(); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// aliasMaxDepth bounds the chain of aliases that one address expands
+// through.
+const aliasMaxDepth = 20
+
+var (
+	errAliasLoop = smtpd.Error{Code: 550, Enhanced: smtpd.EnhancedCode{5, 4, 6}, Message: "Alias loop detected"}
+	errAliasTemp = smtpd.Error{Code: 451, Enhanced: smtpd.EnhancedCode{4, 3, 0}, Message: "Could not expand the recipient, try again later"}
+)
+
+// Aliases returns a Middleware that rewrites each recipient through the
+// virtual alias table of m, at RCPT TO. A recipient takes the addresses that
+// the table gives for it in its place, and each of those goes through the
+// table again.
+//
+// The table answers for the whole address first. An address with a
+// subaddress, such as bob+lists@example.com, then tries bob@example.com, and
+// last "@example.com" stands for every address of the domain. An address
+// of "@domain" on the right of such a key keeps the local part of the
+// recipient, so "@old.example.com @example.com" moves a domain.
+//
+// An alias that names itself, such as "bob@example.com bob@example.com,
+// archive@example.com", delivers to that address too. Any other way back to
+// an address that is already on the chain is a loop, which refuses the
+// recipient with 550 5.4.6, and so does a chain more than 20 aliases long.
+//
+// Server.MaxRecipients counts the addresses after the expansion. The server
+// keeps the address that the client sent as the ORCPT of each address that
+// the table changed.
+func Aliases(m AliasMap) smtpd.Middleware {
+	return smtpd.Middleware{
+		RewriteRecipient: func(ctx context.Context, _ smtpd.Peer, addr string) (context.Context, []string, error) {
+			var out []string
+			if err := expandAlias(ctx, m, addr, nil, &out); err != nil {
+				return ctx, nil, err
+			}
+			if len(out) == 1 && out[0] == addr {
+				return ctx, nil, nil
+			}
+			return ctx, out, nil
+		},
+	}
+}
+
+// expandAlias appends the addresses that addr stands for to out, once each.
+// chain holds the aliases that led to addr.
+func expandAlias(ctx context.Context, m AliasMap, addr string, chain []string, out *[]string) error {
+	if len(chain) > aliasMaxDepth {
+		return errAliasLoop
+	}
+
+	targets, err := lookupAlias(ctx, m, addr)
+	if err != nil {
+		smtpd.LoggerFromContext(ctx).WarnContext(ctx, "alias lookup failed",
+			slog.String("recipient", addr), slog.Any("error", err))
+		return errAliasTemp
+	}
+	if targets == nil {
+		appendAddress(out, addr)
+		return nil
+	}
+
+	chain = append(chain, addr)
+	for _, target := range targets {
+		switch {
+		case strings.EqualFold(target, addr):
+			appendAddress(out, addr)
+		case slices.ContainsFunc(chain, func(a string) bool { return strings.EqualFold(a, target) }):
+			return errAliasLoop
+		default:
+			if err := expandAlias(ctx, m, target, chain, out); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// lookupAlias gives the addresses that the table of m gives for addr: for
+// the address, for the address without its subaddress, or for its domain.
+func lookupAlias(ctx context.Context, m AliasMap, addr string) ([]string, error) {
+	keys := []string{strings.ToLower(addr)}
+	var local string
+	if at := strings.LastIndexByte(addr, '@'); at >= 0 {
+		var domain string
+		local, domain = addr[:at], strings.ToLower(addr[at+1:])
+		if user, _, ok := strings.Cut(local, "+"); ok && user != "" {
+			keys = append(keys, strings.ToLower(user)+"@"+domain)
+		}
+		keys = append(keys, "@"+domain)
+	}
+
+	for i, key := range keys {
+		targets, err := m.Aliases(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if targets == nil {
+			continue
+		}
+		if i > 0 && strings.HasPrefix(key, "@") {
+			// "@domain" on the right of the key of a domain keeps the
+			// local part.
+			targets = slices.Clone(targets)
+			for j, t := range targets {
+				if strings.HasPrefix(t, "@") {
+					targets[j] = local + t
+				}
+			}
+		}
+		return targets, nil
+	}
+	return nil, nil
+}
+
+// appendAddress appends addr to out, unless out holds it already.
+func appendAddress(out *[]string, addr string) {
+	if !slices.ContainsFunc(*out, func(a string) bool { return strings.EqualFold(a, addr) }) {
+		*out = append(*out, addr)
+	}
+}
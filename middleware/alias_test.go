@@ -0,0 +1,161 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/chrj/smtpd/v2"
+)
+
+// rewriteWith runs the RewriteRecipient hook of mw on addr.
+func rewriteWith(t *testing.T, mw smtpd.Middleware, addr string) ([]string, error) {
+	t.Helper()
+
+	_, out, err := mw.RewriteRecipient(context.Background(), smtpd.Peer{}, addr)
+	return out, err
+}
+
+func TestAliases(t *testing.T) {
+	t.Parallel()
+
+	mw := Aliases(AliasTable{
+		"sales@example.com":  {"bob@example.com", "team@example.com"},
+		"team@example.com":   {"carol@example.com", "Dave@example.com"},
+		"dave@example.com":   {"dave@example.com", "archive@example.com"},
+		"bob@example.com":    {"bob@example.net"},
+		"@old.example.com":   {"@example.com"},
+		"@catch.example.com": {"postmaster@example.com"},
+		"loop1@example.com":  {"loop2@example.com"},
+		"loop2@example.com":  {"loop1@example.com"},
+		"twice@example.com":  {"carol@example.com", "team@example.com"},
+	})
+
+	tests := []struct {
+		addr string
+		want []string
+		err  error
+	}{
+		{addr: "nobody@example.com"},
+		{
+			addr: "sales@example.com",
+			want: []string{"bob@example.net", "carol@example.com", "Dave@example.com", "archive@example.com"},
+		},
+		{addr: "SALES@Example.com", want: []string{"bob@example.net", "carol@example.com", "Dave@example.com", "archive@example.com"}},
+		{addr: "bob+lists@example.com", want: []string{"bob@example.net"}},
+		{addr: "Sales@old.example.com", want: []string{"bob@example.net", "carol@example.com", "Dave@example.com", "archive@example.com"}},
+		{addr: "frank@old.example.com", want: []string{"frank@example.com"}},
+		{addr: "anyone@catch.example.com", want: []string{"postmaster@example.com"}},
+		{addr: "twice@example.com", want: []string{"carol@example.com", "Dave@example.com", "archive@example.com"}},
+		{addr: "loop1@example.com", err: errAliasLoop},
+	}
+
+	for _, tc := range tests {
+		got, err := rewriteWith(t, mw, tc.addr)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: error %v, want %v", tc.addr, err, tc.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: %q, want %q", tc.addr, got, tc.want)
+		}
+	}
+}
+
+func TestAliasesDepth(t *testing.T) {
+	t.Parallel()
+
+	table := AliasTable{}
+	for i := range aliasMaxDepth + 1 {
+		table[aliasName(i)] = []string{aliasName(i + 1)}
+	}
+	if _, err := rewriteWith(t, Aliases(table), aliasName(0)); !errors.Is(err, errAliasLoop) {
+		t.Errorf("a chain of %d aliases: %v, want %v", aliasMaxDepth+1, err, errAliasLoop)
+	}
+
+	delete(table, aliasName(aliasMaxDepth))
+	if got, err := rewriteWith(t, Aliases(table), aliasName(0)); err != nil || len(got) != 1 {
+		t.Errorf("a chain of %d aliases: %q, %v", aliasMaxDepth, got, err)
+	}
+}
+
+func aliasName(i int) string {
+	return strings.Repeat("a", i+1) + "@example.com"
+}
+
+type failingAliases struct{}
+
+func (failingAliases) Aliases(context.Context, string) ([]string, error) {
+	return nil, errors.New("database is down")
+}
+
+func TestAliasesTemporaryError(t *testing.T) {
+	t.Parallel()
+
+	if _, err := rewriteWith(t, Aliases(failingAliases{}), "bob@example.com"); !errors.Is(err, errAliasTemp) {
+		t.Errorf("a failing map: %v, want %v", err, errAliasTemp)
+	}
+}
+
+func TestAliasFile(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "virtual")
+	write := func(s string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(s), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`# Lists
+Sales@Example.com     bob@example.com, carol@example.com,
+                      dave@example.com
+team@example.com
+	carol@example.com
+  # a comment in between
+
+@old.example.com      @example.com
+`)
+	f, err := LoadAliasFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string][]string{
+		"sales@example.com": {"bob@example.com", "carol@example.com", "dave@example.com"},
+		"team@example.com":  {"carol@example.com"},
+		"@old.example.com":  {"@example.com"},
+		"bob@example.com":   nil,
+	} {
+		if got, _ := f.Aliases(context.Background(), key); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: %q, want %q", key, got, want)
+		}
+	}
+
+	write("sales@example.com  erin@example.com\n")
+	if err := f.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := f.Aliases(context.Background(), "sales@example.com"); !reflect.DeepEqual(got, []string{"erin@example.com"}) {
+		t.Errorf("after Reload: %q", got)
+	}
+
+	for _, bad := range []string{
+		"  bob@example.com\n",
+		"sales@example.com\n",
+		"sales@example.com a@example.com\nSALES@example.com b@example.com\n",
+	} {
+		write(bad)
+		if err := f.Reload(); err == nil {
+			t.Errorf("Reload of %q succeeded", bad)
+		}
+	}
+	if got, _ := f.Aliases(context.Background(), "sales@example.com"); !reflect.DeepEqual(got, []string{"erin@example.com"}) {
+		t.Errorf("a file that does not parse replaced the table: %q", got)
+	}
+}
@@ -0,0 +1,546 @@
+package middleware
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chrj/smtpd/v2"
+	"github.com/chrj/smtpd/v2/internal/spool"
+)
+
+// ARCChainStatus is the validation status of an ARC chain, the cv= of RFC
+// 8617 section 4.4.
+type ARCChainStatus string
+
+const (
+	// ARCNone is a message without ARC header fields.
+	ARCNone ARCChainStatus = "none"
+
+	// ARCPass is a chain whose every seal, and whose latest message
+	// signature, verified.
+	ARCPass ARCChainStatus = "pass"
+
+	// ARCFail is a chain that is broken, or that a sealer on the way found
+	// broken.
+	ARCFail ARCChainStatus = "fail"
+)
+
+// ARCResult is the validation of the ARC chain of a message.
+type ARCResult struct {
+	Status ARCChainStatus
+
+	// Instances is the number of ARC sets in the chain. A chain that does
+	// not parse, such as one with an incomplete set, gives the highest
+	// instance that it names.
+	Instances int
+
+	// Err tells why a chain failed. It is nil for ARCNone and ARCPass.
+	Err error
+}
+
+// maxARCInstances is the highest instance of RFC 8617 section 4.2.1.
+const maxARCInstances = 50
+
+// errARCFailed is the Err of a chain whose latest seal says cv=fail. A chain
+// that has failed stays failed, and no sealer adds to it.
+var errARCFailed = errors.New("a sealer on the way found the chain broken")
+
+const arcKey contextKey = "smtpd-arc"
+
+// ARCResultFromContext returns the result of the Verify stage of an
+// ARCChecker. ok is false when none ran.
+func ARCResultFromContext(ctx context.Context) (result ARCResult, ok bool) {
+	result, ok = ctx.Value(arcKey).(ARCResult)
+	return result, ok
+}
+
+// VerifyARC validates the ARC chain (RFC 8617) of the message in r. It looks
+// the public keys up through resolver. The error is for a message that could
+// not be read, not for a chain that did not validate.
+func VerifyARC(ctx context.Context, resolver TXTResolver, r io.Reader) (ARCResult, error) {
+	sp, err := spool.Read(r, spool.DefaultMemory, "")
+	if err != nil {
+		return ARCResult{}, err
+	}
+	defer sp.Close()
+
+	h, headerSize, _, err := readHeader(sp.Section(0))
+	if err != nil {
+		return ARCResult{}, err
+	}
+	return verifyARC(ctx, resolver, h, sp, headerSize, time.Now()), nil
+}
+
+// ARCChecker validates and seals ARC chains (RFC 8617), for a server that
+// forwards mail it may change, such as a mailing list. It runs at two
+// Handler stages:
+//
+//	arc := middleware.ARC(
+//	    middleware.WithARCSeal("lists.example.com", keys),
+//	)
+//	srv.Use(smtpd.Middleware{Handler: arc.Verify})
+//	srv.Use(smtpd.Middleware{Handler: addFooter})
+//	srv.Use(smtpd.Middleware{Handler: arc.Seal})
+//
+// Verify validates the chain that the message arrived with, before anything
+// changes the message, and stores the result in the context. Seal adds an ARC
+// set after the changes: ARC-Authentication-Results with the result of the
+// chain and of DMARC, when a DMARCChecker ran, ARC-Message-Signature over the
+// message, and ARC-Seal over the chain.
+//
+// Both stages read the whole message, so they spool it the way DKIMSigner
+// does.
+type ARCChecker struct {
+	resolver    TXTResolver
+	domain      string
+	keys        DKIMKeyStore
+	authServID  string
+	headers     []string
+	spoolMemory int64
+	spoolDir    string
+	now         func() time.Time
+}
+
+// ARCOption configures an ARCChecker at construction time. Pass options to
+// ARC.
+type ARCOption func(*ARCChecker)
+
+// WithARCResolver sets the DNS resolver for the keys of the chain. The
+// default is net.DefaultResolver.
+func WithARCResolver(resolver TXTResolver) ARCOption {
+	return func(a *ARCChecker) { a.resolver = resolver }
+}
+
+// WithARCSeal sets the domain that Seal seals for, and the store of its keys.
+// Seal signs with the first key that the store gives for the domain. Without
+// this option, Seal passes the message on unsealed.
+func WithARCSeal(domain string, keys DKIMKeyStore) ARCOption {
+	return func(a *ARCChecker) { a.domain, a.keys = domain, keys }
+}
+
+// WithARCAuthServID sets the authserv-id of ARC-Authentication-Results, the
+// name of the server that checked the message. The default is the domain of
+// WithARCSeal.
+func WithARCAuthServID(id string) ARCOption {
+	return func(a *ARCChecker) { a.authServID = id }
+}
+
+// WithARCHeaders sets the header fields that ARC-Message-Signature signs, as
+// WithDKIMHeaders does for DKIM. From is always signed.
+func WithARCHeaders(names ...string) ARCOption {
+	return func(a *ARCChecker) { a.headers = names }
+}
+
+// WithARCSpool sets how much of a message the checker holds in memory, and
+// the directory of the temporary file that takes a message past that. The
+// defaults are 1MB and the directory of os.TempDir.
+func WithARCSpool(memory int64, dir string) ARCOption {
+	return func(a *ARCChecker) { a.spoolMemory, a.spoolDir = memory, dir }
+}
+
+// withARCClock is a test hook for overriding time.Now.
+func withARCClock(now func() time.Time) ARCOption {
+	return func(a *ARCChecker) { a.now = now }
+}
+
+// ARC constructs an ARC checker.
+func ARC(opts ...ARCOption) *ARCChecker {
+	a := &ARCChecker{
+		resolver:    net.DefaultResolver,
+		headers:     defaultDKIMHeaders,
+		spoolMemory: spool.DefaultMemory,
+		now:         time.Now,
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	if a.authServID == "" {
+		a.authServID = a.domain
+	}
+	return a
+}
+
+// errARCSeal answers a message that the checker could not seal.
+var errARCSeal = smtpd.Error{Code: 451, Enhanced: smtpd.EnhancedCode{4, 3, 0}, Message: "Could not seal the message, try again later"}
+
+// Verify is an smtpd.Handler that validates the ARC chain of env.Data, and
+// stores the result in the context, where ARCResultFromContext finds it. It
+// refuses no message: what a broken chain means is up to a later stage.
+func (a *ARCChecker) Verify(ctx context.Context, peer smtpd.Peer, env *smtpd.Envelope) (context.Context, error) {
+	sp, err := spool.Read(env.Data, a.spoolMemory, a.spoolDir)
+	_ = env.Data.Close()
+	if err != nil {
+		return ctx, fmt.Errorf("middleware: spool the message from %v: %w", peer.Addr, err)
+	}
+
+	h, headerSize, _, err := readHeader(sp.Section(0))
+	if err != nil {
+		_ = sp.Close()
+		return ctx, fmt.Errorf("middleware: read the header from %v: %w", peer.Addr, err)
+	}
+
+	result := verifyARC(ctx, a.resolver, h, sp, headerSize, a.now())
+	if result.Status == ARCFail {
+		smtpd.LoggerFromContext(ctx).InfoContext(ctx, "ARC chain failed",
+			slog.Int("instances", result.Instances), slog.Any("error", result.Err))
+	}
+
+	env.Data = &spooledBody{Reader: sp.Section(0), spool: sp}
+	return context.WithValue(ctx, arcKey, result), nil
+}
+
+// Seal is an smtpd.Handler that adds an ARC set to env.Data. It takes the
+// status of the chain from Verify, and validates the chain itself when
+// Verify did not run. A chain that a sealer has failed before, or that is
+// full, passes on unsealed, and so does a domain that the store has no key
+// for.
+func (a *ARCChecker) Seal(ctx context.Context, peer smtpd.Peer, env *smtpd.Envelope) (context.Context, error) {
+	if a.keys == nil {
+		return ctx, nil
+	}
+	logger := smtpd.LoggerFromContext(ctx)
+
+	sp, err := spool.Read(env.Data, a.spoolMemory, a.spoolDir)
+	_ = env.Data.Close()
+	if err != nil {
+		return ctx, fmt.Errorf("middleware: spool the message from %v: %w", peer.Addr, err)
+	}
+
+	h, headerSize, eol, err := readHeader(sp.Section(0))
+	if err != nil {
+		_ = sp.Close()
+		return ctx, fmt.Errorf("middleware: read the header from %v: %w", peer.Addr, err)
+	}
+
+	result, ok := ARCResultFromContext(ctx)
+	if !ok {
+		result = verifyARC(ctx, a.resolver, h, sp, headerSize, a.now())
+	}
+
+	passOn := func() (context.Context, error) {
+		env.Data = &spooledBody{Reader: sp.Section(0), spool: sp}
+		return ctx, nil
+	}
+
+	// A chain of ARC fields without a single instance that parses gives no
+	// place for the next set.
+	if errors.Is(result.Err, errARCFailed) || result.Instances >= maxARCInstances ||
+		(result.Status == ARCFail && result.Instances == 0) {
+		return passOn()
+	}
+
+	keys, err := a.keys.DKIMKeys(ctx, a.domain)
+	if err != nil {
+		_ = sp.Close()
+		logger.ErrorContext(ctx, "ARC key lookup failed",
+			slog.String("domain", a.domain), slog.Any("error", err))
+		return ctx, errARCSeal
+	}
+	if len(keys) == 0 {
+		return passOn()
+	}
+
+	set, err := a.seal(ctx, h, sp, headerSize, result, keys[0])
+	if err != nil {
+		_ = sp.Close()
+		logger.ErrorContext(ctx, "ARC sealing failed",
+			slog.String("domain", a.domain),
+			slog.String("selector", keys[0].Selector),
+			slog.Any("error", err))
+		return ctx, errARCSeal
+	}
+
+	env.Data = &spooledBody{
+		Reader: io.MultiReader(strings.NewReader(strings.ReplaceAll(set, "\r\n", eol)), sp.Section(0)),
+		spool:  sp,
+	}
+	return ctx, nil
+}
+
+// seal writes the fields of a new ARC set, the seal first, each with the line
+// break at its end.
+func (a *ARCChecker) seal(ctx context.Context, h header, sp *spool.Spool, headerSize int64, result ARCResult, key DKIMKey) (string, error) {
+	algorithm, hashFunc, err := dkimAlgorithm(key.Signer.Public())
+	if err != nil {
+		return "", err
+	}
+
+	instance := result.Instances + 1
+	cv := ARCNone
+	if instance > 1 {
+		cv = result.Status
+	}
+	i := "i=" + strconv.Itoa(instance)
+	t := "t=" + strconv.FormatInt(a.now().Unix(), 10)
+
+	aar := foldTags("ARC-Authentication-Results", a.authResults(ctx, i, cv)) + "\r\n"
+
+	bodyHash, err := dkimBodyHash(sp.Section(headerSize), DKIMRelaxed, -1)
+	if err != nil {
+		return "", err
+	}
+	signed := signedHeaders(h, a.headers, nil)
+	ams := foldTags("ARC-Message-Signature", []string{
+		i,
+		"a=" + algorithm,
+		"c=relaxed/relaxed",
+		"d=" + a.domain,
+		"s=" + key.Selector,
+		t,
+		"h=" + strings.Join(signed, ":"),
+		"bh=" + base64.StdEncoding.EncodeToString(bodyHash),
+		"b=",
+	})
+	sig, err := signDigest(key, hashFunc, dkimHeaderHash(h, signed, ams, DKIMRelaxed))
+	if err != nil {
+		return "", err
+	}
+	ams += sig + "\r\n"
+
+	seal := foldTags("ARC-Seal", []string{
+		i,
+		"a=" + algorithm,
+		"cv=" + string(cv),
+		"d=" + a.domain,
+		"s=" + key.Selector,
+		t,
+		"b=",
+	})
+
+	// A seal of a failed chain covers its own set only (RFC 8617 section
+	// 5.1.1).
+	var sets []arcSet
+	if cv != ARCFail {
+		sets, _, _ = arcSets(h)
+	}
+	sets = append(sets, arcSet{
+		aar:  headerField{name: "ARC-Authentication-Results", raw: aar},
+		ams:  headerField{name: "ARC-Message-Signature", raw: ams},
+		seal: headerField{name: "ARC-Seal", raw: seal},
+	})
+	sig, err = signDigest(key, hashFunc, arcSealHash(sets))
+	if err != nil {
+		return "", err
+	}
+
+	return seal + sig + "\r\n" + ams + aar, nil
+}
+
+// authResults gives the results for ARC-Authentication-Results: the status of
+// the chain, and what a DMARCChecker before the seal found.
+func (a *ARCChecker) authResults(ctx context.Context, i string, cv ARCChainStatus) []string {
+	results := []string{i, a.authServID, "arc=" + string(cv)}
+
+	dmarc, ok := DMARCResultFromContext(ctx)
+	if !ok || dmarc.Record == nil {
+		return results
+	}
+
+	if dmarc.SPF != "" {
+		results = append(results, "spf="+string(dmarc.SPF)+" smtp.mailfrom="+dmarc.EnvelopeFrom)
+	}
+	for _, r := range dmarc.DKIM {
+		results = append(results, "dkim="+string(r.Status)+" header.d="+r.Domain+" header.s="+r.Selector)
+	}
+	status := "fail"
+	if dmarc.Pass() {
+		status = "pass"
+	}
+	return append(results, "dmarc="+status+" header.from="+dmarc.HeaderFrom)
+}
+
+// arcSet is the three fields of one instance of an ARC chain.
+type arcSet struct {
+	aar, ams, seal headerField
+}
+
+// arcSets gives the sets of the chain of h, in the order of their instances,
+// and the highest instance that its fields name. The chain must run from 1
+// without a gap, with one field of each kind per instance. A chain that does
+// not gives the highest instance with the error, so that a sealer adds its
+// set above it.
+func arcSets(h header) ([]arcSet, int, error) {
+	byInstance := make(map[int]*arcSet)
+	highest := 0
+	var firstErr error
+
+	for _, f := range h {
+		var slot func(*arcSet) *headerField
+		switch {
+		case strings.EqualFold(f.name, "ARC-Authentication-Results"):
+			slot = func(s *arcSet) *headerField { return &s.aar }
+		case strings.EqualFold(f.name, "ARC-Message-Signature"):
+			slot = func(s *arcSet) *headerField { return &s.ams }
+		case strings.EqualFold(f.name, "ARC-Seal"):
+			slot = func(s *arcSet) *headerField { return &s.seal }
+		default:
+			continue
+		}
+
+		instance, err := arcInstance(f)
+		if err != nil {
+			firstErr = cmp.Or(firstErr, err)
+			continue
+		}
+		highest = max(highest, instance)
+		set := byInstance[instance]
+		if set == nil {
+			set = &arcSet{}
+			byInstance[instance] = set
+		}
+		field := slot(set)
+		if field.name != "" {
+			firstErr = cmp.Or(firstErr, fmt.Errorf("instance %d has two %s fields", instance, f.name))
+			continue
+		}
+		*field = f
+	}
+	if firstErr != nil {
+		return nil, highest, firstErr
+	}
+
+	sets := make([]arcSet, highest)
+	for i := range sets {
+		set := byInstance[i+1]
+		if set == nil || set.aar.name == "" || set.ams.name == "" || set.seal.name == "" {
+			return nil, highest, fmt.Errorf("instance %d is incomplete", i+1)
+		}
+		sets[i] = *set
+	}
+	return sets, highest, nil
+}
+
+// arcInstance reads the i= tag of an ARC field. It is the first item of
+// ARC-Authentication-Results, and a tag anywhere in the other two.
+func arcInstance(f headerField) (int, error) {
+	value := f.value()
+	if strings.EqualFold(f.name, "ARC-Authentication-Results") {
+		value, _, _ = strings.Cut(value, ";")
+	}
+	tags, err := parseTagList(value)
+	if err != nil {
+		return 0, err
+	}
+	instance, err := strconv.Atoi(tags["i"])
+	if err != nil || instance < 1 || instance > maxARCInstances {
+		return 0, fmt.Errorf("the %s field has the instance %q", f.name, tags["i"])
+	}
+	return instance, nil
+}
+
+// verifyARC validates the chain of a spooled message, by the steps of RFC
+// 8617 section 5.2.
+func verifyARC(ctx context.Context, resolver TXTResolver, h header, sp *spool.Spool, headerSize int64, now time.Time) ARCResult {
+	sets, highest, err := arcSets(h)
+	if err != nil {
+		return ARCResult{Status: ARCFail, Instances: highest, Err: err}
+	}
+	if len(sets) == 0 {
+		return ARCResult{Status: ARCNone}
+	}
+	fail := func(err error) ARCResult {
+		return ARCResult{Status: ARCFail, Instances: len(sets), Err: err}
+	}
+
+	seals := make([]map[string]string, len(sets))
+	for i, set := range sets {
+		tags, err := parseTagList(set.seal.value())
+		if err != nil {
+			return fail(err)
+		}
+		seals[i] = tags
+
+		want := "pass"
+		if i == 0 {
+			want = "none"
+		}
+		switch cv := tags["cv"]; {
+		case cv == "fail" && i == len(sets)-1:
+			return fail(errARCFailed)
+		case cv != want:
+			return fail(fmt.Errorf("the seal of instance %d has cv=%s", i+1, cv))
+		}
+	}
+
+	// The latest message signature must verify. The older ones broke when
+	// a sealer changed the message, which the chain allows.
+	latest := sets[len(sets)-1].ams
+	tags, err := parseTagList(latest.value())
+	if err != nil {
+		return fail(err)
+	}
+	sig, err := parseSignature(tags)
+	if err != nil {
+		return fail(err)
+	}
+	if status, err := checkSignature(ctx, resolver, h, latest, sig, bodyHasher(sp, headerSize), now); status != DKIMPass {
+		return fail(fmt.Errorf("the message signature of instance %d: %w", len(sets), err))
+	}
+
+	for i := len(sets) - 1; i >= 0; i-- {
+		if err := verifySeal(ctx, resolver, sets[:i+1], seals[i]); err != nil {
+			return fail(fmt.Errorf("the seal of instance %d: %w", i+1, err))
+		}
+	}
+
+	return ARCResult{Status: ARCPass, Instances: len(sets)}
+}
+
+// verifySeal checks the ARC-Seal of the last of sets over all of them.
+func verifySeal(ctx context.Context, resolver TXTResolver, sets []arcSet, tags map[string]string) error {
+	for _, name := range []string{"a", "b", "d", "s"} {
+		if _, ok := tags[name]; !ok {
+			return fmt.Errorf("no %s= tag", name)
+		}
+	}
+	if _, ok := tags["h"]; ok {
+		return errors.New("an h= tag")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(stripFWS(tags["b"]))
+	if err != nil {
+		return fmt.Errorf("the b= tag: %w", err)
+	}
+
+	pub, _, err := lookupKey(ctx, resolver, tags["s"], strings.ToLower(tags["d"]))
+	if err != nil {
+		return err
+	}
+
+	sets = slices.Clone(sets)
+	last := &sets[len(sets)-1].seal
+	*last = headerField{name: last.name, raw: withoutSignature(strings.TrimSuffix(last.raw, "\r\n"))}
+
+	_, err = verifyDigest(pub, strings.ToLower(tags["a"]), arcSealHash(sets), sig)
+	return err
+}
+
+// arcSealHash gives the SHA-256 hash that an ARC-Seal signs: the sets in the
+// order of their instances, each with its results, its message signature and
+// its seal, in relaxed form (RFC 8617 section 5.1.1). The seal of the last
+// set carries an empty b= tag and no line break at its end.
+func arcSealHash(sets []arcSet) []byte {
+	hasher := sha256.New()
+	for i, set := range sets {
+		io.WriteString(hasher, canonicalizeHeader(set.aar.raw, DKIMRelaxed))
+		io.WriteString(hasher, canonicalizeHeader(set.ams.raw, DKIMRelaxed))
+
+		seal := canonicalizeHeader(strings.TrimSuffix(set.seal.raw, "\r\n")+"\r\n", DKIMRelaxed)
+		if i == len(sets)-1 {
+			seal = strings.TrimSuffix(seal, "\r\n")
+		}
+		io.WriteString(hasher, seal)
+	}
+	return hasher.Sum(nil)
+}
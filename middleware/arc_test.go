@@ -0,0 +1,213 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/chrj/smtpd/v2"
+)
+
+// arcHop runs a hop of ARC over msg: Verify, then change, then Seal. It
+// gives the message as the hop sends it on, and the context of the hop.
+func arcHop(t *testing.T, a *ARCChecker, msg string, change func(string) string) (string, context.Context) {
+	t.Helper()
+
+	ctx := context.Background()
+	peer := smtpd.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("1.2.3.4")}}
+	env := &smtpd.Envelope{Sender: "list@example.org", Data: io.NopCloser(strings.NewReader(msg))}
+
+	ctx, err := a.Verify(ctx, peer, env)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	if change != nil {
+		b, err := io.ReadAll(env.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = env.Data.Close()
+		env.Data = io.NopCloser(strings.NewReader(change(string(b))))
+	}
+
+	if ctx, err = a.Seal(ctx, peer, env); err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+
+	out, err := io.ReadAll(env.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Data.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return string(out), ctx
+}
+
+// arcNetwork gives two forwarders with keys of their own, and the resolver
+// that publishes the keys.
+func arcNetwork(t *testing.T) (first, second *ARCChecker, resolver *dmarcResolver) {
+	t.Helper()
+
+	k1 := newEd25519Key(t, "arc")
+	k2 := newEd25519Key(t, "seal")
+	resolver = &dmarcResolver{mockSPFResolver: mockSPFResolver{results: map[string][]string{
+		"arc._domainkey.one.example":  {dkimKeyRecord(t, k1)},
+		"seal._domainkey.two.example": {dkimKeyRecord(t, k2)},
+	}}}
+
+	first = ARC(WithARCResolver(resolver), WithARCSeal("one.example", DKIMKeyMap{"one.example": {k1}}))
+	second = ARC(WithARCResolver(resolver), WithARCSeal("two.example", DKIMKeyMap{"two.example": {k2}}))
+	return first, second, resolver
+}
+
+func verifyARCString(t *testing.T, resolver TXTResolver, msg string) ARCResult {
+	t.Helper()
+
+	result, err := VerifyARC(context.Background(), resolver, strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestARCChain(t *testing.T) {
+	t.Parallel()
+
+	first, second, resolver := arcNetwork(t)
+
+	if got := verifyARCString(t, resolver, dmarcMessage); got.Status != ARCNone {
+		t.Errorf("unsealed message: %+v, want none", got)
+	}
+
+	hop1, ctx := arcHop(t, first, dmarcMessage, nil)
+	if r, ok := ARCResultFromContext(ctx); !ok || r.Status != ARCNone {
+		t.Errorf("first hop saw %+v, want none", r)
+	}
+	if !strings.Contains(hop1, "cv=none") || !strings.Contains(hop1, "arc=none") {
+		t.Errorf("first set:\n%s", hop1)
+	}
+	if got := verifyARCString(t, resolver, hop1); got.Status != ARCPass || got.Instances != 1 {
+		t.Fatalf("after one hop: %+v, want pass", got)
+	}
+
+	// The second hop is a mailing list that adds a footer, which breaks
+	// the first message signature but not the chain.
+	footer := func(msg string) string { return msg + "-- \r\nThe list\r\n" }
+	hop2, ctx := arcHop(t, second, hop1, footer)
+	if r, ok := ARCResultFromContext(ctx); !ok || r.Status != ARCPass {
+		t.Errorf("second hop saw %+v, want pass", r)
+	}
+	if got := verifyARCString(t, resolver, hop2); got.Status != ARCPass || got.Instances != 2 {
+		t.Fatalf("after two hops: %+v, want pass", got)
+	}
+
+	if got := verifyARCString(t, resolver, hop2+"tampered\r\n"); got.Status != ARCFail {
+		t.Errorf("changed after the last seal: %+v, want fail", got)
+	}
+	if got := verifyARCString(t, resolver, strings.Replace(hop2, "cv=none", "cv=pass", 1)); got.Status != ARCFail {
+		t.Errorf("changed seal: %+v, want fail", got)
+	}
+}
+
+func TestARCFailedChain(t *testing.T) {
+	t.Parallel()
+
+	first, second, resolver := arcNetwork(t)
+
+	hop1, _ := arcHop(t, first, dmarcMessage, nil)
+	tampered := strings.Replace(hop1, "Hi Bob.", "Hi Eve.", 1)
+
+	// A sealer that finds the chain broken seals that.
+	hop2, ctx := arcHop(t, second, tampered, nil)
+	if r, _ := ARCResultFromContext(ctx); r.Status != ARCFail {
+		t.Errorf("second hop saw %+v, want fail", r)
+	}
+	if !strings.Contains(hop2, "cv=fail") {
+		t.Errorf("second set:\n%s", hop2)
+	}
+	got := verifyARCString(t, resolver, hop2)
+	if got.Status != ARCFail || !errors.Is(got.Err, errARCFailed) {
+		t.Errorf("after the failed seal: %+v, want fail", got)
+	}
+
+	// And no sealer after it adds to the chain.
+	hop3, _ := arcHop(t, first, hop2, nil)
+	if hop3 != hop2 {
+		t.Error("a sealer added to a failed chain")
+	}
+}
+
+func TestARCIncompleteChain(t *testing.T) {
+	t.Parallel()
+
+	first, second, resolver := arcNetwork(t)
+	hop1, _ := arcHop(t, first, dmarcMessage, nil)
+
+	var lines []string
+	for line := range strings.SplitSeq(hop1, "\r\n") {
+		if !strings.HasPrefix(line, "ARC-Authentication-Results:") {
+			lines = append(lines, line)
+		}
+	}
+	incomplete := strings.Join(lines, "\r\n")
+	if got := verifyARCString(t, resolver, incomplete); got.Status != ARCFail || got.Instances != 1 {
+		t.Errorf("set without results: %+v, want fail at instance 1", got)
+	}
+
+	// A sealer adds its set above the incomplete one, as a failed chain,
+	// and not a second instance 1 that claims there was no chain.
+	hop2, _ := arcHop(t, second, incomplete, nil)
+	added := strings.TrimSuffix(hop2, incomplete)
+	if !strings.Contains(added, "ARC-Seal: i=2;") || !strings.Contains(added, "cv=fail") {
+		t.Errorf("set over an incomplete chain:\n%s", added)
+	}
+	if got := strings.Count(hop2, "ARC-Seal: i=1;"); got != 1 {
+		t.Errorf("the message has %d seals of instance 1, want 1", got)
+	}
+}
+
+func TestARCSealerRecordsDMARC(t *testing.T) {
+	t.Parallel()
+
+	first, _, resolver := arcNetwork(t)
+	resolver.results["_dmarc.example.com"] = []string{"v=DMARC1; p=none"}
+
+	ctx := context.Background()
+	peer := smtpd.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("1.2.3.4")}}
+	env := &smtpd.Envelope{Sender: "alice@example.com", Data: io.NopCloser(strings.NewReader(dmarcMessage))}
+
+	ctx, err := DMARC(WithDMARCResolver(resolver)).Handler(ctx, peer, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.Seal(ctx, peer, env); err != nil {
+		t.Fatal(err)
+	}
+	out, _ := io.ReadAll(env.Data)
+	_ = env.Data.Close()
+
+	h, _, _, err := readHeader(strings.NewReader(string(out)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aar := h.get("ARC-Authentication-Results")
+	for _, want := range []string{"i=1", "one.example", "arc=none", "spf=none smtp.mailfrom=example.com", "dmarc=fail header.from=example.com"} {
+		if !strings.Contains(aar, want) {
+			t.Errorf("ARC-Authentication-Results %q lacks %q", aar, want)
+		}
+	}
+}
+
+func TestARCWithoutKey(t *testing.T) {
+	t.Parallel()
+
+	a := ARC(WithARCResolver(&mockSPFResolver{}), WithARCSeal("one.example", DKIMKeyMap{}))
+	if out, _ := arcHop(t, a, dmarcMessage, nil); out != dmarcMessage {
+		t.Errorf("a sealer without a key changed the message to %q", out)
+	}
+}
@@ -0,0 +1,312 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chrj/smtpd/v2"
+)
+
+var (
+	errAuthLocked  = smtpd.Error{Code: 454, Enhanced: smtpd.EnhancedCode{4, 7, 0}, Message: "Too many authentication failures, try again later"}
+	errAuthTooMany = smtpd.Error{Code: 421, Enhanced: smtpd.EnhancedCode{4, 7, 0}, Message: "Too many authentication failures, closing connection"}
+)
+
+// AuthLimiter holds back clients that guess passwords. It counts the failed
+// AUTH commands of each IP address and of each user name, across
+// connections:
+//
+//   - Each failure waits before its reply, a step longer for each failure of
+//     the IP address, up to a cap.
+//   - An IP address or a user name that fails too often within the window is
+//     locked out for a while. Every AUTH command of a locked IP address, and
+//     every one for a locked user, gets 454 4.7.0 without a look at the
+//     password, so guessing on goes nowhere.
+//   - A session that fails too often gets 421 4.7.0, and the server closes
+//     the connection.
+//
+// A lockout goes to the log of the session. A successful AUTH clears the
+// failures of the user, but not those of the IP address.
+//
+// The lockout of a user name holds for every client, so a client that knows
+// a name can lock its owner out. Leave it off with WithAuthUserLimit(0) where
+// that matters more than guesses spread over many addresses.
+//
+// Wrap the AuthFunc that checks the credentials:
+//
+//	limiter := middleware.AuthLimit()
+//	srv.Use(limiter.Authenticator(users.Authenticate))
+type AuthLimiter struct {
+	ipLimit      int
+	userLimit    int
+	sessionLimit int
+	window       time.Duration
+	lockout      time.Duration
+	delayStep    time.Duration
+	delayMax     time.Duration
+	maxEntries   int
+	now          func() time.Time
+	sleep        func(ctx context.Context, d time.Duration)
+
+	mu        sync.Mutex
+	entries   map[string]*authFailures
+	nextSweep time.Time
+}
+
+// authFailures counts the failures of an IP address or a user name.
+type authFailures struct {
+	count       int
+	first       time.Time
+	lockedUntil time.Time
+}
+
+// AuthLimitOption configures an AuthLimiter at construction time. Pass
+// options to AuthLimit.
+type AuthLimitOption func(*AuthLimiter)
+
+// WithAuthIPLimit sets how many failures of an IP address within the window
+// lock it out. Default 10; zero counts none.
+func WithAuthIPLimit(n int) AuthLimitOption {
+	return func(l *AuthLimiter) { l.ipLimit = n }
+}
+
+// WithAuthUserLimit sets how many failures for a user name within the window
+// lock it out. Default 5; zero counts none.
+func WithAuthUserLimit(n int) AuthLimitOption {
+	return func(l *AuthLimiter) { l.userLimit = n }
+}
+
+// WithAuthSessionLimit sets how many failures in one session close it.
+// Default 3; zero counts none.
+func WithAuthSessionLimit(n int) AuthLimitOption {
+	return func(l *AuthLimiter) { l.sessionLimit = n }
+}
+
+// WithAuthLockout sets the window in which failures count toward a lockout,
+// and how long the lockout lasts. Default 15 minutes each.
+func WithAuthLockout(window, lockout time.Duration) AuthLimitOption {
+	return func(l *AuthLimiter) { l.window, l.lockout = window, lockout }
+}
+
+// WithAuthDelay sets the wait before the reply to a failure: step for each
+// failure of the IP address in the window, up to max. Default 1 second and 5
+// seconds; a zero step waits not at all.
+func WithAuthDelay(step, max time.Duration) AuthLimitOption {
+	return func(l *AuthLimiter) { l.delayStep, l.delayMax = step, max }
+}
+
+// withAuthLimitClock is a test hook for overriding time.Now and the wait.
+func withAuthLimitClock(now func() time.Time, sleep func(context.Context, time.Duration)) AuthLimitOption {
+	return func(l *AuthLimiter) { l.now, l.sleep = now, sleep }
+}
+
+// defaultAuthLimitMaxEntries caps the addresses and names that the limiter
+// counts, in the same way as the cap of Greylist.
+const defaultAuthLimitMaxEntries = 100_000
+
+// AuthLimit constructs an AuthLimiter with sensible defaults. The returned
+// value is safe for concurrent use.
+func AuthLimit(opts ...AuthLimitOption) *AuthLimiter {
+	l := &AuthLimiter{
+		ipLimit:      10,
+		userLimit:    5,
+		sessionLimit: 3,
+		window:       15 * time.Minute,
+		lockout:      15 * time.Minute,
+		delayStep:    time.Second,
+		delayMax:     5 * time.Second,
+		maxEntries:   defaultAuthLimitMaxEntries,
+		now:          time.Now,
+		sleep:        sleepContext,
+		entries:      make(map[string]*authFailures),
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// authSessionKey holds the failures of the session in its context.
+type authSessionKey struct{}
+
+// Authenticator returns a Middleware whose Authenticate hook runs fn under
+// the limits of l. It takes the place of Authenticator(fn).
+func (l *AuthLimiter) Authenticator(fn AuthFunc) smtpd.Middleware {
+	return smtpd.Middleware{
+		Authenticate: func(ctx context.Context, peer smtpd.Peer, user, pass string) (context.Context, error) {
+			ip := ""
+			if tcpAddr, ok := peer.Addr.(*net.TCPAddr); ok {
+				ip = tcpAddr.IP.String()
+			}
+			name := strings.ToLower(user)
+
+			if l.locked(ip, name) {
+				return l.fail(ctx, ip, errAuthLocked)
+			}
+
+			err := fn(ctx, peer, user, pass)
+			if err == nil {
+				l.forget("user:" + name)
+				return ctx, nil
+			}
+
+			l.record(ctx, ip, name)
+			return l.fail(ctx, ip, err)
+		},
+	}
+}
+
+// fail counts a failure of the session, and waits before it answers with
+// err. The failure that reaches the limit of the session closes it.
+func (l *AuthLimiter) fail(ctx context.Context, ip string, err error) (context.Context, error) {
+	n, _ := ctx.Value(authSessionKey{}).(int)
+	n++
+	ctx = context.WithValue(ctx, authSessionKey{}, n)
+
+	l.sleep(ctx, l.delay(ip))
+
+	if l.sessionLimit > 0 && n >= l.sessionLimit {
+		smtpd.LoggerFromContext(ctx).WarnContext(ctx, "closing a session after authentication failures",
+			slog.String("ip", ip), slog.Int("failures", n))
+		return ctx, errAuthTooMany
+	}
+	return ctx, err
+}
+
+// delay gives the wait before the reply to a failure of ip. A locked IP
+// address waits the longest.
+func (l *AuthLimiter) delay(ip string) time.Duration {
+	if l.delayStep <= 0 {
+		return 0
+	}
+
+	now := l.now()
+	l.mu.Lock()
+	f := l.entries["ip:"+ip]
+	n, locked := 1, false
+	if f != nil {
+		n, locked = max(f.count, 1), now.Before(f.lockedUntil)
+	}
+	l.mu.Unlock()
+
+	if locked {
+		return l.delayMax
+	}
+	return min(time.Duration(n)*l.delayStep, l.delayMax)
+}
+
+// locked reports whether ip or user is locked out.
+func (l *AuthLimiter) locked(ip, user string) bool {
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, key := range []string{"ip:" + ip, "user:" + user} {
+		if f := l.entries[key]; f != nil && now.Before(f.lockedUntil) {
+			return true
+		}
+	}
+	return false
+}
+
+// record counts a failure of ip and of user, and locks out each of the two
+// that reached its limit.
+func (l *AuthLimiter) record(ctx context.Context, ip, user string) {
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.maybeSweep(now)
+
+	if ip != "" && l.ipLimit > 0 {
+		l.count(ctx, now, "ip:"+ip, l.ipLimit, slog.String("ip", ip))
+	}
+	if l.userLimit > 0 {
+		l.count(ctx, now, "user:"+user, l.userLimit, slog.String("user", user))
+	}
+}
+
+func (l *AuthLimiter) count(ctx context.Context, now time.Time, key string, limit int, attr slog.Attr) {
+	f := l.entries[key]
+	if f == nil || now.Sub(f.first) > l.window {
+		f = &authFailures{first: now, lockedUntil: timeOf(f)}
+		l.entries[key] = f
+	}
+	f.count++
+
+	if f.count >= limit {
+		f.count, f.first = 0, now
+		f.lockedUntil = now.Add(l.lockout)
+		smtpd.LoggerFromContext(ctx).WarnContext(ctx, "authentication lockout",
+			attr, slog.Duration("duration", l.lockout))
+	}
+}
+
+// timeOf gives the end of the lockout of f, or the zero time for none.
+func timeOf(f *authFailures) time.Time {
+	if f == nil {
+		return time.Time{}
+	}
+	return f.lockedUntil
+}
+
+// forget drops the failures of key.
+func (l *AuthLimiter) forget(key string) {
+	l.mu.Lock()
+	delete(l.entries, key)
+	l.mu.Unlock()
+}
+
+// maybeSweep drops the entries whose window and lockout have both passed. It
+// runs once a minute, and as soon as the map reaches the cap. When the map is
+// still at the cap afterwards, it drops the oldest entries down to nine
+// tenths of it. That forgets some failures, and never locks anyone out.
+func (l *AuthLimiter) maybeSweep(now time.Time) {
+	if now.Before(l.nextSweep) && len(l.entries) < l.maxEntries {
+		return
+	}
+	l.nextSweep = now.Add(time.Minute)
+
+	for k, f := range l.entries {
+		if now.Sub(f.first) > l.window && !now.Before(f.lockedUntil) {
+			delete(l.entries, k)
+		}
+	}
+	if len(l.entries) < l.maxEntries {
+		return
+	}
+
+	firsts := make([]time.Time, 0, len(l.entries))
+	for _, f := range l.entries {
+		firsts = append(firsts, f.first)
+	}
+	slices.SortFunc(firsts, func(a, b time.Time) int { return a.Compare(b) })
+
+	keep := min(max(l.maxEntries*9/10, 1), len(firsts))
+	cut := firsts[len(firsts)-keep]
+	for k, f := range l.entries {
+		if !f.first.After(cut) {
+			delete(l.entries, k)
+		}
+	}
+}
+
+// sleepContext waits for d, or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
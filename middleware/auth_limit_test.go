@@ -0,0 +1,199 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chrj/smtpd/v2"
+)
+
+// authClock is the clock of an AuthLimiter under test. It records each wait
+// in the place of waiting.
+type authClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func (c *authClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *authClock) Sleep(_ context.Context, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sleeps = append(c.sleeps, d)
+}
+
+func (c *authClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// checkPassword is an AuthFunc that takes "secret" for every user.
+func checkPassword(_ context.Context, _ smtpd.Peer, _, pass string) error {
+	if pass != "secret" {
+		return errAuthInvalid
+	}
+	return nil
+}
+
+func peerAt(ip string) smtpd.Peer {
+	return smtpd.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 25}}
+}
+
+// authAs runs the Authenticate hook of mw in a session of its own.
+func authAs(mw smtpd.Middleware, ip, user, pass string) error {
+	_, err := mw.Authenticate(context.Background(), peerAt(ip), user, pass)
+	return err
+}
+
+func TestAuthLimitIP(t *testing.T) {
+	t.Parallel()
+
+	clock := &authClock{now: time.Unix(1_000_000, 0)}
+	mw := AuthLimit(
+		WithAuthIPLimit(3), WithAuthUserLimit(0), WithAuthSessionLimit(0),
+		WithAuthLockout(time.Minute, 10*time.Minute),
+		withAuthLimitClock(clock.Now, clock.Sleep),
+	).Authenticator(checkPassword)
+
+	for _, user := range []string{"alice", "bob", "carol"} {
+		if err := authAs(mw, "192.0.2.1", user, "wrong"); !errors.Is(err, errAuthInvalid) {
+			t.Fatalf("%s: %v, want %v", user, err, errAuthInvalid)
+		}
+	}
+
+	// Locked: the right password does not help, and another address is not
+	// locked.
+	if err := authAs(mw, "192.0.2.1", "alice", "secret"); !errors.Is(err, errAuthLocked) {
+		t.Errorf("a locked address: %v, want %v", err, errAuthLocked)
+	}
+	if err := authAs(mw, "192.0.2.2", "alice", "secret"); err != nil {
+		t.Errorf("another address: %v", err)
+	}
+
+	clock.Advance(10 * time.Minute)
+	if err := authAs(mw, "192.0.2.1", "alice", "secret"); err != nil {
+		t.Errorf("after the lockout: %v", err)
+	}
+}
+
+func TestAuthLimitWindow(t *testing.T) {
+	t.Parallel()
+
+	clock := &authClock{now: time.Unix(1_000_000, 0)}
+	mw := AuthLimit(
+		WithAuthIPLimit(2), WithAuthUserLimit(0), WithAuthSessionLimit(0),
+		WithAuthLockout(time.Minute, 10*time.Minute),
+		withAuthLimitClock(clock.Now, clock.Sleep),
+	).Authenticator(checkPassword)
+
+	// Failures further apart than the window do not add up.
+	for range 3 {
+		_ = authAs(mw, "192.0.2.1", "alice", "wrong")
+		clock.Advance(2 * time.Minute)
+	}
+	if err := authAs(mw, "192.0.2.1", "alice", "secret"); err != nil {
+		t.Errorf("failures outside the window locked the address: %v", err)
+	}
+}
+
+func TestAuthLimitUser(t *testing.T) {
+	t.Parallel()
+
+	clock := &authClock{now: time.Unix(1_000_000, 0)}
+	mw := AuthLimit(
+		WithAuthIPLimit(0), WithAuthUserLimit(2), WithAuthSessionLimit(0),
+		withAuthLimitClock(clock.Now, clock.Sleep),
+	).Authenticator(checkPassword)
+
+	// A success clears the failures of the user.
+	_ = authAs(mw, "192.0.2.1", "alice", "wrong")
+	if err := authAs(mw, "192.0.2.1", "alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Guesses spread over addresses, and over the case of the name.
+	_ = authAs(mw, "192.0.2.1", "alice", "wrong")
+	_ = authAs(mw, "192.0.2.2", "Alice", "wrong")
+	if err := authAs(mw, "192.0.2.3", "alice", "secret"); !errors.Is(err, errAuthLocked) {
+		t.Errorf("a locked user: %v, want %v", err, errAuthLocked)
+	}
+	if err := authAs(mw, "192.0.2.1", "bob", "secret"); err != nil {
+		t.Errorf("another user: %v", err)
+	}
+}
+
+func TestAuthLimitSession(t *testing.T) {
+	t.Parallel()
+
+	clock := &authClock{now: time.Unix(1_000_000, 0)}
+	mw := AuthLimit(WithAuthSessionLimit(3), withAuthLimitClock(clock.Now, clock.Sleep)).Authenticator(checkPassword)
+
+	// The session threads its context from one command to the next.
+	ctx := context.Background()
+	var errs []error
+	for range 3 {
+		var err error
+		ctx, err = mw.Authenticate(ctx, peerAt("192.0.2.1"), "alice", "wrong")
+		errs = append(errs, err)
+	}
+
+	want := []error{errAuthInvalid, errAuthInvalid, errAuthTooMany}
+	for i := range want {
+		if !errors.Is(errs[i], want[i]) {
+			t.Errorf("failure %d: %v, want %v", i+1, errs[i], want[i])
+		}
+	}
+}
+
+func TestAuthLimitDelay(t *testing.T) {
+	t.Parallel()
+
+	clock := &authClock{now: time.Unix(1_000_000, 0)}
+	mw := AuthLimit(
+		WithAuthIPLimit(4), WithAuthUserLimit(0), WithAuthSessionLimit(0),
+		WithAuthDelay(time.Second, 3*time.Second),
+		withAuthLimitClock(clock.Now, clock.Sleep),
+	).Authenticator(checkPassword)
+
+	for range 3 {
+		_ = authAs(mw, "192.0.2.1", "alice", "wrong")
+	}
+	_ = authAs(mw, "192.0.2.1", "alice", "secret")
+	_ = authAs(mw, "192.0.2.1", "alice", "wrong")
+	_ = authAs(mw, "192.0.2.1", "alice", "secret")
+
+	// One step more for each failure, up to the cap, and the cap for every
+	// command of an address under a lockout. The success waits not at all.
+	want := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second, 3 * time.Second}
+	if !reflect.DeepEqual(clock.sleeps, want) {
+		t.Errorf("waits = %v, want %v", clock.sleeps, want)
+	}
+}
+
+func TestAuthLimitSweep(t *testing.T) {
+	t.Parallel()
+
+	clock := &authClock{now: time.Unix(1_000_000, 0)}
+	l := AuthLimit(WithAuthUserLimit(0), withAuthLimitClock(clock.Now, clock.Sleep))
+	l.maxEntries = 10
+	mw := l.Authenticator(checkPassword)
+
+	for i := range 50 {
+		_ = authAs(mw, net.IPv4(192, 0, 2, byte(i)).String(), "alice", "wrong")
+		clock.Advance(time.Second)
+	}
+	if n := len(l.entries); n > l.maxEntries {
+		t.Errorf("the limiter holds %d entries, over the cap of %d", n, l.maxEntries)
+	}
+}
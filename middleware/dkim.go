@@ -0,0 +1,535 @@
+package middleware
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chrj/smtpd/v2"
+	"github.com/chrj/smtpd/v2/internal/spool"
+)
+
+// DKIMKey is one key that a DKIMSigner signs with. Signer holds the private
+// key: an *rsa.PrivateKey gives a signature of rsa-sha256, and an
+// ed25519.PrivateKey one of ed25519-sha256 (RFC 8463). Selector names the
+// record under _domainkey where the public key stands.
+type DKIMKey struct {
+	Selector string
+	Signer   crypto.Signer
+}
+
+// DKIMKeyStore gives the keys that a DKIMSigner signs the mail of a domain
+// with. domain is in lower case.
+//
+// Each key gives the message a signature of its own, so a store that gives
+// an RSA key and an Ed25519 key signs with both, and a receiver that knows
+// only RSA still finds a signature that it reads. A store that gives no key
+// leaves the mail of the domain unsigned. An error fails the message with a
+// temporary error, so the client tries again.
+type DKIMKeyStore interface {
+	DKIMKeys(ctx context.Context, domain string) ([]DKIMKey, error)
+}
+
+// DKIMKeyMap is a DKIMKeyStore that holds the keys in memory. The map is keyed
+// by domain in lower case.
+type DKIMKeyMap map[string][]DKIMKey
+
+// DKIMKeys gives the keys of domain.
+func (m DKIMKeyMap) DKIMKeys(_ context.Context, domain string) ([]DKIMKey, error) {
+	return m[domain], nil
+}
+
+// DKIMCanonicalization is a canonicalization algorithm of RFC 6376 section
+// 3.4.
+type DKIMCanonicalization string
+
+const (
+	// DKIMSimple tolerates almost no change to the message on the way.
+	DKIMSimple DKIMCanonicalization = "simple"
+
+	// DKIMRelaxed tolerates the changes that relays commonly make, such as
+	// a header that they fold again and white space at the end of a line.
+	DKIMRelaxed DKIMCanonicalization = "relaxed"
+)
+
+// defaultDKIMHeaders is the list of header fields that RFC 6376 section 5.4.1
+// recommends to sign.
+var defaultDKIMHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc",
+	"Resent-Date", "Resent-From", "Resent-To", "Resent-Cc",
+	"In-Reply-To", "References",
+	"List-Id", "List-Help", "List-Unsubscribe", "List-Subscribe",
+	"List-Post", "List-Owner", "List-Archive",
+	"Message-ID", "Content-Type", "Content-Transfer-Encoding", "MIME-Version",
+}
+
+// defaultDKIMOversign is the list of header fields that a DKIMSigner signs
+// once more than the message carries them. A receiver that reads the message
+// shows these to the user.
+var defaultDKIMOversign = []string{"From", "Subject", "Date", "To", "Cc", "Reply-To"}
+
+// DKIMSigner signs a message with DKIM (RFC 6376) for the domain of its
+// sender, at the Handler stage:
+//
+//	signer := middleware.DKIM(middleware.DKIMKeyMap{
+//	    "example.com": {
+//	        {Selector: "rsa2026", Signer: rsaKey},
+//	        {Selector: "ed2026", Signer: ed25519Key},
+//	    },
+//	})
+//	srv.Use(smtpd.Middleware{Handler: signer.Handler})
+//
+// A signature covers the body, so the signer reads the whole message before
+// it writes the first DKIM-Signature field. It keeps the message in memory up
+// to a threshold and in a temporary file past it, and env.Data then gives the
+// message from there. Closing env.Data removes the file, which the Envelope
+// asks of the delivery handler.
+//
+// Register it after every stage that changes the message, because a change
+// after the signature breaks it.
+type DKIMSigner struct {
+	keys        DKIMKeyStore
+	headers     []string
+	oversign    []string
+	headerCanon DKIMCanonicalization
+	bodyCanon   DKIMCanonicalization
+	expiry      time.Duration
+	spoolMemory int64
+	spoolDir    string
+	now         func() time.Time
+}
+
+// DKIMOption configures a DKIMSigner at construction time. Pass options to
+// DKIM.
+type DKIMOption func(*DKIMSigner)
+
+// WithDKIMHeaders sets the header fields to sign. A field that the message
+// carries more than once is signed each time it appears. From is always
+// signed, because RFC 6376 section 5.4 asks for it. The default is the list
+// of RFC 6376 section 5.4.1.
+func WithDKIMHeaders(names ...string) DKIMOption {
+	return func(d *DKIMSigner) { d.headers = names }
+}
+
+// WithDKIMOversign sets the header fields to sign once more than the message
+// carries them. The extra entry signs the absence of another such field, so
+// nobody on the way can add a second From or Subject that a reader shows in
+// the place of the signed one. The default is From, Subject, Date, To, Cc
+// and Reply-To. Call it with no names to sign each field only as often as it
+// appears.
+func WithDKIMOversign(names ...string) DKIMOption {
+	return func(d *DKIMSigner) { d.oversign = names }
+}
+
+// WithDKIMCanonicalization sets the canonicalization of the header and of the
+// body. The default is relaxed for both.
+func WithDKIMCanonicalization(header, body DKIMCanonicalization) DKIMOption {
+	return func(d *DKIMSigner) { d.headerCanon, d.bodyCanon = header, body }
+}
+
+// WithDKIMExpiry sets how long a signature stays valid, through the x= tag.
+// Zero, the default, writes no expiry.
+func WithDKIMExpiry(expiry time.Duration) DKIMOption {
+	return func(d *DKIMSigner) { d.expiry = expiry }
+}
+
+// WithDKIMSpool sets how much of a message the signer holds in memory, and
+// the directory of the temporary file that takes a message past that. The
+// defaults are 1MB and the directory of os.TempDir.
+func WithDKIMSpool(memory int64, dir string) DKIMOption {
+	return func(d *DKIMSigner) { d.spoolMemory, d.spoolDir = memory, dir }
+}
+
+// withDKIMClock is a test hook for overriding time.Now.
+func withDKIMClock(now func() time.Time) DKIMOption {
+	return func(d *DKIMSigner) { d.now = now }
+}
+
+// DKIM constructs a signer that takes its keys from keys.
+func DKIM(keys DKIMKeyStore, opts ...DKIMOption) *DKIMSigner {
+	d := &DKIMSigner{
+		keys:        keys,
+		headers:     defaultDKIMHeaders,
+		oversign:    defaultDKIMOversign,
+		headerCanon: DKIMRelaxed,
+		bodyCanon:   DKIMRelaxed,
+		spoolMemory: spool.DefaultMemory,
+		now:         time.Now,
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// errDKIMSign answers a message that the signer could not sign. The cause is
+// on the side of the server, so the client tries again.
+var errDKIMSign = smtpd.Error{Code: 451, Enhanced: smtpd.EnhancedCode{4, 3, 0}, Message: "Could not sign the message, try again later"}
+
+// Handler is an smtpd.Handler that signs env.Data. The domain is the one of
+// env.Sender, and the one of the header From for the null sender. A domain
+// that the store has no key for passes unsigned.
+func (d *DKIMSigner) Handler(ctx context.Context, peer smtpd.Peer, env *smtpd.Envelope) (context.Context, error) {
+	logger := smtpd.LoggerFromContext(ctx)
+
+	sp, err := spool.Read(env.Data, d.spoolMemory, d.spoolDir)
+	_ = env.Data.Close()
+	if err != nil {
+		return ctx, fmt.Errorf("middleware: spool the message from %v: %w", peer.Addr, err)
+	}
+
+	h, headerSize, eol, err := readHeader(sp.Section(0))
+	if err != nil {
+		_ = sp.Close()
+		return ctx, fmt.Errorf("middleware: read the header from %v: %w", peer.Addr, err)
+	}
+
+	domain := domainOf(env.Sender)
+	if domain == "" {
+		domain, _ = headerFromDomain(h)
+	}
+
+	var keys []DKIMKey
+	if domain != "" {
+		keys, err = d.keys.DKIMKeys(ctx, domain)
+		if err != nil {
+			_ = sp.Close()
+			logger.ErrorContext(ctx, "DKIM key lookup failed",
+				slog.String("domain", domain), slog.Any("error", err))
+			return ctx, errDKIMSign
+		}
+	}
+
+	if len(keys) == 0 {
+		env.Data = &spooledBody{Reader: sp.Section(0), spool: sp}
+		return ctx, nil
+	}
+
+	bodyHash, err := dkimBodyHash(sp.Section(headerSize), d.bodyCanon, -1)
+	if err != nil {
+		_ = sp.Close()
+		return ctx, fmt.Errorf("middleware: hash the body from %v: %w", peer.Addr, err)
+	}
+
+	signed := signedHeaders(h, d.headers, d.oversign)
+
+	var fields strings.Builder
+	for _, key := range keys {
+		field, err := d.sign(h, signed, domain, key, bodyHash)
+		if err != nil {
+			_ = sp.Close()
+			logger.ErrorContext(ctx, "DKIM signing failed",
+				slog.String("domain", domain),
+				slog.String("selector", key.Selector),
+				slog.Any("error", err))
+			return ctx, errDKIMSign
+		}
+		fields.WriteString(strings.ReplaceAll(field, "\r\n", eol))
+	}
+
+	env.Data = &spooledBody{
+		Reader: io.MultiReader(strings.NewReader(fields.String()), sp.Section(0)),
+		spool:  sp,
+	}
+	return ctx, nil
+}
+
+// signedHeaders gives the names for the h= tag: each field of headers as
+// often as the message carries it, and each field of oversign once more.
+// From always comes first.
+func signedHeaders(h header, headers, oversign []string) []string {
+	var names []string
+	seen := make(map[string]bool)
+
+	add := func(name string, extra bool) {
+		key := strings.ToLower(name)
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+
+		n := len(h.all(name))
+		if extra {
+			n++
+		}
+		for range n {
+			names = append(names, key)
+		}
+	}
+
+	extra := make(map[string]bool)
+	for _, name := range oversign {
+		extra[strings.ToLower(name)] = true
+	}
+
+	add("from", extra["from"])
+	for _, name := range headers {
+		add(name, extra[strings.ToLower(name)])
+	}
+	return names
+}
+
+// sign writes one DKIM-Signature field, with the line break at its end.
+func (d *DKIMSigner) sign(h header, signed []string, domain string, key DKIMKey, bodyHash []byte) (string, error) {
+	algorithm, hashFunc, err := dkimAlgorithm(key.Signer.Public())
+	if err != nil {
+		return "", err
+	}
+
+	now := d.now()
+	tags := []string{
+		"v=1",
+		"a=" + algorithm,
+		"c=" + string(d.headerCanon) + "/" + string(d.bodyCanon),
+		"d=" + domain,
+		"s=" + key.Selector,
+		"t=" + strconv.FormatInt(now.Unix(), 10),
+	}
+	if d.expiry > 0 {
+		tags = append(tags, "x="+strconv.FormatInt(now.Add(d.expiry).Unix(), 10))
+	}
+	tags = append(tags,
+		"h="+strings.Join(signed, ":"),
+		"bh="+base64.StdEncoding.EncodeToString(bodyHash),
+		"b=",
+	)
+
+	field := foldTags("DKIM-Signature", tags)
+
+	digest := dkimHeaderHash(h, signed, field, d.headerCanon)
+
+	sig, err := signDigest(key, hashFunc, digest)
+	if err != nil {
+		return "", err
+	}
+	return field + sig + "\r\n", nil
+}
+
+// signDigest signs a digest with key, and gives the signature folded for a
+// b= tag.
+func signDigest(key DKIMKey, hashFunc crypto.Hash, digest []byte) (string, error) {
+	sig, err := key.Signer.Sign(rand.Reader, digest, hashFunc)
+	if err != nil {
+		return "", err
+	}
+	return foldBase64(base64.StdEncoding.EncodeToString(sig)), nil
+}
+
+// dkimAlgorithm gives the a= tag for a public key, and the hash that the
+// signer takes: SHA-256 for RSA, and none for Ed25519, which RFC 8463 signs
+// the SHA-256 digest with as it is.
+func dkimAlgorithm(pub crypto.PublicKey) (string, crypto.Hash, error) {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return "rsa-sha256", crypto.SHA256, nil
+	case ed25519.PublicKey:
+		return "ed25519-sha256", 0, nil
+	}
+	return "", 0, fmt.Errorf("middleware: DKIM takes an RSA or an Ed25519 key, not %T", pub)
+}
+
+// headerFromDomain gives the domain of the header From. It reports false
+// when the field does not parse or does not name exactly one address.
+func headerFromDomain(h header) (string, bool) {
+	list, err := addressParser.ParseList(h.get("From"))
+	if err != nil || len(list) != 1 {
+		return "", false
+	}
+	return domainOf(list[0].Address), true
+}
+
+// foldTags writes a field of a tag list, such as DKIM-Signature, and folds it
+// before a line grows past 78 characters. The last tag is left open, for the
+// signature that follows it.
+func foldTags(name string, tags []string) string {
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteString(":")
+
+	line := len(name) + 1
+	for i, tag := range tags {
+		text := " " + tag
+		if i < len(tags)-1 {
+			text += ";"
+		}
+		if line+len(text) > 78 && line > len(name)+1 {
+			b.WriteString("\r\n\t")
+			text = text[1:]
+			line = 8
+		}
+		b.WriteString(text)
+		line += len(text)
+	}
+	return b.String()
+}
+
+// foldBase64 breaks a value of base64 into lines of 72 characters. The
+// folding white space inside a b= value is not part of the signature.
+func foldBase64(v string) string {
+	var b strings.Builder
+	for len(v) > 72 {
+		b.WriteString(v[:72])
+		b.WriteString("\r\n\t")
+		v = v[72:]
+	}
+	b.WriteString(v)
+	return b.String()
+}
+
+// dkimBodyHash gives the SHA-256 hash of the body, canonicalized. A limit of
+// zero or more hashes only that many octets of the canonical body, as the l=
+// tag asks, and a negative one hashes all of it.
+func dkimBodyHash(body io.Reader, canon DKIMCanonicalization, limit int64) ([]byte, error) {
+	hasher := sha256.New()
+	var out io.Writer = hasher
+	if limit >= 0 {
+		out = &limitWriter{w: hasher, n: limit}
+	}
+	w := &bodyCanonicalizer{w: out, relaxed: canon == DKIMRelaxed}
+	if _, err := io.Copy(w, body); err != nil {
+		return nil, err
+	}
+	w.finish()
+	return hasher.Sum(nil), nil
+}
+
+// dkimHeaderHash gives the SHA-256 hash of the signed header fields and of
+// the signature field itself, which ends in an empty b= tag and carries no
+// line break at its end (RFC 6376 section 3.7).
+//
+// A name in signed picks the fields of that name from the bottom of the
+// header up, and a name that has run out of fields adds nothing.
+func dkimHeaderHash(h header, signed []string, field string, canon DKIMCanonicalization) []byte {
+	hasher := sha256.New()
+
+	used := make(map[string]int)
+	for _, name := range signed {
+		key := strings.ToLower(name)
+		fields := h.all(name)
+		n := used[key]
+		used[key] = n + 1
+		if n >= len(fields) {
+			continue
+		}
+		io.WriteString(hasher, canonicalizeHeader(fields[len(fields)-1-n].raw, canon))
+	}
+
+	io.WriteString(hasher, strings.TrimSuffix(canonicalizeHeader(field+"\r\n", canon), "\r\n"))
+	return hasher.Sum(nil)
+}
+
+// canonicalizeHeader gives one field in the canonical form of RFC 6376
+// section 3.4.1 and 3.4.2. raw carries the field with its line break.
+func canonicalizeHeader(raw string, canon DKIMCanonicalization) string {
+	if canon != DKIMRelaxed {
+		return raw
+	}
+
+	name, value, _ := strings.Cut(raw, ":")
+	name = strings.ToLower(strings.TrimRight(name, " \t"))
+
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = strings.Join(strings.FieldsFunc(value, isWSP), " ")
+
+	return name + ":" + value + "\r\n"
+}
+
+// isWSP reports whether r is white space in the sense of RFC 5234.
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
+
+// bodyCanonicalizer writes a body in the canonical form of RFC 6376 section
+// 3.4.3 and 3.4.4. It reads a line break as either CRLF or a bare LF, because
+// a message that arrived through DATA gives its lines without the CR.
+//
+// Empty lines wait until a line with text follows them, because the empty
+// lines at the end of the body are not part of it.
+type bodyCanonicalizer struct {
+	w       io.Writer
+	relaxed bool
+
+	line    []byte
+	empty   int
+	written bool
+}
+
+func (c *bodyCanonicalizer) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if b == '\n' {
+			c.endLine()
+			continue
+		}
+		c.line = append(c.line, b)
+	}
+	return len(p), nil
+}
+
+func (c *bodyCanonicalizer) endLine() {
+	line := c.line
+	c.line = c.line[:0]
+
+	line = trimCR(line)
+	if c.relaxed {
+		line = relaxLine(line)
+	}
+
+	if len(line) == 0 {
+		c.empty++
+		return
+	}
+
+	for ; c.empty > 0; c.empty-- {
+		_, _ = c.w.Write([]byte("\r\n"))
+	}
+	_, _ = c.w.Write(line)
+	_, _ = c.w.Write([]byte("\r\n"))
+	c.written = true
+}
+
+// finish ends the body. A last line without a line break gets one, and the
+// simple algorithm writes one CRLF for an empty body.
+func (c *bodyCanonicalizer) finish() {
+	if len(c.line) > 0 {
+		c.endLine()
+	}
+	if !c.written && !c.relaxed {
+		_, _ = c.w.Write([]byte("\r\n"))
+	}
+}
+
+func trimCR(line []byte) []byte {
+	if n := len(line); n > 0 && line[n-1] == '\r' {
+		return line[:n-1]
+	}
+	return line
+}
+
+// relaxLine turns each run of white space into one space, and drops the white
+// space at the end of the line.
+func relaxLine(line []byte) []byte {
+	out := line[:0:0]
+	space := false
+	for _, b := range line {
+		if b == ' ' || b == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			out = append(out, ' ')
+			space = false
+		}
+		out = append(out, b)
+	}
+	return out
+}
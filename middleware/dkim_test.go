@@ -0,0 +1,431 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chrj/smtpd/v2"
+	"github.com/chrj/smtpd/v2/smtptest"
+)
+
+// rfc8463Message is the message of RFC 8463 appendix A.
+const rfc8463Message = "From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game.  Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+// rfc8463Key is the Ed25519 key of RFC 8463 appendix A.2.
+func rfc8463Key(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+
+	seed, err := base64.StdEncoding.DecodeString("nWGxne/9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ed25519.NewKeyFromSeed(seed)
+}
+
+// TestDKIMCanonicalizationRFC8463 checks the canonicalization against the
+// signature of RFC 8463 appendix A.3, which a signer of another code base
+// made.
+func TestDKIMCanonicalizationRFC8463(t *testing.T) {
+	t.Parallel()
+
+	h, size, _, err := readHeader(strings.NewReader(rfc8463Message))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bh, err := dkimBodyHash(strings.NewReader(rfc8463Message[size:]), DKIMRelaxed, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := base64.StdEncoding.EncodeToString(bh), "2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8="; got != want {
+		t.Errorf("body hash = %s, want %s", got, want)
+	}
+
+	field := "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+		" d=football.example.com; i=@football.example.com;\r\n" +
+		" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+		" subject : date : message-id : from : subject : date;\r\n" +
+		" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+		" b="
+	signed := []string{"from", "to", "subject", "date", "message-id", "from", "subject", "date"}
+	sig, _ := base64.StdEncoding.DecodeString("/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11BusFa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==")
+
+	digest := dkimHeaderHash(h, signed, field, DKIMRelaxed)
+	if !ed25519.Verify(rfc8463Key(t).Public().(ed25519.PublicKey), digest, sig) {
+		t.Error("the signature of RFC 8463 does not verify over the canonical header")
+	}
+}
+
+// signMessage runs the Handler of d over msg and gives what env.Data holds
+// after it.
+func signMessage(t *testing.T, d *DKIMSigner, sender, msg string) string {
+	t.Helper()
+
+	env := &smtpd.Envelope{Sender: sender, Data: io.NopCloser(strings.NewReader(msg))}
+	if _, err := d.Handler(context.Background(), smtpd.Peer{}, env); err != nil {
+		t.Fatalf("Handler: %v", err)
+	}
+
+	out, err := io.ReadAll(env.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Data.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+// dkimTags reads the tag list of a DKIM-Signature field.
+func dkimTags(t *testing.T, f headerField) map[string]string {
+	t.Helper()
+
+	tags := make(map[string]string)
+	for tag := range strings.SplitSeq(f.value(), ";") {
+		name, value, ok := strings.Cut(tag, "=")
+		if !ok {
+			continue
+		}
+		tags[strings.TrimSpace(name)] = strings.Join(strings.Fields(value), "")
+	}
+	return tags
+}
+
+// checkDKIMSignature verifies the signature of f over the message that the
+// signer wrote, with the key pub.
+func checkDKIMSignature(t *testing.T, signed string, f headerField, pub any) {
+	t.Helper()
+
+	h, size, _, err := readHeader(strings.NewReader(signed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := dkimTags(t, f)
+
+	canon := strings.Split(tags["c"], "/")
+	bh, err := dkimBodyHash(strings.NewReader(signed[size:]), DKIMCanonicalization(canon[1]), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := base64.StdEncoding.EncodeToString(bh); got != tags["bh"] {
+		t.Errorf("bh = %s, the body hashes to %s", tags["bh"], got)
+	}
+
+	// The field without the value of b= is what the signer signed.
+	i := strings.LastIndex(f.raw, "b=")
+	unsigned := f.raw[:i+2]
+
+	var names []string
+	for name := range strings.SplitSeq(tags["h"], ":") {
+		names = append(names, name)
+	}
+
+	// The signature field is not part of the signed header.
+	var rest header
+	for _, field := range h {
+		if field.raw != f.raw {
+			rest = append(rest, field)
+		}
+	}
+
+	digest := dkimHeaderHash(rest, names, unsigned, DKIMCanonicalization(canon[0]))
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	switch pub := pub.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, digest, sig) {
+			t.Error("the Ed25519 signature does not verify")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, sig); err != nil {
+			t.Errorf("the RSA signature does not verify: %v", err)
+		}
+	}
+}
+
+func TestDKIMSignsWithEveryKey(t *testing.T) {
+	t.Parallel()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edKey := rfc8463Key(t)
+
+	d := DKIM(DKIMKeyMap{
+		"football.example.com": {
+			{Selector: "rsa", Signer: rsaKey},
+			{Selector: "brisbane", Signer: edKey},
+		},
+	}, withDKIMClock(func() time.Time { return time.Unix(1528637909, 0) }))
+
+	signed := signMessage(t, d, "joe@football.example.com", rfc8463Message)
+
+	if !strings.HasSuffix(signed, rfc8463Message) {
+		t.Fatalf("the signer changed the message:\n%s", signed)
+	}
+
+	h, _, _, err := readHeader(strings.NewReader(signed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigs := h.all("DKIM-Signature")
+	if len(sigs) != 2 {
+		t.Fatalf("got %d signatures, want 2", len(sigs))
+	}
+
+	for _, f := range sigs {
+		tags := dkimTags(t, f)
+		if tags["d"] != "football.example.com" {
+			t.Errorf("d= %q, want football.example.com", tags["d"])
+		}
+		if tags["t"] != "1528637909" {
+			t.Errorf("t= %q, want the time of the clock", tags["t"])
+		}
+
+		switch tags["s"] {
+		case "rsa":
+			if tags["a"] != "rsa-sha256" {
+				t.Errorf("a= %q for the RSA key", tags["a"])
+			}
+			checkDKIMSignature(t, signed, f, &rsaKey.PublicKey)
+		case "brisbane":
+			if tags["a"] != "ed25519-sha256" {
+				t.Errorf("a= %q for the Ed25519 key", tags["a"])
+			}
+			checkDKIMSignature(t, signed, f, edKey.Public())
+		default:
+			t.Errorf("unknown selector %q", tags["s"])
+		}
+	}
+}
+
+func TestDKIMOversign(t *testing.T) {
+	t.Parallel()
+
+	d := DKIM(DKIMKeyMap{"football.example.com": {{Selector: "s", Signer: rfc8463Key(t)}}},
+		WithDKIMHeaders("From", "To", "Subject", "Date", "Message-ID"),
+		WithDKIMOversign("From", "Subject", "Date"))
+
+	signed := signMessage(t, d, "joe@football.example.com", rfc8463Message)
+
+	h, _, _, _ := readHeader(strings.NewReader(signed))
+	tags := dkimTags(t, h.all("DKIM-Signature")[0])
+
+	if want := "from:from:to:subject:subject:date:date:message-id"; tags["h"] != want {
+		t.Errorf("h= %q, want %q", tags["h"], want)
+	}
+}
+
+// TestDKIMSimpleCanonicalization signs with the simple algorithm, which takes
+// the header as it is, folding and all.
+func TestDKIMSimpleCanonicalization(t *testing.T) {
+	t.Parallel()
+
+	key := rfc8463Key(t)
+	d := DKIM(DKIMKeyMap{"football.example.com": {{Selector: "s", Signer: key}}},
+		WithDKIMCanonicalization(DKIMSimple, DKIMSimple))
+
+	signed := signMessage(t, d, "joe@football.example.com", rfc8463Message)
+
+	h, _, _, _ := readHeader(strings.NewReader(signed))
+	f := h.all("DKIM-Signature")[0]
+	if tags := dkimTags(t, f); tags["c"] != "simple/simple" {
+		t.Errorf("c= %q, want simple/simple", tags["c"])
+	}
+	checkDKIMSignature(t, signed, f, key.Public())
+}
+
+// TestDKIMBareLineFeeds signs a message that arrived through DATA, which
+// gives its lines without the CR. The signature must hold for the message
+// with CRLF, which is how it goes on the wire.
+func TestDKIMBareLineFeeds(t *testing.T) {
+	t.Parallel()
+
+	key := rfc8463Key(t)
+	d := DKIM(DKIMKeyMap{"football.example.com": {{Selector: "s", Signer: key}}})
+
+	msg := strings.ReplaceAll(rfc8463Message, "\r\n", "\n")
+	signed := signMessage(t, d, "joe@football.example.com", msg)
+
+	if strings.Contains(signed, "\r") {
+		t.Errorf("the signer wrote a CR into a message of bare line feeds:\n%q", signed)
+	}
+
+	wire := strings.ReplaceAll(signed, "\n", "\r\n")
+	h, _, _, _ := readHeader(strings.NewReader(wire))
+	checkDKIMSignature(t, wire, h.all("DKIM-Signature")[0], key.Public())
+}
+
+func TestDKIMUnknownDomainPassesUnsigned(t *testing.T) {
+	t.Parallel()
+
+	d := DKIM(DKIMKeyMap{})
+
+	if got := signMessage(t, d, "joe@football.example.com", rfc8463Message); got != rfc8463Message {
+		t.Errorf("the message changed:\n%s", got)
+	}
+}
+
+// TestDKIMNullSenderTakesHeaderFrom signs a bounce for the domain of the
+// header From, because the null sender has no domain.
+func TestDKIMNullSenderTakesHeaderFrom(t *testing.T) {
+	t.Parallel()
+
+	d := DKIM(DKIMKeyMap{"football.example.com": {{Selector: "s", Signer: rfc8463Key(t)}}})
+
+	signed := signMessage(t, d, "", rfc8463Message)
+	if !strings.HasPrefix(signed, "DKIM-Signature:") {
+		t.Errorf("the bounce is not signed:\n%s", signed)
+	}
+}
+
+type failingKeyStore struct{}
+
+func (failingKeyStore) DKIMKeys(context.Context, string) ([]DKIMKey, error) {
+	return nil, errors.New("the vault is sealed")
+}
+
+func TestDKIMKeyStoreError(t *testing.T) {
+	t.Parallel()
+
+	d := DKIM(failingKeyStore{})
+	env := &smtpd.Envelope{Sender: "joe@football.example.com", Data: io.NopCloser(strings.NewReader(rfc8463Message))}
+
+	_, err := d.Handler(context.Background(), smtpd.Peer{}, env)
+
+	var smtpErr smtpd.Error
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 451 {
+		t.Fatalf("Handler error = %v, want a 451", err)
+	}
+}
+
+// TestDKIMSpoolsToDisk signs a message larger than the memory of the spool,
+// which moves it to a file, and checks that Close removes the file.
+func TestDKIMSpoolsToDisk(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	key := rfc8463Key(t)
+	d := DKIM(DKIMKeyMap{"football.example.com": {{Selector: "s", Signer: key}}},
+		WithDKIMSpool(64, dir))
+
+	msg := rfc8463Message + strings.Repeat("A line of a long body.\r\n", 1000)
+	env := &smtpd.Envelope{Sender: "joe@football.example.com", Data: io.NopCloser(strings.NewReader(msg))}
+	if _, err := d.Handler(context.Background(), smtpd.Peer{}, env); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatalf("the spool holds %d files, want 1", len(entries))
+	}
+
+	var out bytes.Buffer
+	if _, err := io.Copy(&out, env.Data); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Data.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Close left %d files in the spool", len(entries))
+	}
+
+	signed := out.String()
+	if !strings.HasSuffix(signed, msg) {
+		t.Fatal("the signer changed the message")
+	}
+	h, _, _, _ := readHeader(strings.NewReader(signed))
+	checkDKIMSignature(t, signed, h.all("DKIM-Signature")[0], key.Public())
+}
+
+// TestDKIMSpoolAfterAFailedStage verifies that the spool of a signed message
+// goes once the handlers are done, where a stage after the signer fails and
+// closes nothing.
+func TestDKIMSpoolAfterAFailedStage(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	d := DKIM(DKIMKeyMap{"football.example.com": {{Selector: "s", Signer: rfc8463Key(t)}}},
+		WithDKIMSpool(0, dir))
+
+	ts := smtptest.NewUnstartedServer(func(ctx context.Context, _ smtpd.Peer, _ *smtpd.Envelope) (context.Context, error) {
+		return ctx, smtpd.Error{Code: 554, Message: "Refused after signing"}
+	})
+	ts.Config.Use(smtpd.Middleware{Handler: d.Handler})
+	ts.Start()
+	defer ts.Close()
+
+	c := ts.Dial()
+	defer func() { _ = c.Close() }()
+	if err := smtptest.Send(c, "joe@football.example.com", []string{"suzie@shopping.example.net"}, rfc8463Message); err == nil {
+		t.Fatal("the message went through")
+	}
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("the failed stage left %d files in the spool", len(entries))
+	}
+}
+
+func TestDKIMBodyCanonicalization(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		canon DKIMCanonicalization
+		body  string
+		want  string
+	}{
+		{"simple empty", DKIMSimple, "", "\r\n"},
+		{"relaxed empty", DKIMRelaxed, "", ""},
+		{"simple trailing lines", DKIMSimple, "a\r\n\r\n\r\n", "a\r\n"},
+		{"relaxed white space", DKIMRelaxed, "a  \t b \r\n \r\n", "a b\r\n"},
+		{"simple keeps white space", DKIMSimple, "a  b \r\n", "a  b \r\n"},
+		{"no final line break", DKIMRelaxed, "a\r\nb", "a\r\nb\r\n"},
+		{"bare line feeds", DKIMSimple, "a\n\nb\n", "a\r\n\r\nb\r\n"},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		c := &bodyCanonicalizer{w: &out, relaxed: tt.canon == DKIMRelaxed}
+		_, _ = io.WriteString(c, tt.body)
+		c.finish()
+
+		if out.String() != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, out.String(), tt.want)
+		}
+	}
+
+	sum := sha256.Sum256(nil)
+	got, _ := dkimBodyHash(strings.NewReader(""), DKIMRelaxed, -1)
+	if !bytes.Equal(got, sum[:]) {
+		t.Error("the relaxed hash of an empty body is not the hash of nothing")
+	}
+}
@@ -0,0 +1,455 @@
+package middleware
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chrj/smtpd/v2/internal/spool"
+)
+
+// TXTResolver is the part of a resolver that looks up TXT records.
+// net.DefaultResolver, DNSResolver and spf.DNSResolver satisfy it.
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// DKIMStatus is the result of the check of one DKIM signature, in the terms
+// of RFC 8601 section 2.7.1.
+type DKIMStatus string
+
+const (
+	// DKIMPass is a signature that verified.
+	DKIMPass DKIMStatus = "pass"
+
+	// DKIMFail is a signature that did not verify against its key, or a
+	// body that does not match the body hash.
+	DKIMFail DKIMStatus = "fail"
+
+	// DKIMTempError is a signature whose key could not be looked up for a
+	// cause that may pass, such as a DNS timeout.
+	DKIMTempError DKIMStatus = "temperror"
+
+	// DKIMPermError is a signature that cannot verify: a field that does
+	// not parse, an expired signature, or a key that is missing or revoked.
+	DKIMPermError DKIMStatus = "permerror"
+)
+
+// DKIMResult is the check of one DKIM-Signature field.
+type DKIMResult struct {
+	// Domain and Selector are the d= and s= tags of the signature. They are
+	// empty when the field does not carry them.
+	Domain   string
+	Selector string
+
+	Status DKIMStatus
+
+	// Err tells why a signature did not pass. It is nil for DKIMPass.
+	Err error
+}
+
+// maxDKIMSignatures is how many DKIM-Signature fields of one message are
+// checked. Each costs DNS lookups and a pass over the body, so a message
+// cannot make the server do an unbounded amount of work; the fields past it
+// are ignored.
+const maxDKIMSignatures = 8
+
+// VerifyDKIM checks the DKIM signatures (RFC 6376) of the message in r, and
+// gives one result per DKIM-Signature field, in the order of the message.
+// It looks the public keys up through resolver. A message without
+// signatures gives no results. The error is for a message that could not be
+// read, not for a signature that did not verify.
+func VerifyDKIM(ctx context.Context, resolver TXTResolver, r io.Reader) ([]DKIMResult, error) {
+	sp, err := spool.Read(r, spool.DefaultMemory, "")
+	if err != nil {
+		return nil, err
+	}
+	defer sp.Close()
+
+	h, headerSize, _, err := readHeader(sp.Section(0))
+	if err != nil {
+		return nil, err
+	}
+	return verifyDKIM(ctx, resolver, h, sp, headerSize, time.Now()), nil
+}
+
+// verifyDKIM checks the signatures of a spooled message. The body starts at
+// headerSize.
+func verifyDKIM(ctx context.Context, resolver TXTResolver, h header, sp *spool.Spool, headerSize int64, now time.Time) []DKIMResult {
+	fields := h.all("DKIM-Signature")
+	if len(fields) > maxDKIMSignatures {
+		fields = fields[:maxDKIMSignatures]
+	}
+
+	bodyHash := bodyHasher(sp, headerSize)
+
+	results := make([]DKIMResult, 0, len(fields))
+	for _, field := range fields {
+		results = append(results, verifyDKIMSignature(ctx, resolver, h, field, bodyHash, now))
+	}
+	return results
+}
+
+// bodyHasher gives a function that hashes the body of a spooled message.
+// Signatures often share the canonicalization and length of the body, so
+// the function hashes each pair once.
+func bodyHasher(sp *spool.Spool, headerSize int64) func(DKIMCanonicalization, int64) ([]byte, error) {
+	type bodyKey struct {
+		canon DKIMCanonicalization
+		limit int64
+	}
+	sums := make(map[bodyKey][]byte)
+
+	return func(canon DKIMCanonicalization, limit int64) ([]byte, error) {
+		key := bodyKey{canon, limit}
+		if sum, ok := sums[key]; ok {
+			return sum, nil
+		}
+		sum, err := dkimBodyHash(sp.Section(headerSize), canon, limit)
+		if err != nil {
+			return nil, err
+		}
+		sums[key] = sum
+		return sum, nil
+	}
+}
+
+// dkimSignature is a DKIM-Signature field, or an ARC-Message-Signature
+// field, parsed.
+type dkimSignature struct {
+	algorithm   string
+	sig         []byte
+	bodyHash    []byte
+	headerCanon DKIMCanonicalization
+	bodyCanon   DKIMCanonicalization
+	domain      string
+	selector    string
+	headers     []string
+	limit       int64
+	expires     time.Time
+}
+
+func verifyDKIMSignature(ctx context.Context, resolver TXTResolver, h header, field headerField, bodyHash func(DKIMCanonicalization, int64) ([]byte, error), now time.Time) DKIMResult {
+	tags, err := parseTagList(field.value())
+	if err != nil {
+		return DKIMResult{Status: DKIMPermError, Err: err}
+	}
+	res := DKIMResult{Domain: strings.ToLower(tags["d"]), Selector: tags["s"]}
+
+	sig, err := parseDKIMSignature(tags)
+	if err != nil {
+		res.Status, res.Err = DKIMPermError, err
+		return res
+	}
+
+	res.Status, res.Err = checkSignature(ctx, resolver, h, field, sig, bodyHash, now)
+	return res
+}
+
+// checkSignature verifies a parsed signature of the body and of the header
+// fields that it names.
+func checkSignature(ctx context.Context, resolver TXTResolver, h header, field headerField, sig *dkimSignature, bodyHash func(DKIMCanonicalization, int64) ([]byte, error), now time.Time) (DKIMStatus, error) {
+	if !sig.expires.IsZero() && now.After(sig.expires) {
+		return DKIMPermError, errors.New("the signature has expired")
+	}
+
+	pub, status, err := lookupKey(ctx, resolver, sig.selector, sig.domain)
+	if err != nil {
+		return status, err
+	}
+
+	sum, err := bodyHash(sig.bodyCanon, sig.limit)
+	if err != nil {
+		return DKIMTempError, err
+	}
+	if string(sum) != string(sig.bodyHash) {
+		return DKIMFail, errors.New("the body hash did not verify")
+	}
+
+	raw := strings.TrimSuffix(field.raw, "\r\n")
+	digest := dkimHeaderHash(h, sig.headers, withoutSignature(raw), sig.headerCanon)
+	return verifyDigest(pub, sig.algorithm, digest, sig.sig)
+}
+
+// lookupKey looks up a public key, and gives the status of a signature that
+// the lookup fails for.
+func lookupKey(ctx context.Context, resolver TXTResolver, selector, domain string) (crypto.PublicKey, DKIMStatus, error) {
+	pub, err := lookupDKIMKey(ctx, resolver, selector, domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && !dnsErr.IsNotFound {
+			return nil, DKIMTempError, err
+		}
+		return nil, DKIMPermError, err
+	}
+	return pub, "", nil
+}
+
+// verifyDigest checks sig over a digest with the key pub, for the a= tag
+// algorithm.
+func verifyDigest(pub crypto.PublicKey, algorithm string, digest, sig []byte) (DKIMStatus, error) {
+	var err error
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		if algorithm != "rsa-sha256" {
+			return DKIMPermError, fmt.Errorf("an RSA key cannot verify %s", algorithm)
+		}
+		err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, sig)
+	case ed25519.PublicKey:
+		if algorithm != "ed25519-sha256" {
+			return DKIMPermError, fmt.Errorf("an Ed25519 key cannot verify %s", algorithm)
+		}
+		if !ed25519.Verify(pub, digest, sig) {
+			err = errors.New("ed25519: verification error")
+		}
+	}
+	if err != nil {
+		return DKIMFail, fmt.Errorf("the signature did not verify: %w", err)
+	}
+	return DKIMPass, nil
+}
+
+// parseDKIMSignature checks the tags of a DKIM-Signature field against RFC
+// 6376 section 3.5.
+func parseDKIMSignature(tags map[string]string) (*dkimSignature, error) {
+	if v, ok := tags["v"]; !ok {
+		return nil, errors.New("the signature has no v= tag")
+	} else if v != "1" {
+		return nil, fmt.Errorf("the signature has version %q", v)
+	}
+
+	sig, err := parseSignature(tags)
+	if err != nil {
+		return nil, err
+	}
+
+	if i, ok := tags["i"]; ok {
+		id := domainOf(i)
+		if id != sig.domain && !strings.HasSuffix(id, "."+sig.domain) {
+			return nil, errors.New("the i= tag is outside the d= domain")
+		}
+	}
+	return sig, nil
+}
+
+// parseSignature parses the tags that a DKIM-Signature field and an
+// ARC-Message-Signature field share.
+func parseSignature(tags map[string]string) (*dkimSignature, error) {
+	for _, name := range []string{"a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[name]; !ok {
+			return nil, fmt.Errorf("the signature has no %s= tag", name)
+		}
+	}
+
+	sig := &dkimSignature{
+		algorithm:   strings.ToLower(tags["a"]),
+		domain:      strings.ToLower(tags["d"]),
+		selector:    tags["s"],
+		headerCanon: DKIMSimple,
+		bodyCanon:   DKIMSimple,
+		limit:       -1,
+	}
+	if sig.algorithm != "rsa-sha256" && sig.algorithm != "ed25519-sha256" {
+		return nil, fmt.Errorf("the algorithm %s is not supported", sig.algorithm)
+	}
+
+	var err error
+	if sig.sig, err = base64.StdEncoding.DecodeString(stripFWS(tags["b"])); err != nil {
+		return nil, fmt.Errorf("the b= tag: %w", err)
+	}
+	if sig.bodyHash, err = base64.StdEncoding.DecodeString(stripFWS(tags["bh"])); err != nil {
+		return nil, fmt.Errorf("the bh= tag: %w", err)
+	}
+
+	if c, ok := tags["c"]; ok {
+		hc, bc, hasBody := strings.Cut(strings.ToLower(c), "/")
+		sig.headerCanon = DKIMCanonicalization(hc)
+		if hasBody {
+			sig.bodyCanon = DKIMCanonicalization(bc)
+		}
+		for _, canon := range []DKIMCanonicalization{sig.headerCanon, sig.bodyCanon} {
+			if canon != DKIMSimple && canon != DKIMRelaxed {
+				return nil, fmt.Errorf("the canonicalization %s is not supported", canon)
+			}
+		}
+	}
+
+	for _, name := range strings.Split(tags["h"], ":") {
+		if name = strings.TrimSpace(stripFWS(name)); name != "" {
+			sig.headers = append(sig.headers, name)
+		}
+	}
+	from := false
+	for _, name := range sig.headers {
+		from = from || strings.EqualFold(name, "From")
+	}
+	if !from {
+		return nil, errors.New("the signature does not cover From")
+	}
+
+	if l, ok := tags["l"]; ok {
+		if sig.limit, err = strconv.ParseInt(l, 10, 64); err != nil || sig.limit < 0 {
+			return nil, fmt.Errorf("the l= tag %q is not a length", l)
+		}
+	}
+
+	if x, ok := tags["x"]; ok {
+		unix, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("the x= tag %q is not a time", x)
+		}
+		sig.expires = time.Unix(unix, 0)
+	}
+
+	return sig, nil
+}
+
+// lookupDKIMKey gets the public key of a selector from the record of RFC
+// 6376 section 3.6.1. A lookup that fails gives the *net.DNSError of the
+// resolver, so the caller can tell a missing record from a failing server.
+func lookupDKIMKey(ctx context.Context, resolver TXTResolver, selector, domain string) (crypto.PublicKey, error) {
+	name := selector + "._domainkey." + domain
+	records, err := resolver.LookupTXT(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, record := range records {
+		tags, err := parseTagList(record)
+		if err != nil {
+			continue
+		}
+		if v, ok := tags["v"]; ok && v != "DKIM1" {
+			continue
+		}
+		return parseDKIMKey(tags)
+	}
+	return nil, &net.DNSError{Err: "no DKIM key record", Name: name, IsNotFound: true}
+}
+
+func parseDKIMKey(tags map[string]string) (crypto.PublicKey, error) {
+	p := stripFWS(tags["p"])
+	if p == "" {
+		return nil, errors.New("the key has been revoked")
+	}
+	der, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, fmt.Errorf("the p= tag of the key: %w", err)
+	}
+
+	switch k := strings.ToLower(tags["k"]); k {
+	case "", "rsa":
+		pub, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			// Some records carry the bare RSAPublicKey of PKCS #1.
+			if pkcs1, err1 := x509.ParsePKCS1PublicKey(der); err1 == nil {
+				pub, err = pkcs1, nil
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("the RSA key: %w", err)
+		}
+		rsaPub, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("the key record of type rsa holds a %T", pub)
+		}
+		// RFC 8301 section 3.2.
+		if rsaPub.N.BitLen() < 1024 {
+			return nil, fmt.Errorf("the RSA key of %d bits is too short", rsaPub.N.BitLen())
+		}
+		return rsaPub, nil
+	case "ed25519":
+		if len(der) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("the Ed25519 key has %d octets", len(der))
+		}
+		return ed25519.PublicKey(der), nil
+	default:
+		return nil, fmt.Errorf("the key type %s is not supported", k)
+	}
+}
+
+// parseTagList parses a tag list of RFC 6376 section 3.2 into its tags. A tag
+// that appears twice makes the whole list invalid.
+func parseTagList(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, spec := range strings.Split(s, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("the tag %q has no value", spec)
+		}
+		name = strings.TrimSpace(name)
+		if _, dup := tags[name]; dup {
+			return nil, fmt.Errorf("the tag %s appears twice", name)
+		}
+		tags[name] = strings.TrimSpace(value)
+	}
+	return tags, nil
+}
+
+// withoutSignature gives a DKIM-Signature field with the value of its b= tag
+// deleted, as the header hash takes it (RFC 6376 section 3.7).
+func withoutSignature(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteString(":")
+	for i, spec := range strings.Split(value, ";") {
+		if i > 0 {
+			b.WriteString(";")
+		}
+		tag, _, ok := strings.Cut(spec, "=")
+		if ok && strings.TrimSpace(tag) == "b" {
+			b.WriteString(spec[:len(tag)+1])
+			continue
+		}
+		b.WriteString(spec)
+	}
+	return b.String()
+}
+
+// stripFWS drops the white space that folding leaves in a tag value.
+func stripFWS(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// limitWriter passes the first n octets to w and drops the rest.
+type limitWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if l.n <= 0 {
+		return len(p), nil
+	}
+	q := p
+	if int64(len(q)) > l.n {
+		q = q[:l.n]
+	}
+	n, err := l.w.Write(q)
+	l.n -= int64(n)
+	if err != nil {
+		return n, err
+	}
+	return len(p), nil
+}
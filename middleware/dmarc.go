@@ -0,0 +1,488 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"blitiri.com.ar/go/spf"
+	"github.com/chrj/smtpd/v2"
+	"github.com/chrj/smtpd/v2/internal/spool"
+	"golang.org/x/net/publicsuffix"
+)
+
+// DMARCDisposition is what a DMARC policy asks a receiver to do with a
+// message that fails the check (RFC 7489 section 6.3).
+type DMARCDisposition string
+
+const (
+	DMARCNone       DMARCDisposition = "none"
+	DMARCQuarantine DMARCDisposition = "quarantine"
+	DMARCReject     DMARCDisposition = "reject"
+)
+
+// DMARCAlignment is the alignment mode of the adkim= and aspf= tags.
+type DMARCAlignment string
+
+const (
+	// DMARCRelaxed takes an identity as aligned when it shares the
+	// organizational domain of the header From.
+	DMARCRelaxed DMARCAlignment = "r"
+
+	// DMARCStrict takes an identity as aligned only when it is the domain
+	// of the header From.
+	DMARCStrict DMARCAlignment = "s"
+)
+
+// DMARCRecord is a DMARC policy as its domain publishes it under _dmarc.
+type DMARCRecord struct {
+	// Domain is the domain that publishes the record: the domain of the
+	// header From, or its organizational domain.
+	Domain string
+
+	Policy          DMARCDisposition // p=
+	SubdomainPolicy DMARCDisposition // sp=, empty when the record has none
+	Percent         int              // pct=, 100 when the record has none
+	DKIMAlignment   DMARCAlignment   // adkim=
+	SPFAlignment    DMARCAlignment   // aspf=
+
+	// AggregateReports and FailureReports are the URIs of the rua= and
+	// ruf= tags.
+	AggregateReports []string
+	FailureReports   []string
+}
+
+// DMARCResult is the DMARC check of one message. It carries the fields of a
+// row of an aggregate report (RFC 7489 appendix C).
+type DMARCResult struct {
+	Time     time.Time
+	SourceIP net.IP
+
+	// HeaderFrom is the domain of the header From. EnvelopeFrom is the
+	// domain that SPF checked: the one of MAIL FROM, or the HELO name for
+	// the null sender.
+	HeaderFrom   string
+	EnvelopeFrom string
+
+	// Record is the policy that applied, and nil when neither the domain
+	// nor its organizational domain publishes one.
+	Record *DMARCRecord
+
+	// Disposition is what the checker did with the message, after pct=.
+	Disposition DMARCDisposition
+
+	SPF         spf.Result
+	SPFAligned  bool
+	DKIM        []DKIMResult
+	DKIMAligned bool
+}
+
+// Pass reports whether an aligned identity passed, by SPF or by DKIM.
+func (r *DMARCResult) Pass() bool {
+	return r.SPFAligned || r.DKIMAligned
+}
+
+// DMARCReporter takes the result of each message that a published policy
+// applied to, to build aggregate reports from. ReportDMARC runs on the
+// session goroutine, so an implementation that does more than record the
+// result should hand it off.
+type DMARCReporter interface {
+	ReportDMARC(ctx context.Context, result *DMARCResult)
+}
+
+// The DMARCReporterFunc type is an adapter to allow the use of ordinary
+// functions as a DMARCReporter.
+type DMARCReporterFunc func(ctx context.Context, result *DMARCResult)
+
+// ReportDMARC calls f(ctx, result).
+func (f DMARCReporterFunc) ReportDMARC(ctx context.Context, result *DMARCResult) {
+	f(ctx, result)
+}
+
+type contextKey string
+
+const dmarcKey contextKey = "smtpd-dmarc"
+
+// DMARCResultFromContext returns the result that a DMARCChecker stored in
+// the context of the message. ok is false when no checker ran.
+//
+// A delivery handler honours a quarantine here: the checker passes a message
+// with the disposition DMARCQuarantine on, and leaves the folder to the
+// handler.
+func DMARCResultFromContext(ctx context.Context) (result *DMARCResult, ok bool) {
+	result, ok = ctx.Value(dmarcKey).(*DMARCResult)
+	return result, ok
+}
+
+// DMARCChecker applies the DMARC policy (RFC 7489) of the domain in the
+// header From, at the Handler stage:
+//
+//	dmarc := middleware.DMARC(middleware.WithDMARCReporter(reports))
+//	srv.Use(smtpd.Middleware{Handler: dmarc.Handler})
+//
+// The message passes when SPF passes for an envelope domain aligned with the
+// header From, or when a DKIM signature of an aligned domain verifies. A
+// message that fails gets the disposition of the policy: reject refuses it,
+// quarantine passes it on with the disposition in the context, and none
+// passes it on. pct= applies the policy to that share of the failing
+// messages, and the rest get the next milder disposition.
+//
+// The checker reads the whole message to verify its signatures, so it
+// spools it the way DKIMSigner does. Register it before any stage that
+// changes the message.
+type DMARCChecker struct {
+	resolver    spf.DNSResolver
+	orgDomain   func(domain string) string
+	reporter    DMARCReporter
+	spoolMemory int64
+	spoolDir    string
+	now         func() time.Time
+	sample      func() int
+}
+
+// DMARCOption configures a DMARCChecker at construction time. Pass options
+// to DMARC.
+type DMARCOption func(*DMARCChecker)
+
+// WithDMARCResolver sets the DNS resolver for the policy record, the SPF
+// check and the DKIM keys. The default is net.DefaultResolver.
+func WithDMARCResolver(resolver spf.DNSResolver) DMARCOption {
+	return func(d *DMARCChecker) { d.resolver = resolver }
+}
+
+// WithDMARCOrgDomain sets the function that gives the organizational domain
+// of a domain. The default takes the public suffix list that
+// golang.org/x/net/publicsuffix embeds.
+func WithDMARCOrgDomain(orgDomain func(domain string) string) DMARCOption {
+	return func(d *DMARCChecker) { d.orgDomain = orgDomain }
+}
+
+// WithDMARCReporter sets where the results go for aggregate reports. The
+// default is to keep none.
+func WithDMARCReporter(reporter DMARCReporter) DMARCOption {
+	return func(d *DMARCChecker) { d.reporter = reporter }
+}
+
+// WithDMARCSpool sets how much of a message the checker holds in memory, and
+// the directory of the temporary file that takes a message past that. The
+// defaults are 1MB and the directory of os.TempDir.
+func WithDMARCSpool(memory int64, dir string) DMARCOption {
+	return func(d *DMARCChecker) { d.spoolMemory, d.spoolDir = memory, dir }
+}
+
+// withDMARCClock is a test hook for overriding time.Now.
+func withDMARCClock(now func() time.Time) DMARCOption {
+	return func(d *DMARCChecker) { d.now = now }
+}
+
+// withDMARCSample is a test hook for the draw against pct=, which gives a
+// number from 0 to 99.
+func withDMARCSample(sample func() int) DMARCOption {
+	return func(d *DMARCChecker) { d.sample = sample }
+}
+
+// DMARC constructs a DMARC checker.
+func DMARC(opts ...DMARCOption) *DMARCChecker {
+	d := &DMARCChecker{
+		resolver:    net.DefaultResolver,
+		orgDomain:   organizationalDomain,
+		spoolMemory: spool.DefaultMemory,
+		now:         time.Now,
+		sample:      func() int { return rand.IntN(100) },
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+var (
+	errDMARCFrom        = smtpd.Error{Code: 550, Enhanced: smtpd.EnhancedCode{5, 6, 0}, Message: "The message must have exactly one From header field"}
+	errDMARCFromAddress = smtpd.Error{Code: 550, Enhanced: smtpd.EnhancedCode{5, 6, 0}, Message: "The From header field must name exactly one address"}
+	errDMARCTemp        = smtpd.Error{Code: 451, Enhanced: smtpd.EnhancedCode{4, 7, 0}, Message: "DMARC check temporary error"}
+	errDMARCReject      = smtpd.Error{Code: 550, Enhanced: smtpd.EnhancedCode{5, 7, 1}, Message: "Message rejected by the DMARC policy of the sender"}
+)
+
+// Handler is an smtpd.Handler that applies the DMARC policy of the header
+// From to env.Data. It stores the result in the context, where
+// DMARCResultFromContext finds it.
+func (d *DMARCChecker) Handler(ctx context.Context, peer smtpd.Peer, env *smtpd.Envelope) (context.Context, error) {
+	logger := smtpd.LoggerFromContext(ctx)
+
+	sp, err := spool.Read(env.Data, d.spoolMemory, d.spoolDir)
+	_ = env.Data.Close()
+	if err != nil {
+		return ctx, fmt.Errorf("middleware: spool the message from %v: %w", peer.Addr, err)
+	}
+
+	h, headerSize, _, err := readHeader(sp.Section(0))
+	if err != nil {
+		_ = sp.Close()
+		return ctx, fmt.Errorf("middleware: read the header from %v: %w", peer.Addr, err)
+	}
+
+	// RFC 7489 section 6.6.1: a message with no From, or with more than
+	// one, has no domain to check, and a second From is the way to show a
+	// reader a domain that the check never saw.
+	if len(h.all("From")) != 1 {
+		_ = sp.Close()
+		return ctx, errDMARCFrom
+	}
+
+	result, err := d.check(ctx, peer, env, h, sp, headerSize)
+	if err != nil {
+		_ = sp.Close()
+		return ctx, err
+	}
+
+	if result.Record != nil && d.reporter != nil {
+		d.reporter.ReportDMARC(ctx, result)
+	}
+
+	switch result.Disposition {
+	case DMARCReject:
+		_ = sp.Close()
+		logger.WarnContext(ctx, "DMARC check failed",
+			slog.String("from", result.HeaderFrom),
+			slog.String("policy", result.Record.Domain))
+
+		if dmarcTemporary(result) {
+			return ctx, errDMARCTemp
+		}
+		return ctx, errDMARCReject
+	case DMARCQuarantine:
+		logger.InfoContext(ctx, "DMARC check failed, quarantining",
+			slog.String("from", result.HeaderFrom),
+			slog.String("policy", result.Record.Domain))
+	}
+
+	env.Data = &spooledBody{Reader: sp.Section(0), spool: sp}
+	return context.WithValue(ctx, dmarcKey, result), nil
+}
+
+// check evaluates the message against the policy of its header From.
+func (d *DMARCChecker) check(ctx context.Context, peer smtpd.Peer, env *smtpd.Envelope, h header, sp *spool.Spool, headerSize int64) (*DMARCResult, error) {
+	// A From that does not parse would pass a message that shows a reader
+	// the domain of a policy that the check never looked up, so it fails.
+	from, ok := headerFromDomain(h)
+	if !ok {
+		return nil, errDMARCFromAddress
+	}
+
+	result := &DMARCResult{
+		Time:        d.now(),
+		HeaderFrom:  from,
+		Disposition: DMARCNone,
+	}
+	if tcpAddr, ok := peer.Addr.(*net.TCPAddr); ok {
+		result.SourceIP = tcpAddr.IP
+	}
+
+	// An address with no domain is outside what DMARC can check.
+	if result.HeaderFrom == "" {
+		return result, nil
+	}
+
+	record, err := d.lookupRecord(ctx, result.HeaderFrom)
+	if err != nil {
+		smtpd.LoggerFromContext(ctx).WarnContext(ctx, "DMARC record lookup failed",
+			slog.String("from", result.HeaderFrom), slog.Any("error", err))
+		return nil, errDMARCTemp
+	}
+	if record == nil {
+		return result, nil
+	}
+	result.Record = record
+
+	result.EnvelopeFrom = domainOf(env.Sender)
+	if result.EnvelopeFrom == "" {
+		result.EnvelopeFrom = strings.ToLower(peer.HeloName)
+	}
+
+	result.SPF = spf.None
+	if result.SourceIP != nil {
+		result.SPF, _ = spf.CheckHostWithSender(result.SourceIP, peer.HeloName, env.Sender,
+			spf.WithContext(ctx), spf.WithResolver(d.resolver))
+	}
+	result.SPFAligned = result.SPF == spf.Pass &&
+		d.aligned(result.EnvelopeFrom, result.HeaderFrom, record.SPFAlignment)
+
+	result.DKIM = verifyDKIM(ctx, d.resolver, h, sp, headerSize, result.Time)
+	for _, r := range result.DKIM {
+		if r.Status == DKIMPass && d.aligned(r.Domain, result.HeaderFrom, record.DKIMAlignment) {
+			result.DKIMAligned = true
+		}
+	}
+
+	if result.Pass() {
+		return result, nil
+	}
+
+	policy := record.Policy
+	if record.Domain != result.HeaderFrom && record.SubdomainPolicy != "" {
+		policy = record.SubdomainPolicy
+	}
+
+	// RFC 7489 section 6.6.4: the messages that fall outside pct= get the
+	// next milder policy.
+	if d.sample() >= record.Percent {
+		switch policy {
+		case DMARCReject:
+			policy = DMARCQuarantine
+		case DMARCQuarantine:
+			policy = DMARCNone
+		}
+	}
+	result.Disposition = policy
+	return result, nil
+}
+
+// aligned reports whether domain is aligned with from in the given mode.
+func (d *DMARCChecker) aligned(domain, from string, mode DMARCAlignment) bool {
+	if domain == "" {
+		return false
+	}
+	if domain == from {
+		return true
+	}
+	return mode != DMARCStrict && d.orgDomain(domain) == d.orgDomain(from)
+}
+
+// lookupRecord finds the policy of a domain: its own record, or the one of
+// its organizational domain (RFC 7489 section 6.6.3). It gives nil for a
+// domain that has neither, and an error for a lookup that could not tell.
+func (d *DMARCChecker) lookupRecord(ctx context.Context, domain string) (*DMARCRecord, error) {
+	record, err := d.fetchRecord(ctx, domain)
+	if record != nil || err != nil {
+		return record, err
+	}
+
+	org := d.orgDomain(domain)
+	if org == domain {
+		return nil, nil
+	}
+	return d.fetchRecord(ctx, org)
+}
+
+func (d *DMARCChecker) fetchRecord(ctx context.Context, domain string) (*DMARCRecord, error) {
+	txts, err := d.resolver.LookupTXT(ctx, "_dmarc."+domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var records []*DMARCRecord
+	for _, txt := range txts {
+		if record := parseDMARCRecord(domain, txt); record != nil {
+			records = append(records, record)
+		}
+	}
+
+	// A domain with more than one record has none that applies.
+	if len(records) != 1 {
+		return nil, nil
+	}
+	return records[0], nil
+}
+
+// parseDMARCRecord parses a record of RFC 7489 section 6.3. It gives nil for
+// a text that is not a DMARC record, or one that names no valid policy and
+// no place to report to.
+func parseDMARCRecord(domain, txt string) *DMARCRecord {
+	first, _, _ := strings.Cut(txt, ";")
+	name, version, _ := strings.Cut(first, "=")
+	if strings.TrimSpace(name) != "v" || strings.TrimSpace(version) != "DMARC1" {
+		return nil
+	}
+
+	tags, err := parseTagList(txt)
+	if err != nil {
+		return nil
+	}
+
+	record := &DMARCRecord{
+		Domain:           domain,
+		Policy:           parseDMARCDisposition(tags["p"]),
+		Percent:          100,
+		DKIMAlignment:    DMARCRelaxed,
+		SPFAlignment:     DMARCRelaxed,
+		AggregateReports: splitURIs(tags["rua"]),
+		FailureReports:   splitURIs(tags["ruf"]),
+	}
+
+	valid := record.Policy != ""
+	if sp, ok := tags["sp"]; ok {
+		record.SubdomainPolicy = parseDMARCDisposition(sp)
+		valid = valid && record.SubdomainPolicy != ""
+	}
+	if !valid {
+		// Section 6.6.3: a record with a place to report to still counts,
+		// as if it said p=none.
+		if len(record.AggregateReports) == 0 {
+			return nil
+		}
+		record.Policy, record.SubdomainPolicy = DMARCNone, ""
+	}
+
+	if pct, err := strconv.Atoi(tags["pct"]); err == nil && pct >= 0 && pct <= 100 {
+		record.Percent = pct
+	}
+	if strings.EqualFold(tags["adkim"], "s") {
+		record.DKIMAlignment = DMARCStrict
+	}
+	if strings.EqualFold(tags["aspf"], "s") {
+		record.SPFAlignment = DMARCStrict
+	}
+	return record
+}
+
+func parseDMARCDisposition(s string) DMARCDisposition {
+	switch p := DMARCDisposition(strings.ToLower(s)); p {
+	case DMARCNone, DMARCQuarantine, DMARCReject:
+		return p
+	}
+	return ""
+}
+
+func splitURIs(s string) []string {
+	var uris []string
+	for uri := range strings.SplitSeq(s, ",") {
+		if uri = strings.TrimSpace(uri); uri != "" {
+			uris = append(uris, uri)
+		}
+	}
+	return uris
+}
+
+// dmarcTemporary reports whether a failing result may pass on a later try,
+// because SPF or a DKIM key lookup failed for a cause that may pass.
+func dmarcTemporary(result *DMARCResult) bool {
+	if result.SPF == spf.TempError {
+		return true
+	}
+	for _, r := range result.DKIM {
+		if r.Status == DKIMTempError {
+			return true
+		}
+	}
+	return false
+}
+
+// organizationalDomain gives the organizational domain of RFC 7489 section
+// 3.2: the public suffix of the domain and one label more.
+func organizationalDomain(domain string) string {
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return org
+}
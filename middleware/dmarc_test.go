@@ -0,0 +1,439 @@
+package middleware
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/spf"
+	"github.com/chrj/smtpd/v2"
+)
+
+// dmarcResolver answers TXT lookups from a map, and fails the names in
+// broken the way a DNS server that does not answer does.
+type dmarcResolver struct {
+	mockSPFResolver
+	broken map[string]bool
+}
+
+func (r *dmarcResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if r.broken[name] {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	return r.mockSPFResolver.LookupTXT(ctx, name)
+}
+
+var _ spf.DNSResolver = &dmarcResolver{}
+
+// dkimKeyRecord gives the TXT record that publishes the public key of k.
+func dkimKeyRecord(t *testing.T, k DKIMKey) string {
+	t.Helper()
+
+	switch pub := k.Signer.Public().(type) {
+	case ed25519.PublicKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)
+	default:
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)
+	}
+}
+
+func newEd25519Key(t *testing.T, selector string) DKIMKey {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return DKIMKey{Selector: selector, Signer: priv}
+}
+
+const dmarcMessage = "From: Alice <alice@example.com>\r\n" +
+	"To: bob@example.net\r\n" +
+	"Subject: Hello\r\n" +
+	"\r\n" +
+	"Hi Bob.\r\n"
+
+func TestVerifyDKIMRFC8463(t *testing.T) {
+	t.Parallel()
+
+	signed := "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+		" d=football.example.com; i=@football.example.com;\r\n" +
+		" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+		" subject : date : message-id : from : subject : date;\r\n" +
+		" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+		" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11BusFa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n" +
+		rfc8463Message
+
+	resolver := &mockSPFResolver{results: map[string][]string{
+		"brisbane._domainkey.football.example.com": {"v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="},
+	}}
+
+	results, err := VerifyDKIM(context.Background(), resolver, strings.NewReader(signed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Status != DKIMPass {
+		t.Fatalf("results = %+v, want one pass", results)
+	}
+	if results[0].Domain != "football.example.com" || results[0].Selector != "brisbane" {
+		t.Errorf("result names %s/%s", results[0].Domain, results[0].Selector)
+	}
+}
+
+func TestVerifyDKIM(t *testing.T) {
+	t.Parallel()
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey := DKIMKey{Selector: "rsa", Signer: priv}
+	edKey := newEd25519Key(t, "ed")
+	signed := signMessage(t, DKIM(DKIMKeyMap{"example.com": {rsaKey, edKey}}), "alice@example.com", dmarcMessage)
+
+	resolver := &dmarcResolver{
+		mockSPFResolver: mockSPFResolver{results: map[string][]string{
+			"rsa._domainkey.example.com": {dkimKeyRecord(t, rsaKey)},
+			"ed._domainkey.example.com":  {dkimKeyRecord(t, edKey)},
+		}},
+	}
+
+	statuses := func(msg string) []DKIMStatus {
+		t.Helper()
+		results, err := VerifyDKIM(context.Background(), resolver, strings.NewReader(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var s []DKIMStatus
+		for _, r := range results {
+			s = append(s, r.Status)
+		}
+		return s
+	}
+
+	if got := statuses(signed); len(got) != 2 || got[0] != DKIMPass || got[1] != DKIMPass {
+		t.Errorf("signed message: %v, want two passes", got)
+	}
+	if got := statuses(strings.Replace(signed, "Hi Bob.", "Hi Eve.", 1)); len(got) != 2 || got[0] != DKIMFail || got[1] != DKIMFail {
+		t.Errorf("changed body: %v, want two failures", got)
+	}
+	if got := statuses(strings.Replace(signed, "Subject: Hello", "Subject: Goodbye", 1)); len(got) != 2 || got[0] != DKIMFail || got[1] != DKIMFail {
+		t.Errorf("changed header: %v, want two failures", got)
+	}
+	if got := statuses(dmarcMessage); len(got) != 0 {
+		t.Errorf("unsigned message: %v, want no results", got)
+	}
+
+	delete(resolver.results, "ed._domainkey.example.com")
+	resolver.broken = map[string]bool{"rsa._domainkey.example.com": true}
+	if got := statuses(signed); len(got) != 2 || got[0] != DKIMTempError || got[1] != DKIMPermError {
+		t.Errorf("unreachable and missing keys: %v, want temperror and permerror", got)
+	}
+}
+
+func TestVerifyDKIMExpired(t *testing.T) {
+	t.Parallel()
+
+	key := newEd25519Key(t, "ed")
+	past := func() time.Time { return time.Now().Add(-48 * time.Hour) }
+	signer := DKIM(DKIMKeyMap{"example.com": {key}}, WithDKIMExpiry(time.Hour), withDKIMClock(past))
+	signed := signMessage(t, signer, "alice@example.com", dmarcMessage)
+
+	resolver := &mockSPFResolver{results: map[string][]string{
+		"ed._domainkey.example.com": {dkimKeyRecord(t, key)},
+	}}
+	results, err := VerifyDKIM(context.Background(), resolver, strings.NewReader(signed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Status != DKIMPermError {
+		t.Fatalf("results = %+v, want one permerror", results)
+	}
+}
+
+// dmarcTest runs the Handler of a checker over msg, from 1.2.3.4.
+func dmarcTest(t *testing.T, d *DMARCChecker, sender, msg string) (*DMARCResult, error) {
+	t.Helper()
+
+	peer := smtpd.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("1.2.3.4")}, HeloName: "mx.example.org"}
+	env := &smtpd.Envelope{Sender: sender, Data: io.NopCloser(strings.NewReader(msg))}
+
+	ctx, err := d.Handler(context.Background(), peer, env)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := io.ReadAll(env.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Data.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != msg {
+		t.Errorf("the checker changed the message to %q", out)
+	}
+
+	result, ok := DMARCResultFromContext(ctx)
+	if !ok {
+		t.Fatal("no result in the context")
+	}
+	return result, nil
+}
+
+func TestDMARCAlignedDKIM(t *testing.T) {
+	t.Parallel()
+
+	key := newEd25519Key(t, "ed")
+	signed := signMessage(t, DKIM(DKIMKeyMap{"mail.example.com": {key}}), "bounce@mail.example.com", dmarcMessage)
+
+	resolver := &mockSPFResolver{results: map[string][]string{
+		"ed._domainkey.mail.example.com": {dkimKeyRecord(t, key)},
+		"_dmarc.example.com":             {"v=DMARC1; p=reject"},
+	}}
+
+	result, err := dmarcTest(t, DMARC(WithDMARCResolver(resolver)), "bounce@mail.example.com", signed)
+	if err != nil {
+		t.Fatalf("relaxed alignment: %v", err)
+	}
+	if !result.DKIMAligned || result.SPFAligned || result.Disposition != DMARCNone {
+		t.Errorf("result = %+v, want DKIM aligned", result)
+	}
+
+	resolver.results["_dmarc.example.com"] = []string{"v=DMARC1; p=reject; adkim=s"}
+	if _, err := dmarcTest(t, DMARC(WithDMARCResolver(resolver)), "bounce@mail.example.com", signed); err == nil {
+		t.Error("strict alignment: expected a rejection")
+	}
+}
+
+func TestDMARCAlignedSPF(t *testing.T) {
+	t.Parallel()
+
+	resolver := &mockSPFResolver{results: map[string][]string{
+		"mail.example.com":   {"v=spf1 ip4:1.2.3.4 -all"},
+		"_dmarc.example.com": {"v=DMARC1; p=reject"},
+	}}
+
+	result, err := dmarcTest(t, DMARC(WithDMARCResolver(resolver)), "bounce@mail.example.com", dmarcMessage)
+	if err != nil {
+		t.Fatalf("relaxed alignment: %v", err)
+	}
+	if !result.SPFAligned || result.SPF != spf.Pass || result.EnvelopeFrom != "mail.example.com" {
+		t.Errorf("result = %+v, want SPF aligned", result)
+	}
+
+	resolver.results["_dmarc.example.com"] = []string{"v=DMARC1; p=reject; aspf=s"}
+	if _, err := dmarcTest(t, DMARC(WithDMARCResolver(resolver)), "bounce@mail.example.com", dmarcMessage); err == nil {
+		t.Error("strict alignment: expected a rejection")
+	}
+
+	// SPF that passes for a domain of another organization is no help.
+	resolver.results["example.org"] = []string{"v=spf1 ip4:1.2.3.4 -all"}
+	if _, err := dmarcTest(t, DMARC(WithDMARCResolver(resolver)), "bounce@example.org", dmarcMessage); err == nil {
+		t.Error("unaligned SPF: expected a rejection")
+	}
+}
+
+func TestDMARCPolicy(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		record string
+		sample int
+		want   DMARCDisposition
+	}{
+		{"reject", "v=DMARC1; p=reject", 0, DMARCReject},
+		{"quarantine", "v=DMARC1; p=quarantine", 0, DMARCQuarantine},
+		{"none", "v=DMARC1; p=none", 0, DMARCNone},
+		{"reject within pct", "v=DMARC1; p=reject; pct=50", 49, DMARCReject},
+		{"reject outside pct", "v=DMARC1; p=reject; pct=50", 50, DMARCQuarantine},
+		{"quarantine outside pct", "v=DMARC1; p=quarantine; pct=0", 0, DMARCNone},
+		{"invalid policy with rua", "v=DMARC1; p=bogus; rua=mailto:d@example.com", 0, DMARCNone},
+		{"case of the tags", "v=DMARC1; p=Quarantine", 0, DMARCQuarantine},
+	}
+
+	for _, tt := range tests {
+		resolver := &mockSPFResolver{results: map[string][]string{
+			"_dmarc.example.com": {tt.record},
+		}}
+		d := DMARC(WithDMARCResolver(resolver), withDMARCSample(func() int { return tt.sample }))
+
+		result, err := dmarcTest(t, d, "alice@example.com", dmarcMessage)
+		if tt.want == DMARCReject {
+			var smtpErr smtpd.Error
+			if !errors.As(err, &smtpErr) || smtpErr.Code != 550 {
+				t.Errorf("%s: got %v, want a 550", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if result.Disposition != tt.want {
+			t.Errorf("%s: disposition %s, want %s", tt.name, result.Disposition, tt.want)
+		}
+	}
+}
+
+func TestDMARCOrganizationalDomain(t *testing.T) {
+	t.Parallel()
+
+	resolver := &mockSPFResolver{results: map[string][]string{
+		"_dmarc.example.co.uk": {"v=DMARC1; p=none; sp=reject"},
+	}}
+	d := DMARC(WithDMARCResolver(resolver))
+
+	msg := strings.Replace(dmarcMessage, "alice@example.com", "alice@news.example.co.uk", 1)
+	if _, err := dmarcTest(t, d, "alice@news.example.co.uk", msg); err == nil {
+		t.Error("subdomain: expected the sp= policy to reject")
+	}
+
+	msg = strings.Replace(dmarcMessage, "alice@example.com", "alice@example.co.uk", 1)
+	result, err := dmarcTest(t, d, "alice@example.co.uk", msg)
+	if err != nil {
+		t.Fatalf("organizational domain: %v", err)
+	}
+	if result.Record == nil || result.Record.Domain != "example.co.uk" || result.Disposition != DMARCNone {
+		t.Errorf("result = %+v, want the p= policy of example.co.uk", result)
+	}
+}
+
+func TestDMARCNoRecord(t *testing.T) {
+	t.Parallel()
+
+	resolver := &mockSPFResolver{results: map[string][]string{
+		"_dmarc.example.com": {"v=DMARC1; p=reject", "v=DMARC1; p=none"},
+	}}
+	var reports int
+	d := DMARC(WithDMARCResolver(resolver), WithDMARCReporter(DMARCReporterFunc(func(context.Context, *DMARCResult) {
+		reports++
+	})))
+
+	// Two records are as good as none.
+	result, err := dmarcTest(t, d, "alice@example.com", dmarcMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Record != nil || result.Disposition != DMARCNone {
+		t.Errorf("result = %+v, want no policy", result)
+	}
+	if reports != 0 {
+		t.Errorf("%d reports for a domain without a policy", reports)
+	}
+}
+
+func TestDMARCReporter(t *testing.T) {
+	t.Parallel()
+
+	resolver := &mockSPFResolver{results: map[string][]string{
+		"_dmarc.example.com": {"v=DMARC1; p=quarantine; rua=mailto:a@example.com, mailto:b@example.net"},
+	}}
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	var got []*DMARCResult
+	d := DMARC(
+		WithDMARCResolver(resolver),
+		withDMARCClock(func() time.Time { return now }),
+		WithDMARCReporter(DMARCReporterFunc(func(_ context.Context, r *DMARCResult) {
+			got = append(got, r)
+		})),
+	)
+
+	if _, err := dmarcTest(t, d, "alice@example.org", dmarcMessage); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("%d reports, want 1", len(got))
+	}
+
+	r := got[0]
+	if !r.Time.Equal(now) || !r.SourceIP.Equal(net.ParseIP("1.2.3.4")) {
+		t.Errorf("report at %v from %v", r.Time, r.SourceIP)
+	}
+	if r.HeaderFrom != "example.com" || r.EnvelopeFrom != "example.org" {
+		t.Errorf("report identifiers %s and %s", r.HeaderFrom, r.EnvelopeFrom)
+	}
+	if r.Disposition != DMARCQuarantine || r.SPF != spf.None {
+		t.Errorf("report disposition %s and SPF %s", r.Disposition, r.SPF)
+	}
+	if want := []string{"mailto:a@example.com", "mailto:b@example.net"}; strings.Join(r.Record.AggregateReports, " ") != strings.Join(want, " ") {
+		t.Errorf("rua = %q, want %q", r.Record.AggregateReports, want)
+	}
+}
+
+func TestDMARCTemporaryError(t *testing.T) {
+	t.Parallel()
+
+	resolver := &dmarcResolver{broken: map[string]bool{"_dmarc.example.com": true}}
+
+	_, err := dmarcTest(t, DMARC(WithDMARCResolver(resolver)), "alice@example.com", dmarcMessage)
+	var smtpErr smtpd.Error
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 451 {
+		t.Errorf("got %v, want a 451", err)
+	}
+}
+
+// TestDMARCFromCharset covers a From whose display name is in a charset
+// that the mail package cannot decode. The address behind it takes the
+// policy of its domain all the same, and a From that does not parse fails.
+func TestDMARCFromCharset(t *testing.T) {
+	t.Parallel()
+
+	resolver := &mockSPFResolver{results: map[string][]string{
+		"_dmarc.example.com": {"v=DMARC1; p=reject"},
+	}}
+	d := DMARC(WithDMARCResolver(resolver))
+
+	tests := []struct {
+		name string
+		from string
+		want smtpd.EnhancedCode
+	}{
+		{"plain", "Boss <ceo@example.com>", smtpd.EnhancedCode{5, 7, 1}},
+		{"unknown charset", "=?x-unknown?Q?Boss?= <ceo@example.com>", smtpd.EnhancedCode{5, 7, 1}},
+		{"ISO-2022-JP", "=?ISO-2022-JP?B?GyRCJDMkcyRLJEEkTxsoQg==?= <ceo@example.com>", smtpd.EnhancedCode{5, 7, 1}},
+		{"no address", "Boss <ceo@example.com", smtpd.EnhancedCode{5, 6, 0}},
+		{"two addresses", "ceo@example.com, eve@evil.example", smtpd.EnhancedCode{5, 6, 0}},
+	}
+	for _, tt := range tests {
+		msg := strings.Replace(dmarcMessage, "Alice <alice@example.com>", tt.from, 1)
+		_, err := dmarcTest(t, d, "spoofer@evil.example", msg)
+		var smtpErr smtpd.Error
+		if !errors.As(err, &smtpErr) || smtpErr.Code != 550 || smtpErr.Enhanced != tt.want {
+			t.Errorf("%s: got %v, want 550 %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestDMARCFromFields(t *testing.T) {
+	t.Parallel()
+
+	d := DMARC(WithDMARCResolver(&mockSPFResolver{}))
+
+	tests := map[string]string{
+		"no From":  strings.Replace(dmarcMessage, "From: Alice <alice@example.com>\r\n", "", 1),
+		"two From": "From: eve@example.org\r\n" + dmarcMessage,
+	}
+	for name, msg := range tests {
+		_, err := dmarcTest(t, d, "alice@example.com", msg)
+		var smtpErr smtpd.Error
+		if !errors.As(err, &smtpErr) || smtpErr.Code != 550 {
+			t.Errorf("%s: got %v, want a 550", name, err)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package middleware
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"mime"
+	"net/mail"
+	"strings"
+
+	"github.com/chrj/smtpd/v2/internal/spool"
+)
+
+// spooledBody is a message body that reads from a spool, behind octets that
+// a middleware put in front of it. Close removes the spool.
+type spooledBody struct {
+	io.Reader
+	spool *spool.Spool
+}
+
+func (b *spooledBody) Close() error { return b.spool.Close() }
+
+// headerField is one field of the header of a message.
+type headerField struct {
+	// name is the name of the field as the message writes it.
+	name string
+
+	// raw is the whole field with its folding, and with every line break
+	// written as CRLF. The last line break is part of it.
+	raw string
+}
+
+// value gives the text after the colon, unfolded.
+func (f headerField) value() string {
+	_, v, _ := strings.Cut(f.raw, ":")
+	v = strings.ReplaceAll(v, "\r\n", "")
+	return strings.TrimSpace(v)
+}
+
+// header is the header of a message, with the fields in the order of the
+// message.
+type header []headerField
+
+// get gives the value of the first field of the name, and the empty string
+// when the header has none.
+func (h header) get(name string) string {
+	for _, f := range h {
+		if strings.EqualFold(f.name, name) {
+			return f.value()
+		}
+	}
+	return ""
+}
+
+// all gives every field of the name, in the order of the message.
+func (h header) all(name string) []headerField {
+	var fields []headerField
+	for _, f := range h {
+		if strings.EqualFold(f.name, name) {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// readHeader reads the header of a message. It gives the fields, the length of
+// the header in octets with the empty line after it, and the line break that
+// the message uses: "\r\n", or "\n" for a message that arrived through DATA,
+// which gives the lines without the carriage return.
+//
+// A message without an empty line is all header. A line that is not a field
+// and not the continuation of one ends the header there, and the body starts
+// with it.
+func readHeader(r io.Reader) (h header, size int64, eol string, err error) {
+	br := bufio.NewReader(r)
+	eol = "\r\n"
+
+	var (
+		field   strings.Builder
+		name    string
+		started bool
+	)
+
+	flush := func() {
+		if name != "" {
+			h = append(h, headerField{name: name, raw: field.String()})
+		}
+		field.Reset()
+		name = ""
+	}
+
+	for {
+		line, err := br.ReadString('\n')
+		if line == "" && err != nil {
+			flush()
+			if errors.Is(err, io.EOF) {
+				return h, size, eol, nil
+			}
+			return nil, 0, "", err
+		}
+
+		if !started {
+			started = true
+			if strings.HasSuffix(line, "\n") && !strings.HasSuffix(line, "\r\n") {
+				eol = "\n"
+			}
+		}
+
+		text := strings.TrimRight(line, "\r\n")
+
+		if text == "" {
+			flush()
+			return h, size + int64(len(line)), eol, nil
+		}
+
+		switch {
+		case text[0] == ' ' || text[0] == '\t':
+			if name == "" {
+				// A continuation with no field before it is not a header.
+				flush()
+				return h, size, eol, nil
+			}
+		default:
+			n, _, ok := strings.Cut(text, ":")
+			if !ok || n == "" || strings.ContainsAny(n, " \t") {
+				flush()
+				return h, size, eol, nil
+			}
+			flush()
+			name = n
+		}
+
+		field.WriteString(text)
+		field.WriteString("\r\n")
+		size += int64(len(line))
+	}
+}
+
+// addressParser parses the addresses of a header field such as From. A
+// display name in a charset that mime.WordDecoder does not know, such as
+// ISO-2022-JP or windows-1252, stays as it is encoded, so the address
+// behind it still parses. Only the address matters to the checks here.
+var addressParser = mail.AddressParser{
+	WordDecoder: &mime.WordDecoder{
+		CharsetReader: func(_ string, r io.Reader) (io.Reader, error) { return r, nil },
+	},
+}
+
+// domainOf gives the domain of an address in lower case, and the empty string
+// for an address without one.
+func domainOf(addr string) string {
+	i := strings.LastIndexByte(addr, '@')
+	if i < 0 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSuffix(addr[i+1:], "."))
+}
@@ -0,0 +1,271 @@
+package middleware
+
+import (
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// passwordHash is the stored hash of a password.
+type passwordHash interface {
+	// verify reports whether pass is the password of the hash, in a time
+	// that does not depend on how much of it matches.
+	verify(pass string) bool
+	// decoy gives a hash of the same cost that no password matches.
+	decoy() passwordHash
+	// params names the scheme and the parameters that set the cost of
+	// verify, the same for each hash that costs the same.
+	params() string
+}
+
+// parsePasswordHash reads a hash in the crypt form of one of the schemes
+// that UserFile takes: bcrypt ("$2a$", "$2b$" or "$2y$"), argon2id
+// ("$argon2id$") or SHA-512 crypt ("$6$").
+func parsePasswordHash(s string) (passwordHash, error) {
+	switch {
+	case strings.HasPrefix(s, "$2a$"), strings.HasPrefix(s, "$2b$"), strings.HasPrefix(s, "$2y$"):
+		return parseBcrypt(s)
+	case strings.HasPrefix(s, "$argon2id$"):
+		return parseArgon2id(s)
+	case strings.HasPrefix(s, "$6$"):
+		return parseSHA512Crypt(s)
+	}
+	return nil, errors.New("unknown password hash scheme")
+}
+
+type bcryptHash []byte
+
+func parseBcrypt(s string) (passwordHash, error) {
+	if _, err := bcrypt.Cost([]byte(s)); err != nil {
+		return nil, err
+	}
+	return bcryptHash(s), nil
+}
+
+func (h bcryptHash) verify(pass string) bool {
+	return bcrypt.CompareHashAndPassword(h, []byte(pass)) == nil
+}
+
+func (h bcryptHash) decoy() passwordHash {
+	// The cost and salt stay, and the 31 characters of the digest become
+	// ones that no password gives.
+	d := []byte(string(h))
+	for i := len(d) - 31; i < len(d); i++ {
+		d[i] = '.'
+	}
+	return bcryptHash(d)
+}
+
+func (h bcryptHash) params() string {
+	cost, _ := bcrypt.Cost(h)
+	return fmt.Sprintf("bcrypt cost=%d", cost)
+}
+
+// argon2idHash is a hash in the form of the PHC string format:
+//
+//	$argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+type argon2idHash struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func parseArgon2id(s string) (passwordHash, error) {
+	parts := strings.Split(s, "$")
+	if len(parts) != 6 || parts[2] != "v=19" {
+		return nil, errors.New("malformed argon2id hash")
+	}
+
+	var h argon2idHash
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return nil, fmt.Errorf("malformed argon2id parameters: %w", err)
+	}
+	if h.time == 0 || h.threads == 0 {
+		return nil, errors.New("malformed argon2id parameters")
+	}
+
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("malformed argon2id salt: %w", err)
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return nil, errors.New("malformed argon2id key")
+	}
+	return h, nil
+}
+
+func (h argon2idHash) verify(pass string) bool {
+	key := argon2.IDKey([]byte(pass), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	return subtle.ConstantTimeCompare(key, h.key) == 1
+}
+
+func (h argon2idHash) decoy() passwordHash {
+	// A key of the length that no derivation gives it.
+	h.key = make([]byte, len(h.key)+1)
+	return h
+}
+
+func (h argon2idHash) params() string {
+	return fmt.Sprintf("argon2id m=%d,t=%d,p=%d,len=%d", h.memory, h.time, h.threads, len(h.key))
+}
+
+// sha512CryptHash is a hash of the SHA-512 crypt scheme of glibc:
+//
+//	$6$[rounds=<n>$]<salt>$<digest>
+type sha512CryptHash struct {
+	rounds int
+	salt   []byte
+	digest []byte
+}
+
+const (
+	sha512CryptDefaultRounds = 5000
+	sha512CryptMinRounds     = 1000
+	sha512CryptMaxRounds     = 999999999
+	sha512CryptMaxSalt       = 16
+)
+
+func parseSHA512Crypt(s string) (passwordHash, error) {
+	rest := strings.TrimPrefix(s, "$6$")
+
+	h := sha512CryptHash{rounds: sha512CryptDefaultRounds}
+	if r, ok := strings.CutPrefix(rest, "rounds="); ok {
+		n, after, ok := strings.Cut(r, "$")
+		rounds, err := strconv.Atoi(n)
+		if !ok || err != nil {
+			return nil, errors.New("malformed SHA-512 crypt rounds")
+		}
+		h.rounds = min(max(rounds, sha512CryptMinRounds), sha512CryptMaxRounds)
+		rest = after
+	}
+
+	salt, digest, ok := strings.Cut(rest, "$")
+	if !ok || len(digest) != 86 {
+		return nil, errors.New("malformed SHA-512 crypt hash")
+	}
+	h.salt = []byte(salt[:min(len(salt), sha512CryptMaxSalt)])
+	h.digest = []byte(digest)
+	return h, nil
+}
+
+func (h sha512CryptHash) verify(pass string) bool {
+	return subtle.ConstantTimeCompare(sha512Crypt([]byte(pass), h.salt, h.rounds), h.digest) == 1
+}
+
+func (h sha512CryptHash) decoy() passwordHash {
+	h.digest = nil
+	return h
+}
+
+func (h sha512CryptHash) params() string {
+	return fmt.Sprintf("sha512-crypt rounds=%d", h.rounds)
+}
+
+// sha512Crypt gives the encoded digest of pass under the SHA-512 crypt
+// scheme, as Ulrich Drepper's "Unix crypt using SHA-256 and SHA-512"
+// specifies it.
+func sha512Crypt(pass, salt []byte, rounds int) []byte {
+	b := sha512.New()
+	b.Write(pass)
+	b.Write(salt)
+	b.Write(pass)
+	sumB := b.Sum(nil)
+
+	a := sha512.New()
+	a.Write(pass)
+	a.Write(salt)
+	for i := len(pass); i > 0; i -= sha512.Size {
+		a.Write(sumB[:min(i, sha512.Size)])
+	}
+	for i := len(pass); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(sumB)
+		} else {
+			a.Write(pass)
+		}
+	}
+	sum := a.Sum(nil)
+
+	dp := sha512.New()
+	for range len(pass) {
+		dp.Write(pass)
+	}
+	p := repeatTo(dp.Sum(nil), len(pass))
+
+	ds := sha512.New()
+	for range 16 + int(sum[0]) {
+		ds.Write(salt)
+	}
+	s := repeatTo(ds.Sum(nil), len(salt))
+
+	c := sha512.New()
+	for r := range rounds {
+		c.Reset()
+		if r&1 != 0 {
+			c.Write(p)
+		} else {
+			c.Write(sum)
+		}
+		if r%3 != 0 {
+			c.Write(s)
+		}
+		if r%7 != 0 {
+			c.Write(p)
+		}
+		if r&1 != 0 {
+			c.Write(sum)
+		} else {
+			c.Write(p)
+		}
+		sum = c.Sum(sum[:0])
+	}
+
+	return cryptBase64(sum)
+}
+
+// repeatTo gives the bytes of b repeated up to n bytes.
+func repeatTo(b []byte, n int) []byte {
+	out := make([]byte, n)
+	for i := 0; i < n; i += len(b) {
+		copy(out[i:], b)
+	}
+	return out
+}
+
+// sha512CryptOrder is the order in which the scheme takes the bytes of the
+// digest into groups of three.
+var sha512CryptOrder = [...][3]int{
+	{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+	{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+	{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+	{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+	{62, 20, 41},
+}
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// cryptBase64 encodes a SHA-512 digest in the base64 form of crypt, least
+// significant bits first.
+func cryptBase64(sum []byte) []byte {
+	out := make([]byte, 0, 86)
+	put := func(w uint32, n int) {
+		for range n {
+			out = append(out, cryptAlphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+	for _, g := range sha512CryptOrder {
+		put(uint32(sum[g[0]])<<16|uint32(sum[g[1]])<<8|uint32(sum[g[2]]), 4)
+	}
+	put(uint32(sum[63]), 2)
+	return out
+}
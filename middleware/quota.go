@@ -0,0 +1,459 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/chrj/smtpd/v2"
+	"github.com/chrj/smtpd/v2/internal/spool"
+)
+
+// QuotaKeyFunc gives the key that a quota counts the mail of a transaction
+// under. The empty key leaves the transaction out of the quota.
+type QuotaKeyFunc func(peer smtpd.Peer, sender string) string
+
+// QuotaByUser counts the mail of each authenticated user. A session that did
+// not authenticate has no quota.
+func QuotaByUser(peer smtpd.Peer, _ string) string {
+	return peer.Username
+}
+
+// QuotaBySenderDomain counts the mail of each domain of the envelope sender.
+// The null sender has no quota.
+func QuotaBySenderDomain(_ smtpd.Peer, sender string) string {
+	return domainOf(sender)
+}
+
+// QuotaLimit caps the mail of a key within a window. A zero field other than
+// Window sets no cap.
+type QuotaLimit struct {
+	Window     time.Duration
+	Messages   int
+	Recipients int
+	Bytes      int64
+}
+
+// QuotaUsage counts the mail of a key within a window.
+type QuotaUsage struct {
+	Messages   int
+	Recipients int
+	Bytes      int64
+}
+
+// QuotaBucket names the counts of a key within one window. A window starts
+// at a multiple of its length since the zero time, so a day runs from
+// midnight UTC to the next.
+type QuotaBucket struct {
+	Key    string
+	Window time.Duration
+	Start  time.Time
+}
+
+// Admits reports whether delta fits into l on top of used. A quota of
+// Bytes that is spent admits nothing more, even a delta of no octets.
+func (l QuotaLimit) Admits(used, delta QuotaUsage) bool {
+	return l.exceeded(used, delta) == nil
+}
+
+// exceeded gives the error of the cap of l that delta on top of used goes
+// over.
+func (l QuotaLimit) exceeded(used, delta QuotaUsage) error {
+	switch {
+	case l.Messages > 0 && used.Messages+delta.Messages > l.Messages:
+		return errQuotaMessages
+	case l.Recipients > 0 && used.Recipients+delta.Recipients > l.Recipients:
+		return errQuotaRecipients
+	case l.Bytes > 0 && (used.Bytes >= l.Bytes || used.Bytes+delta.Bytes > l.Bytes):
+		return errQuotaBytes
+	}
+	return nil
+}
+
+// QuotaStore keeps the counts of the quotas. Usage of a bucket that the
+// store does not hold gives the zero QuotaUsage. A store that several
+// servers share makes the quota hold across them.
+//
+// Add checks and counts in one step, so that sessions that count at once
+// cannot all pass a check and then all count past the limit. It adds delta
+// to the counts of bucket where limit admits it, and reports whether it
+// did, with the counts after. The zero QuotaLimit admits every delta, such
+// as the negative one that gives back what a message counted in a bucket
+// before another bucket refused it.
+type QuotaStore interface {
+	Usage(ctx context.Context, bucket QuotaBucket) (QuotaUsage, error)
+	Add(ctx context.Context, bucket QuotaBucket, delta QuotaUsage, limit QuotaLimit) (used QuotaUsage, ok bool, err error)
+}
+
+var (
+	errQuotaMessages   = smtpd.Error{Code: 452, Enhanced: smtpd.EnhancedCode{4, 7, 1}, Message: "Message quota exceeded, try again later"}
+	errQuotaRecipients = smtpd.Error{Code: 452, Enhanced: smtpd.EnhancedCode{4, 7, 1}, Message: "Recipient quota exceeded, try again later"}
+	errQuotaBytes      = smtpd.Error{Code: 452, Enhanced: smtpd.EnhancedCode{4, 7, 1}, Message: "Volume quota exceeded, try again later"}
+	errQuotaTemp       = smtpd.Error{Code: 451, Enhanced: smtpd.EnhancedCode{4, 3, 0}, Message: "Could not check the quota, try again later"}
+)
+
+// QuotaOption configures Quota.
+type QuotaOption func(*quota)
+
+// WithQuotaStore sets the store of the counts. The default is a QuotaMemory
+// of its own.
+func WithQuotaStore(store QuotaStore) QuotaOption {
+	return func(q *quota) { q.store = store }
+}
+
+// WithQuotaSpool sets where a quota of Bytes keeps the message while it
+// counts it: memory octets in memory, and the rest in a temporary file in
+// dir. The default is 1MB, in the directory of os.TempDir.
+func WithQuotaSpool(memory int64, dir string) QuotaOption {
+	return func(q *quota) { q.spoolMemory, q.spoolDir = memory, dir }
+}
+
+// withQuotaClock is a test hook for overriding time.Now.
+func withQuotaClock(now func() time.Time) QuotaOption {
+	return func(q *quota) { q.now = now }
+}
+
+type quota struct {
+	key         QuotaKeyFunc
+	limits      []QuotaLimit
+	store       QuotaStore
+	spoolMemory int64
+	spoolDir    string
+	now         func() time.Time
+}
+
+// quotaTxKey holds the recipients that the quota took in the transaction.
+type quotaTxKey struct{}
+
+// Quota returns a Middleware that caps the mail of each key within the
+// windows of limits, such as the messages of a user in an hour and the
+// octets of a user in a day:
+//
+//	srv.Use(middleware.Quota(middleware.QuotaByUser, []middleware.QuotaLimit{
+//	    {Window: time.Hour, Messages: 100},
+//	    {Window: 24 * time.Hour, Messages: 1000, Recipients: 5000, Bytes: 1 << 30},
+//	}))
+//
+// Each RCPT TO that a full quota of messages or recipients would not take
+// gets 452 4.7.1, and so does each one of a key whose quota of octets is
+// spent. At the Handler stage the quota checks the message once more, with
+// its size, and counts it. A quota of Bytes reads the whole message to learn
+// its size, so it keeps the message in a spool. The check at RCPT TO refuses
+// early, and the count at the Handler stage holds: the store checks and
+// counts the message in one step, so that sessions of one key at once do
+// not all go past a limit.
+//
+// The mail counts as it passes the stage, so a message that fails after it
+// still counts. Register the quota after the checks that refuse mail.
+//
+// Each limit needs a Window, and Quota panics at a limit without one.
+func Quota(key QuotaKeyFunc, limits []QuotaLimit, opts ...QuotaOption) smtpd.Middleware {
+	for _, l := range limits {
+		if l.Window <= 0 {
+			panic(fmt.Sprintf("middleware: Quota limit of window %v", l.Window))
+		}
+	}
+
+	q := &quota{
+		key:         key,
+		limits:      limits,
+		spoolMemory: spool.DefaultMemory,
+		now:         time.Now,
+	}
+	for _, opt := range opts {
+		opt(q)
+	}
+	if q.store == nil {
+		q.store = NewQuotaMemory()
+	}
+
+	return smtpd.Middleware{
+		CheckSender: func(ctx context.Context, _ smtpd.Peer, _ string) (context.Context, error) {
+			return context.WithValue(ctx, quotaTxKey{}, 0), nil
+		},
+		CheckRecipient: q.checkRecipient,
+		Handler:        q.handler,
+	}
+}
+
+// checkRecipient takes a recipient while each quota has room for it.
+func (q *quota) checkRecipient(ctx context.Context, peer smtpd.Peer, _ string) (context.Context, error) {
+	sender, _ := smtpd.SenderFromContext(ctx)
+	key := q.key(peer, sender)
+	if key == "" {
+		return ctx, nil
+	}
+
+	taken, _ := ctx.Value(quotaTxKey{}).(int)
+	if err := q.check(ctx, key, QuotaUsage{Messages: 1, Recipients: taken + 1}); err != nil {
+		return ctx, err
+	}
+	return context.WithValue(ctx, quotaTxKey{}, taken+1), nil
+}
+
+// handler checks the message against each quota, and counts it.
+func (q *quota) handler(ctx context.Context, peer smtpd.Peer, env *smtpd.Envelope) (context.Context, error) {
+	key := q.key(peer, env.Sender)
+	if key == "" {
+		return ctx, nil
+	}
+
+	msg := QuotaUsage{Messages: 1, Recipients: len(env.Recipients)}
+
+	var sp *spool.Spool
+	if q.countsBytes() {
+		var err error
+		sp, err = spool.Read(env.Data, q.spoolMemory, q.spoolDir)
+		_ = env.Data.Close()
+		if err != nil {
+			return ctx, fmt.Errorf("middleware: spool the message from %v: %w", peer.Addr, err)
+		}
+		msg.Bytes = sp.Size()
+	}
+
+	if err := q.add(ctx, key, msg); err != nil {
+		if sp != nil {
+			_ = sp.Close()
+		}
+		return ctx, err
+	}
+
+	if sp != nil {
+		env.Data = &spooledBody{Reader: sp.Section(0), spool: sp}
+	}
+	return ctx, nil
+}
+
+func (q *quota) countsBytes() bool {
+	for _, l := range q.limits {
+		if l.Bytes > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// check gives an error when msg does not fit into a quota of key. A quota
+// of Bytes refuses a recipient once it is spent, before the size of the
+// message is known.
+func (q *quota) check(ctx context.Context, key string, msg QuotaUsage) error {
+	now := q.now()
+	for _, l := range q.limits {
+		used, err := q.store.Usage(ctx, q.bucket(key, l, now))
+		if err != nil {
+			smtpd.LoggerFromContext(ctx).WarnContext(ctx, "quota lookup failed",
+				slog.String("key", key), slog.Any("error", err))
+			return errQuotaTemp
+		}
+
+		if exceeded := l.exceeded(used, msg); exceeded != nil {
+			smtpd.LoggerFromContext(ctx).InfoContext(ctx, "quota exceeded",
+				slog.String("key", key), slog.Duration("window", l.Window))
+			return exceeded
+		}
+	}
+	return nil
+}
+
+// add counts msg in each window of key, where each quota admits it. A quota
+// that does not gives back what the windows before it counted.
+func (q *quota) add(ctx context.Context, key string, msg QuotaUsage) error {
+	now := q.now()
+	for i, l := range q.limits {
+		used, ok, err := q.store.Add(ctx, q.bucket(key, l, now), msg, l)
+		if err != nil {
+			smtpd.LoggerFromContext(ctx).WarnContext(ctx, "quota update failed",
+				slog.String("key", key), slog.Any("error", err))
+			q.undo(ctx, key, msg, now, i)
+			return errQuotaTemp
+		}
+		if !ok {
+			smtpd.LoggerFromContext(ctx).InfoContext(ctx, "quota exceeded",
+				slog.String("key", key), slog.Duration("window", l.Window))
+			q.undo(ctx, key, msg, now, i)
+			if exceeded := l.exceeded(used, msg); exceeded != nil {
+				return exceeded
+			}
+			return errQuotaMessages
+		}
+	}
+	return nil
+}
+
+// undo gives back msg in the first n windows of key, which add counted it in.
+func (q *quota) undo(ctx context.Context, key string, msg QuotaUsage, now time.Time, n int) {
+	back := QuotaUsage{Messages: -msg.Messages, Recipients: -msg.Recipients, Bytes: -msg.Bytes}
+	for _, l := range q.limits[:n] {
+		if _, _, err := q.store.Add(ctx, q.bucket(key, l, now), back, QuotaLimit{}); err != nil {
+			smtpd.LoggerFromContext(ctx).WarnContext(ctx, "quota update failed",
+				slog.String("key", key), slog.Any("error", err))
+		}
+	}
+}
+
+func (q *quota) bucket(key string, l QuotaLimit, now time.Time) QuotaBucket {
+	return QuotaBucket{Key: key, Window: l.Window, Start: now.Truncate(l.Window)}
+}
+
+// QuotaMemory is a QuotaStore that holds the counts in memory. SaveFile and
+// LoadFile keep them across a restart. It is safe for concurrent use.
+type QuotaMemory struct {
+	now func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[quotaMemoryKey]QuotaUsage
+	nextSweep time.Time
+}
+
+// quotaMemoryKey is a QuotaBucket in a form that compares as a map key.
+type quotaMemoryKey struct {
+	key    string
+	window time.Duration
+	start  int64
+}
+
+func memoryKey(b QuotaBucket) quotaMemoryKey {
+	return quotaMemoryKey{key: b.Key, window: b.Window, start: b.Start.UnixNano()}
+}
+
+// NewQuotaMemory returns an empty QuotaMemory.
+func NewQuotaMemory() *QuotaMemory {
+	return &QuotaMemory{now: time.Now, buckets: make(map[quotaMemoryKey]QuotaUsage)}
+}
+
+// Usage gives the counts of bucket.
+func (m *QuotaMemory) Usage(_ context.Context, bucket QuotaBucket) (QuotaUsage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.buckets[memoryKey(bucket)], nil
+}
+
+// Add adds delta to the counts of bucket where limit admits it, and gives
+// the counts after. A bucket whose window has passed goes, once a minute.
+func (m *QuotaMemory) Add(_ context.Context, bucket QuotaBucket, delta QuotaUsage, limit QuotaLimit) (QuotaUsage, bool, error) {
+	now := m.now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !now.Before(m.nextSweep) {
+		m.nextSweep = now.Add(time.Minute)
+		for k := range m.buckets {
+			if time.Unix(0, k.start).Add(k.window).Before(now) {
+				delete(m.buckets, k)
+			}
+		}
+	}
+
+	k := memoryKey(bucket)
+	u := m.buckets[k]
+	if !limit.Admits(u, delta) {
+		return u, false, nil
+	}
+	u.Messages += delta.Messages
+	u.Recipients += delta.Recipients
+	u.Bytes += delta.Bytes
+	m.buckets[k] = u
+	return u, true, nil
+}
+
+// quotaSnapshot is the form of a bucket in the file of SaveFile.
+type quotaSnapshot struct {
+	Key        string        `json:"key"`
+	Window     time.Duration `json:"window"`
+	Start      time.Time     `json:"start"`
+	Messages   int           `json:"messages,omitempty"`
+	Recipients int           `json:"recipients,omitempty"`
+	Bytes      int64         `json:"bytes,omitempty"`
+}
+
+// WriteTo writes the counts to w, as JSON.
+func (m *QuotaMemory) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	snapshot := make([]quotaSnapshot, 0, len(m.buckets))
+	for k, u := range m.buckets {
+		snapshot = append(snapshot, quotaSnapshot{
+			Key: k.key, Window: k.window, Start: time.Unix(0, k.start).UTC(),
+			Messages: u.Messages, Recipients: u.Recipients, Bytes: u.Bytes,
+		})
+	}
+	m.mu.Unlock()
+
+	b, err := json.Marshal(snapshot)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// ReadFrom adds the counts that WriteTo wrote to the ones that m holds.
+func (m *QuotaMemory) ReadFrom(r io.Reader) (int64, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return int64(len(b)), err
+	}
+	var snapshot []quotaSnapshot
+	if err := json.Unmarshal(b, &snapshot); err != nil {
+		return int64(len(b)), fmt.Errorf("quota: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range snapshot {
+		k := memoryKey(QuotaBucket{Key: s.Key, Window: s.Window, Start: s.Start})
+		u := m.buckets[k]
+		u.Messages += s.Messages
+		u.Recipients += s.Recipients
+		u.Bytes += s.Bytes
+		m.buckets[k] = u
+	}
+	return int64(len(b)), nil
+}
+
+// SaveFile writes the counts to the file at path. It writes a temporary
+// file next to it first, so a crash leaves the old file whole.
+func (m *QuotaMemory) SaveFile(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("quota: %w", err)
+	}
+	_, err = m.WriteTo(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return fmt.Errorf("quota: %w", err)
+	}
+	return nil
+}
+
+// LoadFile reads the counts that SaveFile wrote to the file at path. A file
+// that does not exist holds no counts.
+func (m *QuotaMemory) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("quota: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	_, err = m.ReadFrom(f)
+	return err
+}
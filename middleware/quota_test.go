@@ -0,0 +1,271 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chrj/smtpd/v2"
+)
+
+// quotaSession runs a transaction of user through the hooks of mw: MAIL FROM,
+// a RCPT TO for each of rcpts, and the message. It gives the error of the
+// first hook that failed.
+func quotaSession(mw smtpd.Middleware, user, sender string, rcpts []string, message string) error {
+	peer := smtpd.Peer{Username: user}
+	ctx, err := mw.CheckSender(context.Background(), peer, sender)
+	if err != nil {
+		return err
+	}
+	ctx = smtpd.ContextWithSender(ctx, sender)
+
+	for _, rcpt := range rcpts {
+		if ctx, err = mw.CheckRecipient(ctx, peer, rcpt); err != nil {
+			return err
+		}
+	}
+
+	env := &smtpd.Envelope{Sender: sender, Recipients: rcpts, Data: io.NopCloser(strings.NewReader(message))}
+	if _, err := mw.Handler(ctx, peer, env); err != nil {
+		return err
+	}
+	_, err = io.Copy(io.Discard, env.Data)
+	_ = env.Data.Close()
+	return err
+}
+
+func TestQuotaMessages(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 1, 1, 10, 30, 0, 0, time.UTC)
+	mw := Quota(QuotaByUser, []QuotaLimit{{Window: time.Hour, Messages: 2}},
+		withQuotaClock(func() time.Time { return now }))
+
+	rcpts := []string{"bob@example.net"}
+	for i := range 2 {
+		if err := quotaSession(mw, "alice", "alice@example.com", rcpts, "x\r\n"); err != nil {
+			t.Fatalf("message %d: %v", i+1, err)
+		}
+	}
+	if err := quotaSession(mw, "alice", "alice@example.com", rcpts, "x\r\n"); !errors.Is(err, errQuotaMessages) {
+		t.Errorf("over the quota: %v, want %v", err, errQuotaMessages)
+	}
+
+	// Each user has a quota of its own, and a session that did not
+	// authenticate has none.
+	if err := quotaSession(mw, "bob", "bob@example.com", rcpts, "x\r\n"); err != nil {
+		t.Errorf("another user: %v", err)
+	}
+	for range 3 {
+		if err := quotaSession(mw, "", "carol@example.com", rcpts, "x\r\n"); err != nil {
+			t.Errorf("no user: %v", err)
+		}
+	}
+
+	// The next window starts afresh.
+	now = now.Add(30 * time.Minute)
+	if err := quotaSession(mw, "alice", "alice@example.com", rcpts, "x\r\n"); err != nil {
+		t.Errorf("in the next window: %v", err)
+	}
+}
+
+func TestQuotaConcurrent(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 1, 1, 10, 30, 0, 0, time.UTC)
+	store := NewQuotaMemory()
+	limits := []QuotaLimit{
+		{Window: 24 * time.Hour, Messages: 100},
+		{Window: time.Hour, Messages: 5},
+	}
+	mw := Quota(QuotaByUser, limits, WithQuotaStore(store),
+		withQuotaClock(func() time.Time { return now }))
+
+	// The sessions of one account pass the check at RCPT TO together, and
+	// the count at the Handler stage lets five of them through.
+	const sessions = 50
+	peer := smtpd.Peer{Username: "alice"}
+	start := make(chan struct{})
+	errs := make(chan error, sessions)
+	for range sessions {
+		ctx, _ := mw.CheckSender(context.Background(), peer, "alice@example.com")
+		ctx, err := mw.CheckRecipient(ctx, peer, "bob@example.net")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			<-start
+			env := &smtpd.Envelope{Sender: "alice@example.com", Recipients: []string{"bob@example.net"}, Data: io.NopCloser(strings.NewReader("x\r\n"))}
+			_, err := mw.Handler(ctx, peer, env)
+			errs <- err
+		}()
+	}
+	close(start)
+
+	passed := 0
+	for range sessions {
+		switch err := <-errs; {
+		case err == nil:
+			passed++
+		case !errors.Is(err, errQuotaMessages):
+			t.Errorf("a session: %v, want %v", err, errQuotaMessages)
+		}
+	}
+	if passed != 5 {
+		t.Errorf("%d messages passed, want 5", passed)
+	}
+
+	// The day gave back what the refused messages counted in it.
+	ctx := context.Background()
+	for _, l := range limits {
+		used, _ := store.Usage(ctx, QuotaBucket{Key: "alice", Window: l.Window, Start: now.Truncate(l.Window)})
+		if used.Messages != 5 {
+			t.Errorf("the window of %v counts %d messages, want 5", l.Window, used.Messages)
+		}
+	}
+}
+
+func TestQuotaRecipients(t *testing.T) {
+	t.Parallel()
+
+	mw := Quota(QuotaByUser, []QuotaLimit{{Window: 24 * time.Hour, Recipients: 3}})
+	peer := smtpd.Peer{Username: "alice"}
+
+	// The recipients of the transaction count before the message does.
+	ctx, _ := mw.CheckSender(context.Background(), peer, "alice@example.com")
+	var errs []error
+	for _, rcpt := range []string{"a@example.net", "b@example.net", "c@example.net", "d@example.net"} {
+		var err error
+		ctx, err = mw.CheckRecipient(ctx, peer, rcpt)
+		errs = append(errs, err)
+	}
+	if errs[2] != nil || !errors.Is(errs[3], errQuotaRecipients) {
+		t.Errorf("recipients: %v, want the fourth to get %v", errs, errQuotaRecipients)
+	}
+
+	// A new transaction starts its own count.
+	if err := quotaSession(mw, "alice", "alice@example.com", []string{"a@example.net", "b@example.net"}, "x\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := quotaSession(mw, "alice", "alice@example.com", []string{"c@example.net", "d@example.net"}, "x\r\n"); !errors.Is(err, errQuotaRecipients) {
+		t.Errorf("over the quota: %v, want %v", err, errQuotaRecipients)
+	}
+}
+
+func TestQuotaBytes(t *testing.T) {
+	t.Parallel()
+
+	mw := Quota(QuotaBySenderDomain, []QuotaLimit{{Window: 24 * time.Hour, Bytes: 100}})
+	rcpts := []string{"bob@example.net"}
+	message := strings.Repeat("x", 58) + "\r\n"
+
+	// The message goes on to the next stage whole.
+	peer := smtpd.Peer{}
+	ctx, _ := mw.CheckSender(context.Background(), peer, "alice@example.com")
+	env := &smtpd.Envelope{Sender: "alice@example.com", Recipients: rcpts, Data: io.NopCloser(strings.NewReader(message))}
+	if _, err := mw.Handler(ctx, peer, env); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(env.Data)
+	_ = env.Data.Close()
+	if string(got) != message {
+		t.Errorf("the next stage read %q", got)
+	}
+
+	// A message that would not fit fails at the end of the data, while the
+	// recipients still get in. Another address of the domain shares the
+	// quota.
+	if err := quotaSession(mw, "", "bob@Example.com", rcpts, message); !errors.Is(err, errQuotaBytes) {
+		t.Errorf("a message over the quota: %v, want %v", err, errQuotaBytes)
+	}
+	if err := quotaSession(mw, "", "bob@example.com", rcpts, "short\r\n"); err != nil {
+		t.Errorf("a message that fits: %v", err)
+	}
+	if err := quotaSession(mw, "", "alice@example.org", rcpts, message); err != nil {
+		t.Errorf("another domain: %v", err)
+	}
+}
+
+type failingQuotaStore struct{}
+
+func (failingQuotaStore) Usage(context.Context, QuotaBucket) (QuotaUsage, error) {
+	return QuotaUsage{}, errors.New("store is down")
+}
+
+func (failingQuotaStore) Add(context.Context, QuotaBucket, QuotaUsage, QuotaLimit) (QuotaUsage, bool, error) {
+	return QuotaUsage{}, false, errors.New("store is down")
+}
+
+func TestQuotaWithoutWindow(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("Quota with a limit of no window did not panic")
+		}
+	}()
+	Quota(QuotaByUser, []QuotaLimit{{Messages: 10}})
+}
+
+func TestQuotaStoreError(t *testing.T) {
+	t.Parallel()
+
+	mw := Quota(QuotaByUser, []QuotaLimit{{Window: time.Hour, Messages: 10}}, WithQuotaStore(failingQuotaStore{}))
+	if err := quotaSession(mw, "alice", "alice@example.com", []string{"bob@example.net"}, "x\r\n"); !errors.Is(err, errQuotaTemp) {
+		t.Errorf("a failing store: %v, want %v", err, errQuotaTemp)
+	}
+}
+
+func TestQuotaMemorySnapshot(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	bucket := QuotaBucket{Key: "alice", Window: 24 * time.Hour, Start: start}
+
+	m := NewQuotaMemory()
+	m.now = func() time.Time { return start }
+	_, _, _ = m.Add(ctx, bucket, QuotaUsage{Messages: 2, Recipients: 5, Bytes: 1000}, QuotaLimit{})
+
+	path := filepath.Join(t.TempDir(), "quota.json")
+	if err := m.SaveFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewQuotaMemory()
+	if err := restored.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	want := QuotaUsage{Messages: 2, Recipients: 5, Bytes: 1000}
+	if got, _ := restored.Usage(ctx, bucket); got != want {
+		t.Errorf("restored usage = %+v, want %+v", got, want)
+	}
+
+	if err := NewQuotaMemory().LoadFile(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Errorf("a missing file: %v", err)
+	}
+}
+
+func TestQuotaMemorySweep(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	now := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	m := NewQuotaMemory()
+	m.now = func() time.Time { return now }
+
+	old := QuotaBucket{Key: "alice", Window: time.Hour, Start: now}
+	_, _, _ = m.Add(ctx, old, QuotaUsage{Messages: 1}, QuotaLimit{})
+
+	now = now.Add(2 * time.Hour)
+	_, _, _ = m.Add(ctx, QuotaBucket{Key: "alice", Window: time.Hour, Start: now}, QuotaUsage{Messages: 1}, QuotaLimit{})
+
+	if got, _ := m.Usage(ctx, old); got != (QuotaUsage{}) {
+		t.Errorf("a passed window holds %+v", got)
+	}
+	if n := len(m.buckets); n != 1 {
+		t.Errorf("the store holds %d buckets, want 1", n)
+	}
+}
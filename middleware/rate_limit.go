@@ -2,33 +2,184 @@ package middleware
 
 import (
 	"context"
+	"fmt"
+	"math"
 	"net"
+	"strings"
+	"time"
 
 	"github.com/chrj/keyrate"
 	"github.com/chrj/smtpd/v2"
 	"golang.org/x/time/rate"
 )
 
+// RatePhase names the phase of a session that a RateLimit counts.
+type RatePhase int
+
+const (
+	// RateConnection counts each connection, before the greeting.
+	RateConnection RatePhase = iota
+	// RateSender counts each MAIL FROM.
+	RateSender
+	// RateRecipient counts each RCPT TO.
+	RateRecipient
+	// RateData counts each message as it starts to arrive, at DATA or at
+	// the first BDAT chunk, where the Handler stages of the server begin.
+	RateData
+)
+
+// RateSubject is what a RateKey picks the key of a RateLimit from. Sender is
+// set from MAIL FROM on, and Recipient in RCPT TO alone. peer.HeloName is
+// set from MAIL FROM on as well.
+type RateSubject struct {
+	Peer      smtpd.Peer
+	Sender    string
+	Recipient string
+}
+
+// RateKey gives the key that a RateLimit counts a subject under. The empty
+// key leaves the subject out.
+type RateKey func(s RateSubject) string
+
+// RateByIP keys on the IP address of the peer. A peer that is not on TCP,
+// such as one on a unix socket, has no key.
+func RateByIP(s RateSubject) string {
+	if tcpAddr, ok := s.Peer.Addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	return ""
+}
+
+// RateByIPv6Prefix keys on the /64 prefix of an IPv6 peer, which is what a
+// single site usually gets, and on the whole address of an IPv4 peer.
+func RateByIPv6Prefix(s RateSubject) string {
+	tcpAddr, ok := s.Peer.Addr.(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	if ip4 := tcpAddr.IP.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	return tcpAddr.IP.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// RateByHelo keys on the HELO name of the peer, in lower case.
+func RateByHelo(s RateSubject) string {
+	return strings.ToLower(s.Peer.HeloName)
+}
+
+// RateByUser keys on the name of the authenticated user. A session that did
+// not authenticate has no key.
+func RateByUser(s RateSubject) string {
+	return s.Peer.Username
+}
+
+// RateBySenderDomain keys on the domain of the envelope sender. The null
+// sender has no key.
+func RateBySenderDomain(s RateSubject) string {
+	return domainOf(s.Sender)
+}
+
+// RateByRecipientDomain keys on the domain of the recipient, so it counts in
+// RateRecipient alone.
+func RateByRecipientDomain(s RateSubject) string {
+	return domainOf(s.Recipient)
+}
+
+// rateRefusals holds the reply of each phase to a subject over its rate. A
+// refusal of the connection closes it, and the others leave the session
+// open for the client to try again.
+var rateRefusals = map[RatePhase]smtpd.Error{
+	RateConnection: {Code: 421, Enhanced: smtpd.EnhancedCode{4, 7, 0}},
+	RateSender:     {Code: 451, Enhanced: smtpd.EnhancedCode{4, 7, 1}},
+	RateRecipient:  {Code: 450, Enhanced: smtpd.EnhancedCode{4, 7, 1}},
+	RateData:       {Code: 451, Enhanced: smtpd.EnhancedCode{4, 7, 1}},
+}
+
+// RateLimit returns a Middleware that counts the subjects of phase under the
+// keys that key gives. Each key gets its own token bucket of size burst that
+// refills at rps tokens a second, and idle buckets go once they would have
+// refilled. A subject over the rate gets a reply for its phase, with the
+// time until the bucket gives a token again:
+//
+//	phase            reply
+//	RateConnection   421 4.7.0 Rate limit exceeded, try again in 2s
+//	RateSender       451 4.7.1 ...
+//	RateRecipient    450 4.7.1 ...
+//	RateData         451 4.7.1 ...
+//
+// The 421 closes the connection. RateLimit panics on an rps that is not
+// above zero. Limits of several phases and keys stack:
+//
+//	srv.Use(middleware.RateLimit(middleware.RateConnection, middleware.RateByIPv6Prefix, 1, 10))
+//	srv.Use(middleware.RateLimit(middleware.RateData, middleware.RateByUser, 0.1, 50))
+func RateLimit(phase RatePhase, key RateKey, rps float64, burst int) smtpd.Middleware {
+	// A bucket that never refills would refuse for good, with a reply that
+	// asks for a retry all the same.
+	if !(rps > 0) {
+		panic(fmt.Sprintf("middleware: RateLimit of rate %v", rps))
+	}
+	lims := keyrate.New[string](rate.Limit(rps), burst, keyrate.WithAutoEvict())
+
+	// A token comes back within 1/rps seconds.
+	retry := max(time.Duration(math.Ceil(1/rps))*time.Second, time.Second)
+	refusal := rateRefusals[phase]
+	refusal.Message = fmt.Sprintf("Rate limit exceeded, try again in %v", retry)
+
+	allow := func(s RateSubject) error {
+		k := key(s)
+		if k == "" || lims.Allow(k) {
+			return nil
+		}
+		return refusal
+	}
+
+	switch phase {
+	case RateConnection:
+		return smtpd.Middleware{
+			CheckConnection: func(ctx context.Context, peer smtpd.Peer) (context.Context, error) {
+				return ctx, allow(RateSubject{Peer: peer})
+			},
+		}
+	case RateSender:
+		return smtpd.Middleware{
+			CheckSender: func(ctx context.Context, peer smtpd.Peer, addr string) (context.Context, error) {
+				return ctx, allow(RateSubject{Peer: peer, Sender: addr})
+			},
+		}
+	case RateRecipient:
+		return smtpd.Middleware{
+			CheckRecipient: func(ctx context.Context, peer smtpd.Peer, addr string) (context.Context, error) {
+				sender, _ := smtpd.SenderFromContext(ctx)
+				return ctx, allow(RateSubject{Peer: peer, Sender: sender, Recipient: addr})
+			},
+		}
+	case RateData:
+		return smtpd.Middleware{
+			Handler: func(ctx context.Context, peer smtpd.Peer, env *smtpd.Envelope) (context.Context, error) {
+				return ctx, allow(RateSubject{Peer: peer, Sender: env.Sender})
+			},
+		}
+	}
+	panic(fmt.Sprintf("middleware: RateLimit of an unknown phase %d", phase))
+}
+
 // IPAddressRateLimit returns a PeerCheck that throttles inbound connections
 // per remote IP. Each IP gets its own token bucket of size burst that refills
 // at rps tokens/second. Non-TCP peers (e.g. unix sockets) are never throttled.
 // Idle limiters are evicted automatically once their bucket would have refilled.
+// A connection over the rate gets 421 4.7.0, and the server closes it.
 //
-// Typical use:
+// It is RateLimit(RateConnection, RateByIP, rps, burst) in the form of a
+// PeerCheck. Typical use:
 //
 //	srv.Handler = smtpd.Chain(base).
 //	    Use(middleware.CheckConnection(middleware.IPAddressRateLimit(1, 10))).
 //	    Handler()
 func IPAddressRateLimit(rps float64, burst int) PeerCheck {
-	lims := keyrate.New[string](rate.Limit(rps), burst, keyrate.WithAutoEvict())
+	mw := RateLimit(RateConnection, RateByIP, rps, burst)
 	return func(ctx context.Context, peer smtpd.Peer) error {
-		tcpAddr, ok := peer.Addr.(*net.TCPAddr)
-		if !ok {
-			return nil
-		}
-		if !lims.Allow(tcpAddr.IP.String()) {
-			return smtpd.Error{Code: 450, Enhanced: smtpd.EnhancedCode{4, 7, 1}, Message: "rate-limited, try again later"}
-		}
-		return nil
+		_, err := mw.CheckConnection(ctx, peer)
+		return err
 	}
 }
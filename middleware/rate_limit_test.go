@@ -2,7 +2,10 @@ package middleware
 
 import (
 	"context"
+	"errors"
+	"io"
 	"net"
+	"strings"
 	"testing"
 
 	"github.com/chrj/smtpd/v2"
@@ -21,11 +24,11 @@ func TestIPAddressRateLimit(t *testing.T) {
 
 	err := check(context.Background(), peer)
 	if err == nil {
-		t.Fatal("expected 450 error, got nil")
+		t.Fatal("expected 421 error, got nil")
 	}
 	smtpdErr, ok := err.(smtpd.Error)
-	if !ok || smtpdErr.Code != 450 {
-		t.Fatalf("expected 450 error, got %v", err)
+	if !ok || smtpdErr.Code != 421 {
+		t.Fatalf("expected 421 error, got %v", err)
 	}
 
 	peer2 := smtpd.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.2")}}
@@ -61,3 +64,110 @@ func TestIPAddressRateLimit_CheckConnection(t *testing.T) {
 		t.Fatal("expected rate-limit error")
 	}
 }
+
+func TestRateLimitPhases(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	peer := smtpd.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1")}, Username: "alice"}
+	env := &smtpd.Envelope{Sender: "alice@example.com", Data: io.NopCloser(strings.NewReader(""))}
+
+	tests := []struct {
+		phase RatePhase
+		key   RateKey
+		run   func(mw smtpd.Middleware) error
+		code  int
+	}{
+		{RateConnection, RateByIP, func(mw smtpd.Middleware) error {
+			_, err := mw.CheckConnection(ctx, peer)
+			return err
+		}, 421},
+		{RateSender, RateBySenderDomain, func(mw smtpd.Middleware) error {
+			_, err := mw.CheckSender(ctx, peer, "alice@example.com")
+			return err
+		}, 451},
+		{RateRecipient, RateByRecipientDomain, func(mw smtpd.Middleware) error {
+			_, err := mw.CheckRecipient(ctx, peer, "bob@example.net")
+			return err
+		}, 450},
+		{RateData, RateByUser, func(mw smtpd.Middleware) error {
+			_, err := mw.Handler(ctx, peer, env)
+			return err
+		}, 451},
+	}
+
+	for _, tc := range tests {
+		mw := RateLimit(tc.phase, tc.key, 0.5, 1)
+		if err := tc.run(mw); err != nil {
+			t.Fatalf("phase %d: the first one: %v", tc.phase, err)
+		}
+		err := tc.run(mw)
+		var smtpErr smtpd.Error
+		if !errors.As(err, &smtpErr) || smtpErr.Code != tc.code {
+			t.Fatalf("phase %d: %v, want %d", tc.phase, err, tc.code)
+		}
+		if want := "Rate limit exceeded, try again in 2s"; smtpErr.Message != want {
+			t.Errorf("phase %d: message %q, want %q", tc.phase, smtpErr.Message, want)
+		}
+	}
+}
+
+func TestRateLimitWithoutRate(t *testing.T) {
+	for _, rps := range []float64{0, -1} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("RateLimit of rate %v did not panic", rps)
+				}
+			}()
+			RateLimit(RateSender, RateByIP, rps, 10)
+		}()
+	}
+}
+
+func TestRateLimitKeys(t *testing.T) {
+	t.Parallel()
+
+	tcp := func(ip string) smtpd.Peer {
+		return smtpd.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(ip)}}
+	}
+	unix := smtpd.Peer{Addr: &net.UnixAddr{Name: "/tmp/smtpd.sock", Net: "unix"}}
+
+	tests := []struct {
+		name string
+		key  RateKey
+		s    RateSubject
+		want string
+	}{
+		{"ip", RateByIP, RateSubject{Peer: tcp("2001:db8::1")}, "2001:db8::1"},
+		{"ip of a socket", RateByIP, RateSubject{Peer: unix}, ""},
+		{"prefix", RateByIPv6Prefix, RateSubject{Peer: tcp("2001:db8:1:2:3:4:5:6")}, "2001:db8:1:2::/64"},
+		{"prefix of IPv4", RateByIPv6Prefix, RateSubject{Peer: tcp("192.0.2.1")}, "192.0.2.1"},
+		{"helo", RateByHelo, RateSubject{Peer: smtpd.Peer{HeloName: "Mail.Example.COM"}}, "mail.example.com"},
+		{"user", RateByUser, RateSubject{Peer: smtpd.Peer{Username: "alice"}}, "alice"},
+		{"sender domain", RateBySenderDomain, RateSubject{Sender: "alice@Example.com"}, "example.com"},
+		{"null sender", RateBySenderDomain, RateSubject{}, ""},
+		{"recipient domain", RateByRecipientDomain, RateSubject{Recipient: "bob@example.net"}, "example.net"},
+	}
+
+	for _, tc := range tests {
+		if got := tc.key(tc.s); got != tc.want {
+			t.Errorf("%s: %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRateLimitPrefixSharesABucket(t *testing.T) {
+	t.Parallel()
+
+	mw := RateLimit(RateConnection, RateByIPv6Prefix, 1, 1)
+	a := smtpd.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1")}}
+	b := smtpd.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("2001:db8::ffff")}}
+
+	if _, err := mw.CheckConnection(context.Background(), a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mw.CheckConnection(context.Background(), b); err == nil {
+		t.Error("another address of the /64 was not limited")
+	}
+}
@@ -0,0 +1,217 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/chrj/smtpd/v2"
+	"github.com/chrj/smtpd/v2/internal/spool"
+)
+
+// SenderMap gives the sender addresses that a user may use. An entry is an
+// address, or "@domain" for every address of the domain. UserFile is a
+// SenderMap.
+type SenderMap interface {
+	Senders(ctx context.Context, user string) ([]string, error)
+}
+
+// SenderTable is a SenderMap that holds the addresses of each user in
+// memory.
+type SenderTable map[string][]string
+
+// Senders gives the addresses of user.
+func (t SenderTable) Senders(_ context.Context, user string) ([]string, error) {
+	return t[user], nil
+}
+
+var (
+	errSenderNotOwned = smtpd.Error{Code: 553, Enhanced: smtpd.EnhancedCode{5, 7, 1}, Message: "Sender address not owned by the authenticated user"}
+	errSenderTemp     = smtpd.Error{Code: 451, Enhanced: smtpd.EnhancedCode{4, 3, 0}, Message: "Could not check the sender address, try again later"}
+)
+
+// SenderOwnershipOption configures SenderOwnership.
+type SenderOwnershipOption func(*senderOwnership)
+
+// WithSenderAliases lets a user send as an alias of the table of m, when the
+// alias leads to an address that the user owns: with "sales@example.com
+// alice@example.com" in the table, alice may send as sales@example.com.
+func WithSenderAliases(m AliasMap) SenderOwnershipOption {
+	return func(o *senderOwnership) { o.aliases = m }
+}
+
+// WithHeaderFromCheck checks the addresses of the From header field too, at
+// the Handler stage. The envelope sender is what bounces go to, and the
+// header From is what the reader sees, so a stolen account can abuse either.
+func WithHeaderFromCheck() SenderOwnershipOption {
+	return func(o *senderOwnership) { o.headerFrom = true }
+}
+
+// WithSenderOwnershipSpool sets where the check of the header From keeps the
+// message: memory octets in memory, and the rest in a temporary file in dir.
+// The default is 1MB, in the directory of os.TempDir.
+func WithSenderOwnershipSpool(memory int64, dir string) SenderOwnershipOption {
+	return func(o *senderOwnership) { o.spoolMemory, o.spoolDir = memory, dir }
+}
+
+type senderOwnership struct {
+	senders     SenderMap
+	aliases     AliasMap
+	headerFrom  bool
+	spoolMemory int64
+	spoolDir    string
+}
+
+// SenderOwnership returns a Middleware that ties an authenticated user to the
+// sender addresses that m gives for peer.Username. A MAIL FROM with another
+// address gets 553 5.7.1.
+//
+// A user owns an address that m lists, in any case, and each subaddress of
+// it: alice@example.com covers alice+lists@example.com. An entry of
+// "@example.com" covers every address of the domain. The null sender of a
+// bounce belongs to everyone.
+//
+// A session that did not authenticate passes, so pair the middleware with
+// RequireAuth on a submission port:
+//
+//	srv.Use(middleware.Authenticator(users.Authenticate))
+//	srv.Use(middleware.RequireAuth())
+//	srv.Use(middleware.SenderOwnership(users, middleware.WithHeaderFromCheck()))
+func SenderOwnership(m SenderMap, opts ...SenderOwnershipOption) smtpd.Middleware {
+	o := &senderOwnership{senders: m, spoolMemory: spool.DefaultMemory}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	mw := smtpd.Middleware{
+		CheckSender: func(ctx context.Context, peer smtpd.Peer, addr string) (context.Context, error) {
+			if peer.Username == "" || addr == "" {
+				return ctx, nil
+			}
+			return ctx, o.check(ctx, peer.Username, []string{addr})
+		},
+	}
+	if o.headerFrom {
+		mw.Handler = o.checkHeader
+	}
+	return mw
+}
+
+// checkHeader checks the addresses of the From header fields of the message.
+// A From that does not parse is not one that the user owns.
+func (o *senderOwnership) checkHeader(ctx context.Context, peer smtpd.Peer, env *smtpd.Envelope) (context.Context, error) {
+	if peer.Username == "" {
+		return ctx, nil
+	}
+
+	sp, err := spool.Read(env.Data, o.spoolMemory, o.spoolDir)
+	_ = env.Data.Close()
+	if err != nil {
+		return ctx, fmt.Errorf("middleware: spool the message from %v: %w", peer.Addr, err)
+	}
+
+	h, _, _, err := readHeader(sp.Section(0))
+	if err != nil {
+		_ = sp.Close()
+		return ctx, fmt.Errorf("middleware: read the header from %v: %w", peer.Addr, err)
+	}
+
+	var addrs []string
+	for _, f := range h.all("From") {
+		list, err := addressParser.ParseList(f.value())
+		if err != nil {
+			_ = sp.Close()
+			return ctx, errSenderNotOwned
+		}
+		for _, a := range list {
+			addrs = append(addrs, a.Address)
+		}
+	}
+
+	if err := o.check(ctx, peer.Username, addrs); err != nil {
+		_ = sp.Close()
+		return ctx, err
+	}
+
+	env.Data = &spooledBody{Reader: sp.Section(0), spool: sp}
+	return ctx, nil
+}
+
+// check gives an error unless user owns each of addrs.
+func (o *senderOwnership) check(ctx context.Context, user string, addrs []string) error {
+	if len(addrs) == 0 {
+		return nil
+	}
+
+	logger := smtpd.LoggerFromContext(ctx)
+
+	owned, err := o.senders.Senders(ctx, user)
+	if err != nil {
+		logger.WarnContext(ctx, "sender lookup failed",
+			slog.String("user", user), slog.Any("error", err))
+		return errSenderTemp
+	}
+
+	for _, addr := range addrs {
+		ok, err := o.owns(ctx, owned, addr)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			logger.WarnContext(ctx, "sender not owned by the user",
+				slog.String("user", user), slog.String("sender", addr))
+			return errSenderNotOwned
+		}
+	}
+	return nil
+}
+
+// owns reports whether the entries of owned cover addr, or an address that
+// addr is an alias of.
+func (o *senderOwnership) owns(ctx context.Context, owned []string, addr string) (bool, error) {
+	if ownsAddress(owned, addr) {
+		return true, nil
+	}
+	if o.aliases == nil {
+		return false, nil
+	}
+
+	var targets []string
+	if err := expandAlias(ctx, o.aliases, addr, nil, &targets); err != nil {
+		if errors.Is(err, errAliasLoop) {
+			return false, nil
+		}
+		return false, errSenderTemp
+	}
+	for _, t := range targets {
+		if ownsAddress(owned, t) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ownsAddress reports whether an entry of owned covers addr: the address
+// itself, the address without its subaddress, or its domain.
+func ownsAddress(owned []string, addr string) bool {
+	at := strings.LastIndexByte(addr, '@')
+	if at < 0 {
+		return false
+	}
+	local, domain := addr[:at], strings.ToLower(addr[at+1:])
+	user, _, _ := strings.Cut(local, "+")
+
+	for _, e := range owned {
+		switch {
+		case strings.HasPrefix(e, "@"):
+			if strings.EqualFold(e[1:], domain) {
+				return true
+			}
+		case strings.EqualFold(e, addr), strings.EqualFold(e, user+"@"+domain):
+			return true
+		}
+	}
+	return false
+}
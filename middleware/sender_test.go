@@ -0,0 +1,113 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/chrj/smtpd/v2"
+)
+
+var senderTable = SenderTable{
+	"alice": {"alice@example.com", "@example.org"},
+	"bob":   {"Bob@Example.com"},
+}
+
+func TestSenderOwnership(t *testing.T) {
+	t.Parallel()
+
+	mw := SenderOwnership(senderTable, WithSenderAliases(AliasTable{
+		"sales@example.com": {"alice@example.com", "carol@example.com"},
+		"loop@example.com":  {"loop2@example.com"},
+		"loop2@example.com": {"loop@example.com"},
+	}))
+
+	tests := []struct {
+		user, addr string
+		err        error
+	}{
+		{user: "alice", addr: "alice@example.com"},
+		{user: "alice", addr: "ALICE@example.COM"},
+		{user: "alice", addr: "alice+lists@example.com"},
+		{user: "alice", addr: "anyone@example.org"},
+		{user: "alice", addr: "sales@example.com"},
+		{user: "alice", addr: ""},
+		{user: "alice", addr: "bob@example.com", err: errSenderNotOwned},
+		{user: "alice", addr: "anyone@sub.example.org", err: errSenderNotOwned},
+		{user: "alice", addr: "loop@example.com", err: errSenderNotOwned},
+		{user: "bob", addr: "bob@example.com"},
+		{user: "bob", addr: "sales@example.com", err: errSenderNotOwned},
+		{user: "mallory", addr: "alice@example.com", err: errSenderNotOwned},
+		// A session that did not authenticate is the business of RequireAuth.
+		{user: "", addr: "alice@example.com"},
+	}
+
+	for _, tc := range tests {
+		_, err := mw.CheckSender(context.Background(), smtpd.Peer{Username: tc.user}, tc.addr)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s as <%s>: %v, want %v", tc.user, tc.addr, err, tc.err)
+		}
+	}
+}
+
+type failingSenders struct{}
+
+func (failingSenders) Senders(context.Context, string) ([]string, error) {
+	return nil, errors.New("directory is down")
+}
+
+func TestSenderOwnershipTemporaryError(t *testing.T) {
+	t.Parallel()
+
+	mw := SenderOwnership(failingSenders{})
+	if _, err := mw.CheckSender(context.Background(), smtpd.Peer{Username: "alice"}, "alice@example.com"); !errors.Is(err, errSenderTemp) {
+		t.Errorf("a failing map: %v, want %v", err, errSenderTemp)
+	}
+}
+
+func TestSenderOwnershipHeaderFrom(t *testing.T) {
+	t.Parallel()
+
+	if SenderOwnership(senderTable).Handler != nil {
+		t.Error("the header From is checked without WithHeaderFromCheck")
+	}
+	mw := SenderOwnership(senderTable, WithHeaderFromCheck())
+
+	tests := []struct {
+		user, message string
+		err           error
+	}{
+		{user: "alice", message: "From: Alice <alice@example.com>\r\nSubject: x\r\n\r\nbody\r\n"},
+		{user: "alice", message: "From: a@example.org, b@example.org\r\nSender: alice@example.com\r\n\r\nbody\r\n"},
+		{user: "alice", message: "Subject: no From\r\n\r\nbody\r\n"},
+		// A display name in a charset that Go does not decode.
+		{user: "alice", message: "From: =?ISO-2022-JP?B?GyRCJDMkcyRLJEEkTxsoQg==?= <alice@example.com>\r\n\r\nbody\r\n"},
+		{user: "alice", message: "From: =?windows-1252?Q?J=F6rg?= <alice@example.com>\r\n\r\nbody\r\n"},
+		{user: "alice", message: "From: =?x-unknown?Q?Bob?= <bob@example.com>\r\n\r\nbody\r\n", err: errSenderNotOwned},
+		{user: "alice", message: "From: Bob <bob@example.com>\r\n\r\nbody\r\n", err: errSenderNotOwned},
+		{user: "alice", message: "From: alice@example.com\r\nFrom: bob@example.com\r\n\r\nbody\r\n", err: errSenderNotOwned},
+		{user: "alice", message: "From: not an address\r\n\r\nbody\r\n", err: errSenderNotOwned},
+		{user: "", message: "From: bob@example.com\r\n\r\nbody\r\n"},
+	}
+
+	for _, tc := range tests {
+		env := &smtpd.Envelope{Data: io.NopCloser(strings.NewReader(tc.message))}
+		_, err := mw.Handler(context.Background(), smtpd.Peer{Username: tc.user}, env)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: %q: %v, want %v", tc.user, tc.message, err, tc.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		// The message goes on to the next stage as it came.
+		got, err := io.ReadAll(env.Data)
+		_ = env.Data.Close()
+		if err != nil || string(got) != tc.message {
+			t.Errorf("%q: the next stage read %q, %v", tc.message, got, err)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chrj/smtpd/v2"
+)
+
+var errAuthInvalid = smtpd.Error{Code: 535, Enhanced: smtpd.EnhancedCode{5, 7, 8}, Message: "Authentication credentials invalid"}
+
+// UserFile is a store of users and their password hashes, read from a file.
+// Its Authenticate method is an AuthFunc, and Senders gives the sender
+// addresses that each user may use. Reload reads the file again. It is safe
+// for concurrent use.
+//
+// The file takes the htpasswd form, one user on each line, with an optional
+// third field of sender addresses apart by commas:
+//
+//	# user:hash[:senders]
+//	alice:$2y$10$...:alice@example.com,@example.org
+//	bob:$argon2id$v=19$m=65536,t=3,p=4$...$...
+//
+// or, when its first character is "{", the form of a JSON object:
+//
+//	{
+//	  "alice": {"password": "$2y$10$...", "senders": ["alice@example.com"]},
+//	  "bob": {"password": "$6$rounds=100000$..."}
+//	}
+//
+// A password hash takes the crypt form of bcrypt ("$2a$", "$2b$", "$2y$"),
+// argon2id ("$argon2id$", in the PHC string format) or SHA-512 crypt ("$6$").
+type UserFile struct {
+	path string
+
+	mu    sync.RWMutex
+	users map[string]*fileUser
+	// decoy costs as much to check as the costliest hash of the users, and
+	// no password matches it.
+	decoy passwordHash
+}
+
+type fileUser struct {
+	hash    passwordHash
+	senders []string
+}
+
+// LoadUserFile reads the users in the file at path.
+func LoadUserFile(path string) (*UserFile, error) {
+	f := &UserFile{path: path}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads the file again, and puts its users in the place of the ones
+// that the UserFile held. A file that does not parse leaves the old users in
+// place.
+func (f *UserFile) Reload() error {
+	users, err := readUserFile(f.path)
+	if err != nil {
+		return err
+	}
+
+	decoy := costliestDecoy(users)
+
+	f.mu.Lock()
+	f.users, f.decoy = users, decoy
+	f.mu.Unlock()
+	return nil
+}
+
+// costliestDecoy gives the decoy of the hash of users that takes longest to
+// check. The schemes do not compare by their parameters, so it times one
+// check of each set of parameters in the file, a few at most.
+func costliestDecoy(users map[string]*fileUser) passwordHash {
+	var (
+		decoy   passwordHash
+		slowest time.Duration
+	)
+	seen := make(map[string]bool)
+	for _, name := range slices.Sorted(maps.Keys(users)) {
+		h := users[name].hash
+		if seen[h.params()] {
+			continue
+		}
+		seen[h.params()] = true
+
+		d := h.decoy()
+		start := time.Now()
+		d.verify("")
+		if took := time.Since(start); decoy == nil || took > slowest {
+			decoy, slowest = d, took
+		}
+	}
+	return decoy
+}
+
+// Authenticate checks pass against the hash of user, and refuses the
+// credentials with 535 5.7.8 when they do not match. An unknown user takes
+// as long as a known one of the costliest hash with the wrong password, so
+// the time of the reply does not tell a client which users exist.
+func (f *UserFile) Authenticate(_ context.Context, _ smtpd.Peer, user, pass string) error {
+	f.mu.RLock()
+	u, decoy := f.users[user], f.decoy
+	f.mu.RUnlock()
+
+	if u == nil {
+		if decoy != nil {
+			decoy.verify(pass)
+		}
+		return errAuthInvalid
+	}
+	if !u.hash.verify(pass) {
+		return errAuthInvalid
+	}
+	return nil
+}
+
+// Senders gives the sender addresses that the file lists for user, or nil
+// for a user that it does not list. An entry of "@domain" stands for every
+// address of the domain.
+func (f *UserFile) Senders(_ context.Context, user string) ([]string, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if u := f.users[user]; u != nil {
+		return u.senders, nil
+	}
+	return nil, nil
+}
+
+func readUserFile(path string) (map[string]*fileUser, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("users: %w", err)
+	}
+	if bytes.HasPrefix(bytes.TrimLeft(b, " \t\r\n"), []byte("{")) {
+		return parseUserJSON(path, b)
+	}
+	return parseUserLines(path, b)
+}
+
+func parseUserLines(path string, b []byte) (map[string]*fileUser, error) {
+	users := make(map[string]*fileUser)
+
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ":")
+		if len(fields) < 2 || len(fields) > 3 || fields[0] == "" {
+			return nil, fmt.Errorf("users: %s:%d: want user:hash[:senders]", path, n)
+		}
+		if _, ok := users[fields[0]]; ok {
+			return nil, fmt.Errorf("users: %s:%d: %s appears twice", path, n, fields[0])
+		}
+
+		hash, err := parsePasswordHash(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("users: %s:%d: %s: %w", path, n, fields[0], err)
+		}
+		u := &fileUser{hash: hash}
+		if len(fields) == 3 {
+			for s := range strings.SplitSeq(fields[2], ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					u.senders = append(u.senders, s)
+				}
+			}
+		}
+		users[fields[0]] = u
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("users: %w", err)
+	}
+	return users, nil
+}
+
+func parseUserJSON(path string, b []byte) (map[string]*fileUser, error) {
+	var entries map[string]struct {
+		Password string   `json:"password"`
+		Senders  []string `json:"senders"`
+	}
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("users: %s: %w", path, err)
+	}
+
+	users := make(map[string]*fileUser, len(entries))
+	for name, e := range entries {
+		if name == "" {
+			return nil, fmt.Errorf("users: %s: a user without a name", path)
+		}
+		hash, err := parsePasswordHash(e.Password)
+		if err != nil {
+			return nil, fmt.Errorf("users: %s: %s: %w", path, name, err)
+		}
+		users[name] = &fileUser{hash: hash, senders: e.Senders}
+	}
+	return users, nil
+}
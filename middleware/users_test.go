@@ -0,0 +1,160 @@
+package middleware
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/chrj/smtpd/v2"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSHA512Crypt(t *testing.T) {
+	t.Parallel()
+
+	// The hashes of openssl passwd -6.
+	for _, tc := range []struct{ hash, pass string }{
+		{"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1", "Hello world!"},
+		{"$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.", "Hello world!"},
+		{"$6$saltstringsaltst$UXuBvBuPfQU4z1.hi3CoNXH4C7ulNXpsepRT322IE4RHFhcT/ge6WV1Wz4Ryq8EGyu0hllpHMecmXcc/Pudmo.", "secret"},
+	} {
+		h, err := parsePasswordHash(tc.hash)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.hash, err)
+		}
+		if !h.verify(tc.pass) {
+			t.Errorf("%s: the password does not match", tc.hash)
+		}
+		if h.verify(tc.pass + "x") {
+			t.Errorf("%s: a wrong password matches", tc.hash)
+		}
+		if h.decoy().verify(tc.pass) {
+			t.Errorf("%s: the password matches the decoy", tc.hash)
+		}
+	}
+}
+
+// hashes gives a hash of pass in each scheme.
+func hashes(t *testing.T, pass string) map[string]string {
+	t.Helper()
+
+	b, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(pass), salt, 1, 64, 1, 32)
+
+	return map[string]string{
+		"bcrypt": string(b),
+		"argon2id": fmt.Sprintf("$argon2id$v=19$m=64,t=1,p=1$%s$%s",
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)),
+		"sha512": "$6$saltstringsaltst$UXuBvBuPfQU4z1.hi3CoNXH4C7ulNXpsepRT322IE4RHFhcT/ge6WV1Wz4Ryq8EGyu0hllpHMecmXcc/Pudmo.",
+	}
+}
+
+// TestUserFileDecoy covers a file of mixed schemes. The decoy of an unknown
+// user takes the cost of the slowest hash, and not of the first user.
+func TestUserFileDecoy(t *testing.T) {
+	t.Parallel()
+
+	h := hashes(t, "secret")
+	slow, err := bcrypt.GenerateFromPassword([]byte("secret"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(path, fmt.Appendf(nil, "alice:%s\nbob:%s\nzed:%s\n", h["argon2id"], h["sha512"], slow), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := LoadUserFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.decoy.params(), "bcrypt cost=10"; got != want {
+		t.Errorf("the decoy costs %s, want %s", got, want)
+	}
+}
+
+func TestUserFile(t *testing.T) {
+	t.Parallel()
+
+	h := hashes(t, "secret")
+	path := filepath.Join(t.TempDir(), "users")
+	write := func(s string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(s), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(fmt.Sprintf("# users\nalice:%s:alice@example.com, @example.org\n\nbob:%s\ncarol:%s\n",
+		h["bcrypt"], h["argon2id"], h["sha512"]))
+	f, err := LoadUserFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, user := range []string{"alice", "bob", "carol"} {
+		if err := f.Authenticate(context.Background(), smtpd.Peer{}, user, "secret"); err != nil {
+			t.Errorf("%s: %v", user, err)
+		}
+		if err := f.Authenticate(context.Background(), smtpd.Peer{}, user, "wrong"); !errors.Is(err, errAuthInvalid) {
+			t.Errorf("%s with a wrong password: %v, want %v", user, err, errAuthInvalid)
+		}
+	}
+	if err := f.Authenticate(context.Background(), smtpd.Peer{}, "dave", "secret"); !errors.Is(err, errAuthInvalid) {
+		t.Errorf("an unknown user: %v, want %v", err, errAuthInvalid)
+	}
+
+	for user, want := range map[string][]string{
+		"alice": {"alice@example.com", "@example.org"},
+		"bob":   nil,
+		"dave":  nil,
+	} {
+		if got, _ := f.Senders(context.Background(), user); !reflect.DeepEqual(got, want) {
+			t.Errorf("senders of %s: %q, want %q", user, got, want)
+		}
+	}
+
+	write(fmt.Sprintf(`{
+		"dave": {"password": %q, "senders": ["dave@example.com"]}
+	}`, h["argon2id"]))
+	if err := f.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Authenticate(context.Background(), smtpd.Peer{}, "dave", "secret"); err != nil {
+		t.Errorf("dave after Reload: %v", err)
+	}
+	if err := f.Authenticate(context.Background(), smtpd.Peer{}, "alice", "secret"); err == nil {
+		t.Error("alice is left after Reload")
+	}
+	if got, _ := f.Senders(context.Background(), "dave"); !reflect.DeepEqual(got, []string{"dave@example.com"}) {
+		t.Errorf("senders of dave: %q", got)
+	}
+
+	for _, bad := range []string{
+		"alice\n",
+		"alice:plain\n",
+		"alice:$6$salt$short\n",
+		fmt.Sprintf("alice:%s\nalice:%s\n", h["sha512"], h["sha512"]),
+		fmt.Sprintf(":%s\n", h["sha512"]),
+		`{"alice": {"password": "$argon2id$v=19$m=64,t=1,p=1$bad"}}`,
+		`{"alice": `,
+	} {
+		write(bad)
+		if err := f.Reload(); err == nil {
+			t.Errorf("Reload of %q succeeded", bad)
+		}
+	}
+	if err := f.Authenticate(context.Background(), smtpd.Peer{}, "dave", "secret"); err != nil {
+		t.Errorf("a file that does not parse replaced the users: %v", err)
+	}
+}
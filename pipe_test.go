@@ -9,6 +9,7 @@ import (
 	"crypto/x509/pkix"
 	"math/big"
 	"net"
+	"net/netip"
 	"sync"
 	"testing"
 	"time"
@@ -74,6 +75,30 @@ func (l *pipeListener) dial(t *testing.T) net.Conn {
 	}
 }
 
+// dialFrom is dial for a client on TCP at addr, such as "192.0.2.1:1025", for
+// a test of something that the server keeps by the address of the client.
+func (l *pipeListener) dialFrom(t *testing.T, addr string) net.Conn {
+	t.Helper()
+
+	client, server := net.Pipe()
+	remote := net.TCPAddrFromAddrPort(netip.MustParseAddrPort(addr))
+	select {
+	case l.conns <- addrConn{Conn: server, remote: remote}:
+		return client
+	case <-l.closed:
+		t.Fatal("the listener closed before it accepted the connection")
+		return nil
+	}
+}
+
+// addrConn is a net.Conn with the remote address of its own.
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
 // runpipeserver starts server on an in-memory listener. The caller runs inside
 // a synctest bubble and closes the listener when the test ends.
 func runpipeserver(t *testing.T, server *smtpd.Server) *pipeListener {
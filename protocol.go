@@ -27,6 +27,10 @@ func (s *session) handle(ctx context.Context, line string) context.Context {
 	// command closes the window for it. See handlePROXY.
 	defer func() { s.ranCommand = true }()
 
+	if err := s.checkLineBreaks(line); err != nil {
+		return s.replyError(ctx, err)
+	}
+
 	cmd, err := parseCommand(line)
 	if err != nil {
 		return s.replyEnhanced(ctx, 500, EnhancedCode{5, 5, 2}, "Invalid syntax.")
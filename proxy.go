@@ -8,7 +8,6 @@ import (
 	"io"
 	"net"
 	"strconv"
-	"time"
 )
 
 func (s *session) handlePROXY(ctx context.Context, cmd *command) context.Context {
@@ -152,7 +151,7 @@ const proxyUnixPathLen = 108
 func (s *session) readProxyV2() (found bool, err error) {
 	// The proxy writes the header before anything else, so it is there at the
 	// speed of the connection and not at the speed of a client.
-	_ = s.conn.SetReadDeadline(time.Now().Add(s.server.ReadTimeout))
+	_ = s.conn.SetReadDeadline(s.readDeadline(s.server.ReadTimeout))
 
 	first, err := s.reader.Peek(1)
 	if err != nil {
@@ -0,0 +1,335 @@
+// Package queue keeps messages on disk until they are delivered. A Queue is
+// the Handler of a server that answers the client as soon as the message is
+// safe, and delivers it afterwards, in the background, as many times as it
+// takes.
+//
+// The Handler writes the message and its envelope to a directory, and syncs
+// both to the disk before the client gets its 250. Run starts the workers,
+// which hand each message to a DeliverFunc, such as the Deliver method of a
+// relay.Relay. A recipient that fails for now gets the message again after a
+// wait that doubles with each attempt. One that fails for good, or whose
+// message grew too old, goes to the BounceFunc.
+//
+// A Queue opened on a directory that already holds messages, after a restart
+// or a crash, takes them up where the last one left them.
+package queue
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/chrj/smtpd/v2"
+)
+
+// DeliverFunc delivers a message. It gives the answer for each recipient at
+// the index of the recipient in env.Recipients: nil for a recipient that got
+// the message, an smtpd.Error with a code of class 5 for one that never will,
+// and any other error for one to try again later.
+//
+// The Deliver method of relay.Relay is a DeliverFunc.
+type DeliverFunc func(ctx context.Context, env *smtpd.Envelope) []error
+
+// BounceFunc hears of the recipients that the queue gave up on, because the
+// delivery failed for good or the message expired. body reads the message as
+// it came. A message from the null sender, which is a notification itself,
+// must not get a notification back.
+//
+// The function can put a notification in the queue with Enqueue.
+type BounceFunc func(ctx context.Context, msg Message, failed []Recipient, body io.Reader)
+
+// Message is a message in the queue.
+type Message struct {
+	ID       string         `json:"id"`
+	Sender   string         `json:"sender"`
+	BodyType smtpd.BodyType `json:"body_type,omitempty"`
+	SMTPUTF8 bool           `json:"smtputf8,omitempty"`
+
+	// Return and EnvID are the RET and ENVID parameters of RFC 3461.
+	Return smtpd.DSNReturn `json:"return,omitempty"`
+	EnvID  string          `json:"envid,omitempty"`
+
+	// Recipients holds the recipients that still wait for the message.
+	Recipients []Recipient `json:"recipients"`
+
+	// Received is the time at which the message came into the queue.
+	Received time.Time `json:"received"`
+
+	// Attempts counts the deliveries that the queue tried, and NextAttempt
+	// is the time of the next one.
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+}
+
+// Recipient is a recipient of a message in the queue.
+type Recipient struct {
+	Address string             `json:"address"`
+	DSN     smtpd.RecipientDSN `json:"dsn"`
+
+	// Err is the answer of the last delivery to the recipient, and nil
+	// before the first one.
+	Err *smtpd.Error `json:"error,omitempty"`
+}
+
+var (
+	// ErrNotFound is the error of a message that the queue does not hold.
+	ErrNotFound = errors.New("queue: no such message")
+
+	// ErrBusy is the error of Delete for a message that a worker is
+	// delivering at the time.
+	ErrBusy = errors.New("queue: message is being delivered")
+)
+
+// errQueue answers a message that the queue could not write to disk.
+var errQueue = smtpd.Error{Code: 451, Enhanced: smtpd.EnhancedCode{4, 3, 0}, Message: "Could not queue the message, try again later"}
+
+const (
+	defaultWorkers = 4
+	defaultBackoff = 5 * time.Minute
+	defaultMaxWait = time.Hour
+
+	// defaultExpiry follows RFC 5321 section 4.5.4.1, which gives up on a
+	// message after four or five days.
+	defaultExpiry = 5 * 24 * time.Hour
+)
+
+// Queue keeps messages on disk and delivers them. It is safe for concurrent
+// use.
+type Queue struct {
+	dir     string
+	deliver DeliverFunc
+	bounce  BounceFunc
+	logger  *slog.Logger
+
+	workers int
+	backoff time.Duration
+	maxWait time.Duration
+	expiry  time.Duration
+	now     func() time.Time
+
+	mu       sync.Mutex
+	messages map[string]*entry
+	wake     chan struct{}
+}
+
+// entry is a message with the state that only the process keeps.
+type entry struct {
+	msg Message
+
+	// busy says that a worker is delivering the message.
+	busy bool
+}
+
+// Option configures a Queue.
+type Option func(*Queue)
+
+// WithBounce sets the function that hears of the recipients that the queue
+// gave up on. Without one, the queue logs them and drops them.
+func WithBounce(f BounceFunc) Option {
+	return func(q *Queue) { q.bounce = f }
+}
+
+// WithWorkers sets the number of messages that the queue delivers at once.
+// The default is 4.
+func WithWorkers(n int) Option {
+	return func(q *Queue) { q.workers = max(n, 1) }
+}
+
+// WithBackoff sets the wait after the first attempt that failed, which
+// doubles with each attempt after it up to maxWait. The defaults are five
+// minutes and an hour.
+func WithBackoff(initial, maxWait time.Duration) Option {
+	return func(q *Queue) { q.backoff, q.maxWait = initial, maxWait }
+}
+
+// WithExpiry sets the time after which the queue gives up on a message that
+// still has recipients to try. The default is five days.
+func WithExpiry(d time.Duration) Option {
+	return func(q *Queue) { q.expiry = d }
+}
+
+// WithLogger sets the logger of the workers, which run outside of any
+// session. The default discards the records.
+func WithLogger(logger *slog.Logger) Option {
+	return func(q *Queue) { q.logger = logger }
+}
+
+// withQueueClock replaces the clock of the queue, for tests.
+func withQueueClock(now func() time.Time) Option {
+	return func(q *Queue) { q.now = now }
+}
+
+// New opens the queue in dir, and creates the directory if it does not
+// exist. It loads the messages that dir holds, and removes what a crash left
+// of a message that never made it into the queue.
+func New(dir string, deliver DeliverFunc, opts ...Option) (*Queue, error) {
+	q := &Queue{
+		dir:      dir,
+		deliver:  deliver,
+		logger:   slog.New(slog.DiscardHandler),
+		workers:  defaultWorkers,
+		backoff:  defaultBackoff,
+		maxWait:  defaultMaxWait,
+		expiry:   defaultExpiry,
+		now:      time.Now,
+		messages: make(map[string]*entry),
+		wake:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(q)
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("queue: %w", err)
+	}
+	msgs, err := q.load()
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		q.messages[msg.ID] = &entry{msg: msg}
+	}
+
+	return q, nil
+}
+
+// Handler puts the message in the queue, and answers the client once the
+// message is on the disk. A session of LMTP gives every recipient the same
+// answer, since the queue holds the message for all of them.
+func (q *Queue) Handler(ctx context.Context, _ smtpd.Peer, env *smtpd.Envelope) (context.Context, error) {
+	defer func() { _ = env.Data.Close() }()
+
+	id, err := q.Enqueue(ctx, env)
+	if err != nil {
+		smtpd.LoggerFromContext(ctx).WarnContext(ctx, "queue failed", slog.Any("error", err))
+		return ctx, errQueue
+	}
+
+	smtpd.LoggerFromContext(ctx).InfoContext(ctx, "queued", slog.String("id", id))
+	return ctx, nil
+}
+
+// Enqueue puts env in the queue, reading env.Data to the end, and gives the
+// ID of the message. It returns once the message is on the disk.
+func (q *Queue) Enqueue(ctx context.Context, env *smtpd.Envelope) (string, error) {
+	now := q.now()
+	msg := Message{
+		ID:          rand.Text(),
+		Sender:      env.Sender,
+		BodyType:    env.BodyType,
+		SMTPUTF8:    env.SMTPUTF8,
+		Received:    now,
+		NextAttempt: now,
+	}
+	if env.DSN != nil {
+		msg.Return, msg.EnvID = env.DSN.Return, env.DSN.EnvID
+	}
+	for i, addr := range env.Recipients {
+		r := Recipient{Address: addr}
+		if env.DSN != nil && i < len(env.DSN.Recipients) {
+			r.DSN = env.DSN.Recipients[i]
+		}
+		msg.Recipients = append(msg.Recipients, r)
+	}
+
+	if err := q.writeBody(msg.ID, env.Data); err != nil {
+		return "", err
+	}
+	if err := q.writeMessage(msg); err != nil {
+		_ = os.Remove(q.bodyPath(msg.ID))
+		return "", err
+	}
+
+	q.mu.Lock()
+	q.messages[msg.ID] = &entry{msg: msg}
+	q.mu.Unlock()
+	q.notify()
+
+	return msg.ID, nil
+}
+
+// List gives the messages in the queue, the oldest first.
+func (q *Queue) List() []Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	msgs := make([]Message, 0, len(q.messages))
+	for _, e := range q.messages {
+		msgs = append(msgs, e.msg.clone())
+	}
+	slices.SortFunc(msgs, func(a, b Message) int {
+		return a.Received.Compare(b.Received)
+	})
+	return msgs
+}
+
+// Retry makes the message with the given ID due now.
+func (q *Queue) Retry(id string) error {
+	q.mu.Lock()
+	e, ok := q.messages[id]
+	if ok {
+		e.msg.NextAttempt = q.now()
+	}
+	q.mu.Unlock()
+
+	if !ok {
+		return ErrNotFound
+	}
+	q.notify()
+	return nil
+}
+
+// Delete takes the message with the given ID out of the queue, without a
+// notification to anyone.
+func (q *Queue) Delete(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	e, ok := q.messages[id]
+	switch {
+	case !ok:
+		return ErrNotFound
+	case e.busy:
+		return ErrBusy
+	}
+
+	delete(q.messages, id)
+	return q.remove(id)
+}
+
+// Open reads the body of the message with the given ID. Close the reader
+// when done.
+func (q *Queue) Open(id string) (io.ReadCloser, error) {
+	q.mu.Lock()
+	_, ok := q.messages[id]
+	q.mu.Unlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	f, err := os.Open(q.bodyPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// notify wakes the workers that wait for a message.
+func (q *Queue) notify() {
+	q.mu.Lock()
+	close(q.wake)
+	q.wake = make(chan struct{})
+	q.mu.Unlock()
+}
+
+func (m Message) clone() Message {
+	m.Recipients = slices.Clone(m.Recipients)
+	return m
+}
@@ -0,0 +1,331 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chrj/smtpd/v2"
+)
+
+// recorder is a DeliverFunc that writes down each attempt, and answers each
+// recipient with the error that answer gives for it.
+type recorder struct {
+	mu       sync.Mutex
+	attempts []*smtpd.Envelope
+	bodies   []string
+	answer   func(rcpt string) error
+}
+
+func (r *recorder) deliver(_ context.Context, env *smtpd.Envelope) []error {
+	body, _ := io.ReadAll(env.Data)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.attempts = append(r.attempts, env)
+	r.bodies = append(r.bodies, string(body))
+
+	errs := make([]error, len(env.Recipients))
+	for i, rcpt := range env.Recipients {
+		if r.answer != nil {
+			errs[i] = r.answer(rcpt)
+		}
+	}
+	return errs
+}
+
+func envelope(rcpts ...string) *smtpd.Envelope {
+	return &smtpd.Envelope{
+		Sender:     "alice@example.org",
+		Recipients: rcpts,
+		Data:       io.NopCloser(strings.NewReader("Subject: x\r\n\r\nbody\r\n")),
+	}
+}
+
+// step runs the message that is due, as a worker of Run does.
+func step(t *testing.T, q *Queue) {
+	t.Helper()
+
+	id, _, _ := q.next()
+	if id == "" {
+		t.Fatal("no message is due")
+	}
+	q.attempt(context.Background(), id)
+}
+
+func TestQueueRun(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	delivered := make(chan *smtpd.Envelope, 1)
+	q, err := New(dir, func(_ context.Context, env *smtpd.Envelope) []error {
+		_, _ = io.Copy(io.Discard, env.Data)
+		delivered <- env
+		return make([]error, len(env.Recipients))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- q.Run(ctx) }()
+
+	env := envelope("bob@example.net")
+	env.DSN = &smtpd.DSN{EnvID: "env-1", Recipients: []smtpd.RecipientDSN{{Notify: smtpd.DSNNotifyFailure}}}
+	if _, err := q.Handler(context.Background(), smtpd.Peer{}, env); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case got := <-delivered:
+		if got.Sender != "alice@example.org" || !slices.Equal(got.Recipients, []string{"bob@example.net"}) {
+			t.Errorf("delivered %+v", got)
+		}
+		if got.DSN == nil || got.DSN.EnvID != "env-1" || got.DSN.Recipients[0].Notify != smtpd.DSNNotifyFailure {
+			t.Errorf("DSN %+v", got.DSN)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the queue did not deliver the message")
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Run: %v", err)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("the queue left %d files behind", len(files))
+	}
+}
+
+func TestQueueRetryAndBounce(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	rec := &recorder{answer: func(rcpt string) error {
+		switch rcpt {
+		case "later@example.net":
+			return smtpd.Error{Code: 451, Message: "Try later"}
+		case "never@example.net":
+			return smtpd.Error{Code: 550, Enhanced: smtpd.EnhancedCode{5, 1, 1}, Message: "No such user"}
+		case "down@example.net":
+			return errors.New("connection refused")
+		}
+		return nil
+	}}
+
+	var bounced []Recipient
+	var bouncedBody string
+	q, err := New(t.TempDir(), rec.deliver,
+		withQueueClock(func() time.Time { return now }),
+		WithBackoff(time.Minute, 10*time.Minute),
+		WithBounce(func(_ context.Context, msg Message, failed []Recipient, body io.Reader) {
+			b, _ := io.ReadAll(body)
+			bouncedBody = string(b)
+			bounced = append(bounced, failed...)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := q.Enqueue(context.Background(), envelope("ok@example.net", "later@example.net", "never@example.net", "down@example.net")); err != nil {
+		t.Fatal(err)
+	}
+	step(t, q)
+
+	if len(bounced) != 1 || bounced[0].Address != "never@example.net" || bounced[0].Err.Enhanced != (smtpd.EnhancedCode{5, 1, 1}) {
+		t.Errorf("bounced %+v", bounced)
+	}
+	if bouncedBody != "Subject: x\r\n\r\nbody\r\n" {
+		t.Errorf("bounce read %q", bouncedBody)
+	}
+
+	msgs := q.List()
+	if len(msgs) != 1 {
+		t.Fatalf("queue holds %d messages", len(msgs))
+	}
+	var left []string
+	for _, r := range msgs[0].Recipients {
+		left = append(left, r.Address)
+	}
+	if !slices.Equal(left, []string{"later@example.net", "down@example.net"}) {
+		t.Errorf("recipients left: %q", left)
+	}
+	if msgs[0].Recipients[1].Err.Code != 451 {
+		t.Errorf("a network error counts as %+v", msgs[0].Recipients[1].Err)
+	}
+	if want := now.Add(time.Minute); !msgs[0].NextAttempt.Equal(want) || msgs[0].Attempts != 1 {
+		t.Errorf("next attempt %v after %d, want %v after 1", msgs[0].NextAttempt, msgs[0].Attempts, want)
+	}
+
+	if id, wait, _ := q.next(); id != "" || wait != time.Minute {
+		t.Errorf("next() = %q, %v before the backoff ran out", id, wait)
+	}
+
+	now = now.Add(time.Minute)
+	rec.answer = nil
+	step(t, q)
+
+	if got := rec.attempts[1].Recipients; !slices.Equal(got, left) {
+		t.Errorf("second attempt went to %q, want %q", got, left)
+	}
+	if len(q.List()) != 0 {
+		t.Error("the queue still holds the delivered message")
+	}
+}
+
+func TestQueueExpiry(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	rec := &recorder{answer: func(string) error { return smtpd.Error{Code: 421, Message: "Busy"} }}
+
+	var bounced []Recipient
+	q, err := New(t.TempDir(), rec.deliver,
+		withQueueClock(func() time.Time { return now }),
+		WithExpiry(24*time.Hour),
+		WithBounce(func(_ context.Context, _ Message, failed []Recipient, _ io.Reader) {
+			bounced = append(bounced, failed...)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := q.Enqueue(context.Background(), envelope("bob@example.net")); err != nil {
+		t.Fatal(err)
+	}
+	step(t, q)
+	if len(bounced) != 0 {
+		t.Fatalf("bounced before the expiry: %+v", bounced)
+	}
+
+	now = now.Add(25 * time.Hour)
+	step(t, q)
+	if len(bounced) != 1 || *bounced[0].Err != errExpired {
+		t.Errorf("bounced %+v, want the expiry", bounced)
+	}
+	if len(q.List()) != 0 {
+		t.Error("the queue still holds the expired message")
+	}
+}
+
+func TestQueueRecovery(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	rec := &recorder{}
+	q, err := New(dir, rec.deliver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := q.Enqueue(context.Background(), envelope("bob@example.net"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// What a crash leaves of a message that was still on the way in, and of
+	// an envelope that was still being written.
+	for _, name := range []string{"ORPHAN" + bodySuffix, id + metaSuffix + tempSuffix} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q, err = New(dir, rec.deliver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := q.List()
+	if len(msgs) != 1 || msgs[0].ID != id || msgs[0].Recipients[0].Address != "bob@example.net" {
+		t.Fatalf("recovered %+v", msgs)
+	}
+
+	files, _ := os.ReadDir(dir)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	if want := []string{id + metaSuffix, id + bodySuffix}; !slices.Equal(names, want) && !slices.Equal(names, []string{want[1], want[0]}) {
+		t.Errorf("files after recovery: %q, want %q", names, want)
+	}
+
+	step(t, q)
+	if len(rec.bodies) != 1 || rec.bodies[0] != "Subject: x\r\n\r\nbody\r\n" {
+		t.Errorf("delivered %q", rec.bodies)
+	}
+}
+
+func TestQueueInspect(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	q, err := New(t.TempDir(), (&recorder{}).deliver, withQueueClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, _ := q.Enqueue(context.Background(), envelope("a@example.net"))
+	now = now.Add(time.Second)
+	second, _ := q.Enqueue(context.Background(), envelope("b@example.net"))
+
+	msgs := q.List()
+	if len(msgs) != 2 || msgs[0].ID != first || msgs[1].ID != second {
+		t.Fatalf("List: %+v", msgs)
+	}
+
+	body, err := q.Open(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(body)
+	_ = body.Close()
+	if string(b) != "Subject: x\r\n\r\nbody\r\n" {
+		t.Errorf("Open read %q", b)
+	}
+
+	q.messages[first].msg.NextAttempt = now.Add(time.Hour)
+	if err := q.Retry(first); err != nil {
+		t.Fatal(err)
+	}
+	if got := q.List()[0].NextAttempt; !got.Equal(now) {
+		t.Errorf("next attempt after Retry: %v, want %v", got, now)
+	}
+
+	q.messages[second].busy = true
+	if err := q.Delete(second); !errors.Is(err, ErrBusy) {
+		t.Errorf("Delete of a busy message: %v", err)
+	}
+	q.messages[second].busy = false
+
+	if err := q.Delete(second); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []func(string) error{q.Delete, q.Retry} {
+		if err := f(second); !errors.Is(err, ErrNotFound) {
+			t.Errorf("deleted message: %v, want %v", err, ErrNotFound)
+		}
+	}
+	if _, err := os.Stat(q.bodyPath(second)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the body of the deleted message: %v", err)
+	}
+}
+
+func TestQueueWait(t *testing.T) {
+	t.Parallel()
+
+	q := &Queue{backoff: time.Minute, maxWait: 5 * time.Minute}
+	for n, want := range map[int]time.Duration{1: time.Minute, 2: 2 * time.Minute, 3: 4 * time.Minute, 4: 5 * time.Minute, 40: 5 * time.Minute} {
+		if got := q.wait(n); got != want {
+			t.Errorf("wait(%d) = %v, want %v", n, got, want)
+		}
+	}
+}
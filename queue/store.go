@@ -0,0 +1,152 @@
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A message takes two files in the directory of the queue: the body in
+// "ID.msg", and the envelope and the state of the delivery in "ID.json".
+// The body comes first, so an envelope never names a body that is not there.
+// A body without an envelope is what a crash left of a message that the
+// client never got a 250 for, and New removes it.
+const (
+	bodySuffix = ".msg"
+	metaSuffix = ".json"
+	tempSuffix = ".tmp"
+)
+
+func (q *Queue) bodyPath(id string) string {
+	return filepath.Join(q.dir, id+bodySuffix)
+}
+
+func (q *Queue) metaPath(id string) string {
+	return filepath.Join(q.dir, id+metaSuffix)
+}
+
+// writeBody writes the body of message id from r, and syncs it.
+func (q *Queue) writeBody(id string, r io.Reader) error {
+	f, err := os.OpenFile(q.bodyPath(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("queue: %w", err)
+	}
+
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return fmt.Errorf("queue: write body: %w", err)
+	}
+	return nil
+}
+
+// writeMessage writes the envelope of msg, in place of the one that was
+// there. It writes a temporary file and renames it, so a crash leaves the old
+// envelope or the new one and never half of one, and it syncs the directory
+// so that the name survives the crash too.
+func (q *Queue) writeMessage(msg Message) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("queue: %w", err)
+	}
+
+	tmp := q.metaPath(msg.ID) + tempSuffix
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("queue: %w", err)
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, q.metaPath(msg.ID))
+	}
+	if err == nil {
+		err = q.syncDir()
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("queue: write envelope: %w", err)
+	}
+	return nil
+}
+
+// syncDir syncs the directory of the queue, which makes the names of the
+// files in it durable.
+func (q *Queue) syncDir() error {
+	d, err := os.Open(q.dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	return errors.Join(err, d.Close())
+}
+
+// remove deletes the files of message id: the envelope first, so that a crash
+// half way leaves a body that New cleans up.
+func (q *Queue) remove(id string) error {
+	err := os.Remove(q.metaPath(id))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("queue: %w", err)
+	}
+	if err := os.Remove(q.bodyPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("queue: %w", err)
+	}
+	return nil
+}
+
+// load reads the messages in the directory of the queue, and removes the
+// files that belong to no message.
+func (q *Queue) load() ([]Message, error) {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, fmt.Errorf("queue: %w", err)
+	}
+
+	var msgs []Message
+	bodies := make(map[string]bool)
+	for _, de := range entries {
+		name := de.Name()
+		switch {
+		case strings.HasSuffix(name, tempSuffix):
+			_ = os.Remove(filepath.Join(q.dir, name))
+
+		case strings.HasSuffix(name, bodySuffix):
+			bodies[strings.TrimSuffix(name, bodySuffix)] = true
+
+		case strings.HasSuffix(name, metaSuffix):
+			b, err := os.ReadFile(filepath.Join(q.dir, name))
+			if err != nil {
+				return nil, fmt.Errorf("queue: %w", err)
+			}
+			var msg Message
+			if err := json.Unmarshal(b, &msg); err != nil {
+				return nil, fmt.Errorf("queue: read %s: %w", name, err)
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+
+	for _, msg := range msgs {
+		delete(bodies, msg.ID)
+	}
+	for id := range bodies {
+		_ = os.Remove(q.bodyPath(id))
+	}
+
+	return msgs, nil
+}
@@ -0,0 +1,237 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/chrj/smtpd/v2"
+)
+
+// errExpired is the answer for a recipient whose message stayed in the queue
+// for longer than the expiry, after the answer of the last attempt.
+var errExpired = smtpd.Error{Code: 554, Enhanced: smtpd.EnhancedCode{5, 4, 7}, Message: "Delivery time expired"}
+
+// Run delivers the messages in the queue until ctx ends, with the number of
+// workers that WithWorkers set. It returns once every worker stopped, after
+// the deliveries that were on the way end with ctx.
+func (q *Queue) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for range q.workers {
+		wg.Go(func() { q.work(ctx) })
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// work delivers the message that is due, or waits until one is.
+func (q *Queue) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		id, wait, wake := q.next()
+		if id != "" {
+			q.attempt(ctx, id)
+			continue
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+		case <-wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// next takes the message that has been due for longest, and marks it busy.
+// With none due, it gives the time until the next one is, and the channel
+// that Enqueue and Retry close.
+func (q *Queue) next() (id string, wait time.Duration, wake <-chan struct{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.now()
+	var due *entry
+	wait = time.Hour
+	for _, e := range q.messages {
+		if e.busy {
+			continue
+		}
+		if d := e.msg.NextAttempt.Sub(now); d > 0 {
+			wait = min(wait, d)
+			continue
+		}
+		if due == nil || e.msg.NextAttempt.Before(due.msg.NextAttempt) {
+			due = e
+		}
+	}
+
+	if due == nil {
+		return "", wait, q.wake
+	}
+	due.busy = true
+	return due.msg.ID, 0, nil
+}
+
+// attempt delivers message id to the recipients that still wait for it, and
+// writes down what became of them.
+func (q *Queue) attempt(ctx context.Context, id string) {
+	q.mu.Lock()
+	msg := q.messages[id].msg.clone()
+	q.mu.Unlock()
+
+	logger := q.logger.With(slog.String("id", id))
+
+	body, err := os.Open(q.bodyPath(id))
+	if err != nil {
+		// The body went missing from under the queue. No attempt can
+		// work without it.
+		logger.ErrorContext(ctx, "queued message has no body", slog.Any("error", err))
+		q.finish(id, nil)
+		return
+	}
+
+	env := &smtpd.Envelope{
+		Sender:   msg.Sender,
+		Data:     body,
+		BodyType: msg.BodyType,
+		SMTPUTF8: msg.SMTPUTF8,
+	}
+	dsn := &smtpd.DSN{Return: msg.Return, EnvID: msg.EnvID}
+	for _, r := range msg.Recipients {
+		env.Recipients = append(env.Recipients, r.Address)
+		dsn.Recipients = append(dsn.Recipients, r.DSN)
+	}
+	if msg.Return != "" || msg.EnvID != "" || hasRecipientDSN(dsn.Recipients) {
+		env.DSN = dsn
+	}
+
+	errs := q.deliver(ctx, env)
+	_ = body.Close()
+
+	now := q.now()
+	msg.Attempts++
+
+	var pending, failed []Recipient
+	for i, r := range msg.Recipients {
+		var err error = errUnanswered
+		if i < len(errs) {
+			err = errs[i]
+		}
+		if err == nil {
+			continue
+		}
+
+		r.Err = asError(err)
+		if r.Err.Code/100 == 5 {
+			failed = append(failed, r)
+		} else {
+			pending = append(pending, r)
+		}
+	}
+
+	if len(pending) > 0 && now.Sub(msg.Received) >= q.expiry {
+		for _, r := range pending {
+			logger.InfoContext(ctx, "queued message expired",
+				slog.String("recipient", r.Address), slog.Any("error", r.Err))
+			expired := errExpired
+			r.Err = &expired
+			failed = append(failed, r)
+		}
+		pending = nil
+	}
+
+	msg.Recipients = pending
+	msg.NextAttempt = now.Add(q.wait(msg.Attempts))
+
+	if len(failed) > 0 {
+		q.giveUp(ctx, msg, failed, logger)
+	}
+	if len(pending) == 0 {
+		q.finish(id, nil)
+		return
+	}
+
+	logger.InfoContext(ctx, "delivery deferred",
+		slog.Int("recipients", len(pending)), slog.Time("next", msg.NextAttempt))
+	if err := q.writeMessage(msg); err != nil {
+		// The old envelope stays on the disk, so a restart tries the
+		// recipients that this attempt got through to once more.
+		logger.ErrorContext(ctx, "could not update the queue", slog.Any("error", err))
+	}
+	q.finish(id, &msg)
+}
+
+// errUnanswered is the answer for a recipient that a DeliverFunc gave no
+// answer for.
+var errUnanswered = errors.New("queue: the delivery gave no answer for the recipient")
+
+// giveUp hands the recipients that failed for good to the BounceFunc.
+func (q *Queue) giveUp(ctx context.Context, msg Message, failed []Recipient, logger *slog.Logger) {
+	for _, r := range failed {
+		logger.InfoContext(ctx, "delivery failed",
+			slog.String("recipient", r.Address), slog.Any("error", r.Err))
+	}
+	if q.bounce == nil {
+		return
+	}
+
+	body, err := os.Open(q.bodyPath(msg.ID))
+	if err != nil {
+		logger.ErrorContext(ctx, "could not read the message for the bounce", slog.Any("error", err))
+		return
+	}
+	defer func() { _ = body.Close() }()
+
+	q.bounce(ctx, msg, failed, body)
+}
+
+// finish ends an attempt. A message with recipients left goes back into the
+// queue as msg, and one without any leaves the queue.
+func (q *Queue) finish(id string, msg *Message) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if msg != nil {
+		q.messages[id] = &entry{msg: *msg}
+		return
+	}
+
+	delete(q.messages, id)
+	if err := q.remove(id); err != nil {
+		q.logger.Error("could not remove a delivered message",
+			slog.String("id", id), slog.Any("error", err))
+	}
+}
+
+// wait gives the time to wait after attempt n: the initial backoff, doubled
+// for each attempt after the first, and no more than the maximum.
+func (q *Queue) wait(n int) time.Duration {
+	d := q.backoff
+	for i := 1; i < n && d < q.maxWait; i++ {
+		d *= 2
+	}
+	return min(d, q.maxWait)
+}
+
+// asError gives err as an smtpd.Error. An error of another kind is a fault
+// on the way, such as a network that is down, and counts as temporary.
+func asError(err error) *smtpd.Error {
+	var se smtpd.Error
+	if errors.As(err, &se) {
+		return &se
+	}
+	return &smtpd.Error{Code: 451, Enhanced: smtpd.EnhancedCode{4, 0, 0}, Message: err.Error()}
+}
+
+func hasRecipientDSN(rs []smtpd.RecipientDSN) bool {
+	for _, r := range rs {
+		if r != (smtpd.RecipientDSN{}) {
+			return true
+		}
+	}
+	return false
+}
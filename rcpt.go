@@ -86,12 +86,39 @@ func (s *session) handleRCPT(ctx context.Context, cmd *command) context.Context
 
 	ctx, err = s.server.checkRecipient(ctx, s.peer, addr)
 	if err != nil {
+		s.refusedRecipient(err)
 		return s.replyError(ctx, err)
 	}
 
-	s.envelope.Recipients = append(s.envelope.Recipients, addr)
-	s.envelope.recordRecipientDSN(rcptDSN)
+	ctx, addrs, err := s.server.rewriteRecipient(ctx, s.peer, addr)
+	if err != nil {
+		s.refusedRecipient(err)
+		return s.replyError(ctx, err)
+	}
+	if len(s.envelope.Recipients)+len(addrs) > s.server.MaxRecipients {
+		return s.replyEnhanced(ctx, 452, EnhancedCode{4, 5, 3}, "Too many recipients")
+	}
+
+	for _, a := range addrs {
+		dsn := rcptDSN
+		if a != addr && dsn.OriginalType == "" {
+			dsn.OriginalType, dsn.OriginalRecipient = addressType(addr), addr
+		}
+		s.envelope.addRecipient(a, dsn)
+	}
+	s.envelope.commands++
 
 	return s.replyEnhanced(ctx, 250, EnhancedCode{2, 1, 5}, "Go ahead")
 
 }
+
+// addressType gives the ORCPT address type of addr: "utf-8" of RFC 6533 for
+// an address of Unicode, and "rfc822" otherwise.
+func addressType(addr string) string {
+	for i := 0; i < len(addr); i++ {
+		if addr[i] >= 0x80 {
+			return "utf-8"
+		}
+	}
+	return "rfc822"
+}
@@ -0,0 +1,712 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/chrj/smtpd/v2"
+)
+
+// chunkSize is the size of a BDAT chunk. A larger chunk takes fewer round
+// trips, and every chunk sits in memory once.
+const chunkSize = 256 << 10
+
+// conn is a connection to a server, after the greeting, EHLO, STARTTLS and
+// AUTH are done.
+type conn struct {
+	addr    string
+	nc      net.Conn
+	text    *textproto.Conn
+	timeout time.Duration
+	lmtp    bool
+
+	// ext holds the extensions that the smarthost offered, by name in upper
+	// case, with their parameters.
+	ext map[string]string
+
+	// idle is the time at which the connection went back to the pool, and
+	// reap closes it once it has waited there for the idle timeout.
+	idle time.Time
+	reap *time.Timer
+
+	// mu guards cancelled, which says that the context of an exchange
+	// ended and moved the deadline to the past.
+	mu        sync.Mutex
+	cancelled bool
+}
+
+// reply is a reply of the smarthost.
+type reply struct {
+	code    int
+	message string
+}
+
+// err gives the reply as the error that answers the client. The status code
+// of the smarthost stays with the reply, and one that it did not send takes
+// the generic code of the class.
+func (r reply) err() error {
+	lines := strings.Split(r.message, "\n")
+	code, _, ok := parseEnhancedCode(lines[0])
+	if ok && code[0] != r.code/100 {
+		ok = false
+	}
+	if ok {
+		prefix := code.String() + " "
+		for i, line := range lines {
+			lines[i] = strings.TrimPrefix(line, prefix)
+		}
+	}
+
+	e := smtpd.Error{Code: r.code, Message: strings.Join(lines, " ")}
+	if ok {
+		e.Enhanced = code
+	}
+	return e
+}
+
+func (r reply) ok() bool {
+	return r.code/100 == 2
+}
+
+// parseEnhancedCode reads the status code of RFC 3463 at the start of a
+// reply text, such as "5.1.1 No such user".
+func parseEnhancedCode(text string) (smtpd.EnhancedCode, string, bool) {
+	first, rest, _ := strings.Cut(text, " ")
+	parts := strings.Split(first, ".")
+	if len(parts) != 3 {
+		return smtpd.EnhancedCode{}, text, false
+	}
+
+	var code smtpd.EnhancedCode
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || n > 999 {
+			return smtpd.EnhancedCode{}, text, false
+		}
+		code[i] = n
+	}
+	switch code[0] {
+	case 2, 4, 5:
+		return code, rest, true
+	}
+	return smtpd.EnhancedCode{}, text, false
+}
+
+// errOpportunisticTLS says that STARTTLS, which the relay only used because
+// the server offered it, did not work. The relay then connects again and
+// sends the message without TLS.
+var errOpportunisticTLS = errors.New("relay: opportunistic STARTTLS failed")
+
+// dial opens a connection to addr, and takes it through the greeting, EHLO,
+// STARTTLS and AUTH. host is the name of the server, which the certificate
+// must carry. plain leaves out the STARTTLS that a relay of NewMX uses where
+// the server offers it.
+func (r *Relay) dial(ctx context.Context, addr, host string, plain bool) (*conn, error) {
+	dctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	nc, err := r.dialer.DialContext(dctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("relay: dial %s: %w", addr, err)
+	}
+	if r.implicitTLS {
+		tc := tls.Client(nc, r.tlsConfigFor(host))
+		if err := tc.HandshakeContext(dctx); err != nil {
+			_ = nc.Close()
+			return nil, fmt.Errorf("relay: TLS handshake: %w", err)
+		}
+		nc = tc
+	}
+
+	c := &conn{addr: addr, nc: nc, text: textproto.NewConn(nc), timeout: r.timeout, lmtp: r.lmtp}
+	if err := c.handshake(ctx, r, host, plain); err != nil {
+		c.close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// tlsConfigFor gives the TLS configuration for the server host: the one of
+// WithSTARTTLS or WithTLS, or, for the STARTTLS of opportunity of a relay of
+// NewMX, one that takes any certificate. A mail exchanger has no name that
+// DNS without DNSSEC vouches for, so a check of its certificate proves
+// nothing.
+func (r *Relay) tlsConfigFor(host string) *tls.Config {
+	if r.tlsConfig == nil {
+		return &tls.Config{ServerName: host, InsecureSkipVerify: true}
+	}
+	if r.tlsConfig.ServerName != "" {
+		return r.tlsConfig
+	}
+
+	config := r.tlsConfig.Clone()
+	config.ServerName = host
+	return config
+}
+
+// handshake reads the greeting and sends EHLO, STARTTLS and AUTH as the
+// relay asks for them.
+func (c *conn) handshake(ctx context.Context, r *Relay, host string, plain bool) error {
+	defer c.watch(ctx)()
+
+	greeting, err := c.read()
+	if err != nil {
+		return err
+	}
+	if greeting.code != 220 {
+		return fmt.Errorf("relay: greeting: %w", greeting.err())
+	}
+
+	if err := c.hello(r); err != nil {
+		return err
+	}
+
+	required := r.tlsConfig != nil && !r.implicitTLS
+	opportunistic := r.mx && r.tlsConfig == nil && !plain && c.has("STARTTLS")
+	if required || opportunistic {
+		if err := c.startTLS(ctx, r, host); err != nil {
+			if opportunistic {
+				return fmt.Errorf("%w: %w", errOpportunisticTLS, err)
+			}
+			return err
+		}
+	}
+
+	if r.auth != nil && !r.mx {
+		if err := c.authenticate(r, host); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// startTLS upgrades the connection with STARTTLS of RFC 3207, and sends EHLO
+// again over TLS.
+func (c *conn) startTLS(ctx context.Context, r *Relay, host string) error {
+	if !c.has("STARTTLS") {
+		return errors.New("relay: the server does not offer STARTTLS")
+	}
+	rep, err := c.cmd("STARTTLS")
+	if err != nil {
+		return err
+	}
+	if rep.code != 220 {
+		return fmt.Errorf("relay: STARTTLS: %w", rep.err())
+	}
+
+	tc := tls.Client(c.nc, r.tlsConfigFor(host))
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return fmt.Errorf("relay: TLS handshake: %w", err)
+	}
+	c.mu.Lock()
+	c.nc, c.text = tc, textproto.NewConn(tc)
+	c.mu.Unlock()
+
+	return c.hello(r)
+}
+
+// hello sends EHLO, or LHLO to a server of LMTP, and records the extensions
+// of the reply.
+func (c *conn) hello(r *Relay) error {
+	verb := "EHLO"
+	if c.lmtp {
+		verb = "LHLO"
+	}
+
+	rep, err := c.cmd("%s %s", verb, r.hostname)
+	if err != nil {
+		return err
+	}
+	if !rep.ok() {
+		return fmt.Errorf("relay: %s: %w", verb, rep.err())
+	}
+
+	c.ext = make(map[string]string)
+	lines := strings.Split(rep.message, "\n")
+	for _, line := range lines[1:] {
+		name, params, _ := strings.Cut(line, " ")
+		name = strings.ToUpper(name)
+		if !slices.Contains(r.ignore, name) {
+			c.ext[name] = params
+		}
+	}
+	return nil
+}
+
+// authenticate runs the AUTH exchange of RFC 4954 with auth.
+func (c *conn) authenticate(r *Relay, host string) error {
+	mechanisms, ok := c.ext["AUTH"]
+	if !ok {
+		return errors.New("relay: the server does not offer AUTH")
+	}
+
+	_, isTLS := c.nc.(*tls.Conn)
+	info := &smtp.ServerInfo{Name: host, TLS: isTLS, Auth: strings.Fields(mechanisms)}
+	mech, resp, err := r.auth.Start(info)
+	if err != nil {
+		return fmt.Errorf("relay: AUTH: %w", err)
+	}
+
+	line := "AUTH " + mech
+	if resp != nil {
+		line += " " + encodeAuth(resp)
+	}
+	rep, err := c.cmd("%s", line)
+	for err == nil && rep.code == 334 {
+		var challenge []byte
+		challenge, err = base64.StdEncoding.DecodeString(rep.message)
+		if err != nil {
+			// RFC 4954 section 4 answers a challenge that the client
+			// cannot read with a "*", which ends the exchange.
+			_, _ = c.cmd("*")
+			return fmt.Errorf("relay: AUTH: %w", err)
+		}
+		resp, err = r.auth.Next(challenge, true)
+		if err != nil {
+			_, _ = c.cmd("*")
+			return fmt.Errorf("relay: AUTH: %w", err)
+		}
+		rep, err = c.cmd("%s", base64.StdEncoding.EncodeToString(resp))
+	}
+	if err != nil {
+		return err
+	}
+	if rep.code != 235 {
+		return fmt.Errorf("relay: AUTH: %w", rep.err())
+	}
+	return nil
+}
+
+// encodeAuth encodes the initial response of AUTH. RFC 4954 section 4 writes
+// an empty response as "=", since nothing at all means that there is none.
+func encodeAuth(resp []byte) string {
+	if len(resp) == 0 {
+		return "="
+	}
+	return base64.StdEncoding.EncodeToString(resp)
+}
+
+// reset sends RSET, which ends a transaction that a failed message left
+// open, and shows that the smarthost still answers.
+func (c *conn) reset(ctx context.Context) error {
+	defer c.watch(ctx)()
+
+	rep, err := c.cmd("RSET")
+	if err != nil {
+		return err
+	}
+	if !rep.ok() {
+		return fmt.Errorf("relay: RSET: %w", rep.err())
+	}
+	return nil
+}
+
+// close sends QUIT, and closes the connection without waiting long for the
+// reply.
+func (c *conn) close() {
+	_ = c.nc.SetDeadline(time.Now().Add(time.Second))
+	_ = c.text.PrintfLine("QUIT")
+	_, _, _ = c.text.ReadResponse(0)
+	_ = c.nc.Close()
+}
+
+// watch ends the exchange that is on the way when ctx ends, by moving the
+// deadline of the connection to the past. The function it returns stops
+// the watch.
+func (c *conn) watch(ctx context.Context) func() {
+	stop := context.AfterFunc(ctx, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.cancelled = true
+		_ = c.nc.SetDeadline(time.Unix(1, 0))
+	})
+	return func() { stop() }
+}
+
+// extend moves the deadline of the connection on by the timeout, unless the
+// context of the exchange ended.
+func (c *conn) extend() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.cancelled {
+		_ = c.nc.SetDeadline(time.Now().Add(c.timeout))
+	}
+}
+
+// write queues a command without sending it.
+func (c *conn) write(format string, args ...any) error {
+	c.extend()
+	_, err := fmt.Fprintf(c.text.W, format+"\r\n", args...)
+	return err
+}
+
+// flush sends the commands that write queued.
+func (c *conn) flush() error {
+	c.extend()
+	return c.text.W.Flush()
+}
+
+// read reads one reply.
+func (c *conn) read() (reply, error) {
+	c.extend()
+	code, message, err := c.text.ReadResponse(0)
+	if err != nil {
+		return reply{}, fmt.Errorf("relay: read reply: %w", err)
+	}
+	return reply{code: code, message: message}, nil
+}
+
+// cmd sends a command and reads its reply.
+func (c *conn) cmd(format string, args ...any) (reply, error) {
+	if err := c.write(format, args...); err != nil {
+		return reply{}, err
+	}
+	if err := c.flush(); err != nil {
+		return reply{}, err
+	}
+	return c.read()
+}
+
+// deliver sends env in one transaction. It gives the answer of the smarthost
+// for each recipient, nil for a recipient that took the message.
+//
+// With partial unset, a recipient that the smarthost refuses stops the
+// message before any of it goes out, since one reply answers for all of the
+// recipients. The transaction stays open for the next RSET.
+//
+// An error means that the connection broke on the way, and that it is of no
+// further use.
+func (c *conn) deliver(ctx context.Context, env *smtpd.Envelope, partial bool) ([]error, error) {
+	defer c.watch(ctx)()
+
+	errs := make([]error, len(env.Recipients))
+	fail := func(err error) ([]error, error) {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+		return errs, nil
+	}
+
+	if env.SMTPUTF8 && !c.has("SMTPUTF8") {
+		return fail(errNoSMTPUTF8)
+	}
+	if env.BodyType == smtpd.BodyBinaryMIME && (!c.has("BINARYMIME") || !c.has("CHUNKING")) {
+		return fail(errNoBinaryMIME)
+	}
+
+	cmds := append([]string{c.mailCommand(env)}, c.rcptCommands(env)...)
+	replies, err := c.batch(cmds)
+	if err != nil {
+		return nil, err
+	}
+
+	if !replies[0].ok() {
+		return fail(replies[0].err())
+	}
+
+	var accepted []int
+	for i, rep := range replies[1:] {
+		if rep.ok() {
+			accepted = append(accepted, i)
+		} else {
+			errs[i] = rep.err()
+		}
+	}
+	if len(accepted) == 0 || (!partial && len(accepted) < len(env.Recipients)) {
+		return errs, nil
+	}
+
+	// One reply answers for the message, but LMTP has a reply for every
+	// recipient that took it, in the order of RCPT TO.
+	replies = nil
+	if c.has("CHUNKING") {
+		replies, err = c.sendChunks(env, len(accepted))
+	} else {
+		replies, err = c.sendData(env, len(accepted))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for n, i := range accepted {
+		rep := replies[0]
+		if len(replies) == len(accepted) {
+			rep = replies[n]
+		}
+		if !rep.ok() {
+			errs[i] = rep.err()
+		}
+	}
+	return errs, nil
+}
+
+// has reports whether the smarthost offered the extension.
+func (c *conn) has(name string) bool {
+	_, ok := c.ext[name]
+	return ok
+}
+
+// batch sends the commands and reads their replies. A smarthost with
+// PIPELINING of RFC 2920 gets them all at once.
+func (c *conn) batch(cmds []string) ([]reply, error) {
+	replies := make([]reply, 0, len(cmds))
+
+	if !c.has("PIPELINING") {
+		for _, cmd := range cmds {
+			rep, err := c.cmd("%s", cmd)
+			if err != nil {
+				return nil, err
+			}
+			replies = append(replies, rep)
+		}
+		return replies, nil
+	}
+
+	for _, cmd := range cmds {
+		if err := c.write("%s", cmd); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.flush(); err != nil {
+		return nil, err
+	}
+	for range cmds {
+		rep, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, rep)
+	}
+	return replies, nil
+}
+
+// mailCommand writes MAIL FROM with the parameters of env that the smarthost
+// takes.
+//
+// A smarthost without 8BITMIME gets no BODY parameter, and one without DSN
+// gets no parameter of RFC 3461. The message then goes on as it came, which
+// is what most relays do.
+func (c *conn) mailCommand(env *smtpd.Envelope) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "MAIL FROM:<%s>", env.Sender)
+
+	if env.BodyType != "" && c.has("8BITMIME") {
+		fmt.Fprintf(&b, " BODY=%s", env.BodyType)
+	}
+	if env.SMTPUTF8 {
+		b.WriteString(" SMTPUTF8")
+	}
+	if env.DSN != nil && c.has("DSN") {
+		if env.DSN.Return != "" {
+			fmt.Fprintf(&b, " RET=%s", env.DSN.Return)
+		}
+		if env.DSN.EnvID != "" {
+			fmt.Fprintf(&b, " ENVID=%s", encodeXtext(env.DSN.EnvID))
+		}
+	}
+	return b.String()
+}
+
+// rcptCommands writes RCPT TO for each recipient of env, with the NOTIFY
+// and ORCPT parameters of RFC 3461 where the smarthost takes them.
+func (c *conn) rcptCommands(env *smtpd.Envelope) []string {
+	cmds := make([]string, len(env.Recipients))
+	for i, rcpt := range env.Recipients {
+		cmd := fmt.Sprintf("RCPT TO:<%s>", rcpt)
+
+		if env.DSN != nil && c.has("DSN") && i < len(env.DSN.Recipients) {
+			r := env.DSN.Recipients[i]
+			if r.Notify != 0 {
+				cmd += " NOTIFY=" + r.Notify.String()
+			}
+			if r.OriginalType != "" {
+				cmd += " ORCPT=" + encodeORcpt(r.OriginalType, r.OriginalRecipient, env.SMTPUTF8)
+			}
+		}
+
+		cmds[i] = cmd
+	}
+	return cmds
+}
+
+// sendData sends the message with DATA. textproto writes every line end as
+// CRLF and doubles a dot at the start of a line, as RFC 5321 section 4.5.2
+// asks.
+func (c *conn) sendData(env *smtpd.Envelope, replies int) ([]reply, error) {
+	rep, err := c.cmd("DATA")
+	if err != nil {
+		return nil, err
+	}
+	if rep.code != 354 {
+		return []reply{rep}, nil
+	}
+
+	w := c.text.DotWriter()
+	if _, err := io.Copy(w, deadlineReader{env.Data, c}); err != nil {
+		return nil, fmt.Errorf("relay: send message: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("relay: send message: %w", err)
+	}
+
+	return c.readN(replies)
+}
+
+// sendChunks sends the message with BDAT of RFC 3030. A message of text has
+// every line end written as CRLF, as RFC 3030 section 3 asks; a binary one
+// goes as it came.
+func (c *conn) sendChunks(env *smtpd.Envelope, replies int) ([]reply, error) {
+	binary := env.BodyType == smtpd.BodyBinaryMIME
+
+	buf := make([]byte, chunkSize)
+	var out []byte
+	var cr bool
+
+	for {
+		n, err := io.ReadFull(env.Data, buf)
+		last := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+		if err != nil && !last {
+			return nil, fmt.Errorf("relay: read message: %w", err)
+		}
+
+		chunk := buf[:n]
+		if !binary {
+			out, cr = appendCRLF(out[:0], chunk, cr)
+			chunk = out
+		}
+
+		cmd := fmt.Sprintf("BDAT %d", len(chunk))
+		if last {
+			cmd += " LAST"
+		}
+		if err := c.write("%s", cmd); err != nil {
+			return nil, err
+		}
+		if _, err := c.text.W.Write(chunk); err != nil {
+			return nil, fmt.Errorf("relay: send message: %w", err)
+		}
+		if err := c.flush(); err != nil {
+			return nil, fmt.Errorf("relay: send message: %w", err)
+		}
+
+		if last {
+			return c.readN(replies)
+		}
+
+		rep, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		if !rep.ok() {
+			return []reply{rep}, nil
+		}
+	}
+}
+
+// readN reads the replies to the end of a message: one, or one for every
+// recipient that took the message in LMTP.
+func (c *conn) readN(n int) ([]reply, error) {
+	if !c.lmtp {
+		n = 1
+	}
+
+	replies := make([]reply, 0, n)
+	for range n {
+		rep, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, rep)
+	}
+	return replies, nil
+}
+
+// deadlineReader moves the deadline of c on with every read of the message,
+// so that the timeout bounds each part of a message and not the whole of a
+// large one.
+type deadlineReader struct {
+	r io.Reader
+	c *conn
+}
+
+func (d deadlineReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.c.extend()
+	return n, err
+}
+
+// appendCRLF appends p to dst with each bare LF written as CRLF. cr says
+// that the byte before p was a CR, and the second result says the same of
+// the end of p.
+func appendCRLF(dst, p []byte, cr bool) ([]byte, bool) {
+	for _, b := range p {
+		if b == '\n' && !cr {
+			dst = append(dst, '\r')
+		}
+		dst = append(dst, b)
+		cr = b == '\r'
+	}
+	return dst, cr
+}
+
+// encodeXtext encodes s in the xtext of RFC 3461 section 4, which writes a
+// "+", an "=" and every byte outside of the printable ASCII as "+" and two
+// hexadecimal digits.
+func encodeXtext(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < '!' || c > '~' || c == '+' || c == '=' {
+			fmt.Fprintf(&b, "+%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// encodeORcpt writes the value of the ORCPT parameter. An address of the
+// "utf-8" type of RFC 6533 takes the encoding of section 3 there: UTF-8 as it
+// is in a transaction of SMTPUTF8, and "\x{...}" for each character outside
+// of ASCII otherwise. The two encodings write a "+", an "=", a backslash and
+// a control character as "\x{...}" alike.
+func encodeORcpt(addrType, addr string, smtputf8 bool) string {
+	if !strings.EqualFold(addrType, "utf-8") {
+		return addrType + ";" + encodeXtext(addr)
+	}
+
+	var b strings.Builder
+	b.WriteString(addrType + ";")
+	for _, r := range addr {
+		switch {
+		case r == utf8.RuneError:
+			continue
+		case r >= utf8.RuneSelf:
+			if smtputf8 {
+				b.WriteRune(r)
+				continue
+			}
+		case r >= '!' && r <= '~' && r != '+' && r != '=' && r != '\\':
+			b.WriteRune(r)
+			continue
+		}
+		fmt.Fprintf(&b, `\x{%02X}`, r)
+	}
+	return b.String()
+}
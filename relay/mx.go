@@ -0,0 +1,241 @@
+package relay
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/chrj/smtpd/v2"
+	"github.com/chrj/smtpd/v2/internal/answer"
+	"github.com/chrj/smtpd/v2/internal/spool"
+)
+
+// MXResolver looks up the mail exchangers of a domain. *net.Resolver
+// satisfies it, and a test gives one that answers from a table.
+type MXResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// mxPort is the port of SMTP between mail exchangers, from RFC 5321 section
+// 4.5.4.
+const mxPort = "25"
+
+var (
+	// errNullMX answers a recipient of a domain that publishes the null MX
+	// of RFC 7505, which says that the domain takes no mail. Section 4.2
+	// there gives the code.
+	errNullMX = smtpd.Error{Code: 556, Enhanced: smtpd.EnhancedCode{5, 1, 10}, Message: "Recipient address has null MX"}
+
+	// errNoDomain answers a recipient of a domain that DNS does not know.
+	errNoDomain = smtpd.Error{Code: 550, Enhanced: smtpd.EnhancedCode{5, 1, 2}, Message: "Recipient domain does not exist"}
+
+	// errNoAddressDomain answers a recipient without a domain, which the
+	// relay has no place to send to.
+	errNoAddressDomain = smtpd.Error{Code: 550, Enhanced: smtpd.EnhancedCode{5, 1, 3}, Message: "Recipient address has no domain"}
+
+	// errLookup answers a recipient of a domain whose mail exchangers the
+	// relay could not look up.
+	errLookup = smtpd.Error{Code: 451, Enhanced: smtpd.EnhancedCode{4, 4, 3}, Message: "Could not look up the recipient domain, try again later"}
+
+	// errSpool answers a message that the relay could not hold for the
+	// delivery to more than one server.
+	errSpool = smtpd.Error{Code: 451, Enhanced: smtpd.EnhancedCode{4, 3, 0}, Message: "Could not hold the message, try again later"}
+)
+
+// WithResolver sets the resolver of the mail exchangers of a relay of
+// NewMX. The default is net.DefaultResolver.
+func WithResolver(resolver MXResolver) Option {
+	return func(r *Relay) { r.resolver = resolver }
+}
+
+// WithSpool sets the directory of the temporary file that holds a large
+// message of a relay of NewMX. The empty string, the default, is the
+// directory of os.TempDir.
+func WithSpool(dir string) Option {
+	return func(r *Relay) { r.spoolDir = dir }
+}
+
+// NewMX returns a Relay that delivers to the recipient domains themselves.
+// It looks up the mail exchangers of each domain and tries them by
+// preference, on port 25. A domain without MX records is its own mail
+// exchanger, as RFC 5321 section 5.1 asks, and a domain with the null MX of
+// RFC 7505 takes no mail.
+//
+// The relay uses STARTTLS wherever the mail exchanger offers it. It takes
+// any certificate there, and sends the message without TLS to a mail
+// exchanger whose TLS handshake fails. WithSTARTTLS makes TLS a requirement
+// and checks the certificate against the name of the mail exchanger.
+//
+// The relay holds the message for as long as the delivery takes, because
+// more than one domain or server reads it: the first megabyte in memory, and
+// the rest in a temporary file.
+func NewMX(opts ...Option) *Relay {
+	r := newRelay(opts)
+	r.mx = true
+	if r.resolver == nil {
+		r.resolver = net.DefaultResolver
+	}
+	return r
+}
+
+// deliverMX delivers env to the mail exchangers of each recipient domain.
+func (r *Relay) deliverMX(ctx context.Context, env *smtpd.Envelope, partial bool) []error {
+	errs := make([]error, len(env.Recipients))
+
+	s, err := spool.Read(env.Data, spool.DefaultMemory, r.spoolDir)
+	if err != nil {
+		smtpd.LoggerFromContext(ctx).WarnContext(ctx, "relay could not hold the message",
+			slog.Any("error", err))
+		return answer.Fill(errs, errSpool)
+	}
+	defer func() { _ = s.Close() }()
+
+	for _, domain := range domains(env.Recipients) {
+		var idx []int
+		for i, rcpt := range env.Recipients {
+			if domainOf(rcpt) == domain {
+				idx = append(idx, i)
+			}
+		}
+
+		if domain == "" {
+			for _, i := range idx {
+				errs[i] = errNoAddressDomain
+			}
+			continue
+		}
+
+		sub := subEnvelope(env, idx)
+		for n, err := range r.deliverDomain(ctx, domain, sub, s, partial) {
+			errs[idx[n]] = err
+		}
+	}
+
+	return errs
+}
+
+// deliverDomain delivers env, whose recipients all belong to domain, to the
+// first mail exchanger of domain that takes a connection.
+func (r *Relay) deliverDomain(ctx context.Context, domain string, env *smtpd.Envelope, s *spool.Spool, partial bool) []error {
+	logger := smtpd.LoggerFromContext(ctx)
+	errs := make([]error, len(env.Recipients))
+
+	hosts, implicit, err := r.lookupMX(ctx, domain)
+	if err != nil {
+		logger.WarnContext(ctx, "MX lookup failed",
+			slog.String("domain", domain), slog.Any("error", err))
+		return answer.Fill(errs, errLookup)
+	}
+	if len(hosts) == 0 {
+		return answer.Fill(errs, errNullMX)
+	}
+
+	for _, host := range hosts {
+		env.Data = io.NopCloser(s.Section(0))
+
+		got, err := r.send(ctx, net.JoinHostPort(host, mxPort), host, env, partial)
+		if err == nil {
+			return got
+		}
+
+		logger.InfoContext(ctx, "mail exchanger failed",
+			slog.String("domain", domain), slog.String("host", host), slog.Any("error", err))
+
+		// A domain that is its own mail exchanger and has no address
+		// either does not exist.
+		var dnsErr *net.DNSError
+		if implicit && errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return answer.Fill(errs, errNoDomain)
+		}
+	}
+
+	return answer.Fill(errs, errUnavailable)
+}
+
+// lookupMX gives the mail exchangers of domain in the order to try them, and
+// no host for a domain with the null MX. implicit says that the domain has no
+// MX records and is its own mail exchanger.
+func (r *Relay) lookupMX(ctx context.Context, domain string) (hosts []string, implicit bool, err error) {
+	records, err := r.resolver.LookupMX(ctx, domain)
+	if err != nil && len(records) == 0 {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return []string{domain}, true, nil
+		}
+		return nil, false, err
+	}
+
+	// A resolver of Go orders records of the same preference at random, as
+	// RFC 5321 section 5.1 asks. The sort keeps that order.
+	slices.SortStableFunc(records, func(a, b *net.MX) int {
+		return cmp.Compare(a.Pref, b.Pref)
+	})
+
+	for _, mx := range records {
+		host := strings.TrimSuffix(mx.Host, ".")
+		if host == "" {
+			// RFC 7505 section 3 gives the null MX as the only record
+			// of the domain. A domain that lists it with others is in
+			// error, and the others still take its mail.
+			continue
+		}
+		if !slices.Contains(hosts, host) {
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) == 0 && len(records) == 0 {
+		return []string{domain}, true, nil
+	}
+	return hosts, false, nil
+}
+
+// domains gives the domains of addrs in the order of their first recipient.
+func domains(addrs []string) []string {
+	var out []string
+	for _, addr := range addrs {
+		if d := domainOf(addr); !slices.Contains(out, d) {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// domainOf gives the domain of an address in lower case, and the empty string
+// for an address without one.
+func domainOf(addr string) string {
+	i := strings.LastIndexByte(addr, '@')
+	if i < 0 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSuffix(addr[i+1:], "."))
+}
+
+// subEnvelope gives env with the recipients at idx alone, and their DSN
+// parameters with them.
+func subEnvelope(env *smtpd.Envelope, idx []int) *smtpd.Envelope {
+	sub := &smtpd.Envelope{
+		Sender:   env.Sender,
+		BodyType: env.BodyType,
+		SMTPUTF8: env.SMTPUTF8,
+	}
+	if env.DSN != nil {
+		sub.DSN = &smtpd.DSN{Return: env.DSN.Return, EnvID: env.DSN.EnvID}
+	}
+
+	for _, i := range idx {
+		sub.Recipients = append(sub.Recipients, env.Recipients[i])
+		if sub.DSN != nil {
+			var r smtpd.RecipientDSN
+			if i < len(env.DSN.Recipients) {
+				r = env.DSN.Recipients[i]
+			}
+			sub.DSN.Recipients = append(sub.DSN.Recipients, r)
+		}
+	}
+	return sub
+}
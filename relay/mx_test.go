@@ -0,0 +1,187 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/chrj/smtpd/v2"
+	"github.com/chrj/smtpd/v2/smtptest"
+)
+
+// mxTable answers MX lookups from a table. A domain that the table does not
+// carry does not exist, and one in broken gives a temporary error.
+type mxTable struct {
+	records map[string][]*net.MX
+	broken  map[string]bool
+}
+
+func (m mxTable) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	if m.broken[name] {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	if records, ok := m.records[name]; ok {
+		return records, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// mapDialer connects "host:port" addresses to the test servers that stand
+// for them. A host that it does not carry has no address.
+type mapDialer map[string]string
+
+func (d mapDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	target, ok := d[address]
+	if !ok {
+		host, _, _ := net.SplitHostPort(address)
+		return nil, &net.OpError{Op: "dial", Net: network, Err: &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}}
+	}
+	var nd net.Dialer
+	return nd.DialContext(ctx, network, target)
+}
+
+// closedAddr gives an address that refuses connections.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+	return addr
+}
+
+func TestMX(t *testing.T) {
+	t.Parallel()
+
+	a, gotA := smarthost(t, nil)
+	b, gotB := smarthost(t, nil)
+
+	resolver := mxTable{
+		records: map[string][]*net.MX{
+			"a.example":    {{Host: "mx2.a.example.", Pref: 20}, {Host: "mx1.a.example.", Pref: 10}},
+			"b.example":    {},
+			"null.example": {{Host: ".", Pref: 0}},
+		},
+		broken: map[string]bool{"broken.example": true},
+	}
+	dialer := mapDialer{
+		"mx1.a.example:25": closedAddr(t),
+		"mx2.a.example:25": a.Addr,
+		"b.example:25":     b.Addr,
+	}
+
+	r := NewMX(WithResolver(resolver), WithDialer(dialer))
+	defer r.Close()
+
+	env := envelope("Subject: x\n\nbody\n",
+		"one@a.example", "x@b.example", "n@null.example", "two@A.example",
+		"u@unknown.example", "t@broken.example", "postmaster")
+	errs := r.Deliver(context.Background(), env)
+
+	want := []error{nil, nil, errNullMX, nil, errNoDomain, errLookup, errNoAddressDomain}
+	for i := range want {
+		if errs[i] != want[i] {
+			t.Errorf("%s: got %v, want %v", env.Recipients[i], errs[i], want[i])
+		}
+	}
+
+	da := <-gotA
+	if strings.Join(da.rcpts, ",") != "one@a.example,two@A.example" {
+		t.Errorf("a.example got %q", da.rcpts)
+	}
+	db := <-gotB
+	if strings.Join(db.rcpts, ",") != "x@b.example" {
+		t.Errorf("b.example got %q", db.rcpts)
+	}
+	if string(da.data) != "Subject: x\r\n\r\nbody\r\n" || string(db.data) != string(da.data) {
+		t.Errorf("data %q and %q", da.data, db.data)
+	}
+}
+
+func TestMXHandler(t *testing.T) {
+	t.Parallel()
+
+	a, gotA := smarthost(t, nil)
+	resolver := mxTable{records: map[string][]*net.MX{
+		"a.example":    {{Host: "mx.a.example.", Pref: 10}},
+		"down.example": {{Host: "mx.down.example.", Pref: 10}},
+	}}
+	dialer := mapDialer{"mx.a.example:25": a.Addr, "mx.down.example:25": closedAddr(t)}
+
+	r := NewMX(WithResolver(resolver), WithDialer(dialer))
+	defer r.Close()
+
+	// The session gets the temporary failure of one domain, so that the
+	// client tries again, although the other domain took the message.
+	err := relay(r, envelope("Subject: x\n\n", "one@a.example", "two@down.example"))
+	if !errors.Is(err, errUnavailable) {
+		t.Errorf("got %v, want %v", err, errUnavailable)
+	}
+	if d := <-gotA; strings.Join(d.rcpts, ",") != "one@a.example" {
+		t.Errorf("a.example got %q", d.rcpts)
+	}
+}
+
+func TestMXOpportunisticTLS(t *testing.T) {
+	t.Parallel()
+
+	srv, got := smarthost(t, func(s *smtptest.Server) { s.StartSTARTTLS() })
+	plain, gotPlain := smarthost(t, nil)
+
+	resolver := mxTable{records: map[string][]*net.MX{
+		"tls.example":   {{Host: "mx.tls.example.", Pref: 10}},
+		"plain.example": {{Host: "mx.plain.example.", Pref: 10}},
+	}}
+	dialer := mapDialer{"mx.tls.example:25": srv.Addr, "mx.plain.example:25": plain.Addr}
+
+	r := NewMX(WithResolver(resolver), WithDialer(dialer))
+	defer r.Close()
+
+	errs := r.Deliver(context.Background(), envelope("Subject: x\n\n", "a@tls.example", "b@plain.example"))
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("recipient %d: %v", i, err)
+		}
+	}
+	if d := <-got; d.peer.TLS == nil {
+		t.Error("the mail exchanger with STARTTLS got the message without TLS")
+	}
+	if d := <-gotPlain; d.peer.TLS != nil {
+		t.Error("the mail exchanger without STARTTLS got TLS")
+	}
+
+	// A relay that asks for TLS checks the certificate, which names
+	// localhost and not the mail exchanger.
+	config := srv.ClientTLSConfig()
+	config.ServerName = ""
+	r = NewMX(WithResolver(resolver), WithDialer(dialer), WithSTARTTLS(config))
+	defer r.Close()
+	errs = r.Deliver(context.Background(), envelope("Subject: x\n\n", "a@tls.example", "b@plain.example"))
+	for i, err := range errs {
+		if !errors.Is(err, errUnavailable) {
+			t.Errorf("recipient %d with WithSTARTTLS: %v, want %v", i, err, errUnavailable)
+		}
+	}
+}
+
+func TestMXDSN(t *testing.T) {
+	t.Parallel()
+
+	env := envelope("", "a@one.example", "b@two.example", "c@one.example")
+	env.DSN = &smtpd.DSN{EnvID: "id", Recipients: []smtpd.RecipientDSN{
+		{Notify: smtpd.DSNNotifyNever}, {Notify: smtpd.DSNNotifySuccess}, {OriginalType: "rfc822", OriginalRecipient: "c@old.example"},
+	}}
+
+	sub := subEnvelope(env, []int{0, 2})
+	if strings.Join(sub.Recipients, ",") != "a@one.example,c@one.example" {
+		t.Errorf("recipients %q", sub.Recipients)
+	}
+	if sub.DSN.EnvID != "id" || sub.DSN.Recipients[0] != env.DSN.Recipients[0] || sub.DSN.Recipients[1] != env.DSN.Recipients[2] {
+		t.Errorf("DSN %+v", sub.DSN)
+	}
+}
@@ -0,0 +1,129 @@
+package relay
+
+import (
+	"sync"
+	"time"
+)
+
+// pool holds the connections that wait for the next message, by the address
+// of the server. max bounds the connections of each address, and total the
+// connections of all of them, so that a relay to many hosts does not hold a
+// socket open for each one it ever reached.
+type pool struct {
+	max     int
+	total   int
+	timeout time.Duration
+
+	mu     sync.Mutex
+	idle   map[string][]*conn
+	count  int
+	closed bool
+}
+
+// get takes the connection that went idle last, which is the one that the
+// smarthost is most likely to still hold open. It closes the connections
+// that waited too long, and gives nil when none is left.
+func (p *pool) get(addr string) *conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for len(p.idle[addr]) > 0 {
+		idle := p.idle[addr]
+		c := idle[len(idle)-1]
+		p.remove(c)
+		if time.Since(c.idle) < p.timeout {
+			return c
+		}
+		go c.close()
+	}
+	return nil
+}
+
+// put gives a connection back for the next message, or closes it when the
+// pool is full or closed. A pool at its total makes room by closing the
+// connection that waited longest, whatever its address. The connection
+// closes once it waits out the timeout, whether or not its address comes
+// up again.
+func (p *pool) put(c *conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed || p.total <= 0 || len(p.idle[c.addr]) >= p.max {
+		go c.close()
+		return
+	}
+	if p.count >= p.total {
+		oldest := p.oldest()
+		p.remove(oldest)
+		go oldest.close()
+	}
+	if p.idle == nil {
+		p.idle = make(map[string][]*conn)
+	}
+	c.idle = time.Now()
+	c.reap = time.AfterFunc(p.timeout, func() { p.expire(c) })
+	p.idle[c.addr] = append(p.idle[c.addr], c)
+	p.count++
+}
+
+// expire closes c once it has waited out the timeout, unless get took it
+// meanwhile.
+func (p *pool) expire(c *conn) {
+	p.mu.Lock()
+	ok := p.remove(c)
+	p.mu.Unlock()
+
+	if ok {
+		c.close()
+	}
+}
+
+// remove takes c out of the pool, and reports whether it was there. The
+// caller holds mu.
+func (p *pool) remove(c *conn) bool {
+	idle := p.idle[c.addr]
+	for i, ic := range idle {
+		if ic != c {
+			continue
+		}
+		idle = append(idle[:i], idle[i+1:]...)
+		if len(idle) == 0 {
+			delete(p.idle, c.addr)
+		} else {
+			p.idle[c.addr] = idle
+		}
+		p.count--
+		c.reap.Stop()
+		return true
+	}
+	return false
+}
+
+// oldest gives the connection that went idle first. The caller holds mu, and
+// the pool holds a connection.
+func (p *pool) oldest() *conn {
+	var oldest *conn
+	for _, idle := range p.idle {
+		// The connections of an address went idle in order.
+		if c := idle[0]; oldest == nil || c.idle.Before(oldest.idle) {
+			oldest = c
+		}
+	}
+	return oldest
+}
+
+// close closes the idle connections, and every connection that comes back
+// after it.
+func (p *pool) close() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle, p.count, p.closed = nil, 0, true
+	p.mu.Unlock()
+
+	for _, conns := range idle {
+		for _, c := range conns {
+			c.reap.Stop()
+			c.close()
+		}
+	}
+}
@@ -0,0 +1,336 @@
+// Package relay hands messages on to another SMTP server. A Relay is the
+// Handler of a server that forwards all of its mail to one smarthost, such as
+// the submission server of a mail provider or the internal relay of a site.
+// A Relay of NewMX delivers to the mail exchangers of the recipient domains
+// instead.
+//
+// The relay speaks ESMTP to the server. It sends the commands of a
+// transaction in one batch where the server offers PIPELINING, and the
+// message in BDAT chunks where it offers CHUNKING. It passes on the BODY,
+// SMTPUTF8 and delivery status notification parameters that the client sent,
+// and it gives the reply of the server back to the client as an smtpd.Error.
+//
+// A connection that delivered a message stays open for the next one, so a
+// busy server does not pay for a handshake on every message.
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"time"
+
+	"github.com/chrj/smtpd/v2"
+	"github.com/chrj/smtpd/v2/internal/answer"
+)
+
+// Dialer opens the connections to the smarthost. *net.Dialer satisfies it,
+// and so does a dialer of a proxy.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+const (
+	// defaultTimeout bounds each exchange with the smarthost. RFC 5321
+	// section 4.5.3.2 gives five minutes to most of the replies that a client
+	// waits for.
+	defaultTimeout = 5 * time.Minute
+
+	// defaultMaxIdle is the number of connections that a Relay keeps open
+	// while no message is on the way.
+	defaultMaxIdle = 4
+
+	// defaultMaxIdleTotal is the number of connections that a Relay keeps
+	// open across all of the hosts it reaches, such as the many MX hosts of
+	// NewMX.
+	defaultMaxIdleTotal = 64
+
+	// defaultIdleTimeout is the time that an unused connection stays open.
+	// A smarthost closes a quiet connection of its own accord after a while,
+	// and a connection that it closed is of no use.
+	defaultIdleTimeout = 30 * time.Second
+)
+
+var (
+	// errUnavailable answers a message when the relay cannot reach the
+	// smarthost, or loses the connection to it on the way.
+	errUnavailable = smtpd.Error{Code: 451, Enhanced: smtpd.EnhancedCode{4, 4, 1}, Message: "Could not reach the relay, try again later"}
+
+	// errNoSMTPUTF8 answers an internationalized message that the smarthost
+	// does not take. RFC 6531 section 3.2 leaves a relay no way to send it
+	// on to such a server.
+	errNoSMTPUTF8 = smtpd.Error{Code: 550, Enhanced: smtpd.EnhancedCode{5, 6, 7}, Message: "The relay takes no internationalized mail"}
+
+	// errNoBinaryMIME answers a binary message that the smarthost does not
+	// take. The relay does not convert such a message to one of text.
+	errNoBinaryMIME = smtpd.Error{Code: 554, Enhanced: smtpd.EnhancedCode{5, 6, 3}, Message: "The relay takes no binary mail"}
+)
+
+// Relay forwards every message to a smarthost, or, made with NewMX, to the
+// mail exchangers of the recipients. Use its Handler as Server.Handler, or
+// call it from a handler of your own.
+//
+// A Relay is safe for concurrent use. Close it when the server stops, to
+// close the connections that it holds open.
+type Relay struct {
+	addr     string
+	host     string
+	hostname string
+
+	tlsConfig   *tls.Config
+	implicitTLS bool
+	auth        smtp.Auth
+	dialer      Dialer
+	lmtp        bool
+	timeout     time.Duration
+
+	// mx says that the relay delivers to the mail exchangers of the
+	// recipients, which resolver looks up, and not to a smarthost.
+	mx       bool
+	resolver MXResolver
+	spoolDir string
+
+	pool *pool
+
+	// ignore holds extensions that the relay acts as though the smarthost
+	// did not offer. Tests use it to reach the paths of an older server.
+	ignore []string
+}
+
+// Option configures a Relay.
+type Option func(*Relay)
+
+// WithHostname sets the name that the relay gives in EHLO. The default is
+// the name of the host, from os.Hostname.
+func WithHostname(name string) Option {
+	return func(r *Relay) { r.hostname = name }
+}
+
+// WithSTARTTLS makes the relay upgrade the connection with STARTTLS before
+// it sends a message, and refuse a server that does not offer it. config
+// may be nil, and a config without a ServerName checks the certificate
+// against the host of the address, or the name of the mail exchanger.
+//
+// A relay of NewMX without it uses STARTTLS where a mail exchanger offers
+// it, and takes any certificate there.
+func WithSTARTTLS(config *tls.Config) Option {
+	return func(r *Relay) {
+		r.tlsConfig = tlsConfigOrDefault(config)
+		r.implicitTLS = false
+	}
+}
+
+// WithTLS makes the relay open the connection with TLS, as the submission
+// port 465 of RFC 8314 asks for. config works as it does for WithSTARTTLS.
+// It is for a smarthost: a mail exchanger takes no TLS on port 25 before
+// STARTTLS.
+func WithTLS(config *tls.Config) Option {
+	return func(r *Relay) {
+		r.tlsConfig = tlsConfigOrDefault(config)
+		r.implicitTLS = true
+	}
+}
+
+// WithAuth makes the relay authenticate to the smarthost. A relay of NewMX
+// does not authenticate. smtp.PlainAuth gives the usual mechanism, and it
+// refuses to send the password over a connection without TLS to a host
+// other than localhost.
+func WithAuth(auth smtp.Auth) Option {
+	return func(r *Relay) { r.auth = auth }
+}
+
+// WithDialer sets the dialer of the connections to the smarthost. The
+// default is a zero net.Dialer.
+func WithDialer(d Dialer) Option {
+	return func(r *Relay) { r.dialer = d }
+}
+
+// WithLMTP makes the relay speak LMTP of RFC 2033 to the smarthost, which is
+// then a server of mailboxes and no relay. Such a server answers the end of
+// a message once for every recipient.
+func WithLMTP() Option {
+	return func(r *Relay) { r.lmtp = true }
+}
+
+// WithTimeout bounds each exchange with the smarthost: the connection, each
+// command and its reply, and each part of the message. The default is five
+// minutes. The context of the handler can end it sooner.
+func WithTimeout(d time.Duration) Option {
+	return func(r *Relay) { r.timeout = d }
+}
+
+// WithMaxIdle sets the number of connections that the relay keeps open for
+// the next message. The default is 4. Zero closes each connection after its
+// message.
+func WithMaxIdle(n int) Option {
+	return func(r *Relay) { r.pool.max = n }
+}
+
+// WithMaxIdleTotal sets the number of connections that the relay keeps open
+// across all of its hosts. The default is 64. A connection that comes back
+// to a relay at the cap closes the one that waited longest.
+func WithMaxIdleTotal(n int) Option {
+	return func(r *Relay) { r.pool.total = n }
+}
+
+// WithIdleTimeout sets the time that a connection stays open without a
+// message. The default is 30 seconds. The relay closes a connection that
+// waited this long, even where no message goes to its host again.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(r *Relay) { r.pool.timeout = d }
+}
+
+// withoutExtensions makes the relay act as though the smarthost did not offer
+// the given extensions.
+func withoutExtensions(names ...string) Option {
+	return func(r *Relay) { r.ignore = append(r.ignore, names...) }
+}
+
+// New returns a Relay to the smarthost at addr, a "host:port" address.
+func New(addr string, opts ...Option) *Relay {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	r := newRelay(opts)
+	r.addr, r.host = addr, host
+
+	return r
+}
+
+func newRelay(opts []Option) *Relay {
+	r := &Relay{
+		dialer:  &net.Dialer{},
+		timeout: defaultTimeout,
+		pool:    &pool{max: defaultMaxIdle, total: defaultMaxIdleTotal, timeout: defaultIdleTimeout},
+	}
+	if name, err := os.Hostname(); err == nil && name != "" {
+		r.hostname = name
+	} else {
+		r.hostname = "localhost"
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+func tlsConfigOrDefault(config *tls.Config) *tls.Config {
+	if config == nil {
+		return &tls.Config{}
+	}
+	return config
+}
+
+// Handler forwards the message, and it answers the client with the reply
+// that the smarthost or the mail exchanger gave.
+//
+// A session of SMTP gets one reply for the message. A smarthost that refuses
+// one of the recipients makes the relay refuse the whole message, and send
+// the smarthost none of it, because a reply that took the message would lose
+// the mail of that recipient. Check the recipients in CheckRecipient, before
+// the message arrives, where this matters.
+//
+// A relay of NewMX delivers to each domain on its own, so one domain can take
+// the message while another one refuses it. The client then gets the refusal,
+// and the recipients of the first domain get the message again when the
+// client tries once more: RFC 5321 section 6.1 takes a copy too many over a
+// lost message. A queue in front of the relay avoids it.
+//
+// A session of LMTP gets a reply for every recipient. The relay refuses the
+// recipients that the smarthost refused with Envelope.RejectRecipient, and
+// delivers the message to the others.
+func (r *Relay) Handler(ctx context.Context, peer smtpd.Peer, env *smtpd.Envelope) (context.Context, error) {
+	defer func() { _ = env.Data.Close() }()
+
+	perRecipient := peer.Protocol == smtpd.LMTP
+	errs := r.deliver(ctx, env, perRecipient)
+
+	if perRecipient {
+		for i, err := range errs {
+			if err != nil {
+				_ = env.RejectRecipient(i, err)
+			}
+		}
+		return ctx, nil
+	}
+
+	return ctx, answer.First(errs)
+}
+
+// Deliver sends env on, and gives the answer for each recipient at the index
+// of the recipient in env.Recipients: nil for a recipient that took the
+// message, and an smtpd.Error for one that did not. The class of the code
+// tells a temporary failure from a permanent one.
+//
+// Deliver reads env.Data to the end, and leaves it to the caller to close.
+// Unlike Handler, it sends the message to the recipients that the smarthost
+// took when it refuses others.
+func (r *Relay) Deliver(ctx context.Context, env *smtpd.Envelope) []error {
+	return r.deliver(ctx, env, true)
+}
+
+func (r *Relay) deliver(ctx context.Context, env *smtpd.Envelope, partial bool) []error {
+	if r.mx {
+		return r.deliverMX(ctx, env, partial)
+	}
+
+	errs, err := r.send(ctx, r.addr, r.host, env, partial)
+	if err != nil {
+		smtpd.LoggerFromContext(ctx).WarnContext(ctx, "relay failed",
+			slog.String("relay", r.addr), slog.Any("error", err))
+		return answer.Fill(make([]error, len(env.Recipients)), errUnavailable)
+	}
+	return errs
+}
+
+// send delivers env over a connection to addr, whose name for TLS is host.
+// An error means that no connection to addr worked, or that the one that did
+// broke on the way.
+func (r *Relay) send(ctx context.Context, addr, host string, env *smtpd.Envelope, partial bool) ([]error, error) {
+	c, err := r.conn(ctx, addr, host)
+	if err != nil {
+		return nil, err
+	}
+
+	errs, err := c.deliver(ctx, env, partial)
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+	r.pool.put(c)
+	return errs, nil
+}
+
+// Close closes the connections that the relay holds open. A message that is
+// on the way keeps its connection, and the relay closes that one once the
+// message is through.
+func (r *Relay) Close() error {
+	r.pool.close()
+	return nil
+}
+
+// conn gives a connection to addr: one from the pool that still answers, or
+// a new one.
+func (r *Relay) conn(ctx context.Context, addr, host string) (*conn, error) {
+	for c := r.pool.get(addr); c != nil; c = r.pool.get(addr) {
+		if err := c.reset(ctx); err == nil {
+			return c, nil
+		}
+		c.close()
+	}
+
+	c, err := r.dial(ctx, addr, host, false)
+	if errors.Is(err, errOpportunisticTLS) {
+		// RFC 7435 section 3 falls back to a connection without TLS where
+		// TLS was only an opportunity and did not work.
+		c, err = r.dial(ctx, addr, host, true)
+	}
+	return c, err
+}
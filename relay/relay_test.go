@@ -0,0 +1,487 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chrj/smtpd/v2"
+	"github.com/chrj/smtpd/v2/middleware"
+	"github.com/chrj/smtpd/v2/smtptest"
+)
+
+// delivery is a message as the smarthost got it.
+type delivery struct {
+	peer     smtpd.Peer
+	sender   string
+	rcpts    []string
+	data     []byte
+	bodyType smtpd.BodyType
+	smtputf8 bool
+	dsn      *smtpd.DSN
+}
+
+// smarthost gives a server that stands for the smarthost, and the messages
+// that it takes. setup changes the server before it starts, and it can start
+// the server itself in another mode.
+func smarthost(t *testing.T, setup func(*smtptest.Server)) (*smtptest.Server, <-chan delivery) {
+	t.Helper()
+
+	got := make(chan delivery, 10)
+	srv := smtptest.NewUnstartedServer(func(ctx context.Context, peer smtpd.Peer, env *smtpd.Envelope) (context.Context, error) {
+		data, err := io.ReadAll(env.Data)
+		if err != nil {
+			return ctx, err
+		}
+		got <- delivery{peer, env.Sender, env.Recipients, data, env.BodyType, env.SMTPUTF8, env.DSN}
+		return ctx, nil
+	})
+	if setup != nil {
+		setup(srv)
+	}
+	if srv.Addr == "" {
+		srv.Start()
+	}
+	t.Cleanup(srv.Close)
+	return srv, got
+}
+
+// relay runs r.Handler for a message of SMTP.
+func relay(r *Relay, env *smtpd.Envelope) error {
+	_, err := r.Handler(context.Background(), smtpd.Peer{Protocol: smtpd.ESMTP}, env)
+	return err
+}
+
+func envelope(body string, rcpts ...string) *smtpd.Envelope {
+	return &smtpd.Envelope{
+		Sender:     "alice@example.org",
+		Recipients: rcpts,
+		Data:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func TestRelay(t *testing.T) {
+	t.Parallel()
+
+	srv, got := smarthost(t, func(s *smtptest.Server) {
+		s.Config.EnableDSN = true
+		s.Config.EnableSMTPUTF8 = true
+	})
+	r := New(srv.Addr, WithHostname("relay.example.org"))
+	defer r.Close()
+
+	env := envelope("Subject: héllo\n\n.leading dot\nbody\n", "bob@example.net", "ünïcode@example.net")
+	env.BodyType = smtpd.Body8BitMIME
+	env.SMTPUTF8 = true
+	env.DSN = &smtpd.DSN{
+		Return: smtpd.DSNReturnHeaders,
+		EnvID:  "id+1=x",
+		Recipients: []smtpd.RecipientDSN{
+			{Notify: smtpd.DSNNotifyFailure | smtpd.DSNNotifyDelay, OriginalType: "rfc822", OriginalRecipient: "bob+tag@example.net"},
+			{Notify: smtpd.DSNNotifyNever, OriginalType: "utf-8", OriginalRecipient: "ünïcode@example.net"},
+		},
+	}
+
+	if err := relay(r, env); err != nil {
+		t.Fatal(err)
+	}
+
+	d := <-got
+	if d.peer.HeloName != "relay.example.org" || d.sender != "alice@example.org" {
+		t.Errorf("peer %+v, sender %q", d.peer, d.sender)
+	}
+	if strings.Join(d.rcpts, ",") != "bob@example.net,ünïcode@example.net" {
+		t.Errorf("recipients %q", d.rcpts)
+	}
+	if want := "Subject: héllo\r\n\r\n.leading dot\r\nbody\r\n"; string(d.data) != want {
+		t.Errorf("data %q, want %q", d.data, want)
+	}
+	if d.bodyType != smtpd.Body8BitMIME || !d.smtputf8 {
+		t.Errorf("body type %q, SMTPUTF8 %v", d.bodyType, d.smtputf8)
+	}
+	if d.dsn == nil || d.dsn.Return != env.DSN.Return || d.dsn.EnvID != env.DSN.EnvID {
+		t.Fatalf("DSN %+v, want %+v", d.dsn, env.DSN)
+	}
+	for i, want := range env.DSN.Recipients {
+		if got := d.dsn.Recipients[i]; got != want {
+			t.Errorf("recipient %d: DSN %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+func TestRelayDATA(t *testing.T) {
+	t.Parallel()
+
+	srv, got := smarthost(t, nil)
+	r := New(srv.Addr, withoutExtensions("CHUNKING", "PIPELINING"))
+	defer r.Close()
+
+	if err := relay(r, envelope(".\n..\nend", "bob@example.net")); err != nil {
+		t.Fatal(err)
+	}
+	// The smarthost reads DATA with the dots and the CRLF taken off again.
+	if d := <-got; string(d.data) != ".\n..\nend\n" {
+		t.Errorf("data %q", d.data)
+	}
+}
+
+func TestRelayBinaryMIME(t *testing.T) {
+	t.Parallel()
+
+	srv, got := smarthost(t, nil)
+	r := New(srv.Addr)
+	defer r.Close()
+
+	body := bytes.Repeat([]byte("\x00\r\n.\n\r\xff"), chunkSize/3)
+	env := envelope(string(body), "bob@example.net")
+	env.BodyType = smtpd.BodyBinaryMIME
+
+	if err := relay(r, env); err != nil {
+		t.Fatal(err)
+	}
+	if d := <-got; !bytes.Equal(d.data, body) || d.bodyType != smtpd.BodyBinaryMIME {
+		t.Errorf("binary message of %d bytes came as %d bytes of %q", len(body), len(d.data), d.bodyType)
+	}
+
+	r = New(srv.Addr, withoutExtensions("CHUNKING"))
+	defer r.Close()
+	env = envelope(string(body), "bob@example.net")
+	env.BodyType = smtpd.BodyBinaryMIME
+
+	if err := relay(r, env); !errors.Is(err, errNoBinaryMIME) {
+		t.Errorf("binary message without CHUNKING: %v, want %v", err, errNoBinaryMIME)
+	}
+}
+
+func TestRelayNoSMTPUTF8(t *testing.T) {
+	t.Parallel()
+
+	srv, got := smarthost(t, nil)
+	r := New(srv.Addr)
+	defer r.Close()
+
+	env := envelope("Subject: x\n\n", "ünïcode@example.net")
+	env.SMTPUTF8 = true
+	if err := relay(r, env); !errors.Is(err, errNoSMTPUTF8) {
+		t.Errorf("got %v, want %v", err, errNoSMTPUTF8)
+	}
+	select {
+	case d := <-got:
+		t.Errorf("smarthost got %+v", d)
+	default:
+	}
+}
+
+func TestRelayRefusedRecipient(t *testing.T) {
+	t.Parallel()
+
+	srv, got := smarthost(t, func(s *smtptest.Server) {
+		s.Config.Use(middleware.CheckRecipient(func(_ context.Context, _ smtpd.Peer, addr string) error {
+			if strings.HasPrefix(addr, "nobody@") {
+				return smtpd.Error{Code: 550, Enhanced: smtpd.EnhancedCode{5, 1, 1}, Message: "No such user"}
+			}
+			return nil
+		}))
+	})
+	r := New(srv.Addr)
+	defer r.Close()
+
+	err := relay(r, envelope("Subject: x\n\n", "bob@example.net", "nobody@example.net"))
+	var smtpErr smtpd.Error
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 550 || smtpErr.Enhanced != (smtpd.EnhancedCode{5, 1, 1}) || smtpErr.Message != "No such user" {
+		t.Fatalf("got %#v, want the reply of the smarthost", err)
+	}
+
+	// The transaction that the refusal left open ends, and the next
+	// message goes through on the same connection.
+	if err := relay(r, envelope("Subject: y\n\n", "bob@example.net")); err != nil {
+		t.Fatal(err)
+	}
+	if d := <-got; string(d.data) != "Subject: y\r\n\r\n" {
+		t.Errorf("smarthost got %q", d.data)
+	}
+}
+
+// TestRelayLMTP runs a server of LMTP in front of the relay, with a
+// smarthost of LMTP behind it, and checks that each recipient gets the
+// answer that the smarthost gave for it.
+func TestRelayLMTP(t *testing.T) {
+	t.Parallel()
+
+	upstream := smtptest.NewUnstartedServer(func(ctx context.Context, _ smtpd.Peer, env *smtpd.Envelope) (context.Context, error) {
+		_, _ = io.Copy(io.Discard, env.Data)
+		for i, rcpt := range env.Recipients {
+			if strings.HasPrefix(rcpt, "full@") {
+				_ = env.RejectRecipient(i, smtpd.Error{Code: 552, Enhanced: smtpd.EnhancedCode{5, 2, 2}, Message: "Mailbox full"})
+			}
+		}
+		return ctx, nil
+	})
+	upstream.Config.LMTP = true
+	upstream.Config.Use(middleware.CheckRecipient(func(_ context.Context, _ smtpd.Peer, addr string) error {
+		if strings.HasPrefix(addr, "nobody@") {
+			return smtpd.Error{Code: 550, Enhanced: smtpd.EnhancedCode{5, 1, 1}, Message: "No such user"}
+		}
+		return nil
+	}))
+	upstream.Start()
+	defer upstream.Close()
+
+	r := New(upstream.Addr, WithLMTP())
+	defer r.Close()
+
+	front := smtptest.NewUnstartedServer(r.Handler)
+	front.Config.LMTP = true
+	front.Start()
+	defer front.Close()
+
+	nc, err := net.Dial("tcp", front.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = nc.Close() }()
+	_ = nc.SetDeadline(time.Now().Add(10 * time.Second))
+	c := textproto.NewConn(nc)
+
+	expect := func(code int, cmd string) {
+		t.Helper()
+		if cmd != "" {
+			if err := c.PrintfLine("%s", cmd); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, msg, err := c.ReadResponse(code); err != nil {
+			t.Fatalf("%q: %v %s", cmd, err, msg)
+		}
+	}
+
+	expect(220, "")
+	expect(250, "LHLO client.example.org")
+	expect(250, "MAIL FROM:<alice@example.org>")
+	expect(250, "RCPT TO:<bob@example.net>")
+	expect(250, "RCPT TO:<nobody@example.net>")
+	expect(250, "RCPT TO:<full@example.net>")
+	expect(354, "DATA")
+	if err := c.PrintfLine("Subject: x\r\n\r\nbody\r\n."); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"250 2.0.0", "550 5.1.1 No such user", "552 5.2.2 Mailbox full"} {
+		line, err := c.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(line, want) {
+			t.Errorf("reply %q, want %q", line, want)
+		}
+	}
+}
+
+func TestRelaySTARTTLSAndAuth(t *testing.T) {
+	t.Parallel()
+
+	var username atomic.Value
+	srv, got := smarthost(t, func(s *smtptest.Server) {
+		s.Config.Use(smtpd.Middleware{
+			Authenticate: func(ctx context.Context, _ smtpd.Peer, user, pass string) (context.Context, error) {
+				if pass != "secret" {
+					return ctx, smtpd.Error{Code: 535, Message: "Wrong password"}
+				}
+				username.Store(user)
+				return ctx, nil
+			},
+		})
+		s.StartSTARTTLS()
+	})
+
+	r := New(srv.Addr, WithSTARTTLS(srv.ClientTLSConfig()), WithAuth(smtp.PlainAuth("", "alice", "secret", srv.Host)))
+	defer r.Close()
+
+	if err := relay(r, envelope("Subject: x\n\n", "bob@example.net")); err != nil {
+		t.Fatal(err)
+	}
+	d := <-got
+	if d.peer.TLS == nil || d.peer.Username != "alice" {
+		t.Errorf("peer %+v, want TLS and user alice", d.peer)
+	}
+
+	r = New(srv.Addr, WithSTARTTLS(srv.ClientTLSConfig()), WithAuth(smtp.PlainAuth("", "alice", "wrong", srv.Host)))
+	defer r.Close()
+	if err := relay(r, envelope("Subject: x\n\n", "bob@example.net")); !errors.Is(err, errUnavailable) {
+		t.Errorf("wrong password: %v, want %v", err, errUnavailable)
+	}
+}
+
+func TestRelayPool(t *testing.T) {
+	t.Parallel()
+
+	var conns atomic.Int32
+	srv, got := smarthost(t, func(s *smtptest.Server) {
+		s.Config.Use(middleware.CheckConnection(func(context.Context, smtpd.Peer) error {
+			conns.Add(1)
+			return nil
+		}))
+	})
+
+	r := New(srv.Addr)
+	for range 3 {
+		if err := relay(r, envelope("Subject: x\n\n", "bob@example.net")); err != nil {
+			t.Fatal(err)
+		}
+		<-got
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("three messages took %d connections, want 1", n)
+	}
+	_ = r.Close()
+
+	r = New(srv.Addr, WithMaxIdle(0))
+	defer r.Close()
+	for range 2 {
+		if err := relay(r, envelope("Subject: x\n\n", "bob@example.net")); err != nil {
+			t.Fatal(err)
+		}
+		<-got
+	}
+	if n := conns.Load(); n != 3 {
+		t.Errorf("two messages without a pool took %d connections, want 2", n-1)
+	}
+}
+
+// disconnects gives a setup of smarthost that reports the end of each of its
+// sessions.
+func disconnects(ch chan<- struct{}) func(*smtptest.Server) {
+	return func(s *smtptest.Server) {
+		s.Config.Use(smtpd.Middleware{
+			Disconnect: func(context.Context, smtpd.Peer, error) { ch <- struct{}{} },
+		})
+	}
+}
+
+// TestRelayPoolIdleTimeout covers a connection whose host gets no message
+// again. It closes at the idle timeout all the same.
+func TestRelayPoolIdleTimeout(t *testing.T) {
+	t.Parallel()
+
+	closed := make(chan struct{}, 1)
+	srv, got := smarthost(t, disconnects(closed))
+
+	r := New(srv.Addr, WithIdleTimeout(100*time.Millisecond))
+	defer r.Close()
+	if err := relay(r, envelope("Subject: x\n\n", "bob@example.net")); err != nil {
+		t.Fatal(err)
+	}
+	<-got
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Error("the idle connection is still open after its timeout")
+	}
+}
+
+// TestRelayPoolTotal covers the cap on the idle connections of all hosts. A
+// connection to a second host closes the one to the first.
+func TestRelayPoolTotal(t *testing.T) {
+	t.Parallel()
+
+	closedA, closedB := make(chan struct{}, 1), make(chan struct{}, 1)
+	a, got := smarthost(t, disconnects(closedA))
+	b, _ := smarthost(t, disconnects(closedB))
+
+	r := New(a.Addr, WithMaxIdleTotal(1))
+	defer r.Close()
+	if err := relay(r, envelope("Subject: x\n\n", "bob@example.net")); err != nil {
+		t.Fatal(err)
+	}
+	<-got
+
+	host, _, _ := net.SplitHostPort(b.Addr)
+	c, err := r.conn(context.Background(), b.Addr, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.pool.put(c)
+
+	select {
+	case <-closedA:
+	case <-time.After(5 * time.Second):
+		t.Error("the connection to the first host is still open")
+	}
+	select {
+	case <-closedB:
+		t.Error("the pool closed the connection to the second host")
+	default:
+	}
+	if c := r.pool.get(b.Addr); c == nil {
+		t.Error("the pool does not hold the connection to the second host")
+	} else {
+		r.pool.put(c)
+	}
+}
+
+func TestRelayUnavailable(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	r := New(addr, WithTimeout(5*time.Second))
+	defer r.Close()
+
+	err = relay(r, envelope("Subject: x\n\n", "bob@example.net"))
+	var smtpErr smtpd.Error
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 451 || smtpErr.Enhanced != (smtpd.EnhancedCode{4, 4, 1}) {
+		t.Errorf("got %v, want 451 4.4.1", err)
+	}
+}
+
+func TestReplyErr(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		reply reply
+		want  smtpd.Error
+	}{
+		{reply{550, "5.1.1 No such user"}, smtpd.Error{Code: 550, Enhanced: smtpd.EnhancedCode{5, 1, 1}, Message: "No such user"}},
+		{reply{452, "4.5.3 Too many\n4.5.3 recipients"}, smtpd.Error{Code: 452, Enhanced: smtpd.EnhancedCode{4, 5, 3}, Message: "Too many recipients"}},
+		{reply{550, "Go away"}, smtpd.Error{Code: 550, Message: "Go away"}},
+		{reply{550, "4.1.1 wrong class"}, smtpd.Error{Code: 550, Message: "4.1.1 wrong class"}},
+	}
+	for _, tt := range tests {
+		if got := tt.reply.err(); got != tt.want {
+			t.Errorf("%+v: got %#v, want %#v", tt.reply, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeORcpt(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		addrType, addr string
+		smtputf8       bool
+		want           string
+	}{
+		{"rfc822", "bob+tag=x@example.net", false, "rfc822;bob+2Btag+3Dx@example.net"},
+		{"utf-8", "ü+x@example.net", true, `utf-8;ü\x{2B}x@example.net`},
+		{"utf-8", "ü+x@example.net", false, `utf-8;\x{FC}\x{2B}x@example.net`},
+	}
+	for _, tt := range tests {
+		if got := encodeORcpt(tt.addrType, tt.addr, tt.smtputf8); got != tt.want {
+			t.Errorf("encodeORcpt(%q, %q, %v) = %q, want %q", tt.addrType, tt.addr, tt.smtputf8, got, tt.want)
+		}
+	}
+}
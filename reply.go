@@ -25,6 +25,11 @@ func (s *session) replyEnhanced(ctx context.Context, code int, enhanced Enhanced
 		return ctx
 	}
 
+	if code >= 400 {
+		s.errors++
+	}
+	s.tarpit(ctx, code)
+
 	status := s.status(enhanced)
 	message = sanitizeReplyText(message)
 
@@ -125,7 +130,24 @@ func (s *session) status(enhanced EnhancedCode) string {
 	return enhanced.String()
 }
 
+// replyError answers with err. An Error with the code 421 also ends the
+// session, because RFC 5321 section 3.8 gives that code to a server that
+// closes the channel. The Disconnect hooks receive err.
 func (s *session) replyError(ctx context.Context, err error) context.Context {
+	var smtpErr Error
+	if errors.As(err, &smtpErr) && smtpErr.Code == 421 {
+		ctx = s.writeError(ctx, err)
+		s.setErr(err)
+		return s.close(ctx)
+	}
+	return s.writeError(ctx, err)
+}
+
+// writeError answers with err, and leaves the session open whatever its
+// code. The replies of LMTP to the end of a message use it: the client reads
+// one for each recipient, and a 421 among them stands for that recipient
+// alone.
+func (s *session) writeError(ctx context.Context, err error) context.Context {
 	var smtpErr Error
 	if errors.As(err, &smtpErr) {
 		return s.replyEnhanced(ctx, smtpErr.Code, smtpErr.enhanced(), smtpErr.Message)
@@ -0,0 +1,157 @@
+package smtpd_test
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/chrj/smtpd/v2"
+)
+
+// rewrite returns a Middleware whose RewriteRecipient hook gives the
+// addresses of table in the place of an address, and leaves every other one
+// as it was.
+func rewrite(table map[string][]string) smtpd.Middleware {
+	return smtpd.Middleware{
+		RewriteRecipient: func(ctx context.Context, _ smtpd.Peer, addr string) (context.Context, []string, error) {
+			if addr == "refused@example.net" {
+				return ctx, nil, smtpd.Error{Code: 550, Enhanced: smtpd.EnhancedCode{5, 1, 1}, Message: "No such user"}
+			}
+			return ctx, table[addr], nil
+		},
+	}
+}
+
+// envelopeCapture returns a Handler that hands the recipients and the DSN
+// parameters of the envelope to the test.
+func envelopeCapture(got chan<- *smtpd.Envelope) smtpd.Handler {
+	return func(ctx context.Context, _ smtpd.Peer, env *smtpd.Envelope) (context.Context, error) {
+		got <- &smtpd.Envelope{Recipients: env.Recipients, DSN: env.DSN}
+		return ctx, nil
+	}
+}
+
+// TestRewriteRecipient covers the RewriteRecipient hooks: each one runs on the
+// addresses of the one before it, and an address that changed keeps the one
+// that the client sent as its ORCPT.
+func TestRewriteRecipient(t *testing.T) {
+	t.Parallel()
+
+	got := make(chan *smtpd.Envelope, 1)
+	srv := runserver(t, &smtpd.Server{
+		Logger:    testLogger(t),
+		EnableDSN: true,
+		Handler:   envelopeCapture(got),
+	},
+		rewrite(map[string][]string{
+			"sales@example.net": {"bob@example.net", "team@example.net"},
+			"old@example.net":   {"new@example.net"},
+		}),
+		rewrite(map[string][]string{
+			"team@example.net": {"carol@example.net", "dave@example.net"},
+		}),
+	)
+
+	c := dialRaw(t, srv.Addr)
+	for _, cmd := range []string{
+		"EHLO localhost",
+		"MAIL FROM:<sender@example.org>",
+		"RCPT TO:<sales@example.net>",
+		"RCPT TO:<plain@example.net>",
+		"RCPT TO:<old@example.net> ORCPT=rfc822;Old@Example.net",
+	} {
+		if reply := c.send("%s", cmd); !strings.HasPrefix(reply, "250") {
+			t.Fatalf("%s: reply = %q, want 250", cmd, reply)
+		}
+	}
+	if reply := c.send("RCPT TO:<refused@example.net>"); reply != "550 5.1.1 No such user" {
+		t.Errorf("refused recipient: reply = %q", reply)
+	}
+	if reply := c.send("DATA"); !strings.HasPrefix(reply, "354") {
+		t.Fatalf("DATA reply = %q, want 354", reply)
+	}
+	if reply := c.send("Subject: x\r\n\r\nbody\r\n."); !strings.HasPrefix(reply, "250") {
+		t.Fatalf("end of data reply = %q, want 250", reply)
+	}
+
+	env := <-got
+	wantRecipients := []string{"bob@example.net", "carol@example.net", "dave@example.net", "plain@example.net", "new@example.net"}
+	if !reflect.DeepEqual(env.Recipients, wantRecipients) {
+		t.Errorf("recipients = %q, want %q", env.Recipients, wantRecipients)
+	}
+
+	sales := smtpd.RecipientDSN{OriginalType: "rfc822", OriginalRecipient: "sales@example.net"}
+	wantDSN := []smtpd.RecipientDSN{
+		sales, sales, sales,
+		{},
+		{OriginalType: "rfc822", OriginalRecipient: "Old@Example.net"},
+	}
+	if env.DSN == nil || !reflect.DeepEqual(env.DSN.Recipients, wantDSN) {
+		t.Errorf("DSN = %+v, want recipients %+v", env.DSN, wantDSN)
+	}
+}
+
+// TestRewriteRecipientMaxRecipients covers the limit after the expansion: a
+// command whose addresses take the envelope past MaxRecipients adds none of
+// them.
+func TestRewriteRecipientMaxRecipients(t *testing.T) {
+	t.Parallel()
+
+	got := make(chan *smtpd.Envelope, 1)
+	srv := runserver(t, &smtpd.Server{
+		Logger:        testLogger(t),
+		MaxRecipients: 3,
+		Handler:       envelopeCapture(got),
+	}, rewrite(map[string][]string{
+		"list@example.net": {"a@example.net", "b@example.net", "c@example.net"},
+	}))
+
+	c := dialRaw(t, srv.Addr)
+	for _, cmd := range []string{"EHLO localhost", "MAIL FROM:<sender@example.org>", "RCPT TO:<one@example.net>"} {
+		if reply := c.send("%s", cmd); !strings.HasPrefix(reply, "250") {
+			t.Fatalf("%s: reply = %q, want 250", cmd, reply)
+		}
+	}
+	if reply := c.send("RCPT TO:<list@example.net>"); reply != "452 4.5.3 Too many recipients" {
+		t.Errorf("RCPT of the list: reply = %q, want 452", reply)
+	}
+	if reply := c.send("DATA"); !strings.HasPrefix(reply, "354") {
+		t.Fatalf("DATA reply = %q, want 354", reply)
+	}
+	c.send("Subject: x\r\n\r\nbody\r\n.")
+
+	// Without an address that changed, the envelope carries no DSN.
+	if env := <-got; !reflect.DeepEqual(env.Recipients, []string{"one@example.net"}) || env.DSN != nil {
+		t.Errorf("envelope: recipients %q, DSN %+v", env.Recipients, env.DSN)
+	}
+}
+
+// TestLMTPRewriteRepliesPerCommand covers the replies of LMTP after an
+// expansion: one for each RCPT TO command, with the first error of its
+// addresses.
+func TestLMTPRewriteRepliesPerCommand(t *testing.T) {
+	t.Parallel()
+
+	srv := lmtpserver(t, &smtpd.Server{
+		Handler: rejectRecipientAt(t, 2, smtpd.Error{Code: 452, Enhanced: smtpd.EnhancedCode{4, 2, 2}, Message: "Mailbox full"}),
+	}, rewrite(map[string][]string{
+		"list@example.net": {"a@example.net", "b@example.net"},
+	}))
+
+	c := dialRaw(t, srv.Addr)
+	openLMTP(t, c, "one@example.net", "list@example.net", "two@example.net")
+
+	if reply := c.send("DATA"); !strings.HasPrefix(reply, "354") {
+		t.Fatalf("DATA reply = %q, want 354", reply)
+	}
+	c.write([]byte("Subject: one\r\n\r\nA short body.\r\n.\r\n"))
+
+	want := []string{"250 2.0.0 Thank you.", "452 4.2.2 Mailbox full", "250 2.0.0 Thank you."}
+	if got := c.replies(len(want)); !reflect.DeepEqual(got, want) {
+		t.Errorf("replies = %q, want %q", got, want)
+	}
+	if reply := c.send("NOOP"); reply != "250 2.0.0 Go ahead" {
+		t.Errorf("NOOP reply = %q, want the answer to that command", reply)
+	}
+}
@@ -0,0 +1,237 @@
+package smtpd
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Violation names a way in which a client broke the order of the protocol.
+// Spam software shows such signs far more often than a mail server does,
+// since it writes its commands without waiting for the replies.
+type Violation string
+
+const (
+	// ViolationEarlyTalk is a client that wrote before the greeting, which
+	// RFC 5321 section 3.1 has it wait for. GreetPause tests it.
+	ViolationEarlyTalk Violation = "early-talk"
+
+	// ViolationPipelining is a client that wrote a command behind another
+	// one before it learned that the server offers PIPELINING, which RFC
+	// 2920 section 3.1 forbids. ScreenProtocol tests it.
+	ViolationPipelining Violation = "pipelining"
+
+	// ViolationBareLF is a command line that ends in a LF without the CR of
+	// RFC 5321 section 2.3.8. ScreenProtocol tests it.
+	ViolationBareLF Violation = "bare-lf"
+)
+
+// ViolationError ends a session whose client ScreenViolation refused. The
+// Disconnect hooks receive it.
+type ViolationError struct {
+	Violation Violation
+}
+
+func (e ViolationError) Error() string {
+	return "smtpd: the client broke the protocol: " + string(e.Violation)
+}
+
+// errViolation answers a client that broke the protocol, where no
+// ScreenViolation hook decides about it. RFC 7504 gives 521 to a server that
+// takes no mail from the client and closes the connection.
+var errViolation = Error{Code: 521, Enhanced: EnhancedCode{5, 5, 0}, Message: "Protocol error, closing connection"}
+
+// ScreenCache keeps the verdicts of GreetPause and ScreenProtocol by client
+// address. A client whose last session passed skips GreetPause. A
+// ScreenCache is safe for concurrent use.
+type ScreenCache interface {
+	// Verdict gives the verdict on record for addr: the first violation of
+	// its last session, or "" for a session that passed. ok is false where
+	// the cache holds no verdict for addr.
+	Verdict(addr netip.Addr) (v Violation, ok bool)
+
+	// SetVerdict records the verdict of a session from addr.
+	SetVerdict(addr netip.Addr, v Violation)
+}
+
+// screening holds what the tests of the session found.
+type screening struct {
+	// greeted says that the greeting went out, so that the client may talk.
+	// The PROXY header of version 1 comes before it and is no command of the
+	// client.
+	greeted bool
+
+	// passed says that the client passed GreetPause, or skipped it for a
+	// verdict on record.
+	passed bool
+
+	// violation is the first violation of the session.
+	violation Violation
+}
+
+// screenAddr gives the address that ScreenCache keeps the verdicts of the
+// client under. A client that is not on TCP has none.
+func (s *session) screenAddr() (netip.Addr, bool) {
+	tcpAddr, ok := s.peer.Addr.(*net.TCPAddr)
+	if !ok || s.server.ScreenCache == nil {
+		return netip.Addr{}, false
+	}
+	return tcpAddr.AddrPort().Addr().Unmap(), true
+}
+
+// greetPause holds the greeting back for GreetPause, and catches a client
+// that writes before it. The session closes where the client left during the
+// pause, or where ScreenViolation refused it.
+func (s *session) greetPause(ctx context.Context) context.Context {
+	if s.server.GreetPause <= 0 {
+		return ctx
+	}
+
+	addr, ok := s.screenAddr()
+	if ok {
+		if v, found := s.server.ScreenCache.Verdict(addr); found && v == "" {
+			s.screen.passed = true
+			return ctx
+		}
+	}
+
+	_ = s.conn.SetReadDeadline(s.readDeadline(s.server.GreetPause))
+
+	// A peek leaves what the client wrote in the reader, where the session
+	// reads it as commands if the hook lets the client go on.
+	_, err := s.reader.Peek(1)
+	if err == nil {
+		return s.violate(ctx, ViolationEarlyTalk)
+	}
+
+	if limit, ok := s.limitOf(err); ok {
+		return s.closeAtLimit(ctx, limit)
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		s.screen.passed = true
+		return ctx
+	}
+
+	// The client left during the pause, which is no verdict.
+	s.readErr = err
+	return s.close(ctx)
+}
+
+// screenLine runs the tests of ScreenProtocol on the command line that the
+// session just read.
+func (s *session) screenLine(ctx context.Context) context.Context {
+	if !s.server.ScreenProtocol || !s.screen.greeted || s.screen.violation != "" {
+		return ctx
+	}
+
+	if s.bareLF {
+		return s.violate(ctx, ViolationBareLF)
+	}
+
+	// A client that offers no extensions never learned of PIPELINING, so
+	// it waits for each reply before it writes the next command.
+	if !s.peer.Protocol.extended() && s.reader.Buffered() > 0 {
+		return s.violate(ctx, ViolationPipelining)
+	}
+
+	return ctx
+}
+
+// violate records v for the client and lets ScreenViolation decide about it.
+// Only the first violation of a session counts.
+func (s *session) violate(ctx context.Context, v Violation) context.Context {
+	if s.screen.violation != "" {
+		return ctx
+	}
+	s.screen.violation = v
+
+	LoggerFromContext(ctx).WarnContext(ctx, "the client broke the protocol",
+		slog.String("violation", string(v)),
+	)
+
+	if addr, ok := s.screenAddr(); ok {
+		s.server.ScreenCache.SetVerdict(addr, v)
+	}
+
+	err := error(errViolation)
+	if s.server.ScreenViolation != nil {
+		err = s.server.ScreenViolation(ctx, s.peer, v)
+	}
+	if err == nil {
+		return ctx
+	}
+
+	s.setErr(ViolationError{Violation: v})
+	ctx = s.writeError(ctx, err)
+	return s.close(ctx)
+}
+
+// recordPass records the verdict of a session that passed GreetPause and
+// broke the protocol in no other way, so that the client skips the pause
+// when it comes back.
+func (s *session) recordPass() {
+	if !s.screen.passed || s.screen.violation != "" {
+		return
+	}
+	if addr, ok := s.screenAddr(); ok {
+		s.server.ScreenCache.SetVerdict(addr, "")
+	}
+}
+
+// ScreenMemory is a ScreenCache that holds the verdicts in memory, each for
+// the TTL of the cache. It is safe for concurrent use.
+type ScreenMemory struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	verdicts  map[netip.Addr]screenVerdict
+	nextSweep time.Time
+}
+
+type screenVerdict struct {
+	violation Violation
+	expires   time.Time
+}
+
+// NewScreenMemory returns an empty ScreenMemory whose verdicts last ttl.
+func NewScreenMemory(ttl time.Duration) *ScreenMemory {
+	return &ScreenMemory{ttl: ttl, verdicts: make(map[netip.Addr]screenVerdict)}
+}
+
+// Verdict gives the verdict on record for addr.
+func (m *ScreenMemory) Verdict(addr netip.Addr) (Violation, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v, ok := m.verdicts[addr]
+	if !ok || !time.Now().Before(v.expires) {
+		return "", false
+	}
+	return v.violation, true
+}
+
+// SetVerdict records v for addr. A verdict past its TTL goes, once a
+// minute.
+func (m *ScreenMemory) SetVerdict(addr netip.Addr, v Violation) {
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !now.Before(m.nextSweep) {
+		m.nextSweep = now.Add(time.Minute)
+		for a, verdict := range m.verdicts {
+			if !now.Before(verdict.expires) {
+				delete(m.verdicts, a)
+			}
+		}
+	}
+
+	m.verdicts[addr] = screenVerdict{violation: v, expires: now.Add(m.ttl)}
+}
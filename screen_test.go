@@ -0,0 +1,223 @@
+package smtpd_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/chrj/smtpd/v2"
+)
+
+// screenSession connects to a server of l from addr, and gives the client end
+// with its reader.
+func screenSession(t *testing.T, l *pipeListener, addr string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	c := l.dialFrom(t, addr)
+	t.Cleanup(func() { _ = c.Close() })
+	return c, bufio.NewReader(c)
+}
+
+// screenServer runs srv on a pipe in the bubble of the test, and gives the
+// listener with the errors that the Disconnect hooks received.
+func screenServer(t *testing.T, srv *smtpd.Server) (*pipeListener, <-chan error) {
+	t.Helper()
+
+	disconnected := make(chan error, 4)
+	srv.Logger = testLogger(t)
+	srv.Use(smtpd.Middleware{
+		Disconnect: func(_ context.Context, _ smtpd.Peer, err error) { disconnected <- err },
+	})
+
+	l := runpipeserver(t, srv)
+	t.Cleanup(func() { _ = l.Close() })
+	return l, disconnected
+}
+
+// assertViolation checks that err is the ViolationError of v.
+func assertViolation(t *testing.T, err error, v smtpd.Violation) {
+	t.Helper()
+
+	var violationErr smtpd.ViolationError
+	if !errors.As(err, &violationErr) || violationErr.Violation != v {
+		t.Errorf("Disconnect got %v, want the ViolationError of %s", err, v)
+	}
+}
+
+func TestGreetPause(t *testing.T) {
+	t.Parallel()
+
+	synctest.Test(t, func(t *testing.T) {
+		l, disconnected := screenServer(t, &smtpd.Server{GreetPause: 5 * time.Second})
+
+		// A client that waits gets the greeting after the pause, and the
+		// next session from its address gets it at once.
+		for i, want := range []time.Duration{5 * time.Second, 0} {
+			start := time.Now()
+			c, r := screenSession(t, l, "192.0.2.1:1025")
+			line, _ := r.ReadString('\n')
+			if !strings.HasPrefix(line, "220 ") || time.Since(start) != want {
+				t.Errorf("session %d: greeting %q after %v, want it after %v", i+1, line, time.Since(start), want)
+			}
+			timedCmd(t, c, r, "QUIT")
+			if err := <-disconnected; err != nil {
+				t.Errorf("session %d: Disconnect got %v", i+1, err)
+			}
+		}
+
+		// Another address waits.
+		start := time.Now()
+		_, r := screenSession(t, l, "192.0.2.2:1025")
+		_, _ = r.ReadString('\n')
+		if time.Since(start) != 5*time.Second {
+			t.Errorf("greeting of another address after %v, want it after the pause", time.Since(start))
+		}
+	})
+}
+
+func TestGreetPauseEarlyTalk(t *testing.T) {
+	t.Parallel()
+
+	synctest.Test(t, func(t *testing.T) {
+		l, disconnected := screenServer(t, &smtpd.Server{GreetPause: 5 * time.Second})
+
+		start := time.Now()
+		c, r := screenSession(t, l, "192.0.2.1:1025")
+		go func() { _, _ = c.Write([]byte("HELO client.example.com\r\n")) }()
+
+		// The greeting carries no enhanced code, and neither does the reply
+		// in its place.
+		line, _ := r.ReadString('\n')
+		if line != "521 Protocol error, closing connection\r\n" || time.Since(start) != 0 {
+			t.Errorf("reply %q after %v, want a 521 at once", line, time.Since(start))
+		}
+		assertViolation(t, <-disconnected, smtpd.ViolationEarlyTalk)
+
+		// The verdict holds the next session to the pause.
+		start = time.Now()
+		_, r = screenSession(t, l, "192.0.2.1:1025")
+		if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, "220 ") || time.Since(start) != 5*time.Second {
+			t.Errorf("greeting %q after %v, want it after the pause", line, time.Since(start))
+		}
+	})
+}
+
+func TestScreenProtocol(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		write []string
+		want  smtpd.Violation
+	}{
+		{"pipelining after HELO", []string{"HELO client.example.com\r\n", "MAIL FROM:<alice@example.com>\r\nRCPT TO:<bob@example.com>\r\n"}, smtpd.ViolationPipelining},
+		{"pipelining before EHLO", []string{"EHLO client.example.com\r\nMAIL FROM:<alice@example.com>\r\n"}, smtpd.ViolationPipelining},
+		{"bare LF", []string{"EHLO client.example.com\r\n", "NOOP\n"}, smtpd.ViolationBareLF},
+		{"pipelining after EHLO", []string{"EHLO client.example.com\r\n", "MAIL FROM:<alice@example.com>\r\nRCPT TO:<bob@example.com>\r\n", "QUIT\r\n"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			synctest.Test(t, func(t *testing.T) {
+				l, disconnected := screenServer(t, &smtpd.Server{ScreenProtocol: true})
+
+				c, r := screenSession(t, l, "192.0.2.1:1025")
+				_, _ = r.ReadString('\n')
+				go func() {
+					for _, w := range tt.write {
+						if _, err := c.Write([]byte(w)); err != nil {
+							return
+						}
+						synctest.Wait()
+					}
+				}()
+
+				var last string
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						break
+					}
+					last = line
+				}
+
+				err := <-disconnected
+				if tt.want == "" {
+					if err != nil || !strings.HasPrefix(last, "221 ") {
+						t.Errorf("last reply %q, Disconnect got %v; want a clean session", last, err)
+					}
+					return
+				}
+				if !strings.HasPrefix(last, "521 ") {
+					t.Errorf("last reply = %q, want a 521", last)
+				}
+				assertViolation(t, err, tt.want)
+			})
+		})
+	}
+}
+
+func TestScreenViolationHook(t *testing.T) {
+	t.Parallel()
+
+	synctest.Test(t, func(t *testing.T) {
+		var got []smtpd.Violation
+		l, _ := screenServer(t, &smtpd.Server{
+			ScreenProtocol: true,
+			ScreenViolation: func(_ context.Context, _ smtpd.Peer, v smtpd.Violation) error {
+				got = append(got, v)
+				return nil
+			},
+		})
+
+		// A hook that lets the client go on hears of the first violation
+		// alone, and the session runs its commands.
+		c, r := screenSession(t, l, "192.0.2.1:1025")
+		_, _ = r.ReadString('\n')
+		go func() { _, _ = c.Write([]byte("HELO client.example.com\r\nNOOP\r\nNOOP\n")) }()
+		for _, want := range []string{"250 ", "250 ", "250 "} {
+			if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, want) {
+				t.Errorf("reply = %q, want %q", line, want)
+			}
+		}
+		if len(got) != 1 || got[0] != smtpd.ViolationPipelining {
+			t.Errorf("the hook got %v, want the pipelining alone", got)
+		}
+	})
+}
+
+func TestScreenMemory(t *testing.T) {
+	t.Parallel()
+
+	synctest.Test(t, func(t *testing.T) {
+		m := smtpd.NewScreenMemory(time.Hour)
+		addr := netip.MustParseAddr("192.0.2.1")
+
+		if _, ok := m.Verdict(addr); ok {
+			t.Fatal("an empty cache has a verdict")
+		}
+
+		m.SetVerdict(addr, smtpd.ViolationBareLF)
+		if v, ok := m.Verdict(addr); !ok || v != smtpd.ViolationBareLF {
+			t.Errorf("Verdict = %q, %v", v, ok)
+		}
+
+		m.SetVerdict(addr, "")
+		if v, ok := m.Verdict(addr); !ok || v != "" {
+			t.Errorf("Verdict = %q, %v, want a pass", v, ok)
+		}
+
+		time.Sleep(time.Hour)
+		if _, ok := m.Verdict(addr); ok {
+			t.Error("the verdict outlived its TTL")
+		}
+	})
+}
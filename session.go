@@ -39,6 +39,25 @@ type session struct {
 	// the address that every hook after it reads.
 	ranCommand bool
 
+	// errors counts the error replies of the session, for the tarpit and
+	// MaxErrors. commands, transactions and rejectedRecipients count for the
+	// other limits of a session.
+	errors             int
+	commands           int
+	transactions       int
+	rejectedRecipients int
+
+	// screen holds what GreetPause and ScreenProtocol found.
+	screen screening
+
+	// bareLF says that the last line from readLine ended in a LF without a
+	// CR before it.
+	bareLF bool
+
+	// expires is the end of the session under MaxSessionDuration, and the
+	// zero time without one.
+	expires time.Time
+
 	// readErr holds the error that ended the reading of the connection. A
 	// read that failed once fails from then on, in the way that a
 	// bufio.Scanner stops for good. Without that, an AUTH command whose
@@ -73,6 +92,10 @@ func (srv *Server) newSession(ctx context.Context, c net.Conn) (context.Context,
 		},
 	}
 
+	if srv.MaxSessionDuration > 0 {
+		s.expires = time.Now().Add(srv.MaxSessionDuration)
+	}
+
 	ctx = contextWithLogger(ctx, srv.newLogger().With(slog.String("peer", c.RemoteAddr().String())))
 
 	// Check if the underlying connection is already TLS.
@@ -152,12 +175,14 @@ func (s *session) readLine() (string, error) {
 			// A last line without a line break is still a command, which is
 			// how the scanner of the standard library reads it.
 			if errors.Is(err, io.EOF) && len(line) > 0 {
+				s.bareLF = false
 				return string(trimLineBreak(line)), nil
 			}
 			s.readErr = err
 			return "", err
 		}
 
+		s.bareLF = !bytes.HasSuffix(line, []byte("\r\n"))
 		return string(trimLineBreak(line)), nil
 	}
 }
@@ -229,6 +254,11 @@ func (s *session) serve(ctx context.Context) {
 				return
 			}
 
+			if limit, ok := s.limitOf(err); ok {
+				s.closeAtLimit(ctx, limit)
+				return
+			}
+
 			s.setErr(err)
 			if errors.Is(err, bufio.ErrTooLong) {
 				ctx = s.replyEnhanced(ctx, 500, EnhancedCode{5, 5, 2}, "Line too long")
@@ -237,8 +267,24 @@ func (s *session) serve(ctx context.Context) {
 		}
 
 		logger.DebugContext(ctx, "received", slog.String("line", redactLine(line)))
+
+		s.commands++
+		if limit := s.server.MaxCommands; limit > 0 && s.commands > limit {
+			s.closeAtLimit(ctx, "MaxCommands")
+			return
+		}
+
+		ctx = s.screenLine(ctx)
+		if s.closed {
+			return
+		}
+
 		ctx = s.handle(ctx, line)
+		if s.closed {
+			return
+		}
 
+		ctx = s.checkLimits(ctx)
 		if s.closed {
 			return
 		}
@@ -246,12 +292,13 @@ func (s *session) serve(ctx context.Context) {
 
 }
 
-func (s *session) reject(ctx context.Context) context.Context {
-	ctx = s.replyEnhanced(ctx, 421, EnhancedCode{4, 3, 2}, "Too busy. Try again later.")
-	return s.close(ctx)
-}
-
 func (s *session) reset(ctx context.Context) context.Context {
+	// A 421 closed the session, and the Disconnect hooks ran with it. A
+	// Reset hook after them would come out of order.
+	if s.closed {
+		return ctx
+	}
+
 	result := s.stopChunk(errChunkAborted)
 
 	ctx, done := s.reportChunkPanic(ctx, result)
@@ -274,6 +321,14 @@ func (s *session) reset(ctx context.Context) context.Context {
 }
 
 func (s *session) welcome(ctx context.Context) context.Context {
+	// XCLIENT greets the client once more, and the pause is over by then.
+	if !s.screen.greeted {
+		ctx = s.greetPause(ctx)
+		if s.closed {
+			return ctx
+		}
+	}
+
 	var err error
 	ctx, err = s.server.checkConnection(ctx, s.peer)
 	if err != nil {
@@ -283,6 +338,7 @@ func (s *session) welcome(ctx context.Context) context.Context {
 
 	// The greeting carries no status code. RFC 2034 takes it out of the
 	// extension, and the client has not sent EHLO at this point.
+	s.screen.greeted = true
 	return s.replyEnhanced(ctx, 220, EnhancedCode{}, s.server.WelcomeMessage)
 
 }
@@ -290,7 +346,7 @@ func (s *session) welcome(ctx context.Context) context.Context {
 func (s *session) flush(ctx context.Context) context.Context {
 	_ = s.conn.SetWriteDeadline(time.Now().Add(s.server.WriteTimeout))
 	_ = s.writer.Flush()
-	_ = s.conn.SetReadDeadline(time.Now().Add(s.server.ReadTimeout))
+	_ = s.conn.SetReadDeadline(s.readDeadline(s.server.ReadTimeout))
 	return ctx
 }
 
@@ -310,6 +366,7 @@ func (s *session) close(ctx context.Context) context.Context {
 	ctx, _ = s.reportChunkPanic(ctx, s.stopChunk(errChunkAborted))
 
 	_ = s.writer.Flush()
+	s.recordPass()
 	s.notifyDisconnect(ctx)
 	_ = s.conn.Close()
 	return ctx
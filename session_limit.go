@@ -0,0 +1,170 @@
+package smtpd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// SessionLimitError ends a session that reached one of the limits of a
+// session on Server, such as MaxErrors. The server answers 421 4.7.0 and
+// closes the connection, and the Disconnect hooks receive the error.
+type SessionLimitError struct {
+	// Limit is the name of the field of Server that the session reached,
+	// such as "MaxErrors".
+	Limit string
+}
+
+func (e SessionLimitError) Error() string {
+	return "smtpd: the session reached " + e.Limit
+}
+
+// sessionLimitReplies holds the text of the 421 for each limit.
+var sessionLimitReplies = map[string]string{
+	"MaxErrors":             "Too many errors, closing connection",
+	"MaxCommands":           "Too many commands, closing connection",
+	"MaxTransactions":       "Too many transactions, closing connection",
+	"MaxRejectedRecipients": "Too many rejected recipients, closing connection",
+	"MaxSessionDuration":    "Session lasted too long, closing connection",
+	"MinDataRate":           "Message data arrived too slowly, closing connection",
+}
+
+// checkLimits ends the session when its last command brought it to
+// MaxErrors or MaxRejectedRecipients.
+func (s *session) checkLimits(ctx context.Context) context.Context {
+	if limit := s.server.MaxErrors; limit > 0 && s.errors >= limit {
+		return s.closeAtLimit(ctx, "MaxErrors")
+	}
+	if limit := s.server.MaxRejectedRecipients; limit > 0 && s.rejectedRecipients >= limit {
+		return s.closeAtLimit(ctx, "MaxRejectedRecipients")
+	}
+	return ctx
+}
+
+// closeAtLimit answers 421 for limit and closes the session.
+func (s *session) closeAtLimit(ctx context.Context, limit string) context.Context {
+	LoggerFromContext(ctx).WarnContext(ctx, "closing a session at a limit",
+		slog.String("limit", limit),
+	)
+
+	s.setErr(SessionLimitError{Limit: limit})
+	ctx = s.replyEnhanced(ctx, 421, EnhancedCode{4, 7, 0}, sessionLimitReplies[limit])
+	return s.close(ctx)
+}
+
+// refusedRecipient counts a recipient that a hook refused for good, which
+// is what a client that guesses addresses collects.
+func (s *session) refusedRecipient(err error) {
+	var smtpErr Error
+	if !errors.As(err, &smtpErr) || smtpErr.Code >= 500 {
+		s.rejectedRecipients++
+	}
+}
+
+// readDeadline gives the deadline of a read that may take d, which is the
+// end of the session of MaxSessionDuration when that comes first.
+func (s *session) readDeadline(d time.Duration) time.Time {
+	deadline := time.Now().Add(d)
+	if !s.expires.IsZero() && s.expires.Before(deadline) {
+		return s.expires
+	}
+	return deadline
+}
+
+// setDataDeadline sets the deadlines of the octets of a message, and gives
+// the one of the reads.
+func (s *session) setDataDeadline() time.Time {
+	_ = s.conn.SetWriteDeadline(time.Now().Add(s.server.DataTimeout))
+	deadline := s.readDeadline(s.server.DataTimeout)
+	_ = s.conn.SetReadDeadline(deadline)
+	return deadline
+}
+
+// limitOf gives the limit that err stands for: the one of a
+// SessionLimitError, or MaxSessionDuration for a read that ran into the end
+// of the session.
+func (s *session) limitOf(err error) (string, bool) {
+	var limitErr SessionLimitError
+	if errors.As(err, &limitErr) {
+		return limitErr.Limit, true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() && !s.expires.IsZero() && !time.Now().Before(s.expires) {
+		return "MaxSessionDuration", true
+	}
+	return "", false
+}
+
+// rateWindow counts the octets of a message against MinDataRate. It counts
+// the time that the session spent waiting for them, and not the time that a
+// handler took between two reads, so a slow handler does not make a client
+// slow. The window of a BDAT message spans its chunks.
+type rateWindow struct {
+	waited time.Duration
+	n      int64
+}
+
+// rateReader reads the octets of a message, and fails with the
+// SessionLimitError of MinDataRate once a window of MinDataRateWindow brought
+// fewer than MinDataRate octets a second.
+type rateReader struct {
+	s        *session
+	r        io.Reader
+	w        *rateWindow
+	deadline time.Time
+	err      error
+}
+
+// rateReader gives r under MinDataRate, or r itself without one. deadline
+// is the one that setDataDeadline gave.
+func (s *session) rateReader(r io.Reader, w *rateWindow, deadline time.Time) io.Reader {
+	if s.server.MinDataRate <= 0 {
+		return r
+	}
+	return &rateReader{s: s, r: r, w: w, deadline: deadline}
+}
+
+func (r *rateReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	window := r.s.server.MinDataRateWindow
+	for {
+		// A read waits no longer than the rest of the window, so a client
+		// that sends nothing at all meets the check as well.
+		start := time.Now()
+		deadline := start.Add(window - r.w.waited)
+		if r.deadline.Before(deadline) {
+			deadline = r.deadline
+		}
+		_ = r.s.conn.SetReadDeadline(deadline)
+
+		n, err := r.r.Read(p)
+		now := time.Now()
+		r.w.waited += now.Sub(start)
+		r.w.n += int64(n)
+
+		if r.w.waited >= window {
+			if float64(r.w.n) < float64(r.s.server.MinDataRate)*window.Seconds() {
+				r.err = SessionLimitError{Limit: "MinDataRate"}
+				return n, r.err
+			}
+			*r.w = rateWindow{}
+		}
+
+		// The end of the window is no end of the message.
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() && now.Before(r.deadline) {
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
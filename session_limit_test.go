@@ -0,0 +1,274 @@
+package smtpd_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/chrj/smtpd/v2"
+)
+
+// assertLimit checks that the last reply of c is the 421 of a limit, and that
+// the Disconnect hooks received the SessionLimitError of that limit.
+func assertLimit(t *testing.T, c *rawClient, reply string, rec *disconnectRecord, limit string) {
+	t.Helper()
+
+	if !strings.HasPrefix(reply, "421 4.7.0 ") {
+		t.Errorf("reply = %q, want the 421 of %s", reply, limit)
+	}
+
+	_, err := waitDisconnect(rec, 3*time.Second)
+	var limitErr smtpd.SessionLimitError
+	if !errors.As(err, &limitErr) || limitErr.Limit != limit {
+		t.Errorf("Disconnect got %v, want the SessionLimitError of %s", err, limit)
+	}
+
+	// The server closed the connection.
+	_ = c.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := c.br.ReadString('\n'); err == nil {
+		t.Error("the connection is still open")
+	}
+}
+
+func TestMaxErrors(t *testing.T) {
+	t.Parallel()
+
+	var rec disconnectRecord
+	srv := runserver(t, &smtpd.Server{MaxErrors: 3, Logger: testLogger(t)}, disconnectCounter(&rec))
+
+	c := dialRaw(t, srv.Addr)
+	c.send("EHLO client.example.com")
+	c.send("FOO")
+	c.send("NOOP")
+	c.send("RCPT TO:<bob@example.com>")
+
+	// The third error gets its own reply, and the 421 after it.
+	if reply := c.send("BAR"); !strings.HasPrefix(reply, "500 ") {
+		t.Errorf("third error = %q, want its own reply first", reply)
+	}
+	assertLimit(t, c, c.line(), &rec, "MaxErrors")
+}
+
+func TestMaxCommands(t *testing.T) {
+	t.Parallel()
+
+	var rec disconnectRecord
+	srv := runserver(t, &smtpd.Server{MaxCommands: 3, Logger: testLogger(t)}, disconnectCounter(&rec))
+
+	c := dialRaw(t, srv.Addr)
+	c.send("EHLO client.example.com")
+	c.send("NOOP")
+	c.send("RSET")
+	assertLimit(t, c, c.send("NOOP"), &rec, "MaxCommands")
+}
+
+func TestMaxTransactions(t *testing.T) {
+	t.Parallel()
+
+	var rec disconnectRecord
+	srv := runserver(t, &smtpd.Server{MaxTransactions: 2, Logger: testLogger(t)}, disconnectCounter(&rec))
+
+	c := dialRaw(t, srv.Addr)
+	c.send("EHLO client.example.com")
+	for range 2 {
+		if reply := c.send("MAIL FROM:<alice@example.com>"); !strings.HasPrefix(reply, "250 ") {
+			t.Fatalf("MAIL = %q", reply)
+		}
+		c.send("RSET")
+	}
+	assertLimit(t, c, c.send("MAIL FROM:<alice@example.com>"), &rec, "MaxTransactions")
+}
+
+func TestMaxRejectedRecipients(t *testing.T) {
+	t.Parallel()
+
+	var rec disconnectRecord
+	refusals := map[string]error{
+		"unknown@example.com": smtpd.Error{Code: 550, Enhanced: smtpd.EnhancedCode{5, 1, 1}, Message: "No such user"},
+		"later@example.com":   smtpd.Error{Code: 450, Enhanced: smtpd.EnhancedCode{4, 2, 1}, Message: "Try later"},
+	}
+	srv := runserver(t, &smtpd.Server{MaxRejectedRecipients: 2, Logger: testLogger(t)},
+		smtpd.Middleware{
+			CheckRecipient: func(ctx context.Context, _ smtpd.Peer, addr string) (context.Context, error) {
+				return ctx, refusals[addr]
+			},
+		},
+		disconnectCounter(&rec))
+
+	c := dialRaw(t, srv.Addr)
+	c.send("EHLO client.example.com")
+	c.send("MAIL FROM:<alice@example.com>")
+
+	// A temporary refusal does not count.
+	c.send("RCPT TO:<later@example.com>")
+	c.send("RCPT TO:<later@example.com>")
+	if reply := c.send("RCPT TO:<unknown@example.com>"); !strings.HasPrefix(reply, "550 ") {
+		t.Fatalf("first unknown recipient = %q", reply)
+	}
+	if reply := c.send("RCPT TO:<unknown@example.com>"); !strings.HasPrefix(reply, "550 ") {
+		t.Fatalf("second unknown recipient = %q", reply)
+	}
+	assertLimit(t, c, c.line(), &rec, "MaxRejectedRecipients")
+}
+
+// limitSession runs srv on a pipe in the bubble of the test, and gives the
+// client end of a session past its greeting, with the error that the
+// Disconnect hooks received.
+func limitSession(t *testing.T, srv *smtpd.Server) (net.Conn, *bufio.Reader, <-chan error) {
+	t.Helper()
+
+	disconnected := make(chan error, 1)
+	srv.Logger = testLogger(t)
+	srv.Use(smtpd.Middleware{
+		Disconnect: func(_ context.Context, _ smtpd.Peer, err error) { disconnected <- err },
+	})
+
+	l := runpipeserver(t, srv)
+	t.Cleanup(func() { _ = l.Close() })
+
+	c := l.dial(t)
+	t.Cleanup(func() { _ = c.Close() })
+	r := bufio.NewReader(c)
+	_, _ = r.ReadString('\n')
+	return c, r, disconnected
+}
+
+// trickle writes chunk on c every five seconds, until stop closes or the
+// write fails.
+func trickle(c net.Conn, chunk string, stop <-chan struct{}) {
+	for {
+		if _, err := c.Write([]byte(chunk)); err != nil {
+			return
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// assertLimitError checks that err is the SessionLimitError of limit.
+func assertLimitError(t *testing.T, err error, limit string) {
+	t.Helper()
+
+	var limitErr smtpd.SessionLimitError
+	if !errors.As(err, &limitErr) || limitErr.Limit != limit {
+		t.Errorf("Disconnect got %v, want the SessionLimitError of %s", err, limit)
+	}
+}
+
+func TestMaxSessionDuration(t *testing.T) {
+	t.Parallel()
+
+	synctest.Test(t, func(t *testing.T) {
+		c, r, disconnected := limitSession(t, &smtpd.Server{
+			MaxSessionDuration: 10 * time.Second,
+			ReadTimeout:        time.Minute,
+		})
+
+		// A busy client gets no more time than an idle one.
+		start := time.Now()
+		for range 3 {
+			time.Sleep(3 * time.Second)
+			if line, _ := timedCmd(t, c, r, "NOOP"); !strings.HasPrefix(line, "250 ") {
+				t.Fatalf("NOOP = %q", line)
+			}
+		}
+
+		line, _ := r.ReadString('\n')
+		if !strings.HasPrefix(line, "421 ") || time.Since(start) != 10*time.Second {
+			t.Errorf("reply %q after %v, want a 421 after 10s", line, time.Since(start))
+		}
+		assertLimitError(t, <-disconnected, "MaxSessionDuration")
+	})
+}
+
+func TestMinDataRate(t *testing.T) {
+	t.Parallel()
+
+	synctest.Test(t, func(t *testing.T) {
+		c, r, disconnected := limitSession(t, &smtpd.Server{
+			MinDataRate:       100,
+			MinDataRateWindow: 10 * time.Second,
+		})
+
+		for _, cmd := range []string{"HELO client.example.com", "MAIL FROM:<alice@example.com>", "RCPT TO:<bob@example.com>", "DATA"} {
+			timedCmd(t, c, r, cmd)
+		}
+
+		// Twenty octets in ten seconds is too slow for 100 a second.
+		stop := make(chan struct{})
+		defer close(stop)
+		go trickle(c, "slow line\r\n"[:10], stop)
+
+		line, _ := r.ReadString('\n')
+		if !strings.HasPrefix(line, "421 ") {
+			t.Errorf("reply = %q, want a 421", line)
+		}
+		assertLimitError(t, <-disconnected, "MinDataRate")
+	})
+}
+
+func TestMinDataRateSlowHandler(t *testing.T) {
+	t.Parallel()
+
+	synctest.Test(t, func(t *testing.T) {
+		srv := &smtpd.Server{
+			MinDataRate:       100,
+			MinDataRateWindow: 10 * time.Second,
+			Handler: func(ctx context.Context, _ smtpd.Peer, env *smtpd.Envelope) (context.Context, error) {
+				// The time of the handler is no time of the client.
+				time.Sleep(30 * time.Second)
+				_, err := io.Copy(io.Discard, env.Data)
+				return ctx, err
+			},
+		}
+		c, r, _ := limitSession(t, srv)
+
+		for _, cmd := range []string{"HELO client.example.com", "MAIL FROM:<alice@example.com>", "RCPT TO:<bob@example.com>", "DATA"} {
+			timedCmd(t, c, r, cmd)
+		}
+		go func() {
+			_, _ = c.Write([]byte(strings.Repeat("a quick line of the message\r\n", 100) + ".\r\n"))
+		}()
+
+		if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, "250 ") {
+			t.Errorf("reply = %q, want a 250", line)
+		}
+	})
+}
+
+func TestMinDataRateBDAT(t *testing.T) {
+	t.Parallel()
+
+	synctest.Test(t, func(t *testing.T) {
+		c, r, disconnected := limitSession(t, &smtpd.Server{
+			MinDataRate:       100,
+			MinDataRateWindow: 10 * time.Second,
+		})
+
+		for _, cmd := range []string{"HELO client.example.com", "MAIL FROM:<alice@example.com>", "RCPT TO:<bob@example.com>"} {
+			timedCmd(t, c, r, cmd)
+		}
+
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			_, _ = c.Write([]byte("BDAT 1000 LAST\r\n"))
+			trickle(c, "0123456789", stop)
+		}()
+
+		line, _ := r.ReadString('\n')
+		if !strings.HasPrefix(line, "421 ") {
+			t.Errorf("reply = %q, want a 421", line)
+		}
+		assertLimitError(t, <-disconnected, "MinDataRate")
+	})
+}
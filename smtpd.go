@@ -15,6 +15,8 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"golang.org/x/time/rate"
 )
 
 // ErrServerClosed is returned by Serve/ListenAndServe after Shutdown.
@@ -75,6 +77,11 @@ type Peer struct {
 // Set it to give the client a precise reason, such as {5, 7, 1} for a
 // refused relay.
 //
+// An Error with the code 421 ends the session: the server writes the reply,
+// closes the connection, and gives the Error to the Disconnect hooks. The
+// replies of LMTP to the end of a message are the exception, since each of
+// them stands for one recipient.
+//
 // The server writes the status code only to a client that sent EHLO, and
 // only after that command. See EnhancedCode.
 type Error struct {
@@ -162,6 +169,23 @@ type Middleware struct {
 	Authenticate    func(ctx context.Context, peer Peer, username, password string) (context.Context, error)
 	Reset           func(ctx context.Context, peer Peer) context.Context
 
+	// RewriteRecipient runs for a RCPT TO command once the CheckRecipient
+	// hooks took the address, and gives the addresses that the envelope
+	// takes in its place: a new address for an alias, or more than one for
+	// a list. nil leaves the address as it was, and an error refuses the
+	// command.
+	//
+	// The hooks run in Use order, and each one runs for every address that
+	// the one before it gave. The command fails with 452 when the addresses
+	// would take the envelope past MaxRecipients. An address that a hook
+	// changed keeps the one that the client sent in the ORCPT parameter of
+	// Envelope.DSN, unless the client sent one of its own.
+	//
+	// A server of LMTP still writes one reply for each RCPT TO command: the
+	// first error of the addresses that the command gave, or 250 where none
+	// of them has one.
+	RewriteRecipient func(ctx context.Context, peer Peer, addr string) (context.Context, []string, error)
+
 	// Verify runs for a VRFY command and looks the name up. name is the
 	// argument of the command, as the client wrote it: RFC 5321 section
 	// 3.5.1 gives a user name, a mailbox, or a string of another kind that
@@ -235,6 +259,149 @@ type Server struct {
 	MaxMessageSize int // default 10MB; enforced at protocol level
 	MaxRecipients  int // default 100
 
+	// MaxErrors, MaxCommands, MaxTransactions and MaxRejectedRecipients
+	// end a session that goes on too long without getting anywhere, such as
+	// one that sends bad commands or guesses recipients forever. A session
+	// that reaches one gets 421 4.7.0, and the Disconnect hooks receive a
+	// SessionLimitError that names it. Zero, the default, sets no limit.
+	//
+	// MaxErrors counts the replies of 400 and above, and MaxCommands the
+	// command lines. MaxTransactions counts the MAIL FROM commands that the
+	// server took, and the one after the last gets the 421.
+	// MaxRejectedRecipients counts the RCPT TO commands that a hook refused
+	// with a code of 500 and above.
+	MaxErrors             int
+	MaxCommands           int
+	MaxTransactions       int
+	MaxRejectedRecipients int
+
+	// MaxSessionDuration ends a session that lasts longer than this from
+	// the accept, however busy it is: ReadTimeout counts from each line, so
+	// a client that sends a byte now and then holds the session for good.
+	// MinDataRate ends a session whose message arrives slower than this many
+	// octets a second, over each MinDataRateWindow of waiting for it, in the
+	// DATA body and in the chunks of BDAT. Both answer 421 4.7.0, and the
+	// Disconnect hooks receive a SessionLimitError. Zero, the default, sets
+	// no limit.
+	MaxSessionDuration time.Duration
+	MinDataRate        int
+	MinDataRateWindow  time.Duration // default 30s
+
+	// MaxConnectionsPerIP caps the sessions of one client address, so that
+	// one host cannot take every slot of MaxConnections. The server counts a
+	// connection as it accepts it, before any hook runs, and answers one over
+	// the cap with 421 4.7.0 and MaxConnectionsPerIPMessage, and closes it,
+	// with no session and no hook. Zero, the default, sets no cap.
+	// ConnectionsPerIP gives the counts.
+	//
+	// ConnectionPrefixIPv4 and ConnectionPrefixIPv6 count the addresses of a
+	// network together, such as the /64 that one IPv6 site usually gets. The
+	// defaults are 32 and 128, which count each address on its own.
+	//
+	// The count takes the address of the connection, so behind a proxy of
+	// the PROXY protocol it counts the proxy. A connection that is not on
+	// TCP is not counted.
+	MaxConnectionsPerIP        int
+	ConnectionPrefixIPv4       int
+	ConnectionPrefixIPv6       int
+	MaxConnectionsPerIPMessage string // default "Too many connections from your address, try again later"
+
+	// ConnectionQueue lets up to this many connections wait for a slot of
+	// MaxConnections, where they would get 421 at once. A connection waits
+	// up to ConnectionQueueTimeout, with no greeting, and gets the 421 after
+	// that. Zero, the default, keeps no queue. ConnectionQueueStats gives
+	// the depth of the queue.
+	//
+	// The 421 stands in the place of the greeting. One that has nowhere to
+	// wait gets it as Serve accepts it, before ConnContext, as a connection
+	// over MaxConnectionRate does. One that waits has been through
+	// ConnContext and holds a session, which runs its first hook,
+	// CheckConnection, only once it takes a slot, and none at all where it
+	// gets the 421.
+	//
+	// ConnectionPriority ranks the connections in the queue: a slot goes to
+	// the one of the highest priority, and to the one that came first among
+	// equals. It runs as the connection starts to wait, with the address of
+	// the client. nil ranks them all the same.
+	ConnectionQueue        int
+	ConnectionQueueTimeout time.Duration // default 10s
+	ConnectionPriority     func(addr net.Addr) int
+
+	// MaxConnectionRate caps the connections that Serve takes a second, with
+	// bursts of up to ConnectionRateBurst, across the listeners of the
+	// server. A connection over the rate gets 421 and is closed before the
+	// server spends a session on it: no ConnContext, no hook and no
+	// goroutine of its own beyond the write of the reply, so that a flood
+	// costs little more than the accepts. Zero, the default, sets no cap.
+	MaxConnectionRate   int
+	ConnectionRateBurst int // default MaxConnectionRate
+
+	// TarpitDelay slows a client that collects error replies, such as a
+	// spam run that guesses recipients or passwords, or that sends commands
+	// the server does not know. Each reply of 400 and above waits before it
+	// goes out: TarpitDelay for each error of the session past TarpitAfter,
+	// up to TarpitMaxDelay, and never longer than WriteTimeout. A 421 goes
+	// out at once, since it closes the session. Zero, the default, waits
+	// not at all.
+	//
+	// The session waits on its own goroutine, and a Shutdown ends the wait.
+	TarpitDelay    time.Duration
+	TarpitAfter    int           // errors that pass without a wait; default 0
+	TarpitMaxDelay time.Duration // default 10s
+
+	// GreetPause holds the greeting back this long and watches for a client
+	// that writes before it, which RFC 5321 section 3.1 has it wait for.
+	// ScreenProtocol watches the command lines for two more signs of spam
+	// software: a command behind another one from a client that did not
+	// learn of PIPELINING through EHLO, and a line that ends in a bare LF.
+	// The pause holds a slot of MaxConnections, so keep it to a few seconds.
+	//
+	// ScreenViolation decides about a client at the first Violation of its
+	// session. An error refuses the client: the server answers with it in
+	// the place of the greeting or of the command, closes the connection,
+	// and the Disconnect hooks receive a ViolationError. nil lets the
+	// session go on. Without a hook, the server refuses the client with 521.
+	//
+	// ScreenCache keeps the verdicts by client address, and a client whose
+	// last session passed skips the pause. The default with GreetPause is a
+	// ScreenMemory whose verdicts last a day.
+	GreetPause      time.Duration
+	ScreenProtocol  bool
+	ScreenViolation func(ctx context.Context, peer Peer, v Violation) error
+	ScreenCache     ScreenCache
+
+	// BareLineBreaks says what the server does with a CR or a LF outside a
+	// CRLF pair, in a command line and in the body of a DATA message. The
+	// default reads a bare LF as a line break, which leaves the server open
+	// to SMTP smuggling: set BareLineBreaksNormalize or BareLineBreaksReject
+	// on a server that takes mail from the Internet.
+	BareLineBreaks BareLineBreaks
+
+	// BodyConformance says what the server does with a message whose body
+	// breaks RFC 5322 or its BODY parameter: a line longer than
+	// MaxBodyLineLength octets without its line break, or an octet above
+	// 127 in a message of 7-bit text. It can refuse the message, take it and
+	// flag it on the Envelope, or break the long lines. The default takes
+	// the body as it comes.
+	BodyConformance   Conformance
+	MaxBodyLineLength int // default 998, the limit of RFC 5322 section 2.1.1
+
+	// MaxBytesInFlight caps the octets of the messages that all sessions
+	// hold at once: the octets that arrived of each message, from DATA or
+	// the first BDAT until its handler returned. MaxMessageSize bounds one
+	// message, and a burst of them across MaxConnections sessions is more
+	// than a server that buffers them has memory for. A message that finds
+	// the budget spent gets 452 4.3.1 at DATA or at its first chunk, and one
+	// that spends it while it arrives gets the same once it ends. Zero, the
+	// default, sets no cap. BytesInFlight gives the count.
+	//
+	// MaxIngressRate shapes the octets of the messages of all sessions
+	// together to this many a second, so that a burst of them does not take
+	// the link from everything else. The wait goes into DataTimeout, but not
+	// into MinDataRate. Zero, the default, shapes nothing.
+	MaxBytesInFlight int64
+	MaxIngressRate   int
+
 	// Extensions
 	EnableXCLIENT bool
 
@@ -260,8 +427,9 @@ type Server struct {
 	//
 	// The extension is off by default. A server that offers it tells the
 	// client that a notification follows the request, and only the handler
-	// can write one. Turn it on where the handler acts on Envelope.DSN, or
-	// where it passes the parameters to a relay behind the server.
+	// can write one, for instance with the dsn package. Turn it on where the
+	// handler acts on Envelope.DSN, or where it passes the parameters to a
+	// relay behind the server.
 	//
 	// Without it, the server answers 555 to each of the four parameters,
 	// and a client that follows RFC 3461 sends none of them.
@@ -328,11 +496,19 @@ type Server struct {
 	heloCheckers       []func(ctx context.Context, peer Peer, name string) (context.Context, error)
 	senderCheckers     []func(ctx context.Context, peer Peer, addr string) (context.Context, error)
 	recipientCheckers  []func(ctx context.Context, peer Peer, addr string) (context.Context, error)
+	recipientRewriters []func(ctx context.Context, peer Peer, addr string) (context.Context, []string, error)
 	authenticators     []func(ctx context.Context, peer Peer, username, password string) (context.Context, error)
 	verifiers          []func(ctx context.Context, peer Peer, name string) (context.Context, Verification, error)
 	resetters          []func(ctx context.Context, peer Peer) context.Context
 	disconnecters      []func(ctx context.Context, peer Peer, err error)
 
+	perIP      connCounter
+	queueStats connQueueStats
+	budget     byteBudget
+	ingress    *rate.Limiter
+
+	acceptGuard *acceptGuard
+
 	mu         sync.Mutex
 	listener   net.Listener
 	active     map[*session]context.CancelFunc
@@ -360,6 +536,9 @@ func (srv *Server) Use(m Middleware) *Server {
 	if m.CheckRecipient != nil {
 		srv.recipientCheckers = append(srv.recipientCheckers, m.CheckRecipient)
 	}
+	if m.RewriteRecipient != nil {
+		srv.recipientRewriters = append(srv.recipientRewriters, m.RewriteRecipient)
+	}
 	if m.Authenticate != nil {
 		srv.authenticators = append(srv.authenticators, m.Authenticate)
 	}
@@ -419,6 +598,32 @@ func (srv *Server) checkRecipient(ctx context.Context, peer Peer, addr string) (
 	return ctx, nil
 }
 
+// rewriteRecipient runs the RewriteRecipient hooks on addr, each one on every
+// address that the one before it gave, and gives the addresses that come out
+// of the last one.
+func (srv *Server) rewriteRecipient(ctx context.Context, peer Peer, addr string) (context.Context, []string, error) {
+	addrs := []string{addr}
+	for _, h := range srv.recipientRewriters {
+		var next []string
+		for _, a := range addrs {
+			var (
+				out []string
+				err error
+			)
+			ctx, out, err = h(ctx, peer, a)
+			if err != nil {
+				return ctx, nil, err
+			}
+			if len(out) == 0 {
+				out = []string{a}
+			}
+			next = append(next, out...)
+		}
+		addrs = next
+	}
+	return ctx, addrs, nil
+}
+
 func (srv *Server) authenticate(ctx context.Context, peer Peer, username, password string) (context.Context, error) {
 	var err error
 	for _, h := range srv.authenticators {
@@ -462,6 +667,18 @@ func (srv *Server) reset(ctx context.Context, peer Peer) context.Context {
 // comes as an argument, because a chunked message runs the handlers on a
 // goroutine of its own, where the peer of the session can change under them.
 func (srv *Server) deliver(ctx context.Context, peer Peer, env *Envelope) (context.Context, error) {
+	// A Handler stage may put a body of its own into env.Data, such as the
+	// spool of a message that a middleware signed. The server closes that
+	// one as well, once the handlers are done, so that a stage after it that
+	// fails or forgets to close it leaves no spool behind.
+	if data := env.Data; data != nil {
+		defer func() {
+			if env.Data != nil && env.Data != data {
+				_ = env.Data.Close()
+			}
+		}()
+	}
+
 	var err error
 	for _, h := range srv.handlers {
 		ctx, err = h(ctx, peer, env)
@@ -514,6 +731,30 @@ func (srv *Server) configureDefaults() error {
 	if srv.MaxRecipients == 0 {
 		srv.MaxRecipients = 100
 	}
+	if srv.ConnectionQueueTimeout == 0 {
+		srv.ConnectionQueueTimeout = 10 * time.Second
+	}
+	if srv.MaxConnectionRate > 0 && srv.acceptGuard == nil {
+		if srv.ConnectionRateBurst <= 0 {
+			srv.ConnectionRateBurst = srv.MaxConnectionRate
+		}
+		srv.acceptGuard = newAcceptGuard(srv.MaxConnectionRate, srv.ConnectionRateBurst)
+	}
+	if srv.MaxIngressRate > 0 && srv.ingress == nil {
+		srv.ingress = newIngressLimiter(srv.MaxIngressRate)
+	}
+	if srv.MaxBodyLineLength == 0 {
+		srv.MaxBodyLineLength = 998
+	}
+	if srv.MinDataRateWindow == 0 {
+		srv.MinDataRateWindow = 30 * time.Second
+	}
+	if srv.GreetPause > 0 && srv.ScreenCache == nil {
+		srv.ScreenCache = NewScreenMemory(24 * time.Hour)
+	}
+	if srv.TarpitMaxDelay == 0 {
+		srv.TarpitMaxDelay = 10 * time.Second
+	}
 	if srv.ReadTimeout == 0 {
 		srv.ReadTimeout = 60 * time.Second
 	}
@@ -533,7 +774,7 @@ func (srv *Server) configureDefaults() error {
 		}
 		srv.WelcomeMessage = fmt.Sprintf("%s %s ready.", srv.Hostname, protocol)
 	}
-	return nil
+	return srv.configurePerIP()
 }
 
 // errNilConnContext reports a ConnContext that returned a nil context. It
@@ -615,24 +856,42 @@ func (srv *Server) Serve(l net.Listener) error {
 		return err
 	}
 
-	var limiter chan struct{}
+	var slots *connSlots
 	if srv.MaxConnections > 0 {
-		limiter = make(chan struct{}, srv.MaxConnections)
+		slots = newConnSlots(srv.MaxConnections, srv.ConnectionQueue, &srv.queueStats)
 	}
 
+	var backoff acceptBackoff
 	for {
 		conn, err := l.Accept()
 		if err != nil {
 			if srv.inShutdown.Load() {
 				return ErrServerClosed
 			}
-			var ne net.Error
-			if errors.As(err, &ne) && ne.Timeout() {
-				time.Sleep(time.Second)
+			if backoff.wait(srv, err) {
 				continue
 			}
 			return err
 		}
+		backoff.reset()
+
+		if !srv.admit(conn) {
+			continue
+		}
+		perIPKey, ok := srv.admitPeer(conn)
+		if !ok {
+			continue
+		}
+		held := false
+		if slots != nil {
+			var wait bool
+			held, wait = slots.tryAcquire()
+			if !held && !wait {
+				srv.refuse(conn, busyRefusal)
+				srv.releasePeer(perIPKey)
+				continue
+			}
+		}
 
 		connCtx, cancel := context.WithCancel(baseCtx)
 		connCtx, err = srv.connContext(connCtx, conn)
@@ -642,6 +901,10 @@ func (srv *Server) Serve(l net.Listener) error {
 			peer := conn.RemoteAddr().String()
 			cancel()
 			_ = conn.Close()
+			srv.releasePeer(perIPKey)
+			if held {
+				slots.release()
+			}
 
 			// A nil context is a fault in the configuration and repeats on
 			// every connection, so it stops the server. A panic stops the
@@ -661,6 +924,10 @@ func (srv *Server) Serve(l net.Listener) error {
 		if !srv.trackSession(s, cancel) {
 			cancel()
 			_ = conn.Close()
+			srv.releasePeer(perIPKey)
+			if held {
+				slots.release()
+			}
 			return ErrServerClosed
 		}
 
@@ -669,17 +936,16 @@ func (srv *Server) Serve(l net.Listener) error {
 			defer srv.wg.Done()
 			defer srv.untrackSession(s)
 			defer cancel()
-			if limiter != nil {
-				select {
-				case limiter <- struct{}{}:
-					s.serve(ctx)
-					<-limiter
-				default:
-					s.reject(ctx)
+			defer srv.releasePeer(perIPKey)
+			if slots != nil {
+				priority := func() int { return srv.connPriority(ctx, conn.RemoteAddr()) }
+				if !held && !slots.acquire(ctx, priority, srv.ConnectionQueueTimeout) {
+					writeRefusal(conn, busyRefusal)
+					return
 				}
-			} else {
-				s.serve(ctx)
+				defer slots.release()
 			}
+			s.serve(ctx)
 		}()
 	}
 }
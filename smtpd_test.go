@@ -2,12 +2,16 @@ package smtpd_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"net"
 	"net/smtp"
 	"net/textproto"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"testing/synctest"
 	"time"
@@ -713,6 +717,92 @@ func TestNoMaxConnections(t *testing.T) {
 	_ = c1.Close()
 }
 
+func TestMaxConnectionsPerIP(t *testing.T) {
+	t.Parallel()
+
+	disconnected := make(chan error, 4)
+	var sessions atomic.Int32
+	srv := runserver(t, &smtpd.Server{
+		MaxConnectionsPerIP:        1,
+		MaxConnectionsPerIPMessage: "Slow down",
+		ConnContext: func(ctx context.Context, _ net.Conn) context.Context {
+			sessions.Add(1)
+			return ctx
+		},
+		Logger: testLogger(t),
+	}, smtpd.Middleware{
+		Disconnect: func(_ context.Context, _ smtpd.Peer, err error) { disconnected <- err },
+	})
+
+	c1 := dialRaw(t, srv.Addr)
+	if !strings.HasPrefix(c1.banner, "220 ") {
+		t.Fatalf("first banner = %q", c1.banner)
+	}
+	if got, want := srv.Config.ConnectionsPerIP(), map[string]int{"127.0.0.1": 1}; !maps.Equal(got, want) {
+		t.Errorf("ConnectionsPerIP() = %v, want %v", got, want)
+	}
+
+	// The second connection of the address gets the reply in the place of
+	// the greeting. The server refuses it as it accepts it, so it has no
+	// session and runs no hook.
+	c2 := dialRaw(t, srv.Addr)
+	if c2.banner != "421 4.7.0 Slow down" {
+		t.Errorf("second banner = %q, want the 421", c2.banner)
+	}
+	if _, err := c2.br.ReadString('\n'); err != io.EOF {
+		t.Errorf("read after the 421 = %v, want EOF", err)
+	}
+	if n := sessions.Load(); n != 1 {
+		t.Errorf("ConnContext ran %d times, want 1", n)
+	}
+	select {
+	case err := <-disconnected:
+		t.Errorf("Disconnect ran for the refused connection with %v", err)
+	default:
+	}
+
+	// The slot comes back with the end of the first session.
+	c1.send("QUIT")
+	<-disconnected
+	c3 := dialRaw(t, srv.Addr)
+	if !strings.HasPrefix(c3.banner, "220 ") {
+		t.Errorf("banner after the first session = %q", c3.banner)
+	}
+}
+
+func TestConnectionsPerIPPrefix(t *testing.T) {
+	t.Parallel()
+
+	srv := runserver(t, &smtpd.Server{
+		MaxConnectionsPerIP:  2,
+		ConnectionPrefixIPv4: 8,
+		Logger:               testLogger(t),
+	})
+
+	c := dialRaw(t, srv.Addr)
+	if !strings.HasPrefix(c.banner, "220 ") {
+		t.Fatalf("banner = %q", c.banner)
+	}
+	if got, want := srv.Config.ConnectionsPerIP(), map[string]int{"127.0.0.0/8": 1}; !maps.Equal(got, want) {
+		t.Errorf("ConnectionsPerIP() = %v, want %v", got, want)
+	}
+}
+
+func TestConnectionPrefixOutOfRange(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+
+	srv := &smtpd.Server{ConnectionPrefixIPv6: 129, Logger: testLogger(t)}
+	if err := srv.Serve(l); err == nil {
+		t.Error("Serve took a prefix of 129 bits")
+	}
+}
+
 func TestMaxRecipients(t *testing.T) {
 	t.Parallel()
 
@@ -1038,3 +1128,40 @@ func TestServeFailsIfShutdown(t *testing.T) {
 		t.Fatalf("Serve() did not return ErrServerClosed: %v", err)
 	}
 }
+
+// TestHook421ClosesTheSession covers RFC 5321 section 3.8: a hook that
+// answers 421 ends the session. The server closes the connection after the
+// reply, and the Disconnect hooks read the error.
+func TestHook421ClosesTheSession(t *testing.T) {
+	t.Parallel()
+
+	var rec disconnectRecord
+	closing := smtpd.Error{Code: 421, Enhanced: smtpd.EnhancedCode{4, 7, 0}, Message: "Go away"}
+	srv := runserver(t, &smtpd.Server{Logger: testLogger(t)}, smtpd.Middleware{
+		CheckSender: func(ctx context.Context, _ smtpd.Peer, _ string) (context.Context, error) {
+			return ctx, closing
+		},
+	}, disconnectCounter(&rec))
+
+	c := dialRaw(t, srv.Addr)
+	if reply := c.send("EHLO localhost"); !strings.HasPrefix(reply, "250") {
+		t.Fatalf("EHLO reply = %q, want 250", reply)
+	}
+	if reply := c.send("MAIL FROM:<sender@example.org>"); reply != "421 4.7.0 Go away" {
+		t.Errorf("MAIL reply = %q, want the 421 of the hook", reply)
+	}
+
+	_ = c.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if line, err := c.br.ReadString('\n'); err == nil {
+		t.Errorf("the session went on after the 421, and read %q", line)
+	}
+
+	count, lastErr := waitDisconnect(&rec, time.Second)
+	if count != 1 {
+		t.Fatalf("Disconnect ran %d times, want 1", count)
+	}
+	var smtpErr smtpd.Error
+	if !errors.As(lastErr, &smtpErr) || smtpErr != closing {
+		t.Errorf("the Disconnect hook read %v, want %v", lastErr, closing)
+	}
+}
@@ -0,0 +1,39 @@
+package smtpd
+
+import (
+	"context"
+	"time"
+)
+
+// tarpit waits before an error reply of code, for a session that collected
+// errors before. The reply counts in s.errors already. The wait grows by
+// TarpitDelay with each error past TarpitAfter, up to TarpitMaxDelay, and
+// never past WriteTimeout.
+//
+// The session goroutine waits itself, so a tarpitted session holds no more
+// than the one goroutine that it has anyway. A done ctx, such as that of a
+// Shutdown, ends the wait at once.
+func (s *session) tarpit(ctx context.Context, code int) {
+	// A 421 closes the session, and a wait before it holds the connection
+	// for nothing.
+	if s.server.TarpitDelay <= 0 || code < 400 || code == 421 {
+		return
+	}
+
+	n := s.errors - s.server.TarpitAfter
+	if n <= 0 {
+		return
+	}
+
+	d := min(time.Duration(n)*s.server.TarpitDelay, s.server.TarpitMaxDelay, s.server.WriteTimeout)
+	if d <= 0 {
+		return
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
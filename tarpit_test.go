@@ -0,0 +1,133 @@
+package smtpd_test
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/chrj/smtpd/v2"
+)
+
+// timedCmd sends one command on c, and gives the first line of the reply and
+// how long it took to come.
+func timedCmd(t *testing.T, c net.Conn, r *bufio.Reader, cmd string) (string, time.Duration) {
+	t.Helper()
+
+	start := time.Now()
+	if _, err := c.Write([]byte(cmd + "\r\n")); err != nil {
+		t.Fatalf("write %q: %v", cmd, err)
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("reply to %q: %v", cmd, err)
+	}
+	return strings.TrimSpace(line), time.Since(start)
+}
+
+func TestTarpit(t *testing.T) {
+	t.Parallel()
+
+	synctest.Test(t, func(t *testing.T) {
+		l := runpipeserver(t, &smtpd.Server{
+			TarpitDelay:    time.Second,
+			TarpitAfter:    1,
+			TarpitMaxDelay: 2 * time.Second,
+			Logger:         testLogger(t),
+		})
+		defer func() { _ = l.Close() }()
+
+		c := l.dial(t)
+		defer func() { _ = c.Close() }()
+		r := bufio.NewReader(c)
+		_, _ = r.ReadString('\n')
+
+		// The first error passes, and each one after it waits a second more,
+		// up to the cap. A reply that is no error never waits.
+		steps := []struct {
+			cmd  string
+			wait time.Duration
+		}{
+			{"FOO", 0},
+			{"FOO", time.Second},
+			{"NOOP", 0},
+			{"FOO", 2 * time.Second},
+			{"FOO", 2 * time.Second},
+		}
+		for i, step := range steps {
+			line, took := timedCmd(t, c, r, step.cmd)
+			if took != step.wait {
+				t.Errorf("step %d: %q took %v, want %v", i+1, line, took, step.wait)
+			}
+		}
+	})
+}
+
+func TestTarpitWriteTimeout(t *testing.T) {
+	t.Parallel()
+
+	synctest.Test(t, func(t *testing.T) {
+		l := runpipeserver(t, &smtpd.Server{
+			TarpitDelay:  time.Minute,
+			WriteTimeout: 3 * time.Second,
+			Logger:       testLogger(t),
+		})
+		defer func() { _ = l.Close() }()
+
+		c := l.dial(t)
+		defer func() { _ = c.Close() }()
+		r := bufio.NewReader(c)
+		_, _ = r.ReadString('\n')
+
+		if _, took := timedCmd(t, c, r, "FOO"); took != 3*time.Second {
+			t.Errorf("the wait took %v, want the WriteTimeout of 3s", took)
+		}
+	})
+}
+
+func TestTarpitShutdown(t *testing.T) {
+	t.Parallel()
+
+	synctest.Test(t, func(t *testing.T) {
+		srv := &smtpd.Server{
+			TarpitDelay:    time.Minute,
+			TarpitMaxDelay: time.Hour,
+			WriteTimeout:   time.Hour,
+			Logger:         testLogger(t),
+		}
+		l := runpipeserver(t, srv)
+		defer func() { _ = l.Close() }()
+
+		c := l.dial(t)
+		defer func() { _ = c.Close() }()
+		r := bufio.NewReader(c)
+		_, _ = r.ReadString('\n')
+
+		replied := make(chan time.Duration, 1)
+		go func() {
+			start := time.Now()
+			_, _ = c.Write([]byte("FOO\r\n"))
+			_, _ = r.ReadString('\n')
+			replied <- time.Since(start)
+		}()
+
+		time.Sleep(5 * time.Second)
+		synctest.Wait()
+
+		shutdown := make(chan error, 1)
+		go func() { shutdown <- srv.Shutdown(context.Background()) }()
+
+		// The reply goes out as the Shutdown cancels the session, and not
+		// after the minute of the tarpit.
+		if took := <-replied; took != 5*time.Second {
+			t.Errorf("the reply took %v, want it at the Shutdown", took)
+		}
+		_ = c.Close()
+		if err := <-shutdown; err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	})
+}